@@ -38,8 +38,16 @@ var flagsServe = append(
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "key-file", Aliases: []string{"key_file", "K"}, EnvVars: []string{"NTFY_KEY_FILE"}, Usage: "private key file, if listen-https is set"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "cert-file", Aliases: []string{"cert_file", "E"}, EnvVars: []string{"NTFY_CERT_FILE"}, Usage: "certificate file, if listen-https is set"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "firebase-key-file", Aliases: []string{"firebase_key_file", "F"}, EnvVars: []string{"NTFY_FIREBASE_KEY_FILE"}, Usage: "Firebase credentials file; if set additionally publish to FCM topic"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-backend", Aliases: []string{"cache_backend"}, EnvVars: []string{"NTFY_CACHE_BACKEND"}, Value: server.DefaultCacheBackend, Usage: "message cache backend; only sqlite (cache-file, or in-memory if not set) is supported"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-file", Aliases: []string{"cache_file", "C"}, EnvVars: []string{"NTFY_CACHE_FILE"}, Usage: "cache file used for message caching"}),
 	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "cache-duration", Aliases: []string{"cache_duration", "b"}, EnvVars: []string{"NTFY_CACHE_DURATION"}, Value: server.DefaultCacheDuration, Usage: "buffer messages for this time to allow `since` requests"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "cache-batch-size", Aliases: []string{"cache_batch_size"}, EnvVars: []string{"NTFY_CACHE_BATCH_SIZE"}, Usage: "max size of messages to batch together when writing to message cache (if zero, writes are synchronous)"}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "cache-batch-timeout", Aliases: []string{"cache_batch_timeout"}, EnvVars: []string{"NTFY_CACHE_BATCH_TIMEOUT"}, Usage: "timeout for batched async writes to the message cache (if zero, writes are synchronous)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "cache-min-keep", Aliases: []string{"cache_min_keep"}, EnvVars: []string{"NTFY_CACHE_MIN_KEEP"}, Usage: "number of newest messages per topic to keep in the cache regardless of cache-duration"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "cache-max-tags", Aliases: []string{"cache_max_tags"}, EnvVars: []string{"NTFY_CACHE_MAX_TAGS"}, Value: server.DefaultCacheMaxTags, Usage: "max number of tags per message (if zero, the number of tags is not limited)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-synchronous", Aliases: []string{"cache_synchronous"}, EnvVars: []string{"NTFY_CACHE_SYNCHRONOUS"}, Usage: "SQLite synchronous mode of the cache file: off, normal or full (durability vs. write throughput)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-journal-mode", Aliases: []string{"cache_journal_mode"}, EnvVars: []string{"NTFY_CACHE_JOURNAL_MODE"}, Usage: "SQLite journal mode of the cache file: delete, truncate, persist or wal (wal allows concurrent reads and writes)"}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "cache-busy-timeout", Aliases: []string{"cache_busy_timeout"}, EnvVars: []string{"NTFY_CACHE_BUSY_TIMEOUT"}, Usage: "time to wait for a locked cache file before failing (if zero, the SQLite driver default of 5s is used)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-file", Aliases: []string{"auth_file", "H"}, EnvVars: []string{"NTFY_AUTH_FILE"}, Usage: "auth database file used for access control"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-default-access", Aliases: []string{"auth_default_access", "p"}, EnvVars: []string{"NTFY_AUTH_DEFAULT_ACCESS"}, Value: "read-write", Usage: "default permissions if no matching entries in the auth database are found"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-cache-dir", Aliases: []string{"attachment_cache_dir"}, EnvVars: []string{"NTFY_ATTACHMENT_CACHE_DIR"}, Usage: "cache directory for attached files"}),
@@ -101,8 +109,16 @@ func execServe(c *cli.Context) error {
 	keyFile := c.String("key-file")
 	certFile := c.String("cert-file")
 	firebaseKeyFile := c.String("firebase-key-file")
+	cacheBackend := c.String("cache-backend")
 	cacheFile := c.String("cache-file")
 	cacheDuration := c.Duration("cache-duration")
+	cacheBatchSize := c.Int("cache-batch-size")
+	cacheBatchTimeout := c.Duration("cache-batch-timeout")
+	cacheMinKeep := c.Int("cache-min-keep")
+	cacheSynchronous := c.String("cache-synchronous")
+	cacheJournalMode := c.String("cache-journal-mode")
+	cacheBusyTimeout := c.Duration("cache-busy-timeout")
+	cacheMaxTags := c.Int("cache-max-tags")
 	authFile := c.String("auth-file")
 	authDefaultAccess := c.String("auth-default-access")
 	attachmentCacheDir := c.String("attachment-cache-dir")
@@ -156,6 +172,14 @@ func execServe(c *cli.Context) error {
 		return errors.New("if set, base-url must start with http:// or https://")
 	} else if !util.InStringList([]string{"read-write", "read-only", "write-only", "deny-all"}, authDefaultAccess) {
 		return errors.New("if set, auth-default-access must start set to 'read-write', 'read-only', 'write-only' or 'deny-all'")
+	} else if cacheBackend != server.CacheBackendSQLite {
+		return errors.New("if set, cache-backend must be 'sqlite', other backends (e.g. 'postgres') are not supported yet")
+	} else if cacheSynchronous != "" && !util.InStringList([]string{"off", "normal", "full"}, cacheSynchronous) {
+		return errors.New("if set, cache-synchronous must be 'off', 'normal' or 'full'")
+	} else if cacheJournalMode != "" && !util.InStringList([]string{"delete", "truncate", "persist", "wal"}, cacheJournalMode) {
+		return errors.New("if set, cache-journal-mode must be 'delete', 'truncate', 'persist' or 'wal'")
+	} else if cacheBusyTimeout < 0 {
+		return errors.New("if set, cache-busy-timeout must not be negative")
 	} else if !util.InStringList([]string{"app", "home", "disable"}, webRoot) {
 		return errors.New("if set, web-root must be 'home' or 'app'")
 	} else if upstreamBaseURL != "" && !strings.HasPrefix(upstreamBaseURL, "http://") && !strings.HasPrefix(upstreamBaseURL, "https://") {
@@ -218,8 +242,16 @@ func execServe(c *cli.Context) error {
 	conf.KeyFile = keyFile
 	conf.CertFile = certFile
 	conf.FirebaseKeyFile = firebaseKeyFile
+	conf.CacheBackend = cacheBackend
 	conf.CacheFile = cacheFile
 	conf.CacheDuration = cacheDuration
+	conf.CacheBatchSize = cacheBatchSize
+	conf.CacheBatchTimeout = cacheBatchTimeout
+	conf.CacheMinKeep = cacheMinKeep
+	conf.CacheSynchronous = cacheSynchronous
+	conf.CacheJournalMode = cacheJournalMode
+	conf.CacheBusyTimeout = cacheBusyTimeout
+	conf.CacheMaxTags = cacheMaxTags
 	conf.AuthFile = authFile
 	conf.AuthDefaultRead = authDefaultRead
 	conf.AuthDefaultWrite = authDefaultWrite
@@ -70,6 +70,13 @@ func TestCLI_Serve_WebSocket(t *testing.T) {
 	require.Equal(t, "mytopic", m.Topic)
 }
 
+func TestCLI_Serve_CacheBackendUnsupported(t *testing.T) {
+	configFile := newEmptyFile(t) // Avoid issues with existing server.yml file on system
+	app, _, _, _ := newTestApp()
+	err := app.Run([]string{"ntfy", "serve", "--config=" + configFile, "--listen-http=-", "--cache-backend=postgres"})
+	require.EqualError(t, err, "if set, cache-backend must be 'sqlite', other backends (e.g. 'postgres') are not supported yet")
+}
+
 func newEmptyFile(t *testing.T) string {
 	filename := filepath.Join(t.TempDir(), "empty")
 	require.Nil(t, os.WriteFile(filename, []byte{}, 0600))
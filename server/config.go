@@ -7,7 +7,9 @@ import (
 // Defines default config settings (excluding limits, see below)
 const (
 	DefaultListenHTTP                           = ":80"
+	DefaultCacheBackend                         = CacheBackendSQLite
 	DefaultCacheDuration                        = 12 * time.Hour
+	DefaultCacheMaxTags                         = 20               // Generous, but stops clients from bloating messages with hundreds of tags
 	DefaultKeepaliveInterval                    = 45 * time.Second // Not too frequently to save battery (Android read timeout used to be 77s!)
 	DefaultManagerInterval                      = time.Minute
 	DefaultDelayedSenderInterval                = 10 * time.Second
@@ -18,6 +20,11 @@ const (
 	DefaultFirebaseQuotaExceededPenaltyDuration = 10 * time.Minute // Time that over-users are locked out of Firebase if it returns "quota exceeded"
 )
 
+// Defines the supported message cache backends, see Config.CacheBackend
+const (
+	CacheBackendSQLite = "sqlite" // Cache file, or in-memory if CacheFile is not set
+)
+
 // Defines all global and per-visitor limits
 // - message size limit: the max number of bytes for a message
 // - total topic limit: max number of topics overall
@@ -55,8 +62,16 @@ type Config struct {
 	KeyFile                              string
 	CertFile                             string
 	FirebaseKeyFile                      string
+	CacheBackend                         string
 	CacheFile                            string
 	CacheDuration                        time.Duration
+	CacheBatchSize                       int
+	CacheBatchTimeout                    time.Duration
+	CacheMinKeep                         int
+	CacheSynchronous                     string
+	CacheJournalMode                     string
+	CacheBusyTimeout                     time.Duration
+	CacheMaxTags                         int
 	AuthFile                             string
 	AuthDefaultRead                      bool
 	AuthDefaultWrite                     bool
@@ -107,8 +122,16 @@ func NewConfig() *Config {
 		KeyFile:                              "",
 		CertFile:                             "",
 		FirebaseKeyFile:                      "",
+		CacheBackend:                         DefaultCacheBackend,
 		CacheFile:                            "",
 		CacheDuration:                        DefaultCacheDuration,
+		CacheBatchSize:                       0,
+		CacheBatchTimeout:                    0,
+		CacheMinKeep:                         0,
+		CacheSynchronous:                     "",
+		CacheJournalMode:                     "",
+		CacheBusyTimeout:                     0,
+		CacheMaxTags:                         DefaultCacheMaxTags,
 		AuthFile:                             "",
 		AuthDefaultRead:                      true,
 		AuthDefaultWrite:                     true,
@@ -1,23 +1,76 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
 	"heckel.io/ntfy/log"
 	"heckel.io/ntfy/util"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 var (
 	errUnexpectedMessageType = errors.New("unexpected message type")
+	errMessageNotFound       = errors.New("message not found")
+	errMessageUpdateConflict = errors.New("message was modified concurrently")
+	errRateLimited           = errors.New("rate limit exceeded")
+	errAttachmentSizeUnknown = errors.New("attachment size unknown")
+	errAttachmentNotFound    = errors.New("attachment not found")
+	errTopicDisabled         = errors.New("topic is disabled")
+	errCategoryNotAllowed    = errors.New("category not allowed")
+	errInvalidMessageID      = errors.New("invalid message ID")
+	errInvalidDuePolicy      = errors.New("invalid missed schedule policy")
+	errInvalidSound          = errors.New("invalid sound")
+	errTooManyTags           = errors.New("too many tags")
+	errMessageTooLarge       = errors.New("message body too large")
+	errTitleTooLong          = errors.New("message title too long")
+	errMessageDuplicate      = errors.New("message with this deduplication key already exists")
+	errMessageNotScheduled   = errors.New("message was already published and cannot be canceled")
+	errMessageIDAmbiguous    = errors.New("message ID exists in more than one topic")
+	errSchemaNewer           = errors.New("cache database schema is newer than supported, was it created by a newer version?")
+	errSchemaUnknown         = errors.New("cannot determine schema version: cache file may be corrupt")
+
+	soundRegex = regexp.MustCompile(`^[-_.A-Za-z0-9]*$`) // Allowed characters in a message's sound, see validateSound
+)
+
+const (
+	messageTokenLength      = 24              // Random bytes, base64-encoded in the token column
+	forEachMessageBatchSize = 100             // Rows read into memory at a time by ForEachMessageGlobal
+	messageIDMaxLength      = 64              // Maximum message ID length accepted by the default message ID validator
+	soundMaxLength          = 32              // Maximum length of a message's sound, see validateSound
+	pingTimeout             = 2 * time.Second // Maximum time Ping waits for the database
+	pruneMaxRowsBatchSize   = 1000            // Messages deleted per transaction by PruneToMaxRows, unless PruneBatchSize is set
 )
 
+// Policies for scheduled messages that were missed, e.g. during a downtime, see messageCacheOptions.MissedSchedulePolicy
+const (
+	missedScheduleDeliver    = "deliver"
+	missedScheduleSkip       = "skip"
+	missedScheduleReschedule = "reschedule"
+)
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
 // Messages cache
 const (
+	// selectMessageColumns is the select list of all queries that return messages to readMessages, see messageColumns
+	selectMessageColumns = `mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, encoding, updated, collapse_key, origin, body_html, category, publish_seq, topic_display, sound, has_location, lat, lng, repeat_count, ttl, icon, read_count, content_type`
+
+	// notExpiredCondition excludes messages whose TTL has passed (see message.TTL) from queries. Such messages are
+	// hidden right away, but only deleted by the next Prune.
+	notExpiredCondition = `(ttl = 0 OR time + ttl > CAST(strftime('%s', 'now') AS INT))`
+
 	createMessagesTableQuery = `
 		BEGIN;
 		CREATE TABLE IF NOT EXISTS messages (
@@ -38,59 +91,362 @@ const (
 			attachment_url TEXT NOT NULL,
 			sender TEXT NOT NULL,
 			encoding TEXT NOT NULL,
-			published INT NOT NULL
+			published INT NOT NULL,
+			source_ip TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			updated INT NOT NULL,
+			acked INT NOT NULL DEFAULT('0'),
+			acked_at INT NOT NULL DEFAULT('0'),
+			acked_by TEXT NOT NULL DEFAULT(''),
+			collapse_key TEXT NOT NULL DEFAULT(''),
+			token TEXT NOT NULL DEFAULT(''),
+			pinned INT NOT NULL DEFAULT('0'),
+			time_ms INT NOT NULL DEFAULT('0'),
+			origin TEXT NOT NULL DEFAULT(''),
+			raw_priority INT NOT NULL DEFAULT('0'),
+			body_html TEXT NOT NULL DEFAULT(''),
+			category TEXT NOT NULL DEFAULT(''),
+			ttl INT NOT NULL DEFAULT('0'),
+			attachment_deleted INT NOT NULL DEFAULT('0'),
+			publish_seq INT NOT NULL DEFAULT('0'),
+			delivered INT NOT NULL DEFAULT('0'),
+			topic_display TEXT NOT NULL DEFAULT(''),
+			sound TEXT NOT NULL DEFAULT(''),
+			not_after INT NOT NULL DEFAULT('0'),
+			has_location INT NOT NULL DEFAULT('0'),
+			lat REAL NOT NULL DEFAULT('0'),
+			lng REAL NOT NULL DEFAULT('0'),
+			bytes INT NOT NULL DEFAULT('0'),
+			repeat_count INT NOT NULL DEFAULT('0'),
+			dedup_key TEXT,
+			icon TEXT NOT NULL DEFAULT(''),
+			attachment_hash TEXT NOT NULL DEFAULT(''),
+			read_count INT NOT NULL DEFAULT('0'),
+			email TEXT NOT NULL DEFAULT(''),
+			content_type TEXT NOT NULL DEFAULT('')
 		);
 		CREATE INDEX IF NOT EXISTS idx_mid ON messages (mid);
 		CREATE INDEX IF NOT EXISTS idx_topic ON messages (topic);
+		CREATE INDEX IF NOT EXISTS idx_sender ON messages (sender);
+		CREATE INDEX IF NOT EXISTS idx_topic_time ON messages (topic, time);
+		CREATE INDEX IF NOT EXISTS idx_topic_collapse_key ON messages (topic, collapse_key);
+		CREATE INDEX IF NOT EXISTS idx_topic_publish_seq ON messages (topic, publish_seq);
+		CREATE INDEX IF NOT EXISTS idx_high_priority ON messages (topic, time) WHERE priority >= 4;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_topic_dedup_key ON messages (topic, dedup_key) WHERE dedup_key IS NOT NULL;
+		CREATE INDEX IF NOT EXISTS idx_attachment_hash ON messages (attachment_hash) WHERE attachment_hash != '';
+		CREATE INDEX IF NOT EXISTS idx_email ON messages (email, time) WHERE email != '';
 		COMMIT;
 	`
 	insertMessageQuery = `
-		INSERT INTO messages (mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, encoding, published) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, encoding, published, source_ip, user_agent, updated, collapse_key, token, time_ms, origin, raw_priority, body_html, category, ttl, publish_seq, topic_display, sound, not_after, has_location, lat, lng, bytes, repeat_count, dedup_key, icon, attachment_hash, email, content_type) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	pruneMessagesQuery           = `DELETE FROM messages WHERE time < ? AND published = 1`
-	selectRowIDFromMessageID     = `SELECT id FROM messages WHERE topic = ? AND mid = ?`
-	selectMessagesSinceTimeQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, encoding
+	updateMessageQuery             = `UPDATE messages SET message = ?, encoding = ?, title = ?, body_html = ?, content_type = ?, priority = ?, tags = ?, click = ?, actions = ?, updated = ?, bytes = ? + IFNULL(attachment_size, 0) WHERE topic = ? AND mid = ?`
+	updateMessageIfUnchangedQuery  = `UPDATE messages SET message = ?, encoding = ?, title = ?, body_html = ?, content_type = ?, priority = ?, tags = ?, click = ?, actions = ?, updated = ?, bytes = ? + IFNULL(attachment_size, 0) WHERE topic = ? AND mid = ? AND updated = ?`
+	pruneMessagesQuery             = `DELETE FROM messages WHERE time < ? AND published = 1 AND pinned = 0`
+	pruneMessagesBatchQuery        = `DELETE FROM messages WHERE id IN (SELECT id FROM messages WHERE time < ? AND published = 1 AND pinned = 0 LIMIT ?)`
+	pruneExpiredMessagesQuery      = `DELETE FROM messages WHERE ttl > 0 AND time + ttl <= ?`
+	pruneExpiredMessagesBatchQuery = `DELETE FROM messages WHERE id IN (SELECT id FROM messages WHERE ttl > 0 AND time + ttl <= ? LIMIT ?)`
+	pruneExpiredScheduledQuery     = `DELETE FROM messages WHERE published = 0 AND not_after > 0 AND not_after < ?`
+	deleteScheduledMessageQuery    = `DELETE FROM messages WHERE topic = ? AND mid = ? AND published = 0`
+	deleteOrphanedReadStateQuery   = `DELETE FROM message_read WHERE NOT EXISTS (SELECT 1 FROM messages WHERE id = message_read.message_id)`
+	deleteOrphanedTagsQuery        = `DELETE FROM message_tags WHERE NOT EXISTS (SELECT 1 FROM messages WHERE id = message_tags.message_id)`
+	deleteOrphanedAttachmentsQuery = `DELETE FROM message_attachments WHERE NOT EXISTS (SELECT 1 FROM messages WHERE id = message_attachments.message_id)`
+	pruneOldestMessagesQuery       = `DELETE FROM messages WHERE id IN (SELECT id FROM messages WHERE published = 1 AND pinned = 0 ORDER BY time_ms, id LIMIT ?)`
+	pruneTopicToCountQuery         = `DELETE FROM messages WHERE topic = ? AND published = 1 AND pinned = 0 AND id NOT IN (SELECT id FROM messages WHERE topic = ? AND published = 1 ORDER BY time_ms DESC, id DESC LIMIT ?)`
+	pruneTopicToCountBatchQuery    = `DELETE FROM messages WHERE id IN (SELECT id FROM messages WHERE topic = ? AND published = 1 AND pinned = 0 AND id NOT IN (SELECT id FROM messages WHERE topic = ? AND published = 1 ORDER BY time_ms DESC, id DESC LIMIT ?) LIMIT ?)`
+	pruneMessagesKeepNewestQuery   = `DELETE FROM messages WHERE time < ? AND published = 1 AND pinned = 0 AND id NOT IN (SELECT id FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY topic ORDER BY time_ms DESC, id DESC) AS rn FROM messages WHERE published = 1) WHERE rn <= ?)`
+	pruneKeepNewestBatchQuery      = `DELETE FROM messages WHERE id IN (SELECT id FROM messages WHERE time < ? AND published = 1 AND pinned = 0 AND id NOT IN (SELECT id FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY topic ORDER BY time_ms DESC, id DESC) AS rn FROM messages WHERE published = 1) WHERE rn <= ?) LIMIT ?)`
+	updateMessagePinnedQuery       = `UPDATE messages SET pinned = ? WHERE topic = ? AND mid = ?`
+	deleteTopicQuery               = `DELETE FROM messages WHERE topic = ?`
+	deleteMessagesWithCollapseKey  = `DELETE FROM messages WHERE topic = ? AND collapse_key = ?`
+	selectRowIDFromMessageID       = `SELECT id FROM messages WHERE topic = ? AND mid = ?`
+	selectRowIDFromDedupKeyQuery   = `SELECT id FROM messages WHERE topic = ? AND dedup_key = ?`
+	selectMessageTokenQuery        = `SELECT token FROM messages WHERE topic = ? AND mid = ?`
+	selectAttachmentSizeQuery      = `SELECT IFNULL(attachment_size, 0) FROM messages WHERE topic = ? AND mid = ?`
+	selectDuplicateMessageIDsQuery = `SELECT mid FROM messages GROUP BY mid HAVING COUNT(*) > 1 ORDER BY mid`
+	deleteDuplicateMessagesQuery   = `DELETE FROM messages WHERE id NOT IN (SELECT MIN(id) FROM messages GROUP BY mid)`
+	selectLatestMessageIDQuery     = `SELECT mid FROM messages WHERE topic = ? AND published = 1 ORDER BY id DESC LIMIT 1`
+	selectOldestMessageTimeQuery   = `SELECT MIN(time) FROM messages WHERE topic = ? AND published = 1 AND ` + notExpiredCondition
+	selectMessagesSinceTimeQuery   = `
+		SELECT ` + selectMessageColumns + `
 		FROM messages 
-		WHERE topic = ? AND time >= ? AND published = 1
-		ORDER BY time, id
+		WHERE topic = ? AND time >= ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
 	`
 	selectMessagesSinceTimeIncludeScheduledQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, encoding
+		SELECT ` + selectMessageColumns + `
 		FROM messages 
-		WHERE topic = ? AND time >= ?
-		ORDER BY time, id
+		WHERE topic = ? AND time >= ? AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesBetweenTimesQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND time >= ? AND time < ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesBetweenTimesIncludeScheduledQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND time >= ? AND time < ? AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesByTitleSinceTimeQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND title = ? AND time >= ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesByTitleSinceIDQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND title = ? AND id > IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesByEncodingSinceTimeQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND (IFNULL(encoding, '') = ? OR encoding LIKE ? ESCAPE '\') AND time >= ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesByEncodingSinceIDQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND (IFNULL(encoding, '') = ? OR encoding LIKE ? ESCAPE '\') AND id > IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesByAttachmentTypeSinceTimeQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND attachment_name != '' AND attachment_type LIKE ? || '%' ESCAPE '\' AND time >= ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesByAttachmentTypeSinceIDQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND attachment_name != '' AND attachment_type LIKE ? || '%' ESCAPE '\' AND id > IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesLikeQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND (message LIKE '%' || ? || '%' ESCAPE '\' OR instr(encoding, ';') > 0) AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms DESC, id DESC
+	`
+	selectMessagesMatchingQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND (message LIKE '%' || ? || '%' ESCAPE '\' OR title LIKE '%' || ? || '%' ESCAPE '\' OR instr(encoding, ';') > 0) AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms DESC, id DESC
+	`
+	selectMessagesSinceIDCappedQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND id > IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) AND time >= ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesPageQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE %s
+		ORDER BY time_ms, id
+		LIMIT ? OFFSET ?
+	`
+	selectMessagesPageCountQuery = `
+		SELECT COUNT(*)
+		FROM messages
+		WHERE %s
+	`
+	selectMessagesByCategorySinceTimeQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND category = ? AND time >= ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesByCategorySinceIDQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND category = ? AND id > IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectEditedMessagesSinceTimeQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND updated > time AND time >= ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectEditedMessagesSinceIDQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND updated > time AND id > IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesExcludingOriginSinceTimeQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND time >= ? AND published = 1 AND IFNULL(NULLIF(origin, ''), ?) != ? AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessagesExcludingOriginSinceIDQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND id > IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) AND published = 1 AND IFNULL(NULLIF(origin, ''), ?) != ? AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectMessageQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND mid = ?
+	`
+	selectMessageByIDQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE mid = ?
+		LIMIT 2
+	`
+	selectMessagePositionQuery = `SELECT time_ms, id FROM messages WHERE topic = ? AND mid = ?`
+	selectPreviousMessageQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND published = 1 AND (time_ms, id) < (?, ?) AND ` + notExpiredCondition + `
+		ORDER BY time_ms DESC, id DESC
+		LIMIT 1
+	`
+	selectNextMessageQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND published = 1 AND (time_ms, id) > (?, ?) AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+		LIMIT 1
+	`
+	selectMessagesBeforeIDQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND id < IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms DESC, id DESC
+		LIMIT ?
+	`
+	selectMessagesLatestQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms DESC, id DESC
+		LIMIT ?
 	`
 	selectMessagesSinceIDQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, encoding
+		SELECT ` + selectMessageColumns + `
 		FROM messages 
-		WHERE topic = ? AND id > ? AND published = 1 
-		ORDER BY time, id
+		WHERE topic = ? AND id > IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
 	`
 	selectMessagesSinceIDIncludeScheduledQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, encoding
+		SELECT ` + selectMessageColumns + `
 		FROM messages 
-		WHERE topic = ? AND (id > ? OR published = 0)
-		ORDER BY time, id
+		WHERE topic = ? AND (id > IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) OR published = 0) AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
 	`
 	selectMessagesDueQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, encoding
+		SELECT ` + selectMessageColumns + `
 		FROM messages 
-		WHERE time <= ? AND published = 0
-		ORDER BY time, id
+		WHERE time <= ? AND published = 0 AND (not_after = 0 OR not_after >= CAST(strftime('%s', 'now') AS INT))
+		ORDER BY time_ms, id
+	`
+	selectMessagesDueLimitQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE time <= ? AND published = 0 AND (not_after = 0 OR not_after >= CAST(strftime('%s', 'now') AS INT))
+		ORDER BY time_ms, id
+		LIMIT ?
+	`
+	selectMessagesBetweenIDsQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE id > ? AND id <= ?
+		ORDER BY id
+	`
+	selectMessagesWithExpiredAttachmentsQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE attachment_expires > 0 AND attachment_expires < ?
+		ORDER BY time_ms, id
+		LIMIT ?
+	`
+	selectRecentMessagesForSenderQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE sender = ? AND published = 1
+		ORDER BY time_ms DESC, id DESC
+		LIMIT ?
 	`
+	selectMessagesBySenderQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE sender = ? AND time >= ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectUnackedMessagesQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND acked = 0 AND published = 1 AND IFNULL(NULLIF(priority, 0), 3) >= ? AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectUnackedHighPriorityMessagesQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND priority >= 4 AND priority >= ? AND acked = 0 AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	updateMessageAckedQuery         = `UPDATE messages SET acked = 1, acked_at = ?, acked_by = ? WHERE topic = ? AND mid = ? AND acked = 0`
 	updateMessagePublishedQuery     = `UPDATE messages SET published = 1 WHERE mid = ?`
+	updateMessageRescheduledQuery   = `UPDATE messages SET time = ?, time_ms = ?, updated = ? WHERE mid = ? AND published = 0`
+	updateMessageDeliveredQuery     = `UPDATE messages SET delivered = delivered + 1 WHERE topic = ? AND mid = ?`
+	selectMessageDeliveredQuery     = `SELECT delivered FROM messages WHERE topic = ? AND mid = ?`
+	selectTopicDisplayQuery         = `SELECT topic_display FROM messages WHERE topic = ? AND topic_display != '' ORDER BY id LIMIT 1`
 	selectMessagesCountQuery        = `SELECT COUNT(*) FROM messages`
 	selectMessageCountForTopicQuery = `SELECT COUNT(*) FROM messages WHERE topic = ?`
+	selectPublishedCountQuery       = `SELECT COUNT(*) FROM messages WHERE topic = ? AND published = 1 AND ` + notExpiredCondition
+	selectScheduledCountQuery       = `SELECT COUNT(*) FROM messages WHERE topic = ? AND published = 0`
+	selectScheduledCountTotalQuery  = `SELECT COUNT(*) FROM messages WHERE published = 0`
+	selectMessageStatsQuery         = `SELECT COUNT(*), COUNT(DISTINCT topic), MIN(time) FROM messages`
+	selectMessageRangeQuery         = `SELECT MIN(time), MAX(time), COUNT(*) FROM messages WHERE topic = ? AND published = 1 AND ` + notExpiredCondition
+	selectMessageCountSinceQuery    = `SELECT COUNT(*) FROM messages WHERE topic = ? AND time >= ?`
+	selectDailyCountsQuery          = `SELECT strftime('%Y-%m-%d', time + ?, 'unixepoch') AS day, COUNT(*) FROM messages WHERE topic = ? AND time >= ? AND time < ? AND published = 1 GROUP BY day`
+	selectAgeHistogramQuery         = `
+		SELECT CASE WHEN time > ? THEN '0-1h' WHEN time > ? THEN '1-24h' WHEN time > ? THEN '1-7d' ELSE 'older' END AS bucket, COUNT(*)
+		FROM messages
+		WHERE published = 1
+		GROUP BY bucket
+	`
+	selectTopicStorageBytesQuery    = `SELECT IFNULL(SUM(bytes), 0) FROM messages WHERE topic = ?`
 	selectTopicsQuery               = `SELECT topic FROM messages GROUP BY topic`
-	selectAttachmentsSizeQuery      = `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE sender = ? AND attachment_expires >= ?`
-	selectAttachmentsExpiredQuery   = `SELECT mid FROM messages WHERE attachment_expires > 0 AND attachment_expires < ?`
+	selectTopicsPageQuery           = `SELECT topic FROM messages GROUP BY topic ORDER BY topic LIMIT ? OFFSET ?`
+	selectTopicsWithPrefixQuery     = `SELECT topic FROM messages WHERE topic LIKE ? || '%' ESCAPE '\' GROUP BY topic ORDER BY topic`
+	selectAttachmentsSizeTotalQuery = `SELECT IFNULL(SUM(size), 0) FROM message_attachments WHERE expires >= ?`
+	selectAttachmentsExpiredQuery   = `
+		SELECT a.mid, a.owner, a.size
+		FROM message_attachments a
+		JOIN messages m ON m.id = a.message_id
+		WHERE a.expires > 0 AND a.expires < ? AND m.attachment_deleted = 0
+		ORDER BY a.id
+	`
+	selectMessageForensicsQuery    = `SELECT source_ip, user_agent FROM messages WHERE topic = ? AND mid = ?`
+	selectAttachmentsForTopicQuery = `SELECT mid FROM messages WHERE topic = ? AND attachment_expires > 0`
+	selectMessageIDsForTopicQuery  = `SELECT mid FROM messages WHERE topic = ?`
+	selectBatchEndRowIDQuery       = `SELECT IFNULL(MAX(id), 0) FROM (SELECT id FROM messages WHERE id > ? ORDER BY id LIMIT ?)`
+)
+
+// Pragmas; these cannot be used with bound parameters
+const (
+	setAutoVacuumQuery     = `PRAGMA auto_vacuum = %s`
+	incrementalVacuumQuery = `PRAGMA incremental_vacuum(%d)`
+	vacuumQuery            = `VACUUM`
+	walCheckpointQuery     = `PRAGMA wal_checkpoint(TRUNCATE)`
 )
 
 // Schema management queries
 const (
-	currentSchemaVersion          = 7
+	currentSchemaVersion          = 51
 	createSchemaVersionTableQuery = `
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
@@ -103,11 +459,9 @@ const (
 
 	// 0 -> 1
 	migrate0To1AlterMessagesTableQuery = `
-		BEGIN;
 		ALTER TABLE messages ADD COLUMN title TEXT NOT NULL DEFAULT('');
 		ALTER TABLE messages ADD COLUMN priority INT NOT NULL DEFAULT(0);
 		ALTER TABLE messages ADD COLUMN tags TEXT NOT NULL DEFAULT('');
-		COMMIT;
 	`
 
 	// 1 -> 2
@@ -117,7 +471,6 @@ const (
 
 	// 2 -> 3
 	migrate2To3AlterMessagesTableQuery = `
-		BEGIN;
 		ALTER TABLE messages ADD COLUMN click TEXT NOT NULL DEFAULT('');
 		ALTER TABLE messages ADD COLUMN attachment_name TEXT NOT NULL DEFAULT('');
 		ALTER TABLE messages ADD COLUMN attachment_type TEXT NOT NULL DEFAULT('');
@@ -125,7 +478,6 @@ const (
 		ALTER TABLE messages ADD COLUMN attachment_expires INT NOT NULL DEFAULT('0');
 		ALTER TABLE messages ADD COLUMN attachment_owner TEXT NOT NULL DEFAULT('');
 		ALTER TABLE messages ADD COLUMN attachment_url TEXT NOT NULL DEFAULT('');
-		COMMIT;
 	`
 	// 3 -> 4
 	migrate3To4AlterMessagesTableQuery = `
@@ -134,7 +486,6 @@ const (
 
 	// 4 -> 5
 	migrate4To5AlterMessagesTableQuery = `
-		BEGIN;
 		CREATE TABLE IF NOT EXISTS messages_new (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			mid TEXT NOT NULL,
@@ -166,7 +517,6 @@ const (
 			FROM messages;
 		DROP TABLE messages;
 		ALTER TABLE messages_new RENAME TO messages;
-		COMMIT;
 	`
 
 	// 5 -> 6
@@ -178,26 +528,463 @@ const (
 	migrate6To7AlterMessagesTableQuery = `
 		ALTER TABLE messages RENAME COLUMN attachment_owner TO sender;
 	`
+
+	// 7 -> 8
+	migrate7To8AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN source_ip TEXT NOT NULL DEFAULT('');
+		ALTER TABLE messages ADD COLUMN user_agent TEXT NOT NULL DEFAULT('');
+	`
+
+	// 8 -> 9
+	migrate8To9SelectTagsQuery = `SELECT id, tags FROM messages WHERE tags != ''`
+	migrate8To9UpdateTagsQuery = `UPDATE messages SET tags = ? WHERE id = ?`
+
+	// 9 -> 10
+	migrate9To10AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN updated INT NOT NULL DEFAULT('0');
+		UPDATE messages SET updated = time;
+	`
+
+	// 10 -> 11
+	migrate10To11CreateDictionariesTableQuery = createDictionariesTableQuery
+
+	// 11 -> 12
+	migrate11To12AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN acked INT NOT NULL DEFAULT('0');
+		ALTER TABLE messages ADD COLUMN acked_at INT NOT NULL DEFAULT('0');
+		ALTER TABLE messages ADD COLUMN acked_by TEXT NOT NULL DEFAULT('');
+	`
+
+	// 12 -> 13
+	migrate12To13CreateSenderIndexQuery = `
+		CREATE INDEX IF NOT EXISTS idx_sender ON messages (sender);
+	`
+
+	// 13 -> 14
+	migrate13To14CreateTopicTimeIndexQuery = `
+		CREATE INDEX IF NOT EXISTS idx_topic_time ON messages (topic, time);
+	`
+
+	// 14 -> 15
+	migrate14To15AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN collapse_key TEXT NOT NULL DEFAULT('');
+		CREATE INDEX IF NOT EXISTS idx_topic_collapse_key ON messages (topic, collapse_key);
+	`
+
+	// 15 -> 16
+	migrate15To16CreateTopicDefaultsTableQuery = `
+		CREATE TABLE IF NOT EXISTS topic_defaults (
+			topic TEXT PRIMARY KEY,
+			priority INT NOT NULL,
+			tags TEXT NOT NULL
+		);
+	`
+
+	// 16 -> 17
+	migrate16To17AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN token TEXT NOT NULL DEFAULT('');
+	`
+
+	// 17 -> 18
+	migrate17To18AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN pinned INT NOT NULL DEFAULT('0');
+	`
+
+	// 18 -> 19
+	migrate18To19AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN time_ms INT NOT NULL DEFAULT('0');
+		UPDATE messages SET time_ms = time * 1000;
+	`
+
+	// 19 -> 20
+	migrate19To20CreateMessageTagsTableQuery = createMessageTagsTableQuery
+
+	// 20 -> 21
+	migrate20To21AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN origin TEXT NOT NULL DEFAULT('');
+	`
+
+	// 21 -> 22
+	migrate21To22AlterMessagesTableQuery = `
+		ALTER TABLE topic_defaults ADD COLUMN max_priority INT NOT NULL DEFAULT('0');
+		ALTER TABLE messages ADD COLUMN raw_priority INT NOT NULL DEFAULT('0');
+	`
+
+	// 22 -> 23
+	migrate22To23AlterTopicDefaultsTableQuery = `
+		ALTER TABLE topic_defaults ADD COLUMN disabled INT NOT NULL DEFAULT('0');
+	`
+
+	// 23 -> 24
+	migrate23To24CreateAttachmentQuotaTableQuery = createAttachmentQuotaTableQuery + `
+		INSERT INTO attachment_quota (sender, bytes, expires)
+		SELECT sender, SUM(attachment_size), MIN(attachment_expires)
+		FROM messages
+		WHERE attachment_size > 0 AND attachment_expires >= CAST(strftime('%s', 'now') AS INT)
+		GROUP BY sender;
+	`
+	// 24 -> 25
+	migrate24To25AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN body_html TEXT NOT NULL DEFAULT('');
+	`
+	// 25 -> 26
+	migrate25To26CreateTopicActivityTableQuery = createTopicActivityTableQuery
+	// 26 -> 27
+	migrate26To27AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN category TEXT NOT NULL DEFAULT('');
+	`
+	// 27 -> 28
+	migrate27To28AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN ttl INT NOT NULL DEFAULT('0');
+	`
+	// 28 -> 29
+	migrate28To29AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN attachment_deleted INT NOT NULL DEFAULT('0');
+	`
+	// 29 -> 30
+	migrate29To30CreateTopicAliasesTableQuery = createTopicAliasesTableQuery
+	// 30 -> 31
+	migrate30To31AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN publish_seq INT NOT NULL DEFAULT('0');
+		UPDATE messages SET publish_seq = id;
+		CREATE INDEX IF NOT EXISTS idx_topic_publish_seq ON messages (topic, publish_seq);
+		CREATE TABLE IF NOT EXISTS publish_sequence (
+			seq INT NOT NULL
+		);
+		INSERT INTO publish_sequence (seq) SELECT IFNULL(MAX(publish_seq), 0) FROM messages;
+	`
+	// 31 -> 32
+	migrate31To32CreateMessageAttachmentsTableQuery = `
+		CREATE TABLE IF NOT EXISTS message_attachments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			mid TEXT NOT NULL,
+			name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			size INT NOT NULL,
+			expires INT NOT NULL,
+			url TEXT NOT NULL,
+			owner TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_attachments_message_id ON message_attachments (message_id);
+		CREATE INDEX IF NOT EXISTS idx_message_attachments_mid ON message_attachments (mid);
+		CREATE INDEX IF NOT EXISTS idx_message_attachments_expires ON message_attachments (expires);
+		INSERT INTO message_attachments (message_id, mid, name, type, size, expires, url, owner)
+		SELECT id, mid, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender
+		FROM messages
+		WHERE attachment_name != '' AND attachment_url != ''
+		ORDER BY id;
+	`
+	// 32 -> 33
+	migrate32To33AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN delivered INT NOT NULL DEFAULT('0');
+	`
+	// 33 -> 34
+	migrate33To34AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN topic_display TEXT NOT NULL DEFAULT('');
+	`
+	// 34 -> 35
+	migrate34To35AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN sound TEXT NOT NULL DEFAULT('');
+	`
+	// 35 -> 36
+	migrate35To36AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN not_after INT NOT NULL DEFAULT('0');
+	`
+	// 36 -> 37
+	migrate36To37CreateMessageReadTableQuery = createMessageReadTableQuery
+	// 37 -> 38
+	migrate37To38CreateHighPriorityIndexQuery = `
+		CREATE INDEX IF NOT EXISTS idx_high_priority ON messages (topic, time) WHERE priority >= 4;
+	`
+	// 38 -> 39
+	migrate38To39AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN has_location INT NOT NULL DEFAULT('0');
+		ALTER TABLE messages ADD COLUMN lat REAL NOT NULL DEFAULT('0');
+		ALTER TABLE messages ADD COLUMN lng REAL NOT NULL DEFAULT('0');
+	`
+	// 39 -> 40
+	migrate39To40AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN bytes INT NOT NULL DEFAULT('0');
+		UPDATE messages SET bytes = length(CAST(message AS BLOB)) + IFNULL(length(CAST(title AS BLOB)), 0) + IFNULL(length(CAST(tags AS BLOB)), 0) + IFNULL(attachment_size, 0);
+	`
+	// 40 -> 41
+	migrate40To41CreateDeletedMessagesTableQuery = createDeletedMessagesTableQuery
+	// 41 -> 42
+	migrate41To42AlterTopicDefaultsTableQuery = `
+		ALTER TABLE topic_defaults ADD COLUMN attachment_ttl INT NOT NULL DEFAULT('0');
+	`
+	// 42 -> 43
+	migrate42To43AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN repeat_count INT NOT NULL DEFAULT('0');
+	`
+	// 43 -> 44
+	migrate43To44CreateAuditTableQuery = createAuditTableQuery
+	// 44 -> 45
+	migrate44To45AddDedupKeyColumnQuery = `
+		ALTER TABLE messages ADD COLUMN dedup_key TEXT;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_topic_dedup_key ON messages (topic, dedup_key) WHERE dedup_key IS NOT NULL;
+	`
+	// 45 -> 46
+	migrate45To46AddIconColumnQuery = `
+		ALTER TABLE messages ADD COLUMN icon TEXT NOT NULL DEFAULT('');
+	`
+	// 46 -> 47
+	migrate46To47AddAttachmentHashColumnQuery = `
+		ALTER TABLE messages ADD COLUMN attachment_hash TEXT NOT NULL DEFAULT('');
+		CREATE INDEX IF NOT EXISTS idx_attachment_hash ON messages (attachment_hash) WHERE attachment_hash != '';
+	`
+	// 47 -> 48
+	migrate47To48CreateMessageVersionsTableQuery = createMessageVersionsTableQuery
+	// 48 -> 49
+	migrate48To49AddReadCountColumnQuery = `
+		ALTER TABLE messages ADD COLUMN read_count INT NOT NULL DEFAULT('0');
+	`
+	// 49 -> 50
+	migrate49To50AddEmailColumnQuery = `
+		ALTER TABLE messages ADD COLUMN email TEXT NOT NULL DEFAULT('');
+		CREATE INDEX IF NOT EXISTS idx_email ON messages (email, time) WHERE email != '';
+	`
+	// 50 -> 51
+	migrate50To51AddContentTypeColumnQuery = `
+		ALTER TABLE messages ADD COLUMN content_type TEXT NOT NULL DEFAULT('');
+		UPDATE messages SET content_type = 'text/markdown' WHERE body_html != '';
+	`
 )
 
 type messageCache struct {
-	db  *sql.DB
-	nop bool
+	totalPruned       int64 // Accessed atomically; 64-bit fields must be first for alignment on 32-bit platforms
+	lastPruneTime     int64 // Unix time in nanoseconds, accessed atomically
+	lastPruneDuration int64 // Nanoseconds, accessed atomically
+	messagesFound     int64 // Message lookups that found the message, accessed atomically, see LookupStats
+	messagesNotFound  int64 // Message lookups for messages that do not exist (anymore), accessed atomically
+	db                *sql.DB
+	nop               bool
+	dictionaries      map[int64]*bodyDictionary  // Body compression dictionaries by ID, see TrainBodyDictionary
+	topicDictionaries map[string]*bodyDictionary // Latest body compression dictionary per topic
+	topicDefaults     map[string]*topicDefaults  // Default priority and tags per topic, see SetTopicDefaults
+	insertBuffer      *messageInsertBuffer       // Optional write-behind buffer, see EnableInsertBuffer
+	nilEmptyTags      bool                       // See messageCacheOptions
+	origin            string                     // See messageCacheOptions
+	spill             *messageCacheSpill         // Optional spilling to disk for in-memory caches, see Spill
+	keyProvider       KeyProvider                // See messageCacheOptions
+	categories        map[string]bool            // Allowed message categories, see messageCacheOptions
+	maxTags           int                        // See messageCacheOptions
+	maxMessageSize    int                        // See messageCacheOptions
+	maxTitleLength    int                        // See messageCacheOptions
+	writeFeed         *messageWriteFeed          // Optional feed of all writes, see messageCacheOptions.OnWrite
+	ownerHasher       func(owner string) string  // See messageCacheOptions.OwnerHasher
+	topicAliases      map[string]string          // Canonical topic by alias, see SetTopicAlias
+	idValidator       func(id string) error      // See ValidateMessageID
+	duePolicy         string                     // See messageCacheOptions.MissedSchedulePolicy
+	foldTopics        bool                       // See messageCacheOptions.CaseInsensitiveTopics
+	dueGrace          time.Duration              // See messageCacheOptions.MissedScheduleGrace
+	debounceWindow    time.Duration              // See messageCacheOptions.DebounceWindow
+	auditDeletions    bool                       // See messageCacheOptions.AuditDeletions
+	busyRetries       int                        // See messageCacheOptions.BusyRetries
+	busyBackoff       time.Duration              // See messageCacheOptions.BusyRetryBackoff
+	pruneBatchSize    int                        // See messageCacheOptions.PruneBatchSize
+	keepHistory       bool                       // See messageCacheOptions.KeepHistory
+	onQuery           queryHook                  // See messageCacheOptions.OnQuery
+	compressThreshold int                        // See messageCacheOptions.CompressionThreshold
+	mu                sync.RWMutex
+	bufferMu          sync.RWMutex // Protects insertBuffer
+}
+
+// messageCacheOptions are options for the SQLite cache that can only be set when the cache is created
+type messageCacheOptions struct {
+	AutoVacuum   string      // SQLite auto_vacuum mode, one of "none" (default), "full" or "incremental"; only applies to new databases
+	NilEmptyTags bool        // If set, messages without tags are read with nil tags instead of an empty slice (legacy behavior)
+	Origin       string      // ID of this server, stored as the origin of messages published locally (for federation)
+	KeyProvider  KeyProvider // If set, message bodies are encrypted at rest with per-topic keys, see KeyProvider
+	Categories   []string    // Allowed message categories (e.g. "incident", "maintenance"); messages with other categories are rejected
+	MaxTags      int         // Maximum number of distinct tags per message; messages with more are rejected, 0 for no limit
+
+	// MaxMessageSize is the maximum size of a message body in bytes, as published (i.e. before it is compressed
+	// or encrypted), and MaxTitleLength the maximum length of a title in characters. Messages that exceed them
+	// are rejected with errMessageTooLarge and errTitleTooLong. 0 means no limit.
+	MaxMessageSize int
+	MaxTitleLength int
+
+	// MessageIDValidator validates the IDs of added messages, see ValidateMessageID. If it is not set, message IDs
+	// must be non-empty and at most messageIDMaxLength characters long.
+	MessageIDValidator func(id string) error
+
+	// MissedSchedulePolicy defines what DueMessagesBatched does with scheduled messages that are overdue by more
+	// than MissedScheduleGrace, e.g. after a long downtime: "deliver" them like all other due messages (default),
+	// "skip" them by marking them published without returning them, or "reschedule" them to the current time.
+	MissedSchedulePolicy string
+	MissedScheduleGrace  time.Duration
+
+	// CaseInsensitiveTopics stores messages under the lowercased topic, so that e.g. "MyTopic" and "mytopic" are the
+	// same topic. The casing of the first stored message of a topic is kept as its display name, and returned as
+	// the topic of all its messages. Topic settings such as defaults and aliases apply case-insensitively as well.
+	CaseInsensitiveTopics bool
+
+	// Synchronous is the SQLite synchronous mode ("off", "normal" or "full"), which trades write throughput for
+	// durability. It is applied with PRAGMA synchronous to every connection of file-backed caches. The default
+	// is "normal", which syncs less often and may lose the most recent messages on power loss. "full" also keeps
+	// those, at the cost of an fsync for every commit. With "off", writes are fastest, but the database may be
+	// corrupted if the operating system crashes or the power fails.
+	Synchronous string
+
+	// JournalMode is the SQLite journal mode ("delete", "truncate", "persist" or "wal") of file-backed caches. The
+	// default is the driver default, "delete". With "wal", readers do not block the writer and vice versa, which
+	// avoids "database is locked" errors under concurrent load; the cache file then comes with -wal and -shm files.
+	// It does not apply to in-memory caches.
+	JournalMode string
+
+	// BusyTimeout is how long a connection waits for a lock held by another connection before the query fails
+	// with "database is locked". If it is 0, the driver default of 5 seconds is used.
+	BusyTimeout time.Duration
+
+	// BusyRetries is how often writes (adding, updating, publishing, deleting and pruning messages) are retried if
+	// they fail because the database is busy or locked, see retryBusy. BusyRetryBackoff is the wait time before the
+	// first retry, which doubles with every further retry. If BusyRetries is 0, writes are not retried.
+	BusyRetries      int
+	BusyRetryBackoff time.Duration
+
+	// OwnerHasher, if set, is applied to the sender of every added message before it is stored, so that the
+	// database only contains opaque attachment owners, see newHMACOwnerHasher. Methods that take a sender or owner
+	// apply it as well. Messages read from the cache have the hashed sender.
+	OwnerHasher func(owner string) string
+
+	// OnWrite is called for every message that was added, updated or deleted, after the write was committed. It is
+	// called from a background goroutine, so that a slow handler does not block writes, see messageWriteFeed.
+	OnWrite func(op writeOp, m *message)
+
+	// OnQuery, if set, is called with the name, duration and error of the main operations of the cache, e.g. to
+	// record them in metrics. It is called synchronously, so it must be fast, see queryHook.
+	OnQuery queryHook
+
+	// SpillFilename and SpillThreshold enable spilling an in-memory cache to disk, see Spill. The cache is spilled
+	// automatically once it holds more than SpillThreshold messages; if the threshold is 0, only Spill does.
+	SpillFilename  string
+	SpillThreshold int
+
+	// DebounceWindow, if set, merges a message into the most recent message of its topic instead of inserting it,
+	// if both have the same title, body and priority and were published at most this far apart. The merged message
+	// is moved to the time of the repeat, and its RepeatCount is incremented, see debounceMessage.
+	DebounceWindow time.Duration
+
+	// AuditDeletions records every deleted message in the audit table, along with the reason it was deleted, so
+	// that it can be explained where a message went, see AuditTrail
+	AuditDeletions bool
+
+	// PruneBatchSize, if set, makes Prune delete at most this many messages per transaction, so that a prune of a
+	// large database does not hold the write lock for seconds at a time, and publishing can continue in between.
+	// The same messages are deleted either way. If it is 0, each kind of message is pruned in a single transaction.
+	PruneBatchSize int
+
+	// KeepHistory keeps the previous versions of messages that are overwritten by UpdateMessage or
+	// UpdateMessageIfUnchanged in the message_versions table, see MessageHistory
+	KeepHistory bool
+
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime configure the connection pool, see configureConnPool. For
+	// file-backed caches, 0 keeps the database/sql defaults. In-memory caches default to a single connection.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// CompressionThreshold, if set, gzips message bodies of at least this many bytes before they are stored, if
+	// that makes them smaller, see compressBody. Messages are read back unchanged.
+	CompressionThreshold int
 }
 
 // newSqliteCache creates a SQLite file-backed cache
 func newSqliteCache(filename string, nop bool) (*messageCache, error) {
-	db, err := sql.Open("sqlite3", filename)
-	if err != nil {
+	return newSqliteCacheWithOptions(filename, nop, &messageCacheOptions{})
+}
+
+// newSqliteCacheWithOptions creates a SQLite file-backed cache with the given creation-time options
+func newSqliteCacheWithOptions(filename string, nop bool, options *messageCacheOptions) (*messageCache, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	var db *sql.DB
+	var spill *messageCacheSpill
+	if options.SpillFilename != "" {
+		var connector *spillConnector
+		db, connector = openSpillableDB(filename)
+		spill = &messageCacheSpill{
+			connector: connector,
+			filename:  options.SpillFilename,
+			threshold: options.SpillThreshold,
+			options:   options,
+		}
+	} else {
+		var err error
+		db, err = sql.Open("sqlite3", sqlitePragmasDSN(sqliteDSN(filename), options))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := configureConnPool(db, filename, options); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return newCache(db, nop, options, spill)
+}
+
+// newCacheFromDB creates a cache on top of an already opened database, e.g. to use a custom driver, a shared
+// connection pool or an instrumented database. The database is set up or migrated as needed. The caller must
+// make sure that foreign key constraints are enabled for every connection (see sqliteDSN).
+func newCacheFromDB(db *sql.DB, nop bool) (*messageCache, error) {
+	return newCache(db, nop, &messageCacheOptions{}, nil)
+}
+
+func newCache(db *sql.DB, nop bool, options *messageCacheOptions, spill *messageCacheSpill) (*messageCache, error) {
+	if err := setupCacheDB(db, options); err != nil {
+		return nil, err
+	}
+	c := &messageCache{
+		db:                db,
+		nop:               nop,
+		dictionaries:      make(map[int64]*bodyDictionary),
+		topicDictionaries: make(map[string]*bodyDictionary),
+		topicDefaults:     make(map[string]*topicDefaults),
+		nilEmptyTags:      options.NilEmptyTags,
+		origin:            options.Origin,
+		spill:             spill,
+		keyProvider:       options.KeyProvider,
+		categories:        make(map[string]bool),
+		maxTags:           options.MaxTags,
+		maxMessageSize:    options.MaxMessageSize,
+		maxTitleLength:    options.MaxTitleLength,
+		ownerHasher:       options.OwnerHasher,
+		topicAliases:      make(map[string]string),
+		idValidator:       options.MessageIDValidator,
+		duePolicy:         options.MissedSchedulePolicy,
+		foldTopics:        options.CaseInsensitiveTopics,
+		dueGrace:          options.MissedScheduleGrace,
+		debounceWindow:    options.DebounceWindow,
+		auditDeletions:    options.AuditDeletions,
+		busyRetries:       options.BusyRetries,
+		busyBackoff:       options.BusyRetryBackoff,
+		pruneBatchSize:    options.PruneBatchSize,
+		keepHistory:       options.KeepHistory,
+		onQuery:           options.OnQuery,
+		compressThreshold: options.CompressionThreshold,
+	}
+	if c.idValidator == nil {
+		c.idValidator = validateMessageIDLength
+	}
+	if options.OnWrite != nil {
+		c.writeFeed = newMessageWriteFeed(options.OnWrite)
+	}
+	for _, category := range options.Categories {
+		c.categories[category] = true
+	}
+	if err := c.loadBodyDictionaries(); err != nil {
+		return nil, err
+	}
+	if err := c.loadTopicDefaults(); err != nil {
 		return nil, err
 	}
-	if err := setupCacheDB(db); err != nil {
+	if err := c.loadTopicAliases(); err != nil {
 		return nil, err
 	}
-	return &messageCache{
-		db:  db,
-		nop: nop,
-	}, nil
+	return c, nil
 }
 
 // newMemCache creates an in-memory cache
@@ -205,12 +992,51 @@ func newMemCache() (*messageCache, error) {
 	return newSqliteCache(createMemoryFilename(), false)
 }
 
+// newMemCacheWithOptions creates an in-memory cache with the given creation-time options,
+// e.g. to spill to disk once it grows too large
+func newMemCacheWithOptions(options *messageCacheOptions) (*messageCache, error) {
+	return newSqliteCacheWithOptions(createMemoryFilename(), false, options)
+}
+
 // newNopCache creates an in-memory cache that discards all messages;
 // it is always empty and can be used if caching is entirely disabled
 func newNopCache() (*messageCache, error) {
 	return newSqliteCache(createMemoryFilename(), true)
 }
 
+// configureConnPool applies the connection pool options to the database. An in-memory database only exists as
+// long as a connection to it is open, and every connection is a chance to hit "database table is locked" errors
+// of the shared cache mode, so in-memory caches default to a single connection, and connections are never closed
+// while the cache is open: at least one connection is kept idle, and a connection lifetime is rejected.
+func configureConnPool(db *sql.DB, filename string, options *messageCacheOptions) error {
+	maxOpen, maxIdle := options.MaxOpenConns, options.MaxIdleConns
+	if isMemoryFilename(filename) {
+		if options.ConnMaxLifetime > 0 {
+			return errors.New("connection lifetime is not supported for in-memory caches")
+		} else if maxOpen == 0 {
+			maxOpen = 1
+		}
+		if maxIdle == 0 || maxIdle > maxOpen {
+			maxIdle = maxOpen
+		}
+	}
+	if maxOpen > 0 {
+		db.SetMaxOpenConns(maxOpen)
+	}
+	if maxIdle > 0 {
+		db.SetMaxIdleConns(maxIdle)
+	}
+	if options.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(options.ConnMaxLifetime)
+	}
+	return nil
+}
+
+// isMemoryFilename returns true if the filename refers to an in-memory database, see createMemoryFilename
+func isMemoryFilename(filename string) bool {
+	return filename == ":memory:" || strings.Contains(filename, "mode=memory")
+}
+
 // createMemoryFilename creates a unique memory filename to use for the SQLite backend.
 // From mattn/go-sqlite3: "Each connection to ":memory:" opens a brand new in-memory
 // sql database, so if the stdlib's sql engine happens to open another connection and
@@ -221,162 +1047,2252 @@ func createMemoryFilename() string {
 	return fmt.Sprintf("file:%s?mode=memory&cache=shared", util.RandomString(10))
 }
 
-func (c *messageCache) AddMessage(m *message) error {
+// withTx runs fn in a transaction, see runInTx
+func (c *messageCache) withTx(fn func(tx *sql.Tx) error) error {
+	return runInTx(c.db, fn)
+}
+
+// runInTx begins a transaction, runs fn and commits the transaction. If fn returns an error or panics,
+// the transaction is rolled back; errors returned by fn are passed through unchanged, so that callers can
+// still compare them to errMessageNotFound and friends.
+func runInTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot begin transaction: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Warn("Message cache: Cannot roll back transaction: %s", rollbackErr.Error())
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot commit transaction: %w", err)
+	}
+	return nil
+}
+
+// AddMessage stores a single message. If the insert buffer is enabled, the message is only queued,
+// and written to the database with the next batch (see EnableInsertBuffer).
+//
+// If the message has a deduplication key that was already used in the topic, e.g. because the publisher
+// retried after a timeout, the message is not stored, and errMessageDuplicate is returned, so that the caller
+// does not send it to subscribers again. With the insert buffer enabled, duplicates are dropped silently.
+func (c *messageCache) AddMessage(m *message) (err error) {
+	defer c.observe(queryOpAddMessage, time.Now(), &err)
 	if m.Event != messageEvent {
 		return errUnexpectedMessageType
+	} else if err := validateTopic(m.Topic); err != nil {
+		return err
 	}
-	if c.nop {
+	m = m.clone() // The caller's message may be sent to subscribers at the same time, so it is never changed
+	m.Topic = c.resolveMessageTopic(m.Topic)
+	if err := c.validateMessage(m); err != nil {
+		return err
+	} else if c.nop {
 		return nil
+	} else if err := prepareMessage(m); err != nil {
+		return err
 	}
-	published := m.Time <= time.Now().Unix()
-	tags := strings.Join(m.Tags, ",")
-	var attachmentName, attachmentType, attachmentURL string
-	var attachmentSize, attachmentExpires int64
-	if m.Attachment != nil {
-		attachmentName = m.Attachment.Name
-		attachmentType = m.Attachment.Type
-		attachmentSize = m.Attachment.Size
-		attachmentExpires = m.Attachment.Expires
-		attachmentURL = m.Attachment.URL
+	c.bufferMu.RLock()
+	defer c.bufferMu.RUnlock()
+	if c.insertBuffer != nil {
+		c.insertBuffer.enqueue(m, c.ResolveTopic(m.Topic))
+		return nil
 	}
-	var actionsStr string
-	if len(m.Actions) > 0 {
-		actionsBytes, err := json.Marshal(m.Actions)
+	inserted, err := c.addMessages([]*message{m})
+	if err != nil {
+		return err
+	} else if len(inserted) == 0 {
+		return errMessageDuplicate
+	}
+	return nil
+}
+
+// TryAddMessage stores a message like AddMessage, unless the topic already has maxPerMinute or more messages
+// from the last minute, in which case errRateLimited is returned. A maxPerMinute <= 0 means no limit.
+//
+// Since the limit is checked against the database, it survives restarts. It is not exact, though: Concurrent
+// calls may slightly exceed the limit, and messages still in the insert buffer are not counted.
+func (c *messageCache) TryAddMessage(m *message, maxPerMinute int) error {
+	if maxPerMinute > 0 && !c.nop {
+		if err := validateTopic(m.Topic); err != nil {
+			return err
+		}
+		count, err := c.MessageCountSince(m.Topic, time.Now().Add(-time.Minute))
 		if err != nil {
 			return err
+		} else if count >= maxPerMinute {
+			return errRateLimited
 		}
-		actionsStr = string(actionsBytes)
 	}
-	_, err := c.db.Exec(
-		insertMessageQuery,
-		m.ID,
-		m.Time,
-		m.Topic,
-		m.Message,
-		m.Title,
-		m.Priority,
-		tags,
-		m.Click,
-		actionsStr,
-		attachmentName,
-		attachmentType,
-		attachmentSize,
-		attachmentExpires,
-		attachmentURL,
-		m.Sender,
-		m.Encoding,
-		published,
-	)
-	return err
+	return c.AddMessage(m)
 }
 
-func (c *messageCache) Messages(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
-	if since.IsNone() {
-		return make([]*message, 0), nil
-	} else if since.IsID() {
-		return c.messagesSinceID(topic, since, scheduled)
-	}
-	return c.messagesSinceTime(topic, since, scheduled)
+// AddMessages stores multiple messages in a single transaction. Either all messages are stored, or none. Since
+// the whole batch is committed (and synced to disk) once, this is much faster than calling AddMessage in a loop,
+// e.g. to replay messages that were buffered during an outage. Messages with a deduplication key that was already
+// used in their topic are skipped, see AddMessage.
+func (c *messageCache) AddMessages(ms []*message) (err error) {
+	defer c.observe(queryOpAddMessages, time.Now(), &err)
+	_, err = c.addMessages(ms)
+	return err
 }
 
-func (c *messageCache) messagesSinceTime(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
-	var rows *sql.Rows
-	var err error
-	if scheduled {
-		rows, err = c.db.Query(selectMessagesSinceTimeIncludeScheduledQuery, topic, since.Time().Unix())
-	} else {
-		rows, err = c.db.Query(selectMessagesSinceTimeQuery, topic, since.Time().Unix())
+// addMessages implements AddMessages, and returns the messages that were actually stored. These are copies of
+// the given messages, which are never changed, since they may be sent to subscribers at the same time.
+func (c *messageCache) addMessages(ms []*message) ([]*message, error) {
+	ms = cloneMessages(ms)
+	if err := c.prepareMessages(ms); err != nil {
+		return nil, err
+	} else if c.nop || len(ms) == 0 {
+		return ms, nil
 	}
+	var inserted []*message
+	err := c.retryBusy(func() error {
+		var err error
+		inserted, err = c.insertMessages(cloneMessages(ms)) // A rolled back attempt may have changed them, see debounceMessage
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return readMessages(rows)
+	c.emitWrite(writeOpAdd, inserted...)
+	return inserted, c.maybeSpill()
 }
 
-func (c *messageCache) messagesSinceID(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
-	idrows, err := c.db.Query(selectRowIDFromMessageID, topic, since.ID())
-	if err != nil {
-		return nil, err
+// validateMessage checks a message whose topic was already resolved (see resolveMessageTopic) before it is added.
+// Apart from the checks that only depend on the message itself, this includes settings that may change at any
+// time, such as whether its topic is disabled.
+func (c *messageCache) validateMessage(m *message) error {
+	if c.TopicDisabled(m.Topic) {
+		return errTopicDisabled
+	} else if !c.categoryAllowed(m.Category) {
+		return errCategoryNotAllowed
+	} else if err := c.ValidateMessageID(m.ID); err != nil {
+		return err
+	} else if err := validateSound(m.Sound); err != nil {
+		return err
+	} else if err := validateLocation(m.Location); err != nil {
+		return err
+	} else if err := c.validateTags(m.Tags); err != nil {
+		return err
+	} else if err := c.validateSize(m); err != nil {
+		return err
 	}
-	defer idrows.Close()
-	if !idrows.Next() {
-		return c.messagesSinceTime(topic, sinceAllMessages, scheduled)
+	return nil
+}
+
+// cloneMessages returns copies of the given messages, see message.clone
+func cloneMessages(ms []*message) []*message {
+	clones := make([]*message, len(ms))
+	for i, m := range ms {
+		clones[i] = m.clone()
 	}
-	var rowID int64
-	if err := idrows.Scan(&rowID); err != nil {
-		return nil, err
+	return clones
+}
+
+// prepareMessages validates the messages before they are added, resolves their topic aliases, and assigns
+// delivery tokens. Nothing is changed if the cache is a nop cache.
+func (c *messageCache) prepareMessages(ms []*message) error {
+	for _, m := range ms {
+		if m.Event != messageEvent {
+			return errUnexpectedMessageType
+		} else if err := validateTopic(m.Topic); err != nil {
+			return err
+		}
+		m.Topic = c.resolveMessageTopic(m.Topic)
+		if err := c.validateMessage(m); err != nil {
+			return err
+		}
 	}
-	idrows.Close()
-	var rows *sql.Rows
-	if scheduled {
-		rows, err = c.db.Query(selectMessagesSinceIDIncludeScheduledQuery, topic, rowID)
-	} else {
-		rows, err = c.db.Query(selectMessagesSinceIDQuery, topic, rowID)
+	if c.nop {
+		return nil
 	}
-	if err != nil {
-		return nil, err
+	for _, m := range ms {
+		if err := prepareMessage(m); err != nil {
+			return err
+		}
 	}
-	return readMessages(rows)
+	return nil
 }
 
-func (c *messageCache) MessagesDue() ([]*message, error) {
-	rows, err := c.db.Query(selectMessagesDueQuery, time.Now().Unix())
-	if err != nil {
-		return nil, err
+// insertMessages inserts the messages in a single transaction, skipping duplicates (see errMessageDuplicate),
+// and returns the inserted messages
+func (c *messageCache) insertMessages(ms []*message) ([]*message, error) {
+	if c.spill != nil {
+		c.spill.mu.RLock() // Messages added while spilling would be lost
+		defer c.spill.mu.RUnlock()
 	}
-	return readMessages(rows)
-}
-
+	inserted := make([]*message, 0, len(ms))
+	err := c.withTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(insertMessageQuery) // Parsed once for the whole batch
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, m := range ms {
+			if err := c.insertMessageWithStmt(tx, stmt, m); err == errMessageDuplicate {
+				log.Debug("Message cache: Skipping message %s, deduplication key %s was already used in topic %s", m.ID, m.DedupKey, m.Topic)
+				continue
+			} else if err != nil {
+				return err
+			}
+			inserted = append(inserted, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
+// insertMessage inserts a single message within the given transaction. If the message has a collapse key,
+// existing messages with the same key in the topic are replaced, so that only the latest one is kept. Repeats
+// of the most recent message are merged into it instead, see debounceMessage.
+// Topic defaults are applied before inserting, see ApplyTopicDefaults. If the message has a deduplication key
+// that was already used in the topic, nothing is changed, and errMessageDuplicate is returned.
+func (c *messageCache) insertMessage(tx *sql.Tx, m *message) error {
+	return c.insertMessageWithStmt(tx, nil, m)
+}
+
+// insertMessageWithStmt is like insertMessage, but inserts the message with the given prepared insertMessageQuery
+// statement of the transaction, so that the query does not have to be parsed for every message of a batch. If
+// stmt is nil, the query is prepared on the fly.
+func (c *messageCache) insertMessageWithStmt(tx *sql.Tx, stmt *sql.Stmt, m *message) error {
+	if m.DedupKey != "" {
+		// Checked before anything else, so that a duplicate neither replaces messages with its collapse key,
+		// nor is merged into the message it duplicates
+		if exists, err := dedupKeyExists(tx, c.topicKey(m.Topic), m.DedupKey); err != nil {
+			return err
+		} else if exists {
+			return errMessageDuplicate
+		}
+	}
+	c.ApplyTopicDefaults(m)
+	if merged, err := c.debounceMessage(tx, m); err != nil || merged {
+		return err
+	}
+	if m.CollapseKey != "" {
+		if err := c.auditDeletes(tx, auditReasonCollapsed, deleteMessagesWithCollapseKey, c.topicKey(m.Topic), m.CollapseKey); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(deleteMessagesWithCollapseKey, c.topicKey(m.Topic), m.CollapseKey); err != nil {
+			return err
+		}
+	}
+	published := m.Time <= time.Now().Unix()
+	tagsStr, actionsStr, err := marshalTagsAndActions(m)
+	if err != nil {
+		return err
+	}
+	body, encoding, err := c.encodeMessageBody(m)
+	if err != nil {
+		return err
+	}
+	bodyHTML, err := c.encodeMessageHTML(m, encoding)
+	if err != nil {
+		return err
+	}
+	title, err := c.encodeMessageTitle(m, encoding)
+	if err != nil {
+		return err
+	}
+	origin := m.Origin
+	if origin == "" {
+		origin = c.origin
+	}
+	seq, err := nextPublishSeq(tx)
+	if err != nil {
+		return err
+	}
+	topicDisplay, err := c.topicDisplay(tx, m.Topic)
+	if err != nil {
+		return err
+	}
+	owner := c.ownerKey(m.Sender)
+	var attachmentName, attachmentType, attachmentURL, attachmentHash string
+	var attachmentSize, attachmentExpires int64
+	attachments := messageAttachments(m)
+	if len(attachments) > 0 {
+		attachmentName = attachments[0].Name
+		attachmentType = attachments[0].Type
+		attachmentSize = attachments[0].Size
+		attachmentExpires = attachments[0].Expires
+		attachmentURL = attachments[0].URL
+		attachmentHash = attachments[0].Hash
+	}
+	var hasLocation bool
+	var lat, lng float64
+	if m.Location != nil {
+		hasLocation, lat, lng = true, m.Location.Lat, m.Location.Lng
+	}
+	exec := func(args ...interface{}) (sql.Result, error) {
+		return tx.Exec(insertMessageQuery, args...)
+	}
+	if stmt != nil {
+		exec = stmt.Exec
+	}
+	res, err := exec(
+		m.ID,
+		m.Time,
+		c.topicKey(m.Topic),
+		body,
+		title,
+		m.Priority,
+		tagsStr,
+		m.Click,
+		actionsStr,
+		attachmentName,
+		attachmentType,
+		attachmentSize,
+		attachmentExpires,
+		attachmentURL,
+		owner,
+		encoding,
+		published,
+		m.SourceIP,
+		m.UserAgent,
+		m.Time, // updated
+		m.CollapseKey,
+		m.Token,
+		messageTimeMillis(m),
+		origin,
+		m.RawPriority,
+		bodyHTML,
+		m.Category,
+		m.TTL,
+		seq,
+		topicDisplay,
+		m.Sound,
+		m.NotAfter,
+		hasLocation,
+		lat,
+		lng,
+		storedMessageBytes(body, title, tagsStr)+attachmentSize,
+		m.RepeatCount,
+		sql.NullString{String: m.DedupKey, Valid: m.DedupKey != ""},
+		m.Icon,
+		attachmentHash,
+		m.Email,
+		messageContentType(m),
+	)
+	if err != nil {
+		return err
+	}
+	if len(attachments) > 0 {
+		rowID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		} else if err := insertMessageAttachments(tx, rowID, m.ID, owner, attachments); err != nil {
+			return err
+		}
+	}
+	m.PublishSeq = seq
+	return nil
+}
+
+// dedupKeyExists returns true if a message with the given deduplication key exists in the topic
+func dedupKeyExists(tx *sql.Tx, topic, dedupKey string) (bool, error) {
+	rows, err := tx.Query(selectRowIDFromDedupKeyQuery, topic, dedupKey)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
+}
+
+// UpdateMessage overwrites the content (message, title, priority, tags, click action and action buttons)
+// of an existing message, and sets its updated timestamp. The HTML rendering of the body is rendered again
+// from the new body if the message is Markdown (see message.Markdown), and cleared otherwise; the content type
+// is overwritten as well. It returns errMessageNotFound if the message does not exist.
+func (c *messageCache) UpdateMessage(m *message) (err error) {
+	defer c.observe(queryOpUpdateMessage, time.Now(), &err)
+	if err := c.validateTags(m.Tags); err != nil {
+		return err
+	} else if err := c.validateSize(m); err != nil {
+		return err
+	}
+	tagsStr, actionsStr, err := marshalTagsAndActions(m)
+	if err != nil {
+		return err
+	}
+	updated := time.Now().Unix()
+	stored := *m
+	stored.Topic = c.ResolveTopic(m.Topic) // Encrypted with the key of the stored topic, see encryptBody
+	body, encoding, err := c.encodeMessageBody(&stored)
+	if err != nil {
+		return err
+	}
+	title, err := c.encodeMessageTitle(&stored, encoding)
+	if err != nil {
+		return err
+	}
+	bodyHTML, err := c.encodeMessageHTML(&stored, encoding)
+	if err != nil {
+		return err
+	}
+	err = c.retryBusy(func() error {
+		return c.withTx(func(tx *sql.Tx) error {
+			if err := c.recordMessageVersion(tx, stored.Topic, m.ID); err != nil {
+				return err
+			}
+			res, err := tx.Exec(updateMessageQuery, body, encoding, title, bodyHTML, messageContentType(m), m.Priority, tagsStr, m.Click, actionsStr, updated, storedMessageBytes(body, title, tagsStr), stored.Topic, m.ID)
+			if err != nil {
+				return err
+			}
+			if affected, err := res.RowsAffected(); err != nil {
+				return err
+			} else if affected == 0 {
+				return errMessageNotFound
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	m.Updated = updated
+	c.emitWrite(writeOpUpdate, m)
+	return nil
+}
+
+// UpdateMessageIfUnchanged is like UpdateMessage, but only applies the update if the message has not been
+// modified since it was read, i.e. if its updated timestamp still equals expectedUpdated (optimistic locking).
+// It returns errMessageUpdateConflict if the message was modified in the meantime, and errMessageNotFound
+// if it does not exist.
+//
+// Since the updated timestamp has a resolution of one second, the new timestamp is always at least
+// expectedUpdated+1, so that two updates within the same second can still be told apart.
+func (c *messageCache) UpdateMessageIfUnchanged(m *message, expectedUpdated int64) error {
+	if err := c.validateTags(m.Tags); err != nil {
+		return err
+	} else if err := c.validateSize(m); err != nil {
+		return err
+	}
+	tagsStr, actionsStr, err := marshalTagsAndActions(m)
+	if err != nil {
+		return err
+	}
+	updated := time.Now().Unix()
+	if updated <= expectedUpdated {
+		updated = expectedUpdated + 1
+	}
+	stored := *m
+	stored.Topic = c.ResolveTopic(m.Topic) // Encrypted with the key of the stored topic, see encryptBody
+	body, encoding, err := c.encodeMessageBody(&stored)
+	if err != nil {
+		return err
+	}
+	title, err := c.encodeMessageTitle(&stored, encoding)
+	if err != nil {
+		return err
+	}
+	bodyHTML, err := c.encodeMessageHTML(&stored, encoding)
+	if err != nil {
+		return err
+	}
+	err = c.withTx(func(tx *sql.Tx) error {
+		if err := c.recordMessageVersion(tx, stored.Topic, m.ID); err != nil {
+			return err
+		}
+		res, err := tx.Exec(updateMessageIfUnchangedQuery, body, encoding, title, bodyHTML, messageContentType(m), m.Priority, tagsStr, m.Click, actionsStr, updated, storedMessageBytes(body, title, tagsStr), stored.Topic, m.ID, expectedUpdated)
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			rows, err := tx.Query(selectRowIDFromMessageID, stored.Topic, m.ID)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			if !rows.Next() {
+				return errMessageNotFound
+			}
+			return errMessageUpdateConflict
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.Updated = updated
+	c.emitWrite(writeOpUpdate, m)
+	return nil
+}
+
+// marshalTagsAndActions encodes the tags and actions of a message as JSON, as they are stored
+// in the database. Empty tags and actions are stored as an empty string.
+func marshalTagsAndActions(m *message) (tagsStr string, actionsStr string, err error) {
+	if len(m.Tags) > 0 {
+		tagsBytes, err := json.Marshal(m.Tags)
+		if err != nil {
+			return "", "", err
+		}
+		tagsStr = string(tagsBytes)
+	}
+	if len(m.Actions) > 0 {
+		actionsBytes, err := json.Marshal(m.Actions)
+		if err != nil {
+			return "", "", err
+		}
+		actionsStr = string(actionsBytes)
+	}
+	return tagsStr, actionsStr, nil
+}
+
+// Messages returns the messages of a topic since the given marker, including scheduled messages if scheduled is
+// set. Messages are ordered by their time in milliseconds, and by the order in which they were inserted if they
+// have the same time, so the order is the same for every call. See MessagesPage to read them in pages.
+func (c *messageCache) Messages(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
+	return c.MessagesContext(context.Background(), topic, since, scheduled)
+}
+
+// MessagesContext is like Messages, but aborts the query if the context is cancelled or times out, e.g. because
+// the subscriber disconnected, in which case the context's error is returned.
+func (c *messageCache) MessagesContext(ctx context.Context, topic string, since sinceMarker, scheduled bool) (messages []*message, err error) {
+	defer c.observe(queryOpMessages, time.Now(), &err)
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), nil
+	} else if err := c.flushTopic(topic); err != nil {
+		return nil, err
+	}
+	query, args := messagesSinceQuery(c.ResolveTopic(topic), since, scheduled)
+	return c.queryMessagesContext(ctx, query, args...)
+}
+
+// MessagesAndMarkDelivered returns the same messages as Messages, and increments the delivery count of each of
+// them (see DeliveryCount) in the same transaction, so that the count is accurate even if the caller fails after
+// reading the messages. It is meant to be used when replaying messages to a subscriber.
+func (c *messageCache) MessagesAndMarkDelivered(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), nil
+	}
+	topic = c.ResolveTopic(topic)
+	var messages []*message
+	err := c.withTx(func(tx *sql.Tx) error {
+		query, args := messagesSinceQuery(topic, since, scheduled)
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		if messages, err = c.readMessages(tx, rows); err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(updateMessageDeliveredQuery)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, m := range messages {
+			if _, err := stmt.Exec(topic, m.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// DeliveryCount returns how often a message was delivered by MessagesAndMarkDelivered, or errMessageNotFound if
+// the message does not exist
+func (c *messageCache) DeliveryCount(topic, id string) (int, error) {
+	topic = c.ResolveTopic(topic)
+	rows, err := c.db.Query(selectMessageDeliveredQuery, topic, id)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errMessageNotFound
+	}
+	var delivered int
+	if err := rows.Scan(&delivered); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return delivered, nil
+}
+
+// ResolveSince turns a sinceNow marker into a marker that can be used for subsequent calls to Messages:
+// If the topic has messages, the returned marker points to the latest published message (by ID), otherwise
+// it is the current time. All other markers are returned unchanged.
+//
+// This allows clients to start with "only new messages" without computing a timestamp themselves: The
+// first call to Messages with sinceNow returns nothing, and all later calls with the resolved marker return
+// the messages that were published in the meantime.
+func (c *messageCache) ResolveSince(topic string, since sinceMarker) (sinceMarker, error) {
+	if !since.IsNow() {
+		return since, nil
+	}
+	id, err := c.LatestID(topic)
+	if err == errMessageNotFound {
+		return newSinceTime(time.Now().Unix()), nil
+	} else if err != nil {
+		return sinceNoMessages, err
+	}
+	return newSinceID(id), nil
+}
+
+// LatestID returns the ID of the newest published message of a topic, or errMessageNotFound if the topic
+// has no published messages. Clients can use it as since ID to resume from the current tip of the topic.
+func (c *messageCache) LatestID(topic string) (string, error) {
+	rows, err := c.db.Query(selectLatestMessageIDQuery, c.ResolveTopic(topic))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", errMessageNotFound
+	}
+	var id string
+	if err := rows.Scan(&id); err != nil {
+		return "", err
+	} else if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// OldestMessageTime returns the time (Unix time in seconds) of the oldest published message of a topic that has
+// not been pruned yet, and false if the topic has no published messages. Clients can use it to tell whether
+// older messages than the ones they have may still be requested at all.
+func (c *messageCache) OldestMessageTime(topic string) (int64, bool, error) {
+	if err := validateTopic(topic); err != nil {
+		return 0, false, err
+	}
+	rows, err := c.db.Query(selectOldestMessageTimeQuery, c.ResolveTopic(topic))
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, false, errors.New("no rows found")
+	}
+	var oldest sql.NullInt64
+	if err := rows.Scan(&oldest); err != nil {
+		return 0, false, err
+	} else if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+	return oldest.Int64, oldest.Valid, nil
+}
+
+// queryMessagesContext runs the given message query with the context, and reads the messages. If the context is
+// done before all rows were read, the context's error is returned rather than the error of the driver (SQLite
+// reports an interrupted query as "interrupted").
+func (c *messageCache) queryMessagesContext(ctx context.Context, query string, args ...interface{}) ([]*message, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	messages, err := c.readMessages(c.db, rows)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return messages, nil
+}
+
+// messagesSince returns the messages of a topic after the given since time or ID, see messagesSinceQuery
+func (c *messageCache) messagesSince(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
+	query, args := messagesSinceQuery(topic, since, scheduled)
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// messagesSinceQuery returns the query and arguments to select the messages of a topic after the given since
+// time or ID. The since ID is resolved in a subquery rather than a separate query, so that the read is atomic
+// and messages inserted concurrently cannot slip in between. An unknown since ID means all messages.
+func messagesSinceQuery(topic string, since sinceMarker, scheduled bool) (string, []interface{}) {
+	if since.IsID() {
+		if scheduled {
+			return selectMessagesSinceIDIncludeScheduledQuery, []interface{}{topic, topic, since.ID()}
+		}
+		return selectMessagesSinceIDQuery, []interface{}{topic, topic, since.ID()}
+	} else if scheduled {
+		return selectMessagesSinceTimeIncludeScheduledQuery, []interface{}{topic, since.Time().Unix()}
+	}
+	return selectMessagesSinceTimeQuery, []interface{}{topic, since.Time().Unix()}
+}
+
+// MessagesBetween returns the messages of a topic published at or after start and before end, including scheduled
+// messages if scheduled is set, in the same order as Messages. Unlike a since marker, this bounds the query on both
+// ends, e.g. to show the messages of a single day. Since message times have second precision, start and end are
+// truncated to the second. If end is not after start, no messages are returned.
+func (c *messageCache) MessagesBetween(topic string, start, end time.Time, scheduled bool) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if !end.After(start) {
+		return make([]*message, 0), nil
+	}
+	query := selectMessagesBetweenTimesQuery
+	if scheduled {
+		query = selectMessagesBetweenTimesIncludeScheduledQuery
+	}
+	rows, err := c.db.Query(query, c.ResolveTopic(topic), start.Unix(), end.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// MessagesSinceIDCapped returns the published messages of a topic after the given since marker, but never
+// messages older than maxAge. This prevents clients with a very old since ID from replaying all messages
+// after a long downtime. A maxAge <= 0 means no cap, i.e. it behaves like Messages.
+func (c *messageCache) MessagesSinceIDCapped(topic string, since sinceMarker, maxAge time.Duration) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if maxAge <= 0 {
+		return c.Messages(topic, since, false)
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), nil
+	}
+	topic = c.ResolveTopic(topic)
+	cutoff := time.Now().Add(-maxAge)
+	if !since.IsID() {
+		if since.Time().After(cutoff) {
+			return c.messagesSince(topic, since, false)
+		}
+		return c.messagesSince(topic, newSinceTime(cutoff.Unix()), false)
+	}
+	rows, err := c.db.Query(selectMessagesSinceIDCappedQuery, topic, topic, since.ID(), cutoff.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// MessagesPage returns a page of the messages that Messages would return for the same arguments, skipping the
+// first offset messages and returning at most limit messages. A limit <= 0 means no limit. Since the order is
+// the same as in Messages, a client can read a topic page by page by increasing the offset by the page size. New
+// messages are added to the end, but deleted or pruned messages shift all later pages, so for live topics, a
+// since ID marker (the last message of the previous page) is the more robust cursor.
+func (c *messageCache) MessagesPage(topic string, since sinceMarker, scheduled bool, limit, offset int) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), nil
+	}
+	if limit <= 0 {
+		limit = -1 // No limit in SQLite
+	}
+	where, args := messagesPageFilter(c.ResolveTopic(topic), since, scheduled)
+	rows, err := c.db.Query(fmt.Sprintf(selectMessagesPageQuery, where), append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// MessagesPageWithTotal returns a page of the messages that Messages would return for the same arguments,
+// along with the total number of these messages, e.g. to show "50 of 1,234" in a UI. The page and the count
+// are read in the same transaction, so they are consistent with each other. A limit <= 0 means no limit.
+func (c *messageCache) MessagesPageWithTotal(topic string, since sinceMarker, scheduled bool, limit, offset int) ([]*message, int, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, 0, err
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), 0, nil
+	}
+	if limit <= 0 {
+		limit = -1 // No limit in SQLite
+	}
+	topic = c.ResolveTopic(topic)
+	var messages []*message
+	var total int
+	err := c.withTx(func(tx *sql.Tx) error {
+		where, args := messagesPageFilter(topic, since, scheduled)
+		rows, err := tx.Query(fmt.Sprintf(selectMessagesPageCountQuery, where), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			return errors.New("no rows found")
+		}
+		if err := rows.Scan(&total); err != nil {
+			return err
+		} else if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		rows, err = tx.Query(fmt.Sprintf(selectMessagesPageQuery, where), append(args, limit, offset)...)
+		if err != nil {
+			return err
+		}
+		messages, err = c.readMessages(tx, rows)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return messages, total, nil
+}
+
+// MessagesWithPriority returns the messages that Messages would return for the same arguments, but only those
+// with at least the given priority, e.g. to replay only urgent messages to a pager. As in UnackedMessages, a
+// message without priority is treated as default priority (3). A minPriority <= 0 means no filtering.
+func (c *messageCache) MessagesWithPriority(topic string, since sinceMarker, minPriority int, scheduled bool) ([]*message, error) {
+	if minPriority <= 0 {
+		return c.Messages(topic, since, scheduled)
+	} else if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), nil
+	}
+	where, args := messagesPageFilter(c.ResolveTopic(topic), since, scheduled)
+	where += " AND IFNULL(NULLIF(priority, 0), 3) >= ?"
+	rows, err := c.db.Query(fmt.Sprintf(selectMessagesPageQuery, where), append(args, minPriority, -1, 0)...) // No limit in SQLite
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// messagesPageFilter returns the WHERE clause and its arguments for MessagesPage and MessagesPageWithTotal, so
+// that the page and the count query share the exact same filter. It matches the filters used by Messages.
+func messagesPageFilter(topic string, since sinceMarker, scheduled bool) (string, []interface{}) {
+	const notExpired = " AND " + notExpiredCondition
+	if since.IsID() {
+		args := []interface{}{topic, topic, since.ID()}
+		if scheduled {
+			return "topic = ? AND (id > IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) OR published = 0)" + notExpired, args
+		}
+		return "topic = ? AND id > IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) AND published = 1" + notExpired, args
+	}
+	args := []interface{}{topic, since.Time().Unix()}
+	if scheduled {
+		return "topic = ? AND time >= ?" + notExpired, args
+	}
+	return "topic = ? AND time >= ? AND published = 1" + notExpired, args
+}
+
+// MessagesByTitle returns the published messages of a topic with exactly the given title, e.g. to poll for
+// recurrences of a specific alert. The since marker is interpreted the same way as in Messages. Encrypted titles
+// never match (see encodeMessageTitle).
+func (c *messageCache) MessagesByTitle(topic, title string, since sinceMarker) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), nil
+	}
+	topic = c.ResolveTopic(topic)
+	var rows *sql.Rows
+	var err error
+	if since.IsID() {
+		rows, err = c.db.Query(selectMessagesByTitleSinceIDQuery, topic, title, topic, since.ID())
+	} else {
+		rows, err = c.db.Query(selectMessagesByTitleSinceTimeQuery, topic, title, since.Time().Unix())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+func (c *messageCache) MessagesDue() (messages []*message, err error) {
+	defer c.observe(queryOpMessagesDue, time.Now(), &err)
+	rows, err := c.db.Query(selectMessagesDueQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// DueMessagesBatched is like MessagesDue, but returns at most batchSize of the messages that are due at now
+// (Unix time in seconds), so that a large backlog, e.g. after a downtime, is delivered in several batches.
+// Messages that are overdue by more than the grace period are handled according to the missed schedule
+// policy (see messageCacheOptions): When skipped, they are marked as published; when rescheduled, their time
+// is set to now, so that they are returned by the next call. Neither are returned, so a batch may contain
+// fewer messages than batchSize even though more messages are due.
+func (c *messageCache) DueMessagesBatched(now int64, batchSize int) ([]*message, error) {
+	return c.dueMessages(now, batchSize, false)
+}
+
+// ClaimDue is like DueMessagesBatched, but atomically marks the returned messages as published, so that they
+// are returned exactly once, even if several schedulers share the cache. It returns at most limit messages, which
+// lets the caller pace the delivery of a large backlog instead of firing it all at once: Call ClaimDue in a loop
+// until it returns no messages, deliver each batch, and sleep between batches, e.g.
+//
+//	for {
+//		messages, err := c.ClaimDue(time.Now().Unix(), 100)
+//		if err != nil || len(messages) == 0 {
+//			break
+//		}
+//		deliver(messages)
+//		time.Sleep(time.Second)
+//	}
+//
+// Since the messages are claimed before they are delivered, a message is lost if its delivery fails.
+func (c *messageCache) ClaimDue(now int64, limit int) ([]*message, error) {
+	return c.dueMessages(now, limit, true)
+}
+
+// dueMessages returns at most limit of the messages that are due at now, applying the missed schedule policy,
+// and marks the returned messages as published if claim is set
+func (c *messageCache) dueMessages(now int64, limit int, claim bool) ([]*message, error) {
+	if limit <= 0 {
+		return make([]*message, 0), nil
+	}
+	due := make([]*message, 0)
+	err := c.withTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(selectMessagesDueLimitQuery, now, limit)
+		if err != nil {
+			return err
+		}
+		messages, err := c.readMessages(tx, rows)
+		if err != nil {
+			return err
+		}
+		overdueBefore := now - int64(c.dueGrace.Seconds())
+		for _, m := range messages {
+			if c.duePolicy == "" || c.duePolicy == missedScheduleDeliver || m.Time >= overdueBefore {
+				if claim {
+					if _, err := tx.Exec(updateMessagePublishedQuery, m.ID); err != nil {
+						return err
+					}
+				}
+				due = append(due, m)
+			} else if c.duePolicy == missedScheduleSkip {
+				if _, err := tx.Exec(updateMessagePublishedQuery, m.ID); err != nil {
+					return err
+				}
+			} else if _, err := tx.Exec(updateMessageRescheduledQuery, now, now*1000, now, m.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return due, nil
+}
+
+// StuckScheduled returns scheduled messages that have been due for more than olderThan, but were never marked
+// as published, e.g. because MarkPublished failed. Such messages are returned by MessagesDue over and over.
+func (c *messageCache) StuckScheduled(olderThan time.Duration) ([]*message, error) {
+	rows, err := c.db.Query(selectMessagesDueQuery, time.Now().Add(-olderThan).Unix())
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// CancelScheduled deletes a scheduled message before it is published. Unlike DeleteMessage, the message does
+// not go to the trash. It returns errMessageNotScheduled if the message was already published, and
+// errMessageNotFound if it does not exist. A message that is due, but was not marked as published by the
+// scheduler yet, can still be canceled.
+func (c *messageCache) CancelScheduled(topic, id string) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	} else if c.nop {
+		return nil
+	} else if err := c.flushTopic(topic); err != nil {
+		return err
+	}
+	topic = c.ResolveTopic(topic)
+	err := c.retryBusy(func() error {
+		return c.withTx(func(tx *sql.Tx) error {
+			res, err := tx.Exec(deleteScheduledMessageQuery, topic, id)
+			if err != nil {
+				return err
+			}
+			deleted, err := res.RowsAffected()
+			if err != nil {
+				return err
+			} else if deleted == 0 {
+				if _, err := queryMessageRowID(tx, topic, id); err != nil {
+					return err // errMessageNotFound
+				}
+				return errMessageNotScheduled
+			}
+			return c.auditMessage(tx, auditReasonCanceled, topic, id)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	c.emitWrite(writeOpDelete, &message{ID: id, Event: messageEvent, Topic: topic})
+	return nil
+}
+
 func (c *messageCache) MarkPublished(m *message) error {
-	_, err := c.db.Exec(updateMessagePublishedQuery, m.ID)
-	return err
+	return c.retryBusy(func() error {
+		_, err := c.db.Exec(updateMessagePublishedQuery, m.ID)
+		return err
+	})
+}
+
+// MarkPublishedBatch marks all given messages as published, e.g. all messages returned by MessagesDue. It has
+// the same effect as calling MarkPublished for each message, but the messages are marked in a single transaction
+// with a prepared statement, so either all of them are marked, or none.
+func (c *messageCache) MarkPublishedBatch(ms []*message) error {
+	if len(ms) == 0 {
+		return nil
+	}
+	return c.retryBusy(func() error {
+		return c.withTx(func(tx *sql.Tx) error {
+			stmt, err := tx.Prepare(updateMessagePublishedQuery)
+			if err != nil {
+				return err
+			}
+			defer stmt.Close()
+			for _, m := range ms {
+				if _, err := stmt.Exec(m.ID); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// MessagesByEncoding is like Messages (without scheduled messages), but only returns messages with the
+// given encoding, e.g. "base64", or empty for plain UTF-8 messages. Storage codecs such as compression
+// are not considered part of the encoding, see splitStorageEncoding.
+func (c *messageCache) MessagesByEncoding(topic, encoding string, since sinceMarker) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), nil
+	}
+	topic = c.ResolveTopic(topic)
+	withCodecs := escapeLikePattern(encoding) + storageEncodingSeparator + "%"
+	var rows *sql.Rows
+	var err error
+	if since.IsID() {
+		rows, err = c.db.Query(selectMessagesByEncodingSinceIDQuery, topic, encoding, withCodecs, topic, since.ID())
+	} else {
+		rows, err = c.db.Query(selectMessagesByEncodingSinceTimeQuery, topic, encoding, withCodecs, since.Time().Unix())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// SearchLike returns up to limit published messages of a topic whose body contains the given text, in the same
+// order as Messages. If there are more matches, the newest ones are returned. A limit <= 0 means no limit. This is
+// a simple fallback for SQLite builds without full-text search: Every message of the topic is scanned, so it is
+// only suitable for topics with few messages. Like all LIKE matches in SQLite, it ignores the case of ASCII
+// letters. Bodies stored with a storage codec (compression or encryption, see encodeMessageBody) are decoded
+// and matched in Go, which is even slower, since all of them have to be read.
+func (c *messageCache) SearchLike(topic, pattern string, limit int) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	rows, err := c.db.Query(selectMessagesLikeQuery, c.ResolveTopic(topic), escapeLikePattern(pattern))
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.readMessages(c.db, rows)
+	if err != nil {
+		return nil, err
+	}
+	messages = filterSearchMatches(messages, limit, func(m *message) bool {
+		return searchMatches(m.Message, pattern)
+	})
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// SearchMessages returns up to limit published messages of a topic whose body or title contains the given text,
+// newest first. A limit <= 0 means no limit. Like SearchLike, this scans every message of the topic and ignores
+// the case of ASCII letters only. Rows stored with a storage codec (compression or encryption, see
+// encodeMessageBody) are opaque to SQLite, so they are decoded and matched in Go (see searchMatches).
+// It does not use a full-text index, since FTS5 is not compiled into the SQLite driver by default.
+func (c *messageCache) SearchMessages(topic, query string, limit int) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	pattern := escapeLikePattern(query)
+	rows, err := c.db.Query(selectMessagesMatchingQuery, c.ResolveTopic(topic), pattern, pattern)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.readMessages(c.db, rows)
+	if err != nil {
+		return nil, err
+	}
+	return filterSearchMatches(messages, limit, func(m *message) bool {
+		return searchMatches(m.Message, query) || searchMatches(m.Title, query)
+	}), nil
+}
+
+// MessagesByAttachmentType is like Messages (without scheduled messages), but only returns messages with an
+// attachment whose content type starts with the given prefix, e.g. "image/" for all images or "application/pdf"
+// for PDFs, or an empty prefix for all attachments. LIKE metacharacters in the prefix are escaped, so they
+// match literally.
+func (c *messageCache) MessagesByAttachmentType(topic, mimePrefix string, since sinceMarker) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), nil
+	}
+	topic = c.ResolveTopic(topic)
+	pattern := escapeLikePattern(mimePrefix)
+	var rows *sql.Rows
+	var err error
+	if since.IsID() {
+		rows, err = c.db.Query(selectMessagesByAttachmentTypeSinceIDQuery, topic, pattern, topic, since.ID())
+	} else {
+		rows, err = c.db.Query(selectMessagesByAttachmentTypeSinceTimeQuery, topic, pattern, since.Time().Unix())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// EditedMessages is like Messages (without scheduled messages), but only returns messages that were modified
+// after they were published (see UpdateMessage), e.g. to audit changes to alerts. Since the updated timestamp
+// has a resolution of seconds, edits within the same second as the publication are not detected.
+func (c *messageCache) EditedMessages(topic string, since sinceMarker) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), nil
+	}
+	topic = c.ResolveTopic(topic)
+	var rows *sql.Rows
+	var err error
+	if since.IsID() {
+		rows, err = c.db.Query(selectEditedMessagesSinceIDQuery, topic, topic, since.ID())
+	} else {
+		rows, err = c.db.Query(selectEditedMessagesSinceTimeQuery, topic, since.Time().Unix())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// MessagesByCategory is like Messages (without scheduled messages), but only returns messages with the given
+// category, or messages without category if it is empty, see messageCacheOptions.Categories
+func (c *messageCache) MessagesByCategory(topic, category string, since sinceMarker) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), nil
+	}
+	topic = c.ResolveTopic(topic)
+	var rows *sql.Rows
+	var err error
+	if since.IsID() {
+		rows, err = c.db.Query(selectMessagesByCategorySinceIDQuery, topic, category, topic, since.ID())
+	} else {
+		rows, err = c.db.Query(selectMessagesByCategorySinceTimeQuery, topic, category, since.Time().Unix())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// ValidateMessageID checks the given message ID using the cache's message ID validator (see messageCacheOptions),
+// to catch clients that send empty or malformed IDs before they are stored. Errors returned by a custom validator
+// are wrapped, so that the returned error always matches errInvalidMessageID.
+func (c *messageCache) ValidateMessageID(id string) error {
+	if err := c.idValidator(id); errors.Is(err, errInvalidMessageID) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidMessageID, err.Error())
+	}
+	return nil
+}
+
+// validateMessageIDLength is the default message ID validator; it only rejects empty and overly long IDs, since
+// messages may also be imported from other servers or backups with a different ID format
+func validateMessageIDLength(id string) error {
+	if id == "" || len(id) > messageIDMaxLength {
+		return errInvalidMessageID
+	}
+	return nil
+}
+
+// validateSound checks that a message's sound is empty, or a short identifier of letters, digits, dashes,
+// underscores and dots. The sound is only a hint for clients to pick a notification channel, so anything
+// longer or fancier than a channel name is rejected.
+func validateSound(sound string) error {
+	if len(sound) > soundMaxLength || !soundRegex.MatchString(sound) {
+		return errInvalidSound
+	}
+	return nil
+}
+
+// validateTags returns errTooManyTags if the message has more distinct tags than allowed (see messageCacheOptions).
+// Empty and duplicate tags are not counted, see normalizeTags.
+func (c *messageCache) validateTags(tags []string) error {
+	if c.maxTags > 0 && len(tags) > c.maxTags && len(normalizeTags(tags)) > c.maxTags {
+		return errTooManyTags
+	}
+	return nil
+}
+
+// validateSize returns errMessageTooLarge or errTitleTooLong if the message body or title exceed the limits of
+// the cache (see messageCacheOptions)
+func (c *messageCache) validateSize(m *message) error {
+	if c.maxMessageSize > 0 && len(m.Message) > c.maxMessageSize {
+		return errMessageTooLarge
+	} else if c.maxTitleLength > 0 && utf8.RuneCountInString(m.Title) > c.maxTitleLength {
+		return errTitleTooLong
+	}
+	return nil
+}
+
+// categoryAllowed returns true if the category is empty, or one of the categories the cache was created with
+func (c *messageCache) categoryAllowed(category string) bool {
+	return category == "" || c.categories[category]
+}
+
+// MessagesExcludingOrigin is like Messages (without scheduled messages), but skips messages that originated
+// on the given server, so that a federated server does not re-deliver its own messages. Messages without
+// origin are considered to have originated on this server.
+func (c *messageCache) MessagesExcludingOrigin(topic, origin string, since sinceMarker) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), nil
+	}
+	topic = c.ResolveTopic(topic)
+	var rows *sql.Rows
+	var err error
+	if since.IsID() {
+		rows, err = c.db.Query(selectMessagesExcludingOriginSinceIDQuery, topic, topic, since.ID(), c.origin, origin)
+	} else {
+		rows, err = c.db.Query(selectMessagesExcludingOriginSinceTimeQuery, topic, since.Time().Unix(), c.origin, origin)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// ForEachMessageGlobal calls fn for every message in the cache, across all topics and including scheduled
+// messages, in the order in which they were inserted. Rows are read in batches, so memory usage is bounded
+// regardless of the size of the table, and fn may modify the cache. If fn returns an error, iteration stops
+// and the error is returned.
+func (c *messageCache) ForEachMessageGlobal(fn func(m *message) error) error {
+	lastID := int64(0)
+	for {
+		endID, err := c.batchEndRowID(lastID, forEachMessageBatchSize)
+		if err != nil {
+			return err
+		} else if endID == 0 {
+			return nil
+		}
+		rows, err := c.db.Query(selectMessagesBetweenIDsQuery, lastID, endID)
+		if err != nil {
+			return err
+		}
+		messages, err := c.readMessages(c.db, rows)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		lastID = endID
+	}
+}
+
+// IterateFrom returns the next batch of at most batchSize messages after the given cursor, across all topics and
+// including scheduled messages, in the order in which they were inserted, along with the cursor of the next batch.
+// Start with a cursor of 0; once all messages were read, an empty batch and the unchanged cursor are returned.
+// Unlike ForEachMessageGlobal, no state is kept between calls, so that long-running jobs (e.g. re-encryption or
+// external indexing) can persist the cursor after every batch and resume from it after a restart. Messages added
+// while iterating are returned in a later batch. A batchSize <= 0 means forEachMessageBatchSize.
+func (c *messageCache) IterateFrom(lastID int64, batchSize int) ([]*message, int64, error) {
+	if batchSize <= 0 {
+		batchSize = forEachMessageBatchSize
+	}
+	endID, err := c.batchEndRowID(lastID, batchSize)
+	if err != nil {
+		return nil, 0, err
+	} else if endID == 0 {
+		return make([]*message, 0), lastID, nil
+	}
+	rows, err := c.db.Query(selectMessagesBetweenIDsQuery, lastID, endID)
+	if err != nil {
+		return nil, 0, err
+	}
+	messages, err := c.readMessages(c.db, rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return messages, endID, nil
+}
+
+// batchEndRowID returns the row ID of the last of the next batchSize rows after afterID, or 0 if there are none
+func (c *messageCache) batchEndRowID(afterID int64, batchSize int) (int64, error) {
+	rows, err := c.db.Query(selectBatchEndRowIDQuery, afterID, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	var endID int64
+	if err := rows.Scan(&endID); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return endID, nil
+}
+
+// AttachmentSizeByID returns the size of the attachment of the given message, without reading the rest of
+// the message. It returns errAttachmentSizeUnknown if the message has no attachment or its size is not known,
+// since range requests cannot be served without it.
+func (c *messageCache) AttachmentSizeByID(topic, id string) (int64, error) {
+	rows, err := c.db.Query(selectAttachmentSizeQuery, c.ResolveTopic(topic), id)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errMessageNotFound
+	}
+	var size int64
+	if err := rows.Scan(&size); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if size <= 0 {
+		return 0, errAttachmentSizeUnknown
+	}
+	return size, nil
+}
+
+// ValidateToken returns true if the given token matches the secret delivery token of the message, see
+// message.Token. It returns errMessageNotFound if the message does not exist.
+func (c *messageCache) ValidateToken(topic, id, token string) (bool, error) {
+	rows, err := c.db.Query(selectMessageTokenQuery, c.ResolveTopic(topic), id)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false, errMessageNotFound
+	}
+	var expected string
+	if err := rows.Scan(&expected); err != nil {
+		return false, err
+	} else if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if expected == "" || token == "" {
+		return false, nil // Messages stored before tokens were introduced
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1, nil
+}
+
+// RecentForSender returns the most recent published messages of the given sender across all topics,
+// newest first. This is used for a per-user timeline. A limit <= 0 means no limit.
+func (c *messageCache) RecentForSender(sender string, limit int) ([]*message, error) {
+	if limit <= 0 {
+		limit = -1 // No limit in SQLite
+	}
+	rows, err := c.db.Query(selectRecentMessagesForSenderQuery, c.ownerKey(sender), limit)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// MessagesBySender returns all published messages of the given sender since the given time across all topics,
+// oldest first. This is meant for abuse investigations, e.g. to see what a single IP address has published.
+func (c *messageCache) MessagesBySender(sender string, since time.Time) ([]*message, error) {
+	rows, err := c.db.Query(selectMessagesBySenderQuery, c.ownerKey(sender), since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// AckMessage marks a message as acknowledged by the given user (or any other identifier). If the message
+// has already been acknowledged, the original acknowledgement is kept. It returns errMessageNotFound if
+// the message does not exist.
+func (c *messageCache) AckMessage(topic, id, by string) error {
+	topic = c.ResolveTopic(topic)
+	res, err := c.db.Exec(updateMessageAckedQuery, time.Now().Unix(), by, topic, id)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected > 0 {
+		return nil
+	}
+	rows, err := c.db.Query(selectRowIDFromMessageID, topic, id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return errMessageNotFound
+	}
+	return nil // Already acknowledged
+}
+
+// UnackedMessages returns all published messages of a topic with at least the given priority that have not
+// been acknowledged yet. As with query filters, a message without priority is treated as default priority (3).
+// This is meant to be polled by an escalation worker.
+//
+// For high priorities (4 and 5), only the partial index idx_high_priority is scanned, instead of the
+// topic's entire history. The literal "priority >= 4" in the query is what lets SQLite use that index.
+func (c *messageCache) UnackedMessages(topic string, minPriority int) ([]*message, error) {
+	topic = c.ResolveTopic(topic)
+	query := selectUnackedMessagesQuery
+	if minPriority >= 4 {
+		query = selectUnackedHighPriorityMessagesQuery
+	}
+	rows, err := c.db.Query(query, topic, minPriority)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// Message returns a single message by topic and message ID, regardless of whether it was
+// published yet. It returns errMessageNotFound if the message does not exist.
+func (c *messageCache) Message(topic, id string) (*message, error) {
+	return c.MessageContext(context.Background(), topic, id)
+}
+
+// MessageContext is like Message, but aborts the query if the context is cancelled or times out, in which case
+// the context's error is returned
+func (c *messageCache) MessageContext(ctx context.Context, topic, id string) (m *message, err error) {
+	defer c.observe(queryOpMessage, time.Now(), &err)
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if err := c.flushTopic(topic); err != nil {
+		return nil, err
+	}
+	messages, err := c.queryMessagesContext(ctx, selectMessageQuery, c.ResolveTopic(topic), id)
+	if err != nil {
+		return nil, err
+	} else if len(messages) == 0 {
+		atomic.AddInt64(&c.messagesNotFound, 1)
+		return nil, errMessageNotFound
+	}
+	atomic.AddInt64(&c.messagesFound, 1)
+	return messages[0], nil
+}
+
+// MessageByID is like Message, but looks up a message by its ID alone, e.g. for support requests that only
+// reference the ID of a notification. It returns errMessageNotFound if the message does not exist, and
+// errMessageIDAmbiguous if messages with the ID exist in more than one topic. Like most query methods, it does
+// not see messages that are still in the insert buffer.
+func (c *messageCache) MessageByID(id string) (*message, error) {
+	rows, err := c.db.Query(selectMessageByIDQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.readMessages(c.db, rows)
+	if err != nil {
+		return nil, err
+	} else if len(messages) == 0 {
+		return nil, errMessageNotFound
+	} else if len(messages) > 1 {
+		return nil, errMessageIDAmbiguous
+	}
+	return messages[0], nil
+}
+
+// NeighborMessages returns the published messages directly before and after the given message in the
+// topic, in the same order as Messages, e.g. for prev/next navigation in a message detail view. prev or
+// next is nil if the message is the first or last message of the topic. It returns errMessageNotFound if
+// the message does not exist.
+func (c *messageCache) NeighborMessages(topic, id string) (prev, next *message, err error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, nil, err
+	}
+	topic = c.ResolveTopic(topic)
+	rows, err := c.db.Query(selectMessagePositionQuery, topic, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, nil, errMessageNotFound
+	}
+	var timeMillis, rowID int64
+	if err := rows.Scan(&timeMillis, &rowID); err != nil {
+		return nil, nil, err
+	} else if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	rows.Close()
+	if prev, err = c.neighborMessage(selectPreviousMessageQuery, topic, timeMillis, rowID); err != nil {
+		return nil, nil, err
+	}
+	if next, err = c.neighborMessage(selectNextMessageQuery, topic, timeMillis, rowID); err != nil {
+		return nil, nil, err
+	}
+	return prev, next, nil
+}
+
+func (c *messageCache) neighborMessage(query, topic string, timeMillis, rowID int64) (*message, error) {
+	rows, err := c.db.Query(query, topic, timeMillis, rowID)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.readMessages(c.db, rows)
+	if err != nil {
+		return nil, err
+	} else if len(messages) == 0 {
+		return nil, nil
+	}
+	return messages[0], nil
+}
+
+// MessagesBefore returns up to limit published messages that were stored before the message with the given ID,
+// in the same order as Messages, e.g. to load older messages when scrolling up in a message history. It is the
+// counterpart to paging forward with a since ID. If the message does not exist, no messages are returned.
+func (c *messageCache) MessagesBefore(topic, beforeID string, limit int) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if limit <= 0 {
+		return make([]*message, 0), nil
+	}
+	topic = c.ResolveTopic(topic)
+	rows, err := c.db.Query(selectMessagesBeforeIDQuery, topic, topic, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.readMessages(c.db, rows)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// MessagesLatest returns the most recent published messages of a topic, newest first, e.g. for clients that
+// only show the last few notifications and can stop reading early. Unlike Messages, which replays a topic in
+// publishing order, it does not read the topic's whole history. A limit <= 0 means no limit.
+func (c *messageCache) MessagesLatest(topic string, limit int) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if limit <= 0 {
+		limit = -1 // No limit in SQLite
+	}
+	topic = c.ResolveTopic(topic)
+	rows, err := c.db.Query(selectMessagesLatestQuery, topic, limit)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+func (c *messageCache) MessageCount(topic string) (int, error) {
+	if err := validateTopic(topic); err != nil {
+		return 0, err
+	}
+	topic = c.ResolveTopic(topic)
+	rows, err := c.db.Query(selectMessageCountForTopicQuery, topic)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var count int
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// PublishedCount is like MessageCount, but only counts the messages of a topic that are returned by Messages,
+// i.e. it does not count scheduled messages and messages whose TTL has passed
+func (c *messageCache) PublishedCount(topic string) (int, error) {
+	if err := validateTopic(topic); err != nil {
+		return 0, err
+	}
+	return c.queryCount(selectPublishedCountQuery, c.ResolveTopic(topic))
+}
+
+// ScheduledCount returns the number of scheduled messages of a topic that were not published yet
+func (c *messageCache) ScheduledCount(topic string) (int, error) {
+	if err := validateTopic(topic); err != nil {
+		return 0, err
+	}
+	return c.queryCount(selectScheduledCountQuery, c.ResolveTopic(topic))
+}
+
+// ScheduledCountTotal returns the number of scheduled messages across all topics that were not published yet,
+// e.g. to alert if the backlog of the scheduler grows unexpectedly
+func (c *messageCache) ScheduledCountTotal() (int, error) {
+	return c.queryCount(selectScheduledCountTotalQuery)
+}
+
+// queryCount runs a query that returns a single count
+func (c *messageCache) queryCount(query string, args ...interface{}) (int, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	var count int
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Stats returns the total number of messages, the number of distinct topics, and the time of the oldest message
+// across all topics, in a single query. Like MessageCount, it includes scheduled messages. If the cache is empty,
+// oldest is the zero time.
+func (c *messageCache) Stats() (messages int, topics int, oldest time.Time, err error) {
+	rows, err := c.db.Query(selectMessageStatsQuery)
+	if err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, 0, time.Time{}, errors.New("no rows found")
+	}
+	var oldestTime sql.NullInt64
+	if err := rows.Scan(&messages, &topics, &oldestTime); err != nil {
+		return 0, 0, time.Time{}, err
+	} else if err := rows.Err(); err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	if oldestTime.Valid {
+		oldest = time.Unix(oldestTime.Int64, 0)
+	}
+	return messages, topics, oldest, nil
+}
+
+// MessageRange returns the time of the oldest and the newest published message of a topic, and the number of
+// published messages, in a single query. If the topic has no messages, both times are the zero time.
+func (c *messageCache) MessageRange(topic string) (oldest, newest time.Time, count int, err error) {
+	if err := validateTopic(topic); err != nil {
+		return time.Time{}, time.Time{}, 0, err
+	}
+	topic = c.ResolveTopic(topic)
+	rows, err := c.db.Query(selectMessageRangeQuery, topic)
+	if err != nil {
+		return time.Time{}, time.Time{}, 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return time.Time{}, time.Time{}, 0, errors.New("no rows found")
+	}
+	var oldestTime, newestTime sql.NullInt64
+	if err := rows.Scan(&oldestTime, &newestTime, &count); err != nil {
+		return time.Time{}, time.Time{}, 0, err
+	} else if err := rows.Err(); err != nil {
+		return time.Time{}, time.Time{}, 0, err
+	}
+	if oldestTime.Valid {
+		oldest, newest = time.Unix(oldestTime.Int64, 0), time.Unix(newestTime.Int64, 0)
+	}
+	return oldest, newest, count, nil
+}
+
+// TopicStorageBytes returns an estimate of the storage used by the messages of a topic, i.e. the size in bytes
+// of all message bodies, titles and tags as stored, plus the size of their attachments. This allows limiting
+// the history of a topic by size rather than by count. The size of each message is kept in the bytes column
+// when it is added or updated (see storedMessageBytes), so that this does not have to look at the contents.
+func (c *messageCache) TopicStorageBytes(topic string) (int64, error) {
+	if err := validateTopic(topic); err != nil {
+		return 0, err
+	}
+	topic = c.ResolveTopic(topic)
+	rows, err := c.db.Query(selectTopicStorageBytesQuery, topic)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var size int64
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	if err := rows.Scan(&size); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// storedMessageBytes returns the size in bytes of a message body (as returned by encodeMessageBody), title
+// (as returned by encodeMessageTitle) and tags as stored, which is kept in the bytes column, see TopicStorageBytes
+func storedMessageBytes(body, title interface{}, tagsStr string) int64 {
+	size := len(tagsStr)
+	for _, v := range []interface{}{body, title} {
+		switch b := v.(type) {
+		case string:
+			size += len(b)
+		case []byte:
+			size += len(b)
+		}
+	}
+	return int64(size)
+}
+
+// DailyCounts returns the number of published messages in a topic per day, for messages with a timestamp
+// in [from, to). Days are keyed as YYYY-MM-DD, and start at midnight in the time zone with the given UTC
+// offset, e.g. 2*time.Hour for UTC+2. Days without messages are not included.
+func (c *messageCache) DailyCounts(topic string, from, to time.Time, utcOffset time.Duration) (map[string]int, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	topic = c.ResolveTopic(topic)
+	rows, err := c.db.Query(selectDailyCountsQuery, int64(utcOffset.Seconds()), topic, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var day string
+		var count int
+		if err := rows.Scan(&day, &count); err != nil {
+			return nil, err
+		}
+		counts[day] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// AgeHistogram returns the number of published messages across all topics by age at the given time, in the
+// buckets "0-1h", "1-24h", "1-7d" and "older". All buckets are included, even if they are empty. This is meant
+// to help choosing a retention period, e.g. to see how many messages a shorter cache duration would prune.
+func (c *messageCache) AgeHistogram(now time.Time) (map[string]int, error) {
+	rows, err := c.db.Query(selectAgeHistogramQuery, now.Add(-time.Hour).Unix(), now.Add(-24*time.Hour).Unix(), now.Add(-7*24*time.Hour).Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	histogram := map[string]int{"0-1h": 0, "1-24h": 0, "1-7d": 0, "older": 0}
+	for rows.Next() {
+		var bucket string
+		var count int
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return nil, err
+		}
+		histogram[bucket] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return histogram, nil
+}
+
+// MessageCountSince returns the number of messages in a topic with a timestamp of at least since
+func (c *messageCache) MessageCountSince(topic string, since time.Time) (int, error) {
+	if err := validateTopic(topic); err != nil {
+		return 0, err
+	}
+	topic = c.ResolveTopic(topic)
+	rows, err := c.db.Query(selectMessageCountSinceQuery, topic, since.Unix())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var count int
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (c *messageCache) Topics() (map[string]*topic, error) {
+	rows, err := c.db.Query(selectTopicsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := make(map[string]*topic)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		topics[id] = newTopic(id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// TopicsPage returns a page of topic names, ordered by name. Unlike Topics, this allows
+// iterating over all topics in chunks without loading all of them into memory at once.
+// A limit <= 0 means no limit.
+func (c *messageCache) TopicsPage(offset, limit int) ([]string, error) {
+	if limit <= 0 {
+		limit = -1 // No limit in SQLite
+	}
+	rows, err := c.db.Query(selectTopicsPageQuery, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		topics = append(topics, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// TopicsWithPrefix returns the names of all topics starting with the given prefix, ordered by name.
+// LIKE metacharacters in the prefix are escaped, so they match literally.
+func (c *messageCache) TopicsWithPrefix(prefix string) ([]string, error) {
+	rows, err := c.db.Query(selectTopicsWithPrefixQuery, escapeLikePattern(prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(id, prefix) { // LIKE is case-insensitive in SQLite, topics are not
+			topics = append(topics, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// SetPinned pins or unpins a message. Pinned messages are never deleted by Prune, but are otherwise
+// treated like all other messages, e.g. scheduled messages are still delivered. It returns errMessageNotFound
+// if the message does not exist.
+func (c *messageCache) SetPinned(topic, id string, pinned bool) error {
+	topic = c.ResolveTopic(topic)
+	res, err := c.db.Exec(updateMessagePinnedQuery, pinned, topic, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errMessageNotFound
+	}
+	return nil
+}
+
+// Ping checks that the database is still usable, e.g. for a liveness probe. It fails if the cache was closed,
+// or if the database does not respond within pingTimeout.
+func (c *messageCache) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return c.db.PingContext(ctx)
+}
+
+// IncrementalVacuum returns up to the given number of free pages to the operating system, or all free
+// pages if pages <= 0. Unlike a full VACUUM, this does not rewrite the database. It only has an effect if
+// the database was created with the "incremental" auto-vacuum mode, see messageCacheOptions.
+func (c *messageCache) IncrementalVacuum(pages int) error {
+	// Zero or negative means all pages in SQLite. The pragma frees one page per step, so
+	// it must be run via Query and stepped through to the end; Exec only frees a single page.
+	rows, err := c.db.Query(fmt.Sprintf(incrementalVacuumQuery, pages))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// Compact rebuilds the database with VACUUM, so that the space freed by pruning is returned to the operating
+// system, and then truncates the write-ahead log if the cache is in WAL mode (see messageCacheOptions.JournalMode).
+// Unlike IncrementalVacuum, this works regardless of the auto-vacuum mode, but it rewrites the entire database.
+//
+// VACUUM cannot run within a transaction, and needs exclusive access to the database: It waits for (and then
+// blocks) all other writers, and temporarily needs up to twice the size of the database on disk. It is therefore
+// meant to be run rarely, e.g. from a maintenance goroutine during quiet hours. It is safe to call concurrently
+// with Prune and publishing, which are blocked until it is done, or fail if it takes longer than the busy timeout.
+func (c *messageCache) Compact() error {
+	if c.nop {
+		return nil
+	}
+	start := time.Now()
+	if _, err := c.db.Exec(vacuumQuery); err != nil {
+		return err
+	}
+	rows, err := c.db.Query(walCheckpointQuery) // No-op if not in WAL mode
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return errors.New("no rows found")
+	}
+	var busy, logPages, checkpointedPages int
+	if err := rows.Scan(&busy, &logPages, &checkpointedPages); err != nil {
+		return err
+	} else if err := rows.Err(); err != nil {
+		return err
+	} else if busy != 0 {
+		log.Debug("Message cache: Could not truncate write-ahead log after compacting, database is busy")
+	}
+	log.Debug("Message cache: Compacted database in %s", time.Since(start))
+	return nil
+}
+
+// Prune deletes published messages older than olderThan. If minKeep is positive, the newest minKeep
+// messages of each topic are kept regardless of their age, so that quiet topics do not appear empty.
+// Messages whose TTL has passed are deleted as well; they are already hidden from all queries.
+// If messageCacheOptions.PruneBatchSize is set, messages are deleted in batches, see pruneMessages.
+func (c *messageCache) Prune(olderThan time.Time, minKeep int) (err error) {
+	defer c.observe(queryOpPrune, time.Now(), &err)
+	start := time.Now()
+	expired, err := c.pruneMessages(auditReasonExpired, pruneExpiredMessagesQuery, pruneExpiredMessagesBatchQuery, start.Unix())
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.totalPruned, expired)
+	var pruned int64
+	if minKeep > 0 {
+		pruned, err = c.pruneMessages(auditReasonPruned, pruneMessagesKeepNewestQuery, pruneKeepNewestBatchQuery, olderThan.Unix(), minKeep)
+	} else {
+		pruned, err = c.pruneMessages(auditReasonPruned, pruneMessagesQuery, pruneMessagesBatchQuery, olderThan.Unix())
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.totalPruned, pruned)
+	atomic.StoreInt64(&c.lastPruneTime, start.UnixNano())
+	atomic.StoreInt64(&c.lastPruneDuration, int64(time.Since(start)))
+	return nil
+}
+
+// pruneMessages runs the given DELETE FROM messages query like deleteMessagesAudited, and returns the number of
+// deleted messages. If c.pruneBatchSize is set, batchQuery is run repeatedly instead, each time in its own
+// transaction, until a batch comes up short. batchQuery must have the same WHERE clause as query, wrapped in
+// "id IN (SELECT id FROM messages WHERE ... LIMIT ?)", see e.g. pruneMessagesBatchQuery. The WHERE clause is
+// evaluated anew for every batch, so the batches add up to the messages that the query would delete at once,
+// except for changes made by other writers in between, e.g. a message that is pinned while pruning is in progress.
+func (c *messageCache) pruneMessages(reason, query, batchQuery string, args ...interface{}) (int64, error) {
+	if c.pruneBatchSize <= 0 {
+		return c.deleteMessagesAudited(reason, query, args...)
+	}
+	batchArgs := append(append([]interface{}{}, args...), c.pruneBatchSize)
+	var total int64
+	for {
+		deleted, err := c.deleteMessagesAudited(reason, batchQuery, batchArgs...)
+		if err != nil {
+			return total, err
+		}
+		total += deleted
+		if deleted < int64(c.pruneBatchSize) {
+			return total, nil
+		}
+	}
+}
+
+// PruneTopicToCount deletes the oldest published messages of a topic, so that at most the newest keep messages
+// remain, regardless of their age, and returns how many were deleted. This complements Prune for chatty topics.
+// As in Prune, scheduled messages and pinned messages are never deleted, but pinned messages count towards keep.
+// A keep < 0 is treated as 0, i.e. all published messages of the topic (except pinned ones) are deleted.
+func (c *messageCache) PruneTopicToCount(topic string, keep int) (deleted int64, err error) {
+	if err := validateTopic(topic); err != nil {
+		return 0, err
+	} else if keep < 0 {
+		keep = 0
+	}
+	topic = c.ResolveTopic(topic)
+	return c.pruneMessages(auditReasonPruned, pruneTopicToCountQuery, pruneTopicToCountBatchQuery, topic, topic, keep)
+}
+
+// PruneToMaxRows deletes the oldest published messages across all topics, so that at most max messages remain,
+// regardless of their age, and returns how many were deleted. This is a safety net against a retention that
+// would fill the disk, complementing Prune and PruneTopicToCount. As in Prune, scheduled and pinned messages are
+// never deleted, but count towards max, so fewer messages may be deleted than needed to reach max. It is cheap
+// to call if there are no more than max messages. Messages are deleted in batches of PruneBatchSize (see
+// messageCacheOptions), or pruneMaxRowsBatchSize if it is not set, each in its own transaction.
+func (c *messageCache) PruneToMaxRows(max int) (deleted int64, err error) {
+	if max < 0 {
+		max = 0
+	}
+	count, err := c.messageCountTotal()
+	if err != nil {
+		return 0, err
+	} else if count <= max {
+		return 0, nil
+	}
+	batchSize := c.pruneBatchSize
+	if batchSize <= 0 {
+		batchSize = pruneMaxRowsBatchSize
+	}
+	for remaining := int64(count - max); remaining > 0; {
+		limit := int64(batchSize)
+		if remaining < limit {
+			limit = remaining
+		}
+		n, err := c.deleteMessagesAudited(auditReasonPruned, pruneOldestMessagesQuery, limit)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+		remaining -= n
+		if n < limit {
+			break // Only scheduled and pinned messages left
+		}
+	}
+	return deleted, nil
+}
+
+// PruneExpiredScheduled deletes scheduled messages that were not published before their drop-dead time
+// (see message.NotAfter) passed at now (Unix time in seconds), and returns how many were deleted. Such messages
+// are never returned by MessagesDue, so without this they would accumulate. Unlike Prune, which only deletes
+// published messages, this only deletes unpublished ones.
+func (c *messageCache) PruneExpiredScheduled(now int64) (int, error) {
+	deleted, err := c.deleteMessagesAudited(auditReasonDropped, pruneExpiredScheduledQuery, now)
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// CompactOrphans deletes rows of the tables that reference messages (read state, tags and attachments) whose
+// message no longer exists, and returns how many were deleted. Normally, these rows are deleted along with their
+// message (ON DELETE CASCADE), but rows can be left behind if messages were deleted while foreign key constraints
+// were not enforced, e.g. by third-party tooling or via a database passed to newCacheFromDB.
+func (c *messageCache) CompactOrphans() (int, error) {
+	var deleted int64
+	err := c.withTx(func(tx *sql.Tx) error {
+		for _, query := range []string{deleteOrphanedReadStateQuery, deleteOrphanedTagsQuery, deleteOrphanedAttachmentsQuery} {
+			res, err := tx.Exec(query)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// TotalPruned returns the number of messages deleted by Prune since the cache was created
+func (c *messageCache) TotalPruned() int64 {
+	return atomic.LoadInt64(&c.totalPruned)
+}
+
+// messageCacheLookupStats are the number of Message lookups since the cache was created, see LookupStats
+type messageCacheLookupStats struct {
+	MessagesFound    int64
+	MessagesNotFound int64
+}
+
+// LookupStats returns how often Message found the requested message, and how often it did not, e.g. because
+// the message was already pruned. A high number of misses hints at clients holding on to stale message IDs,
+// or at a cache duration that is too short.
+func (c *messageCache) LookupStats() *messageCacheLookupStats {
+	return &messageCacheLookupStats{
+		MessagesFound:    atomic.LoadInt64(&c.messagesFound),
+		MessagesNotFound: atomic.LoadInt64(&c.messagesNotFound),
+	}
 }
 
-func (c *messageCache) MessageCount(topic string) (int, error) {
-	rows, err := c.db.Query(selectMessageCountForTopicQuery, topic)
+// LastPruneTime returns the time at which the last successful Prune started, or the zero time
+// if Prune has not been called yet
+func (c *messageCache) LastPruneTime() time.Time {
+	nanos := atomic.LoadInt64(&c.lastPruneTime)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// LastPruneDuration returns how long the last successful Prune took
+func (c *messageCache) LastPruneDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.lastPruneDuration))
+}
+
+// DeleteTopic deletes all messages of a topic, including scheduled messages and messages that are still in
+// the insert buffer, and returns the number of deleted messages. Use DeleteTopicWithAttachments if the
+// attachment files of the deleted messages have to be removed as well.
+func (c *messageCache) DeleteTopic(topic string) (deleted int64, err error) {
+	n, _, err := c.DeleteTopicWithAttachments(topic)
+	return int64(n), err
+}
+
+// DeleteTopicWithAttachments deletes all messages of a topic like DeleteTopic. It returns the number of deleted
+// messages, and the IDs of all deleted messages that had an attachment, so that the attachment files can be
+// removed from the file cache.
+func (c *messageCache) DeleteTopicWithAttachments(topic string) (int, []string, error) {
+	if err := validateTopic(topic); err != nil {
+		return 0, nil, err
+	} else if err := c.flushTopic(topic); err != nil {
+		return 0, nil, err
+	}
+	topic = c.ResolveTopic(topic)
+	ids := make([]string, 0)
+	deletedIDs := make([]string, 0)
+	var deleted int64
+	err := c.withTx(func(tx *sql.Tx) error {
+		var err error
+		if c.writeFeed != nil {
+			if deletedIDs, err = queryMessageIDs(tx, selectMessageIDsForTopicQuery, topic); err != nil {
+				return err
+			}
+		}
+		if ids, err = queryMessageIDs(tx, selectAttachmentsForTopicQuery, topic); err != nil {
+			return err
+		}
+		if err := c.auditDeletes(tx, auditReasonTopicDeleted, deleteTopicQuery, topic); err != nil {
+			return err
+		}
+		res, err := tx.Exec(deleteTopicQuery, topic)
+		if err != nil {
+			return err
+		}
+		deleted, err = res.RowsAffected()
+		return err
+	})
 	if err != nil {
-		return 0, err
+		return 0, nil, err
+	}
+	for _, id := range deletedIDs {
+		c.emitWrite(writeOpDelete, &message{ID: id, Event: messageEvent, Topic: topic})
+	}
+	return int(deleted), ids, nil
+}
+
+// queryMessageIDs runs the given query within the transaction, and returns the message IDs it selects
+func queryMessageIDs(tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
 	}
 	defer rows.Close()
-	var count int
-	if !rows.Next() {
-		return 0, errors.New("no rows found")
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
 	}
-	if err := rows.Scan(&count); err != nil {
-		return 0, err
-	} else if err := rows.Err(); err != nil {
-		return 0, err
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-	return count, nil
+	return ids, nil
 }
 
-func (c *messageCache) Topics() (map[string]*topic, error) {
-	rows, err := c.db.Query(selectTopicsQuery)
+// DuplicateMessageIDs returns all message IDs that are used by more than one row. Older databases may
+// contain such duplicates, see DeduplicateMessages.
+func (c *messageCache) DuplicateMessageIDs() ([]string, error) {
+	rows, err := c.db.Query(selectDuplicateMessageIDsQuery)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	topics := make(map[string]*topic)
+	ids := make([]string, 0)
 	for rows.Next() {
 		var id string
 		if err := rows.Scan(&id); err != nil {
 			return nil, err
 		}
-		topics[id] = newTopic(id)
+		ids = append(ids, id)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	return topics, nil
+	return ids, nil
 }
 
-func (c *messageCache) Prune(olderThan time.Time) error {
-	_, err := c.db.Exec(pruneMessagesQuery, olderThan.Unix())
-	return err
+// DeduplicateMessages deletes all but the oldest row (the one with the lowest row ID) for each duplicate
+// message ID, and returns the number of deleted rows.
+func (c *messageCache) DeduplicateMessages() (int, error) {
+	var deleted int64
+	err := c.withTx(func(tx *sql.Tx) error {
+		if err := c.auditDeletes(tx, auditReasonDuplicate, deleteDuplicateMessagesQuery); err != nil {
+			return err
+		}
+		res, err := tx.Exec(deleteDuplicateMessagesQuery)
+		if err != nil {
+			return err
+		}
+		deleted, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
 }
 
-func (c *messageCache) AttachmentBytesUsed(sender string) (int64, error) {
-	rows, err := c.db.Query(selectAttachmentsSizeQuery, sender, time.Now().Unix())
+// AttachmentsSizeTotal returns the total size (in bytes) of all non-expired attachments, across all senders
+func (c *messageCache) AttachmentsSizeTotal() (int64, error) {
+	rows, err := c.db.Query(selectAttachmentsSizeTotalQuery, time.Now().Unix())
 	if err != nil {
 		return 0, err
 	}
@@ -393,34 +3309,310 @@ func (c *messageCache) AttachmentBytesUsed(sender string) (int64, error) {
 	return size, nil
 }
 
+// MessagesWithExpiredAttachments returns messages whose attachment has expired, but which still reference
+// it. Unlike AttachmentsExpired, it returns the full messages, e.g. to show them in a cleanup UI.
+// A limit <= 0 means no limit.
+func (c *messageCache) MessagesWithExpiredAttachments(limit int) ([]*message, error) {
+	if limit <= 0 {
+		limit = -1 // No limit in SQLite
+	}
+	rows, err := c.db.Query(selectMessagesWithExpiredAttachmentsQuery, time.Now().Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// AttachmentsExpired returns the IDs of all messages with an expired attachment that was not deleted yet,
+// see ExpireAttachments. Each message ID is only returned once, even if more than one of its attachments expired.
 func (c *messageCache) AttachmentsExpired() ([]string, error) {
+	expired, err := c.AttachmentsExpiredDetails()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	ids := make([]string, 0)
+	for _, e := range expired {
+		if !seen[e.ID] {
+			seen[e.ID] = true
+			ids = append(ids, e.ID)
+		}
+	}
+	return ids, nil
+}
+
+// AttachmentsExpiredDetails is like AttachmentsExpired, but returns the owner and size of each expired attachment
+// as well, so that per-owner quota counters can be decremented after deleting the files, without summing up all
+// remaining attachments again. Messages with more than one expired attachment have one entry per attachment.
+func (c *messageCache) AttachmentsExpiredDetails() ([]attachmentExpiry, error) {
 	rows, err := c.db.Query(selectAttachmentsExpiredQuery, time.Now().Unix())
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	ids := make([]string, 0)
+	expired := make([]attachmentExpiry, 0)
 	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
+		var e attachmentExpiry
+		if err := rows.Scan(&e.ID, &e.Owner, &e.Size); err != nil {
 			return nil, err
 		}
-		ids = append(ids, id)
+		expired = append(expired, e)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	return ids, nil
+	return expired, nil
+}
+
+// MessageForensics returns the publisher details (IP address and user agent) of a message. These
+// details are never returned by the regular read methods, so they are not leaked to subscribers.
+// This method is meant for admins investigating abuse only.
+func (c *messageCache) MessageForensics(topic, id string) (*messageForensics, error) {
+	topic = c.ResolveTopic(topic)
+	rows, err := c.db.Query(selectMessageForensicsQuery, topic, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, errMessageNotFound
+	}
+	var forensics messageForensics
+	if err := rows.Scan(&forensics.SourceIP, &forensics.UserAgent); err != nil {
+		return nil, err
+	} else if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &forensics, nil
+}
+
+// sqliteDSN returns the data source name for the given SQLite filename. It enables foreign key constraints,
+// which must be done for every connection, so that tables referencing messages(id) with ON DELETE CASCADE are
+// cleaned up whenever messages are deleted (e.g. by Prune or DeleteTopic).
+func sqliteDSN(filename string) string {
+	if strings.Contains(filename, "?") {
+		return filename + "&_foreign_keys=1"
+	}
+	return filename + "?_foreign_keys=1"
+}
+
+// sqlitePragmasDSN adds the synchronous mode, journal mode and busy timeout of the options to the data source
+// name, so that they are applied to every connection. Empty options keep the driver defaults. The journal mode
+// is not added for in-memory databases, which always use an in-memory journal.
+func sqlitePragmasDSN(dsn string, options *messageCacheOptions) string {
+	if options.Synchronous != "" {
+		dsn += "&_sync=" + strings.ToUpper(options.Synchronous)
+	}
+	if options.JournalMode != "" && !strings.Contains(dsn, "mode=memory") {
+		dsn += "&_journal_mode=" + strings.ToUpper(options.JournalMode)
+	}
+	if options.BusyTimeout > 0 {
+		dsn += fmt.Sprintf("&_busy_timeout=%d", options.BusyTimeout.Milliseconds())
+	}
+	return dsn
+}
+
+func (o *messageCacheOptions) validate() error {
+	if o.SpillThreshold < 0 || (o.SpillThreshold > 0 && o.SpillFilename == "") {
+		return errors.New("spill threshold requires a spill filename")
+	} else if o.DebounceWindow < 0 {
+		return errors.New("invalid debounce window")
+	}
+	switch o.MissedSchedulePolicy {
+	case "", missedScheduleDeliver, missedScheduleSkip, missedScheduleReschedule:
+	default:
+		return errInvalidDuePolicy
+	}
+	switch o.Synchronous {
+	case "", "off", "normal", "full":
+	default:
+		return fmt.Errorf("invalid synchronous mode %s", o.Synchronous)
+	}
+	switch o.JournalMode {
+	case "", "delete", "truncate", "persist", "wal":
+	default:
+		return fmt.Errorf("invalid journal mode %s", o.JournalMode)
+	}
+	if o.BusyTimeout < 0 {
+		return errors.New("invalid busy timeout")
+	} else if o.BusyRetries < 0 || o.BusyRetryBackoff < 0 {
+		return errors.New("invalid busy retries or backoff")
+	} else if o.PruneBatchSize < 0 {
+		return errors.New("invalid prune batch size")
+	} else if o.MaxOpenConns < 0 || o.MaxIdleConns < 0 || o.ConnMaxLifetime < 0 {
+		return errors.New("invalid connection pool size or lifetime")
+	}
+	switch o.AutoVacuum {
+	case "", "none", "full", "incremental":
+		return nil
+	}
+	return fmt.Errorf("invalid auto-vacuum mode %s", o.AutoVacuum)
+}
+
+// messageTimeMillis returns the message time in milliseconds, which is used to order messages that were
+// published within the same second. This is the time the message was created (see newMessage), unless its time
+// was changed since, e.g. because it is scheduled. Otherwise, the current time is used if it falls within the
+// second of the message time, and the end of that second if not, so that a message that is stored a bit later
+// (e.g. because of the insert buffer) never sorts before messages that were stored before it.
+func messageTimeMillis(m *message) int64 {
+	if m.TimeMillis/1000 == m.Time && m.TimeMillis > 0 {
+		return m.TimeMillis
+	}
+	nowMillis := time.Now().UnixMilli()
+	if nowMillis/1000 == m.Time {
+		return nowMillis
+	}
+	return m.Time*1000 + 999
+}
+
+// prepareMessage assigns a delivery token and sanitizes the attachment name of a message before it is stored.
+// This happens before the message is queued in the insert buffer, so that it is never modified concurrently.
+// Published messages already went through both in handlePublish, so that subscribers see the same message.
+func prepareMessage(m *message) error {
+	if m.Attachment != nil {
+		m.Attachment.Name = util.SafeAttachmentName(m.Attachment.Name)
+	}
+	return assignMessageToken(m)
+}
+
+// assignMessageToken generates a random secret delivery token for the message, unless it already has one
+func assignMessageToken(m *message) error {
+	if m.Token != "" {
+		return nil
+	}
+	b := make([]byte, messageTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	m.Token = base64.RawURLEncoding.EncodeToString(b)
+	return nil
 }
 
-func readMessages(rows *sql.Rows) ([]*message, error) {
+// validateTopic returns errInvalidTopic if the topic is empty or only consists of whitespace. Messages
+// stored under such a topic could never be retrieved via the API.
+func validateTopic(topic string) error {
+	if strings.TrimSpace(topic) == "" {
+		return errInvalidTopic
+	}
+	return nil
+}
+
+// topicKey returns the topic as it is stored in the topic column, i.e. lowercased if the cache was created with
+// case-insensitive topics (see messageCacheOptions), or unchanged otherwise
+func (c *messageCache) topicKey(topic string) string {
+	if c.foldTopics {
+		return strings.ToLower(topic)
+	}
+	return topic
+}
+
+// topicDisplay returns the display name to store with a new message of the given topic: the casing of the first
+// stored message of the topic, or the given topic if there is none. It is empty unless topics are case-insensitive.
+func (c *messageCache) topicDisplay(tx *sql.Tx, topic string) (string, error) {
+	if !c.foldTopics {
+		return "", nil
+	}
+	rows, err := tx.Query(selectTopicDisplayQuery, c.topicKey(topic))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return topic, rows.Err()
+	}
+	var display string
+	if err := rows.Scan(&display); err != nil {
+		return "", err
+	}
+	return display, rows.Err()
+}
+
+// escapeLikePattern escapes the LIKE metacharacters in s, to be used with ESCAPE '\'
+func escapeLikePattern(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// searchMatches reports whether s contains text, ignoring the case of ASCII letters only, just like a LIKE match
+// with escapeLikePattern. It is used to match rows whose columns cannot be matched by SQLite, e.g. compressed bodies.
+func searchMatches(s, text string) bool {
+	return strings.Contains(lowerASCII(s), lowerASCII(text))
+}
+
+func lowerASCII(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// filterSearchMatches returns the first limit messages for which matches returns true, or all of them if
+// limit <= 0. Search queries select candidates that match in SQLite, plus all rows with a storage codec,
+// so the final match (and thereby the limit) is applied after the rows are decoded.
+func filterSearchMatches(messages []*message, limit int, matches func(m *message) bool) []*message {
+	filtered := make([]*message, 0)
+	for _, m := range messages {
+		if limit > 0 && len(filtered) >= limit {
+			break
+		} else if matches(m) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+// messageColumns are the columns read by readMessages, starting with selectMessageColumns
+var messageColumns = []string{
+	"mid", "time", "topic", "message", "title", "priority", "tags", "click", "actions", "attachment_name", "attachment_type",
+	"attachment_size", "attachment_expires", "attachment_url", "sender", "encoding", "updated", "collapse_key", "origin",
+	"body_html", "category", "publish_seq", "topic_display", "sound", "has_location", "lat", "lng", "repeat_count", "ttl",
+	"icon", "read_count", "content_type",
+	"token", "source_ip", "user_agent", "raw_priority", "not_after", "dedup_key", "attachment_hash", // Only read by ExportTopic and MigrateCache
+	"email", // Only read by ExportTopic, MigrateCache and MessagesByEmail
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// readMessages reads messages from rows, mapping columns by name rather than by position: Unknown columns are
+// ignored and missing ones are left empty. This keeps the reader working against databases of other versions,
+// e.g. a reporting tool that reads the cache of a newer server, as long as schema changes are additive.
+//
+// Attachments are read with a second query through q, which must be the transaction the rows were read in, if
+// any. In-memory caches only have a single connection (see configureConnPool), so reading them through c.db
+// while a transaction is open would block forever.
+func (c *messageCache) readMessages(q queryer, rows *sql.Rows) ([]*message, error) {
 	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	positions := make([]int, len(columns)) // Index in messageColumns for every column, or -1 if unknown
+	for i, column := range columns {
+		positions[i] = -1
+		for j, known := range messageColumns {
+			if column == known {
+				positions[i] = j
+				break
+			}
+		}
+	}
 	messages := make([]*message, 0)
 	for rows.Next() {
-		var timestamp, attachmentSize, attachmentExpires int64
-		var priority int
-		var id, topic, msg, title, tagsStr, click, actionsStr, attachmentName, attachmentType, attachmentURL, sender, encoding string
-		err := rows.Scan(
+		// Optional columns are scanned NULL-safe, in case rows were inserted by third-party tooling
+		var timestamp, updated, publishSeq, ttl, notAfter int64
+		var priority, repeatCount, rawPriority, readCount int
+		var id, topic, msg, sender, collapseKey, origin, category, topicDisplay, sound, icon string
+		var title, tagsStr, click, actionsStr, attachmentName, attachmentType, attachmentURL, encoding, bodyHTML, contentType sql.NullString
+		var token, sourceIP, userAgent, dedupKey, attachmentHash, email sql.NullString
+		var attachmentSize, attachmentExpires sql.NullInt64
+		var hasLocation bool
+		var lat, lng float64
+		var ignored interface{}
+		fields := []interface{}{
 			&id,
 			&timestamp,
 			&topic,
@@ -437,57 +3629,145 @@ func readMessages(rows *sql.Rows) ([]*message, error) {
 			&attachmentURL,
 			&sender,
 			&encoding,
-		)
+			&updated,
+			&collapseKey,
+			&origin,
+			&bodyHTML,
+			&category,
+			&publishSeq,
+			&topicDisplay,
+			&sound,
+			&hasLocation,
+			&lat,
+			&lng,
+			&repeatCount,
+			&ttl,
+			&icon,
+			&readCount,
+			&contentType,
+			&token,
+			&sourceIP,
+			&userAgent,
+			&rawPriority,
+			&notAfter,
+			&dedupKey,
+			&attachmentHash,
+			&email,
+		}
+		dest := make([]interface{}, len(columns))
+		for i, position := range positions {
+			if position >= 0 {
+				dest[i] = fields[position]
+			} else {
+				dest[i] = &ignored
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		msg, decodedEncoding, err := c.decodeMessageBody(topic, msg, encoding.String)
+		if err != nil {
+			return nil, err
+		}
+		html, err := c.decodeMessageHTML(topic, bodyHTML.String, encoding.String)
+		if err != nil {
+			return nil, err
+		}
+		if !contentType.Valid && html != "" {
+			contentType.String = contentTypeMarkdown // Column not selected, e.g. when reading from deleted_messages
+		}
+		decodedTitle, err := c.decodeMessageTitle(topic, title.String, encoding.String)
 		if err != nil {
 			return nil, err
 		}
-		var tags []string
-		if tagsStr != "" {
-			tags = strings.Split(tagsStr, ",")
+		tags := make([]string, 0) // Never nil, unless the legacy behavior is requested
+		if tagsStr.String != "" {
+			if err := json.Unmarshal([]byte(tagsStr.String), &tags); err != nil {
+				return nil, err
+			}
+		}
+		if c.nilEmptyTags && len(tags) == 0 {
+			tags = nil
+		}
+		if origin == "" {
+			origin = c.origin // Rows without origin were published locally
+		}
+		if topicDisplay != "" {
+			topic = topicDisplay // See messageCacheOptions.CaseInsensitiveTopics
 		}
 		var actions []*action
-		if actionsStr != "" {
-			if err := json.Unmarshal([]byte(actionsStr), &actions); err != nil {
+		if actionsStr.String != "" {
+			if err := json.Unmarshal([]byte(actionsStr.String), &actions); err != nil {
 				return nil, err
 			}
 		}
 		var att *attachment
-		if attachmentName != "" && attachmentURL != "" {
+		if attachmentName.String != "" && attachmentURL.String != "" {
 			att = &attachment{
-				Name:    attachmentName,
-				Type:    attachmentType,
-				Size:    attachmentSize,
-				Expires: attachmentExpires,
-				URL:     attachmentURL,
+				Name:    attachmentName.String,
+				Type:    attachmentType.String,
+				Size:    attachmentSize.Int64,
+				Expires: attachmentExpires.Int64,
+				URL:     attachmentURL.String,
+				Hash:    attachmentHash.String,
 			}
 		}
+		var loc *location
+		if hasLocation {
+			loc = &location{Lat: lat, Lng: lng}
+		}
 		messages = append(messages, &message{
-			ID:         id,
-			Time:       timestamp,
-			Event:      messageEvent,
-			Topic:      topic,
-			Message:    msg,
-			Title:      title,
-			Priority:   priority,
-			Tags:       tags,
-			Click:      click,
-			Actions:    actions,
-			Attachment: att,
-			Sender:     sender,
-			Encoding:   encoding,
+			ID:          id,
+			Time:        timestamp,
+			Event:       messageEvent,
+			Topic:       topic,
+			Message:     msg,
+			Title:       decodedTitle,
+			Priority:    priority,
+			Tags:        tags,
+			Click:       click.String,
+			Icon:        icon,
+			Actions:     actions,
+			Attachment:  att,
+			Sender:      sender,
+			Encoding:    decodedEncoding,
+			Updated:     updated,
+			CollapseKey: collapseKey,
+			Origin:      origin,
+			Markdown:    contentType.String == contentTypeMarkdown,
+			ContentType: contentType.String,
+			BodyHTML:    html,
+			Category:    category,
+			PublishSeq:  publishSeq,
+			Sound:       sound,
+			Location:    loc,
+			RepeatCount: repeatCount,
+			ReadCount:   readCount,
+			TTL:         ttl,
+			Token:       token.String,
+			SourceIP:    sourceIP.String,
+			UserAgent:   userAgent.String,
+			RawPriority: rawPriority,
+			NotAfter:    notAfter,
+			DedupKey:    dedupKey.String,
+			Email:       email.String,
 		})
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	rows.Close()
+	if err := c.readMessageAttachments(q, messages); err != nil {
+		return nil, err
+	}
 	return messages, nil
 }
 
-func setupCacheDB(db *sql.DB) error {
+func setupCacheDB(db *sql.DB, options *messageCacheOptions) error {
 	// If 'messages' table does not exist, this must be a new database
 	rowsMC, err := db.Query(selectMessagesCountQuery)
 	if err != nil {
-		return setupNewCacheDB(db)
+		return setupNewCacheDB(db, options)
 	}
 	rowsMC.Close()
 
@@ -497,7 +3777,7 @@ func setupCacheDB(db *sql.DB) error {
 	if err == nil {
 		defer rowsSV.Close()
 		if !rowsSV.Next() {
-			return errors.New("cannot determine schema version: cache file may be corrupt")
+			return errSchemaUnknown
 		}
 		if err := rowsSV.Scan(&schemaVersion); err != nil {
 			return err
@@ -505,116 +3785,233 @@ func setupCacheDB(db *sql.DB) error {
 		rowsSV.Close()
 	}
 
+	// A newer binary may have migrated the database already, e.g. before a rollback. There is no way to
+	// downgrade, and opening it anyway would fail in confusing ways on the first unknown column.
+	if schemaVersion > currentSchemaVersion {
+		return fmt.Errorf("%w: found schema version %d, supported up to %d", errSchemaNewer, schemaVersion, currentSchemaVersion)
+	}
+
 	// Do migrations
-	if schemaVersion == currentSchemaVersion {
-		return nil
-	} else if schemaVersion == 0 {
-		return migrateFrom0(db)
-	} else if schemaVersion == 1 {
-		return migrateFrom1(db)
-	} else if schemaVersion == 2 {
-		return migrateFrom2(db)
-	} else if schemaVersion == 3 {
-		return migrateFrom3(db)
-	} else if schemaVersion == 4 {
-		return migrateFrom4(db)
-	} else if schemaVersion == 5 {
-		return migrateFrom5(db)
-	} else if schemaVersion == 6 {
-		return migrateFrom6(db)
-	}
-	return fmt.Errorf("unexpected schema version found: %d", schemaVersion)
-}
-
-func setupNewCacheDB(db *sql.DB) error {
+	return migrateCacheDB(db, schemaVersion)
+}
+
+func setupNewCacheDB(db *sql.DB, options *messageCacheOptions) error {
+	if options != nil && options.AutoVacuum != "" {
+		// Must be set before the first table is created
+		if _, err := db.Exec(fmt.Sprintf(setAutoVacuumQuery, options.AutoVacuum)); err != nil {
+			return err
+		}
+	}
 	if _, err := db.Exec(createMessagesTableQuery); err != nil {
 		return err
 	}
-	if _, err := db.Exec(createSchemaVersionTableQuery); err != nil {
+	if _, err := db.Exec(createDictionariesTableQuery); err != nil {
 		return err
 	}
-	if _, err := db.Exec(insertSchemaVersion, currentSchemaVersion); err != nil {
+	if _, err := db.Exec(createTopicDefaultsTableQuery); err != nil {
 		return err
 	}
-	return nil
-}
-
-func migrateFrom0(db *sql.DB) error {
-	log.Info("Migrating cache database schema: from 0 to 1")
-	if _, err := db.Exec(migrate0To1AlterMessagesTableQuery); err != nil {
+	if _, err := db.Exec(createAuditTableQuery); err != nil {
 		return err
 	}
-	if _, err := db.Exec(createSchemaVersionTableQuery); err != nil {
+	if _, err := db.Exec(createMessageTagsTableQuery); err != nil {
 		return err
 	}
-	if _, err := db.Exec(insertSchemaVersion, 1); err != nil {
+	if _, err := db.Exec(createAttachmentQuotaTableQuery); err != nil {
 		return err
 	}
-	return migrateFrom1(db)
-}
-
-func migrateFrom1(db *sql.DB) error {
-	log.Info("Migrating cache database schema: from 1 to 2")
-	if _, err := db.Exec(migrate1To2AlterMessagesTableQuery); err != nil {
+	if _, err := db.Exec(createTopicActivityTableQuery); err != nil {
 		return err
 	}
-	if _, err := db.Exec(updateSchemaVersion, 2); err != nil {
+	if _, err := db.Exec(createTopicAliasesTableQuery); err != nil {
 		return err
 	}
-	return migrateFrom2(db)
-}
-
-func migrateFrom2(db *sql.DB) error {
-	log.Info("Migrating cache database schema: from 2 to 3")
-	if _, err := db.Exec(migrate2To3AlterMessagesTableQuery); err != nil {
+	if _, err := db.Exec(createPublishSequenceTableQuery); err != nil {
 		return err
 	}
-	if _, err := db.Exec(updateSchemaVersion, 3); err != nil {
+	if _, err := db.Exec(createMessageAttachmentsTableQuery); err != nil {
 		return err
 	}
-	return migrateFrom3(db)
-}
-
-func migrateFrom3(db *sql.DB) error {
-	log.Info("Migrating cache database schema: from 3 to 4")
-	if _, err := db.Exec(migrate3To4AlterMessagesTableQuery); err != nil {
+	if _, err := db.Exec(createMessageReadTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createDeletedMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createMessageVersionsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createSchemaVersionTableQuery); err != nil {
 		return err
 	}
-	if _, err := db.Exec(updateSchemaVersion, 4); err != nil {
+	if _, err := db.Exec(insertSchemaVersion, currentSchemaVersion); err != nil {
 		return err
 	}
-	return migrateFrom4(db)
+	return nil
 }
 
-func migrateFrom4(db *sql.DB) error {
-	log.Info("Migrating cache database schema: from 4 to 5")
-	if _, err := db.Exec(migrate4To5AlterMessagesTableQuery); err != nil {
-		return err
+// migration is a single step of the schema migration from one schema version to the next. Each step is run in
+// its own transaction, together with the update of the schema version, so that a migration that is interrupted
+// resumes at exactly the step that failed. Migration queries must therefore not contain BEGIN/COMMIT.
+type migration struct {
+	from int
+	to   int
+	fn   func(tx *sql.Tx) error
+}
+
+// migrations are all schema migrations, in order. When adding a new one, also update currentSchemaVersion.
+var migrations = []*migration{
+	{0, 1, migrateFrom0},
+	{1, 2, migrateWithQuery(migrate1To2AlterMessagesTableQuery)},
+	{2, 3, migrateWithQuery(migrate2To3AlterMessagesTableQuery)},
+	{3, 4, migrateWithQuery(migrate3To4AlterMessagesTableQuery)},
+	{4, 5, migrateWithQuery(migrate4To5AlterMessagesTableQuery)},
+	{5, 6, migrateWithQuery(migrate5To6AlterMessagesTableQuery)},
+	{6, 7, migrateWithQuery(migrate6To7AlterMessagesTableQuery)},
+	{7, 8, migrateWithQuery(migrate7To8AlterMessagesTableQuery)},
+	{8, 9, migrateFrom8},
+	{9, 10, migrateWithQuery(migrate9To10AlterMessagesTableQuery)},
+	{10, 11, migrateWithQuery(migrate10To11CreateDictionariesTableQuery)},
+	{11, 12, migrateWithQuery(migrate11To12AlterMessagesTableQuery)},
+	{12, 13, migrateWithQuery(migrate12To13CreateSenderIndexQuery)},
+	{13, 14, migrateWithQuery(migrate13To14CreateTopicTimeIndexQuery)},
+	{14, 15, migrateWithQuery(migrate14To15AlterMessagesTableQuery)},
+	{15, 16, migrateWithQuery(migrate15To16CreateTopicDefaultsTableQuery)},
+	{16, 17, migrateWithQuery(migrate16To17AlterMessagesTableQuery)},
+	{17, 18, migrateWithQuery(migrate17To18AlterMessagesTableQuery)},
+	{18, 19, migrateWithQuery(migrate18To19AlterMessagesTableQuery)},
+	{19, 20, migrateWithQuery(migrate19To20CreateMessageTagsTableQuery)},
+	{20, 21, migrateWithQuery(migrate20To21AlterMessagesTableQuery)},
+	{21, 22, migrateWithQuery(migrate21To22AlterMessagesTableQuery)},
+	{22, 23, migrateWithQuery(migrate22To23AlterTopicDefaultsTableQuery)},
+	{23, 24, migrateWithQuery(migrate23To24CreateAttachmentQuotaTableQuery)},
+	{24, 25, migrateWithQuery(migrate24To25AlterMessagesTableQuery)},
+	{25, 26, migrateWithQuery(migrate25To26CreateTopicActivityTableQuery)},
+	{26, 27, migrateWithQuery(migrate26To27AlterMessagesTableQuery)},
+	{27, 28, migrateWithQuery(migrate27To28AlterMessagesTableQuery)},
+	{28, 29, migrateWithQuery(migrate28To29AlterMessagesTableQuery)},
+	{29, 30, migrateWithQuery(migrate29To30CreateTopicAliasesTableQuery)},
+	{30, 31, migrateWithQuery(migrate30To31AlterMessagesTableQuery)},
+	{31, 32, migrateWithQuery(migrate31To32CreateMessageAttachmentsTableQuery)},
+	{32, 33, migrateWithQuery(migrate32To33AlterMessagesTableQuery)},
+	{33, 34, migrateWithQuery(migrate33To34AlterMessagesTableQuery)},
+	{34, 35, migrateWithQuery(migrate34To35AlterMessagesTableQuery)},
+	{35, 36, migrateWithQuery(migrate35To36AlterMessagesTableQuery)},
+	{36, 37, migrateWithQuery(migrate36To37CreateMessageReadTableQuery)},
+	{37, 38, migrateWithQuery(migrate37To38CreateHighPriorityIndexQuery)},
+	{38, 39, migrateWithQuery(migrate38To39AlterMessagesTableQuery)},
+	{39, 40, migrateWithQuery(migrate39To40AlterMessagesTableQuery)},
+	{40, 41, migrateWithQuery(migrate40To41CreateDeletedMessagesTableQuery)},
+	{41, 42, migrateWithQuery(migrate41To42AlterTopicDefaultsTableQuery)},
+	{42, 43, migrateWithQuery(migrate42To43AlterMessagesTableQuery)},
+	{43, 44, migrateWithQuery(migrate43To44CreateAuditTableQuery)},
+	{44, 45, migrateWithQuery(migrate44To45AddDedupKeyColumnQuery)},
+	{45, 46, migrateWithQuery(migrate45To46AddIconColumnQuery)},
+	{46, 47, migrateWithQuery(migrate46To47AddAttachmentHashColumnQuery)},
+	{47, 48, migrateWithQuery(migrate47To48CreateMessageVersionsTableQuery)},
+	{48, 49, migrateWithQuery(migrate48To49AddReadCountColumnQuery)},
+	{49, 50, migrateWithQuery(migrate49To50AddEmailColumnQuery)},
+	{50, 51, migrateWithQuery(migrate50To51AddContentTypeColumnQuery)},
+}
+
+const (
+	migrationMaxAttempts = 3
+	migrationRetryDelay  = 500 * time.Millisecond
+)
+
+// migrateCacheDB runs all migrations from the given schema version to currentSchemaVersion. Failed steps are
+// retried a few times, since they may fail for transient reasons (e.g. a full disk or a locked database).
+func migrateCacheDB(db *sql.DB, schemaVersion int) error {
+	for _, m := range migrations {
+		if m.from != schemaVersion {
+			continue
+		}
+		if err := runMigrationWithRetry(db, m); err != nil {
+			return err
+		}
+		schemaVersion = m.to
+	}
+	if schemaVersion != currentSchemaVersion {
+		return fmt.Errorf("unexpected schema version found: %d", schemaVersion)
+	}
+	return nil
+}
+
+func runMigrationWithRetry(db *sql.DB, m *migration) error {
+	var err error
+	for attempt := 1; attempt <= migrationMaxAttempts; attempt++ {
+		log.Info("Migrating cache database schema: from %d to %d", m.from, m.to)
+		if err = runMigration(db, m); err == nil {
+			return nil
+		}
+		log.Warn("Migrating cache database schema from %d to %d failed (attempt %d of %d): %s", m.from, m.to, attempt, migrationMaxAttempts, err.Error())
+		if attempt < migrationMaxAttempts {
+			time.Sleep(time.Duration(attempt) * migrationRetryDelay)
+		}
 	}
-	if _, err := db.Exec(updateSchemaVersion, 5); err != nil {
+	return err
+}
+
+// runMigration runs a single migration step and updates the schema version in the same transaction
+func runMigration(db *sql.DB, m *migration) error {
+	return runInTx(db, func(tx *sql.Tx) error {
+		if err := m.fn(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec(updateSchemaVersion, m.to)
+		return err
+	})
+}
+
+// migrateWithQuery returns a migration function that executes the given query
+func migrateWithQuery(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
 		return err
 	}
-	return migrateFrom5(db)
 }
 
-func migrateFrom5(db *sql.DB) error {
-	log.Info("Migrating cache database schema: from 5 to 6")
-	if _, err := db.Exec(migrate5To6AlterMessagesTableQuery); err != nil {
+// migrateFrom0 creates the schemaVersion table; its version is set to 1 once the migration is complete
+func migrateFrom0(tx *sql.Tx) error {
+	if _, err := tx.Exec(migrate0To1AlterMessagesTableQuery); err != nil {
 		return err
 	}
-	if _, err := db.Exec(updateSchemaVersion, 6); err != nil {
+	if _, err := tx.Exec(createSchemaVersionTableQuery); err != nil {
 		return err
 	}
-	return migrateFrom6(db)
+	_, err := tx.Exec(insertSchemaVersion, 0)
+	return err
 }
 
-func migrateFrom6(db *sql.DB) error {
-	log.Info("Migrating cache database schema: from 6 to 7")
-	if _, err := db.Exec(migrate6To7AlterMessagesTableQuery); err != nil {
+// migrateFrom8 re-encodes the comma-separated tags column as a JSON array, so that
+// tags can contain commas. Unlike the other migrations, this cannot be done in pure SQL.
+func migrateFrom8(tx *sql.Tx) error {
+	rows, err := tx.Query(migrate8To9SelectTagsQuery)
+	if err != nil {
 		return err
 	}
-	if _, err := db.Exec(updateSchemaVersion, 7); err != nil {
+	defer rows.Close()
+	tagsByRowID := make(map[int64]string)
+	for rows.Next() {
+		var rowID int64
+		var tagsStr string
+		if err := rows.Scan(&rowID, &tagsStr); err != nil {
+			return err
+		}
+		tagsBytes, err := json.Marshal(strings.Split(tagsStr, ","))
+		if err != nil {
+			return err
+		}
+		tagsByRowID[rowID] = string(tagsBytes)
+	}
+	if err := rows.Err(); err != nil {
 		return err
 	}
-	return nil // Update this when a new version is added
+	rows.Close()
+	for rowID, tagsStr := range tagsByRowID {
+		if _, err := tx.Exec(migrate8To9UpdateTagsQuery, tagsStr, rowID); err != nil {
+			return err
+		}
+	}
+	return nil
 }
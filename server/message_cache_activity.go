@@ -0,0 +1,129 @@
+package server
+
+import (
+	"time"
+)
+
+// Topics that nobody reads anymore should not keep their messages as long as active topics. To identify
+// them, the time messages were last delivered to a subscriber is tracked per topic in the topic_activity
+// table, see MarkTopicDelivered. Together with the time of the newest message, this is the building block
+// for retention policies that target abandoned topics, see TopicsIdleSince.
+//
+// The opposite are hot topics, which drive the write load and may be better served by a faster backend,
+// see TopMessageTopics.
+
+const (
+	createTopicActivityTableQuery = `
+		CREATE TABLE IF NOT EXISTS topic_activity (
+			topic TEXT PRIMARY KEY,
+			last_delivered INT NOT NULL
+		);
+	`
+	upsertTopicDeliveredQuery = `
+		INSERT INTO topic_activity (topic, last_delivered) VALUES (?, ?)
+		ON CONFLICT (topic) DO UPDATE SET last_delivered = MAX(last_delivered, excluded.last_delivered)
+	`
+	selectTopicsIdleSinceQuery = `
+		SELECT topic
+		FROM messages
+		GROUP BY topic
+		HAVING MAX(time) < ? AND topic NOT IN (SELECT topic FROM topic_activity WHERE last_delivered >= ?)
+		ORDER BY topic
+	`
+	selectTopicsWithActivityQuery = `
+		SELECT topic, MAX(time)
+		FROM messages
+		WHERE published = 1
+		GROUP BY topic
+	`
+	selectTopMessageTopicsQuery = `
+		SELECT topic, COUNT(*)
+		FROM messages
+		WHERE time >= ?
+		GROUP BY topic
+		ORDER BY COUNT(*) DESC, topic
+		LIMIT ?
+	`
+)
+
+// topicCount is the number of messages of a topic, see TopMessageTopics
+type topicCount struct {
+	Topic string
+	Count int
+}
+
+// MarkTopicDelivered records that messages of the given topic were delivered to a subscriber at the given
+// time. Earlier times than the one already recorded are ignored.
+func (c *messageCache) MarkTopicDelivered(topic string, t time.Time) error {
+	_, err := c.db.Exec(upsertTopicDeliveredQuery, c.ResolveTopic(topic), t.Unix())
+	return err
+}
+
+// TopicsIdleSince returns the names of all topics that have neither received new messages nor delivered
+// messages to a subscriber since the given time, ordered by name
+func (c *messageCache) TopicsIdleSince(t time.Time) ([]string, error) {
+	rows, err := c.db.Query(selectTopicsIdleSinceQuery, t.Unix(), t.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := make([]string, 0)
+	for rows.Next() {
+		var topic string
+		if err := rows.Scan(&topic); err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// TopicsWithActivity returns the time of the newest published message of every topic that has published messages,
+// e.g. to list topics by recent activity. Unlike Topics, scheduled messages are not considered, since they would
+// make topics look active before anything was delivered.
+func (c *messageCache) TopicsWithActivity() (map[string]time.Time, error) {
+	rows, err := c.db.Query(selectTopicsWithActivityQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := make(map[string]time.Time)
+	for rows.Next() {
+		var topic string
+		var last int64
+		if err := rows.Scan(&topic, &last); err != nil {
+			return nil, err
+		}
+		topics[topic] = time.Unix(last, 0)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// TopMessageTopics returns the limit topics with the most messages since the given time, most messages first.
+// Scheduled messages are counted as well, since they add to the write load just the same. The query only
+// reads the (topic, time) index, not the messages themselves.
+func (c *messageCache) TopMessageTopics(since time.Time, limit int) ([]topicCount, error) {
+	rows, err := c.db.Query(selectTopMessageTopicsQuery, since.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make([]topicCount, 0)
+	for rows.Next() {
+		var tc topicCount
+		if err := rows.Scan(&tc.Topic, &tc.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, tc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_TopicsIdleSince(t *testing.T) {
+	testCacheTopicsIdleSince(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicsIdleSince(t *testing.T) {
+	testCacheTopicsIdleSince(t, newMemTestCache(t))
+}
+
+func testCacheTopicsIdleSince(t *testing.T, c *messageCache) {
+	now := time.Now()
+	old := now.Add(-40 * 24 * time.Hour)
+	for _, topic := range []string{"abandoned", "polled", "active"} {
+		m := newDefaultMessage(topic, "old message")
+		m.Time = old.Unix()
+		require.Nil(t, c.AddMessage(m))
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("active", "new message")))
+	require.Nil(t, c.MarkTopicDelivered("polled", now.Add(-time.Hour)))
+	require.Nil(t, c.MarkTopicDelivered("polled", old)) // Earlier times are ignored
+	require.Nil(t, c.MarkTopicDelivered("abandoned", now.Add(-35*24*time.Hour)))
+
+	topics, err := c.TopicsIdleSince(now.Add(-30 * 24 * time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, []string{"abandoned"}, topics)
+
+	topics, err = c.TopicsIdleSince(now.Add(time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, []string{"abandoned", "active", "polled"}, topics)
+
+	topics, err = c.TopicsIdleSince(old)
+	require.Nil(t, err)
+	require.Empty(t, topics)
+}
+
+func TestSqliteCache_TopicsWithActivity(t *testing.T) {
+	testCacheTopicsWithActivity(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicsWithActivity(t *testing.T) {
+	testCacheTopicsWithActivity(t, newMemTestCache(t))
+}
+
+func testCacheTopicsWithActivity(t *testing.T, c *messageCache) {
+	now := time.Now().Unix()
+	add := func(topic string, t int64) *message {
+		m := newDefaultMessage(topic, "some message")
+		m.Time = t
+		return m
+	}
+	require.Nil(t, c.AddMessages([]*message{
+		add("topic1", now-3600),
+		add("topic1", now-60),
+		add("topic1", now-7200),
+		add("topic2", now-600),
+		add("topic2", now+3600), // Scheduled
+		add("topic3", now+3600), // Scheduled
+	}))
+
+	topics, err := c.TopicsWithActivity()
+	require.Nil(t, err)
+	require.Equal(t, map[string]time.Time{
+		"topic1": time.Unix(now-60, 0),
+		"topic2": time.Unix(now-600, 0),
+	}, topics)
+
+	_, err = c.DeleteTopic("topic1")
+	require.Nil(t, err)
+	topics, err = c.TopicsWithActivity()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(topics))
+}
+
+func TestSqliteCache_TopMessageTopics(t *testing.T) {
+	testCacheTopMessageTopics(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopMessageTopics(t *testing.T) {
+	testCacheTopMessageTopics(t, newMemTestCache(t))
+}
+
+func testCacheTopMessageTopics(t *testing.T, c *messageCache) {
+	now := time.Now()
+	add := func(topic string, count int, at time.Time) {
+		for i := 0; i < count; i++ {
+			m := newDefaultMessage(topic, "message")
+			m.Time = at.Unix()
+			require.Nil(t, c.AddMessage(m))
+		}
+	}
+	add("hot", 5, now)
+	add("warm", 3, now)
+	add("lukewarm", 3, now)
+	add("cold", 1, now)
+	add("formerlyhot", 10, now.Add(-2*time.Hour))
+
+	counts, err := c.TopMessageTopics(now.Add(-time.Hour), 3)
+	require.Nil(t, err)
+	require.Equal(t, []topicCount{{"hot", 5}, {"lukewarm", 3}, {"warm", 3}}, counts)
+
+	counts, err = c.TopMessageTopics(now.Add(-3*time.Hour), 1)
+	require.Nil(t, err)
+	require.Equal(t, []topicCount{{"formerlyhot", 10}}, counts)
+
+	counts, err = c.TopMessageTopics(now.Add(time.Hour), 10)
+	require.Nil(t, err)
+	require.Empty(t, counts)
+}
+
+func TestSqliteCache_QueryPlanTopMessageTopics(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Contains(t, queryPlan(t, c, selectTopMessageTopicsQuery, 0, 10), "USING COVERING INDEX idx_topic_time")
+}
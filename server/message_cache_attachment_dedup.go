@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// Identical attachments (e.g. the same alert screenshot sent over and over) do not have to be stored more than
+// once. The upload layer sets attachment.Hash to a hash of the content (e.g. the hex-encoded SHA-256) before adding
+// the message, which is stored in the attachment_hash column. Before storing a new upload, it can look up an
+// existing attachment with the same hash using AttachmentByHash, and point the new message at the existing file
+// (same URL) instead of storing it again. Rows from before schema version 47 have an empty hash, and are never
+// returned by the lookup.
+//
+// A shared file is owned by every sender that has a message referencing it, and it must be kept as long as any of
+// these messages references it. Files are deleted via AttachmentsExpired, i.e. when the attachment of the message
+// that stored it expires, so a message reusing a file must not outlive it: AttachmentByHash returns the expiry
+// of the existing attachment, which the new message should use as is. For quotas, each owner is charged for a
+// shared file once (see AttachmentBytesUsedDeduplicated), no matter how many of their messages reference it, and
+// no matter whether other owners are charged for it as well. Charging only the first owner would let others keep
+// a file alive for free, and would shift the cost to the first owner's quota.
+
+const (
+	selectAttachmentByHashQuery = `
+		SELECT attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_hash
+		FROM messages
+		WHERE attachment_hash = ? AND attachment_deleted = 0 AND (attachment_expires = 0 OR attachment_expires > ?)
+		ORDER BY attachment_expires DESC, id DESC
+		LIMIT 1
+	`
+	selectAttachmentBytesUsedDeduplicatedQuery = `
+		SELECT IFNULL(SUM(size), 0)
+		FROM (
+			SELECT MAX(attachment_size) AS size
+			FROM messages
+			WHERE sender = ? AND attachment_size > 0 AND attachment_expires >= ?
+			GROUP BY CASE WHEN attachment_hash = '' THEN 'id:' || id ELSE attachment_hash END
+		)
+	`
+)
+
+// AttachmentByHash returns a non-expired attachment with the given content hash, see attachment.Hash. If more
+// than one message has such an attachment, the one that expires last is returned. It returns errAttachmentNotFound
+// if there is no such attachment, or if the hash is empty.
+func (c *messageCache) AttachmentByHash(hash string) (*attachment, error) {
+	if hash == "" {
+		return nil, errAttachmentNotFound
+	}
+	rows, err := c.db.Query(selectAttachmentByHashQuery, hash, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, errAttachmentNotFound
+	}
+	a := &attachment{}
+	if err := rows.Scan(&a.Name, &a.Type, &a.Size, &a.Expires, &a.URL, &a.Hash); err != nil {
+		return nil, err
+	} else if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// AttachmentBytesUsedDeduplicated is like AttachmentBytesUsed, but counts attachments with the same content hash
+// only once, so that a sender is not charged again for re-sending a file that is already stored. Attachments
+// without a hash are counted individually. Unlike AttachmentBytesUsed, the value is always computed from the
+// messages table, since the attachment_quota table cannot track shared files.
+func (c *messageCache) AttachmentBytesUsedDeduplicated(sender string) (int64, error) {
+	rows, err := c.db.Query(selectAttachmentBytesUsedDeduplicatedQuery, c.ownerKey(sender), time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	var bytes int64
+	if err := rows.Scan(&bytes); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return bytes, nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqliteCache_AttachmentByHash(t *testing.T) {
+	testCacheAttachmentByHash(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AttachmentByHash(t *testing.T) {
+	testCacheAttachmentByHash(t, newMemTestCache(t))
+}
+
+func testCacheAttachmentByHash(t *testing.T, c *messageCache) {
+	expires := time.Now().Add(time.Hour).Unix()
+	m1 := newDefaultMessage("mytopic", "screenshot")
+	m1.Attachment = &attachment{Name: "screen.png", Type: "image/png", Size: 5000, Expires: expires, URL: "https://ntfy.sh/file/" + m1.ID + ".png", Hash: "abc123"}
+	m2 := newDefaultMessage("mytopic", "old row without hash")
+	m2.Attachment = &attachment{Name: "other.png", Size: 1000, Expires: expires, URL: "https://ntfy.sh/file/" + m2.ID + ".png"}
+	m3 := newDefaultMessage("mytopic", "expired")
+	m3.Attachment = &attachment{Name: "expired.png", Size: 1000, Expires: time.Now().Add(-time.Hour).Unix(), URL: "https://ntfy.sh/file/" + m3.ID + ".png", Hash: "expired"}
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+
+	a, err := c.AttachmentByHash("abc123")
+	require.Nil(t, err)
+	require.Equal(t, *m1.Attachment, *a)
+
+	// A new message reusing the existing file
+	m4 := newDefaultMessage("othertopic", "same screenshot")
+	m4.Attachment = a
+	require.Nil(t, c.AddMessage(m4))
+	messages, err := c.Messages("othertopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, m1.Attachment.URL, messages[0].Attachment.URL)
+
+	_, err = c.AttachmentByHash("")
+	require.Equal(t, errAttachmentNotFound, err)
+	_, err = c.AttachmentByHash("expired")
+	require.Equal(t, errAttachmentNotFound, err)
+	_, err = c.AttachmentByHash("doesnotexist")
+	require.Equal(t, errAttachmentNotFound, err)
+
+	// The hash is not sent to subscribers
+	b, err := json.Marshal(messages[0])
+	require.Nil(t, err)
+	require.NotContains(t, string(b), "abc123")
+}
+
+func TestSqliteCache_AttachmentBytesUsedDeduplicated(t *testing.T) {
+	testCacheAttachmentBytesUsedDeduplicated(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AttachmentBytesUsedDeduplicated(t *testing.T) {
+	testCacheAttachmentBytesUsedDeduplicated(t, newMemTestCache(t))
+}
+
+func testCacheAttachmentBytesUsedDeduplicated(t *testing.T, c *messageCache) {
+	expires := time.Now().Add(time.Hour).Unix()
+	add := func(sender string, size int64, hash string) {
+		m := newDefaultMessage("mytopic", "file")
+		m.Sender = sender
+		m.Attachment = &attachment{Name: "file.png", Size: size, Expires: expires, URL: "https://ntfy.sh/file/" + m.ID, Hash: hash}
+		require.Nil(t, c.AddMessage(m))
+	}
+	add("1.2.3.4", 5000, "abc123")
+	add("1.2.3.4", 5000, "abc123")
+	add("1.2.3.4", 2000, "def456")
+	add("1.2.3.4", 1000, "") // Counted individually
+	add("1.2.3.4", 1000, "")
+	add("5.6.7.8", 5000, "abc123") // Shared file, charged to both owners
+
+	used, err := c.AttachmentBytesUsedDeduplicated("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(9000), used)
+	used, err = c.AttachmentBytesUsed("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(14000), used)
+	used, err = c.AttachmentBytesUsedDeduplicated("5.6.7.8")
+	require.Nil(t, err)
+	require.Equal(t, int64(5000), used)
+	used, err = c.AttachmentBytesUsedDeduplicated("9.9.9.9")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), used)
+}
+
+func TestSqliteCache_AttachmentHash_Export(t *testing.T) {
+	c, imported := newSqliteTestCache(t), newSqliteTestCache(t)
+	m := newDefaultMessage("mytopic", "screenshot")
+	m.Attachment = &attachment{Name: "screen.png", Size: 5000, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://ntfy.sh/file/" + m.ID + ".png", Hash: "abc123"}
+	require.Nil(t, c.AddMessage(m))
+
+	var exported bytes.Buffer
+	require.Nil(t, c.ExportTopic("mytopic", &exported))
+	_, err := imported.ImportMessages(&exported)
+	require.Nil(t, err)
+	a, err := imported.AttachmentByHash("abc123")
+	require.Nil(t, err)
+	require.Equal(t, m.Attachment.URL, a.URL)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The attachment bytes used per sender are checked on every upload. Instead of summing up the attachment
+// sizes of all messages of the sender every time, they are kept in the attachment_quota table, which is
+// maintained by triggers in the same transaction as every insert, update and delete of a message.
+//
+// Attachments expire over time, which triggers cannot track. That is why each row also stores the earliest
+// expiry time of the attachments it counts: Once that has passed, the row is recomputed on the next read.
+
+const (
+	createAttachmentQuotaTableQuery = `
+		CREATE TABLE IF NOT EXISTS attachment_quota (
+			sender TEXT PRIMARY KEY,
+			bytes INT NOT NULL,
+			expires INT NOT NULL
+		);
+		CREATE TRIGGER IF NOT EXISTS attachment_quota_insert AFTER INSERT ON messages
+		WHEN new.attachment_size > 0 AND new.attachment_expires >= CAST(strftime('%s', 'now') AS INT)
+		BEGIN
+			INSERT INTO attachment_quota (sender, bytes, expires) VALUES (new.sender, new.attachment_size, new.attachment_expires)
+			ON CONFLICT (sender) DO UPDATE SET bytes = bytes + excluded.bytes, expires = MIN(expires, excluded.expires);
+		END;
+		CREATE TRIGGER IF NOT EXISTS attachment_quota_delete AFTER DELETE ON messages
+		WHEN old.attachment_size > 0 AND old.attachment_expires >= CAST(strftime('%s', 'now') AS INT)
+		BEGIN
+			UPDATE attachment_quota SET bytes = bytes - old.attachment_size WHERE sender = old.sender;
+		END;
+		CREATE TRIGGER IF NOT EXISTS attachment_quota_update AFTER UPDATE OF sender, attachment_size, attachment_expires ON messages
+		BEGIN
+			UPDATE attachment_quota SET bytes = bytes - old.attachment_size
+			WHERE sender = old.sender AND old.attachment_size > 0 AND old.attachment_expires >= CAST(strftime('%s', 'now') AS INT);
+			INSERT INTO attachment_quota (sender, bytes, expires)
+			SELECT new.sender, new.attachment_size, new.attachment_expires
+			WHERE new.attachment_size > 0 AND new.attachment_expires >= CAST(strftime('%s', 'now') AS INT)
+			ON CONFLICT (sender) DO UPDATE SET bytes = bytes + excluded.bytes, expires = MIN(expires, excluded.expires);
+		END;
+	`
+	selectAttachmentQuotaQuery = `SELECT bytes, expires FROM attachment_quota WHERE sender = ?`
+	deleteAttachmentQuotaQuery = `DELETE FROM attachment_quota WHERE sender = ?`
+	insertAttachmentQuotaQuery = `
+		INSERT INTO attachment_quota (sender, bytes, expires)
+		SELECT sender, SUM(attachment_size), MIN(attachment_expires)
+		FROM messages
+		WHERE sender = ? AND attachment_size > 0 AND attachment_expires >= ?
+		GROUP BY sender
+	`
+	selectAttachmentsCountQuery       = `SELECT COUNT(*) FROM messages WHERE sender = ? AND attachment_size > 0 AND attachment_expires >= ?`
+	selectExpiredAttachmentBytesQuery = `
+		SELECT sender, SUM(attachment_size)
+		FROM messages
+		WHERE attachment_expires > 0 AND attachment_expires < ? AND attachment_deleted = 0
+		GROUP BY sender
+	`
+	updateAttachmentsDeletedQuery = `UPDATE messages SET attachment_deleted = 1 WHERE attachment_expires > 0 AND attachment_expires < ? AND attachment_deleted = 0`
+)
+
+// AttachmentBytesUsed returns the total size (in bytes) of all non-expired attachments of the given sender.
+// The value is read from the attachment_quota table, and only recomputed if one of the attachments expired.
+func (c *messageCache) AttachmentBytesUsed(sender string) (int64, error) {
+	sender = c.ownerKey(sender)
+	bytes, expires, err := c.attachmentQuota(sender)
+	if err != nil {
+		return 0, err
+	} else if expires > 0 && expires < time.Now().Unix() {
+		if err := c.recomputeAttachmentQuota(sender); err != nil {
+			return 0, err
+		}
+		bytes, _, err = c.attachmentQuota(sender)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return bytes, nil
+}
+
+// AttachmentsCount returns the number of non-expired attachments of the given owner (sender), e.g. for quotas that
+// limit the number of files rather than bytes. It uses the same filter as AttachmentBytesUsed (including the
+// expiry boundary), so that an attachment either counts towards both quotas or towards neither.
+func (c *messageCache) AttachmentsCount(owner string) (int, error) {
+	rows, err := c.db.Query(selectAttachmentsCountQuery, c.ownerKey(owner), time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	var count int
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// RecomputeAttachmentQuota recomputes the cached attachment bytes used by the given sender from the
+// messages table. This is done automatically when attachments expire, but may also be used to fix drift,
+// e.g. after the database was modified with triggers disabled.
+func (c *messageCache) RecomputeAttachmentQuota(sender string) error {
+	return c.recomputeAttachmentQuota(c.ownerKey(sender))
+}
+
+// recomputeAttachmentQuota is like RecomputeAttachmentQuota, but expects the sender as stored in the database
+func (c *messageCache) recomputeAttachmentQuota(sender string) error {
+	return c.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(deleteAttachmentQuotaQuery, sender); err != nil {
+			return err
+		}
+		_, err := tx.Exec(insertAttachmentQuotaQuery, sender, time.Now().Unix())
+		return err
+	})
+}
+
+// ExpireAttachments marks all attachments that expired before now as deleted, and returns the number of bytes
+// freed per sender (as stored in the database, see messageCacheOptions.OwnerHasher). The attachment quota of these senders is recomputed in the same transaction, so that it is
+// consistent with the marked attachments. Attachments marked as deleted are no longer returned by
+// AttachmentsExpired, so the attachment files should be removed before calling this.
+func (c *messageCache) ExpireAttachments(now time.Time) (map[string]int64, error) {
+	freed := make(map[string]int64)
+	err := c.withTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(selectExpiredAttachmentBytesQuery, now.Unix())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var sender string
+			var bytes int64
+			if err := rows.Scan(&sender, &bytes); err != nil {
+				return err
+			}
+			freed[sender] = bytes
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		if _, err := tx.Exec(updateAttachmentsDeletedQuery, now.Unix()); err != nil {
+			return err
+		}
+		for sender := range freed {
+			if _, err := tx.Exec(deleteAttachmentQuotaQuery, sender); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(insertAttachmentQuotaQuery, sender, now.Unix()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return freed, nil
+}
+
+func (c *messageCache) attachmentQuota(sender string) (bytes int64, expires int64, err error) {
+	rows, err := c.db.Query(selectAttachmentQuotaQuery, sender)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, 0, nil
+	}
+	if err := rows.Scan(&bytes, &expires); err != nil {
+		return 0, 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	return bytes, expires, nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqliteCache_AttachmentQuota(t *testing.T) {
+	testCacheAttachmentQuota(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AttachmentQuota(t *testing.T) {
+	testCacheAttachmentQuota(t, newMemTestCache(t))
+}
+
+func testCacheAttachmentQuota(t *testing.T, c *messageCache) {
+	expires := time.Now().Add(time.Hour).Unix()
+	add := func(topic, sender string, size int64, expires int64, collapseKey string) *message {
+		m := newDefaultMessage(topic, "file")
+		m.Sender = sender
+		m.CollapseKey = collapseKey
+		m.Attachment = &attachment{Name: "file.txt", Size: size, Expires: expires, URL: "https://ntfy.sh/file/" + m.ID}
+		require.Nil(t, c.AddMessage(m))
+		return m
+	}
+	requireQuotaMatches := func(sender string, expected int64) {
+		cached, err := c.AttachmentBytesUsed(sender)
+		require.Nil(t, err)
+		require.Equal(t, expected, cached)
+		require.Equal(t, queryAttachmentBytesSum(t, c, sender), cached)
+	}
+
+	// Inserts
+	add("topic1", "1.2.3.4", 1000, expires, "")
+	m2 := add("topic1", "1.2.3.4", 2000, expires, "")
+	add("topic2", "1.2.3.4", 3000, expires, "")
+	add("topic2", "9.9.9.9", 500, expires, "")
+	add("topic2", "1.2.3.4", 7000, time.Now().Add(-time.Hour).Unix(), "") // Already expired
+	requireQuotaMatches("1.2.3.4", 6000)
+	requireQuotaMatches("9.9.9.9", 500)
+	requireQuotaMatches("5.5.5.5", 0)
+
+	// Collapse key replaces a message
+	add("topic1", "9.9.9.9", 100, expires, "status")
+	add("topic1", "9.9.9.9", 200, expires, "status")
+	requireQuotaMatches("9.9.9.9", 700)
+
+	// Clearing and reassigning attachments
+	_, err := c.db.Exec(`UPDATE messages SET attachment_size = 0, attachment_expires = 0 WHERE mid = ?`, m2.ID)
+	require.Nil(t, err)
+	requireQuotaMatches("1.2.3.4", 4000)
+	_, err = c.db.Exec(`UPDATE messages SET sender = '9.9.9.9' WHERE topic = 'topic2' AND sender = '1.2.3.4'`)
+	require.Nil(t, err)
+	requireQuotaMatches("1.2.3.4", 1000)
+	requireQuotaMatches("9.9.9.9", 3700)
+
+	// Deleting messages
+	_, err = c.DeleteTopic("topic2")
+	require.Nil(t, err)
+	requireQuotaMatches("1.2.3.4", 1000)
+	requireQuotaMatches("9.9.9.9", 200)
+
+	// Expiring attachments
+	_, err = c.db.Exec(`UPDATE messages SET attachment_expires = ? WHERE sender = '9.9.9.9'`, time.Now().Add(-time.Minute).Unix())
+	require.Nil(t, err)
+	requireQuotaMatches("9.9.9.9", 0)
+}
+
+func TestSqliteCache_AttachmentQuotaExpiry(t *testing.T) {
+	c := newSqliteTestCache(t)
+	m := newDefaultMessage("mytopic", "file")
+	m.Sender = "1.2.3.4"
+	m.Attachment = &attachment{Name: "file.txt", Size: 1000, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://ntfy.sh/file/abc"}
+	require.Nil(t, c.AddMessage(m))
+
+	// Simulate the attachment expiring without a change to the row, and drift in the cached value
+	_, err := c.db.Exec(`UPDATE attachment_quota SET expires = ?, bytes = 12345`, time.Now().Add(-time.Minute).Unix())
+	require.Nil(t, err)
+	used, err := c.AttachmentBytesUsed("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(1000), used) // Recomputed, since the attachment is still valid
+
+	_, err = c.db.Exec(`UPDATE attachment_quota SET bytes = 12345`)
+	require.Nil(t, err)
+	require.Nil(t, c.RecomputeAttachmentQuota("1.2.3.4"))
+	used, err = c.AttachmentBytesUsed("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(1000), used)
+}
+
+func TestSqliteCache_AttachmentsCount(t *testing.T) {
+	testCacheAttachmentsCount(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AttachmentsCount(t *testing.T) {
+	testCacheAttachmentsCount(t, newMemTestCache(t))
+}
+
+func testCacheAttachmentsCount(t *testing.T, c *messageCache) {
+	add := func(sender string, size int64, expires time.Time) *message {
+		m := newDefaultMessage("mytopic", "file")
+		m.Sender = sender
+		m.Attachment = &attachment{Name: "file.txt", Size: size, Expires: expires.Unix(), URL: "https://ntfy.sh/file/" + m.ID}
+		require.Nil(t, c.AddMessage(m))
+		return m
+	}
+	add("1.2.3.4", 1000, time.Now().Add(time.Hour))
+	m := add("1.2.3.4", 2000, time.Now().Add(time.Hour))
+	add("1.2.3.4", 3000, time.Now().Add(-time.Minute)) // Already expired
+	add("9.9.9.9", 500, time.Now().Add(time.Hour))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "no attachment")))
+
+	requireCountMatches := func(sender string, expectedCount int, expectedBytes int64) {
+		count, err := c.AttachmentsCount(sender)
+		require.Nil(t, err)
+		require.Equal(t, expectedCount, count)
+		used, err := c.AttachmentBytesUsed(sender)
+		require.Nil(t, err)
+		require.Equal(t, expectedBytes, used)
+	}
+	requireCountMatches("1.2.3.4", 2, 3000)
+	requireCountMatches("9.9.9.9", 1, 500)
+	requireCountMatches("5.5.5.5", 0, 0)
+
+	// Counts and bytes expire together
+	_, err := c.db.Exec(`UPDATE messages SET attachment_expires = ? WHERE mid = ?`, time.Now().Add(-time.Second).Unix(), m.ID)
+	require.Nil(t, err)
+	requireCountMatches("1.2.3.4", 1, 1000)
+}
+
+func queryAttachmentBytesSum(t *testing.T, c *messageCache, sender string) int64 {
+	var sum int64
+	query := `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE sender = ? AND attachment_expires >= ?`
+	require.Nil(t, c.db.QueryRow(query, sender, time.Now().Unix()).Scan(&sum))
+	return sum
+}
+
+func TestSqliteCache_ExpireAttachments(t *testing.T) {
+	testCacheExpireAttachments(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ExpireAttachments(t *testing.T) {
+	testCacheExpireAttachments(t, newMemTestCache(t))
+}
+
+func testCacheExpireAttachments(t *testing.T, c *messageCache) {
+	now := time.Now()
+	add := func(sender string, size int64, expires time.Time) {
+		m := newDefaultMessage("mytopic", "file")
+		m.Sender = sender
+		m.Attachment = &attachment{Name: "file.txt", Size: size, Expires: expires.Unix(), URL: "https://ntfy.sh/file/" + m.ID}
+		require.Nil(t, c.AddMessage(m))
+	}
+	add("1.2.3.4", 1000, now.Add(time.Hour))
+	add("1.2.3.4", 2000, now.Add(2*time.Hour))
+	add("1.2.3.4", 3000, now.Add(3*time.Hour))
+	add("9.9.9.9", 500, now.Add(2*time.Hour))
+	add("5.5.5.5", 700, now.Add(5*time.Hour))
+
+	// Sweep as if it was 2.5 hours later
+	later := now.Add(150 * time.Minute)
+	freed, err := c.ExpireAttachments(later)
+	require.Nil(t, err)
+	require.Equal(t, map[string]int64{"1.2.3.4": 3000, "9.9.9.9": 500}, freed)
+
+	var bytes int64
+	require.Nil(t, c.db.QueryRow(`SELECT bytes FROM attachment_quota WHERE sender = '1.2.3.4'`).Scan(&bytes))
+	require.Equal(t, int64(3000), bytes)
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM attachment_quota WHERE sender = '9.9.9.9'`).Scan(&bytes))
+	require.Equal(t, int64(0), bytes)
+
+	// Attachments are only swept once
+	freed, err = c.ExpireAttachments(later)
+	require.Nil(t, err)
+	require.Empty(t, freed)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"database/sql"
+)
+
+// Attachment files are stored outside of the cache, so the attachment metadata of a message can outlive its
+// file, e.g. if files were deleted by hand. Such attachments still count towards the attachment quota of their
+// owner. To reconcile the cache with the file store, list the attachments of an owner with AttachmentsAll, check
+// which files are gone, and call ClearAttachment for their messages. The attachment quota (see
+// AttachmentBytesUsed) is updated by the attachment_quota triggers as the attachment columns are cleared.
+
+const (
+	selectAttachmentsForOwnerQuery = `
+		SELECT a.mid, a.url, a.size, a.expires
+		FROM message_attachments a
+		JOIN messages m ON m.id = a.message_id
+		WHERE a.owner = ? AND m.attachment_deleted = 0
+		ORDER BY a.id
+	`
+	updateClearAttachmentQuery = `
+		UPDATE messages
+		SET attachment_name = '', attachment_type = '', attachment_size = 0, attachment_expires = 0, attachment_url = '', attachment_hash = '', bytes = bytes - attachment_size
+		WHERE mid = ?
+	`
+	deleteMessageAttachmentsByMidQuery = `DELETE FROM message_attachments WHERE mid = ?`
+)
+
+// AttachmentsAll returns all attachments of the given owner (sender), including expired attachments whose files
+// were not deleted yet (see ExpireAttachments), in the order in which they were added. Messages with more than
+// one attachment have one entry per attachment.
+func (c *messageCache) AttachmentsAll(owner string) ([]attachmentRef, error) {
+	rows, err := c.db.Query(selectAttachmentsForOwnerQuery, c.ownerKey(owner))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	refs := make([]attachmentRef, 0)
+	for rows.Next() {
+		var r attachmentRef
+		if err := rows.Scan(&r.ID, &r.URL, &r.Size, &r.Expires); err != nil {
+			return nil, err
+		}
+		refs = append(refs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// ClearAttachment removes all attachments from the message with the given ID, e.g. because their files no
+// longer exist, but keeps the message itself. The freed bytes no longer count towards the attachment quota of
+// the owner. If messages with the ID exist in more than one topic (see MessageByID), the attachments of all of
+// them are removed. It returns errMessageNotFound if there is no message with the ID.
+func (c *messageCache) ClearAttachment(id string) error {
+	return c.retryBusy(func() error {
+		return c.withTx(func(tx *sql.Tx) error {
+			res, err := tx.Exec(updateClearAttachmentQuery, id)
+			if err != nil {
+				return err
+			}
+			if updated, err := res.RowsAffected(); err != nil {
+				return err
+			} else if updated == 0 {
+				return errMessageNotFound
+			}
+			_, err = tx.Exec(deleteMessageAttachmentsByMidQuery, id)
+			return err
+		})
+	})
+}
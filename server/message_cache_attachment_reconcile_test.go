@@ -0,0 +1,73 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqliteCache_AttachmentsReconcile(t *testing.T) {
+	testCacheAttachmentsReconcile(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AttachmentsReconcile(t *testing.T) {
+	testCacheAttachmentsReconcile(t, newMemTestCache(t))
+}
+
+func testCacheAttachmentsReconcile(t *testing.T, c *messageCache) {
+	expires := time.Now().Add(time.Hour).Unix()
+	m1 := newDefaultMessage("mytopic", "file is gone")
+	m1.Sender = "1.2.3.4"
+	m1.Attachment = &attachment{Name: "gone.png", Type: "image/png", Size: 5000, Expires: expires, URL: "https://ntfy.sh/file/gone.png", Hash: "abc123"}
+	m2 := newDefaultMessage("mytopic", "bundle")
+	m2.Sender = "1.2.3.4"
+	m2.Attachments = []*attachment{
+		{Name: "a.log", Size: 1000, Expires: expires, URL: "https://ntfy.sh/file/a.log"},
+		{Name: "b.log", Size: 2000, Expires: expires, URL: "https://ntfy.sh/file/b.log"},
+	}
+	m3 := newDefaultMessage("mytopic", "other owner")
+	m3.Sender = "5.6.7.8"
+	m3.Attachment = &attachment{Name: "other.png", Size: 3000, Expires: expires, URL: "https://ntfy.sh/file/other.png"}
+	m4 := newDefaultMessage("mytopic", "no attachment")
+	m4.Sender = "1.2.3.4"
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4}))
+
+	refs, err := c.AttachmentsAll("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, []attachmentRef{
+		{ID: m1.ID, URL: "https://ntfy.sh/file/gone.png", Size: 5000, Expires: expires},
+		{ID: m2.ID, URL: "https://ntfy.sh/file/a.log", Size: 1000, Expires: expires},
+		{ID: m2.ID, URL: "https://ntfy.sh/file/b.log", Size: 2000, Expires: expires},
+	}, refs)
+	used, err := c.AttachmentBytesUsed("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(6000), used) // Only the first attachment of a message counts, see attachment_quota
+
+	// Clearing keeps the message, but removes its attachment from the quota
+	require.Nil(t, c.ClearAttachment(m1.ID))
+	message, err := c.Message("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, "file is gone", message.Message)
+	require.Nil(t, message.Attachment)
+	used, err = c.AttachmentBytesUsed("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(1000), used)
+	refs, err = c.AttachmentsAll("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(refs))
+	_, err = c.AttachmentByHash("abc123")
+	require.Equal(t, errAttachmentNotFound, err)
+
+	// Clearing again, or a message without attachment, does nothing
+	require.Nil(t, c.ClearAttachment(m1.ID))
+	require.Nil(t, c.ClearAttachment(m4.ID))
+	used, err = c.AttachmentBytesUsed("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(1000), used)
+	require.Equal(t, errMessageNotFound, c.ClearAttachment("doesnotexist"))
+
+	used, err = c.AttachmentBytesUsed("5.6.7.8")
+	require.Nil(t, err)
+	require.Equal(t, int64(3000), used)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// A message can have more than one attachment, e.g. a bundle of log files. All attachments of a message are
+// stored in the normalized message_attachments table, with one row per attachment; rows are removed along with
+// their message (ON DELETE CASCADE). For compatibility with existing clients and queries, the first attachment
+// is also stored in the attachment_* columns of the messages table, and returned as message.Attachment.
+
+const (
+	createMessageAttachmentsTableQuery = `
+		CREATE TABLE IF NOT EXISTS message_attachments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			mid TEXT NOT NULL,
+			name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			size INT NOT NULL,
+			expires INT NOT NULL,
+			url TEXT NOT NULL,
+			owner TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_attachments_message_id ON message_attachments (message_id);
+		CREATE INDEX IF NOT EXISTS idx_message_attachments_mid ON message_attachments (mid);
+		CREATE INDEX IF NOT EXISTS idx_message_attachments_expires ON message_attachments (expires);
+	`
+	insertMessageAttachmentQuery = `
+		INSERT INTO message_attachments (message_id, mid, name, type, size, expires, url, owner)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	selectMessageAttachmentsQuery = `
+		SELECT mid, name, type, size, expires, url
+		FROM message_attachments
+		WHERE mid IN (%s)
+		ORDER BY id
+	`
+)
+
+const readAttachmentsBatchSize = 500
+
+// messageAttachments returns all attachments of a message: message.Attachments if set, otherwise the single
+// message.Attachment, if any
+func messageAttachments(m *message) []*attachment {
+	if len(m.Attachments) > 0 {
+		return m.Attachments
+	} else if m.Attachment != nil {
+		return []*attachment{m.Attachment}
+	}
+	return nil
+}
+
+// insertMessageAttachments stores the attachments of the message with the given row ID and message ID within the
+// given transaction. The owner is stored as is, see messageCache.ownerKey.
+func insertMessageAttachments(tx *sql.Tx, rowID int64, id, owner string, attachments []*attachment) error {
+	for _, a := range attachments {
+		if _, err := tx.Exec(insertMessageAttachmentQuery, rowID, id, a.Name, a.Type, a.Size, a.Expires, a.URL, owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMessageAttachments sets message.Attachments for all given messages that have an attachment, reading them
+// through q (see readMessages). Only messages with an attachment in the messages table can have rows in
+// message_attachments, so other messages do not cause a lookup. Attachments are read in batches to stay below
+// SQLite's limit of query parameters.
+func (c *messageCache) readMessageAttachments(q queryer, messages []*message) error {
+	byID := make(map[string]*message)
+	ids := make([]interface{}, 0)
+	for _, m := range messages {
+		if m.Attachment != nil {
+			byID[m.ID] = m
+			ids = append(ids, m.ID)
+		}
+	}
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > readAttachmentsBatchSize {
+			n = readAttachmentsBatchSize
+		}
+		if err := c.readMessageAttachmentsBatch(q, byID, ids[:n]); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+func (c *messageCache) readMessageAttachmentsBatch(q queryer, byID map[string]*message, ids []interface{}) error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	rows, err := q.Query(fmt.Sprintf(selectMessageAttachmentsQuery, placeholders), ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		a := &attachment{}
+		if err := rows.Scan(&id, &a.Name, &a.Type, &a.Size, &a.Expires, &a.URL); err != nil {
+			return err
+		}
+		if m, ok := byID[id]; ok {
+			m.Attachments = append(m.Attachments, a)
+		}
+	}
+	return rows.Err()
+}
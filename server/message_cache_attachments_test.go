@@ -0,0 +1,146 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_MultipleAttachments(t *testing.T) {
+	testCacheMultipleAttachments(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MultipleAttachments(t *testing.T) {
+	testCacheMultipleAttachments(t, newMemTestCache(t))
+}
+
+func testCacheMultipleAttachments(t *testing.T, c *messageCache) {
+	expires := time.Now().Add(time.Hour).Unix()
+	m1 := newDefaultMessage("mytopic", "log bundle")
+	m1.Sender = "1.2.3.4"
+	m1.Attachments = []*attachment{
+		{Name: "app.log", Type: "text/plain", Size: 1000, Expires: expires, URL: "https://ntfy.sh/file/app.log"},
+		{Name: "db.log", Type: "text/plain", Size: 2000, Expires: expires, URL: "https://ntfy.sh/file/db.log"},
+	}
+	m2 := newDefaultMessage("mytopic", "single attachment")
+	m2.Attachment = &attachment{Name: "image.png", Type: "image/png", Size: 500, Expires: expires, URL: "https://ntfy.sh/file/image.png"}
+	m3 := newDefaultMessage("mytopic", "no attachment")
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "app.log", messages[0].Attachment.Name) // First attachment, for older clients
+	require.Equal(t, 2, len(messages[0].Attachments))
+	require.Equal(t, "app.log", messages[0].Attachments[0].Name)
+	require.Equal(t, "db.log", messages[0].Attachments[1].Name)
+	require.Equal(t, int64(2000), messages[0].Attachments[1].Size)
+	require.Equal(t, "https://ntfy.sh/file/db.log", messages[0].Attachments[1].URL)
+	require.Equal(t, 1, len(messages[1].Attachments))
+	require.Equal(t, "image.png", messages[1].Attachments[0].Name)
+	require.Nil(t, messages[2].Attachment)
+	require.Nil(t, messages[2].Attachments)
+
+	size, err := c.AttachmentsSizeTotal()
+	require.Nil(t, err)
+	require.Equal(t, int64(3500), size)
+
+	// Attachment rows are deleted along with their message
+	_, err = c.DeleteTopic("mytopic")
+	require.Nil(t, err)
+	var count int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM message_attachments`).Scan(&count))
+	require.Equal(t, 0, count)
+}
+
+func TestSqliteCache_MultipleAttachmentsExpired(t *testing.T) {
+	testCacheMultipleAttachmentsExpired(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MultipleAttachmentsExpired(t *testing.T) {
+	testCacheMultipleAttachmentsExpired(t, newMemTestCache(t))
+}
+
+func testCacheMultipleAttachmentsExpired(t *testing.T, c *messageCache) {
+	m := newDefaultMessage("mytopic", "one of two attachments expired")
+	m.Attachments = []*attachment{
+		{Name: "current.log", Size: 1000, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://ntfy.sh/file/current.log"},
+		{Name: "old.log", Size: 2000, Expires: time.Now().Add(-time.Hour).Unix(), URL: "https://ntfy.sh/file/old.log"},
+	}
+	require.Nil(t, c.AddMessage(m))
+
+	ids, err := c.AttachmentsExpired()
+	require.Nil(t, err)
+	require.Equal(t, []string{m.ID}, ids)
+
+	size, err := c.AttachmentsSizeTotal()
+	require.Nil(t, err)
+	require.Equal(t, int64(1000), size)
+}
+
+func TestSqliteCache_AttachmentsExpiredDetails(t *testing.T) {
+	testCacheAttachmentsExpiredDetails(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AttachmentsExpiredDetails(t *testing.T) {
+	testCacheAttachmentsExpiredDetails(t, newMemTestCache(t))
+}
+
+func testCacheAttachmentsExpiredDetails(t *testing.T, c *messageCache) {
+	expired := time.Now().Add(-time.Hour).Unix()
+	m1 := newDefaultMessage("mytopic", "two expired attachments")
+	m1.Sender = "1.2.3.4"
+	m1.Attachments = []*attachment{
+		{Name: "a.log", Size: 1000, Expires: expired, URL: "https://ntfy.sh/file/a.log"},
+		{Name: "b.log", Size: 2000, Expires: expired, URL: "https://ntfy.sh/file/b.log"},
+	}
+	m2 := newDefaultMessage("mytopic", "one expired attachment")
+	m2.Sender = "5.6.7.8"
+	m2.Attachment = &attachment{Name: "c.log", Size: 3000, Expires: expired, URL: "https://ntfy.sh/file/c.log"}
+	m3 := newDefaultMessage("mytopic", "not expired")
+	m3.Sender = "5.6.7.8"
+	m3.Attachment = &attachment{Name: "d.log", Size: 4000, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://ntfy.sh/file/d.log"}
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+
+	details, err := c.AttachmentsExpiredDetails()
+	require.Nil(t, err)
+	require.Equal(t, []attachmentExpiry{
+		{ID: m1.ID, Owner: "1.2.3.4", Size: 1000},
+		{ID: m1.ID, Owner: "1.2.3.4", Size: 2000},
+		{ID: m2.ID, Owner: "5.6.7.8", Size: 3000},
+	}, details)
+
+	ids, err := c.AttachmentsExpired()
+	require.Nil(t, err)
+	require.Equal(t, []string{m1.ID, m2.ID}, ids)
+
+	// Attachments marked as deleted are no longer returned
+	_, err = c.ExpireAttachments(time.Now())
+	require.Nil(t, err)
+	details, err = c.AttachmentsExpiredDetails()
+	require.Nil(t, err)
+	require.Empty(t, details)
+}
+
+func TestSqliteCache_MigrateAttachmentsToTable(t *testing.T) {
+	c := newSqliteTestCache(t)
+	m := newDefaultMessage("mytopic", "legacy attachment")
+	m.Sender = "1.2.3.4"
+	m.Attachment = &attachment{Name: "file.txt", Type: "text/plain", Size: 100, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://ntfy.sh/file/file.txt"}
+	require.Nil(t, c.AddMessages([]*message{m, newDefaultMessage("mytopic", "no attachment")}))
+
+	// Simulate a database from before schema version 32, and re-run the migration
+	_, err := c.db.Exec(`DROP TABLE message_attachments`)
+	require.Nil(t, err)
+	_, err = c.db.Exec(migrate31To32CreateMessageAttachmentsTableQuery)
+	require.Nil(t, err)
+
+	var owner string
+	require.Nil(t, c.db.QueryRow(`SELECT owner FROM message_attachments WHERE mid = ?`, m.ID).Scan(&owner))
+	require.Equal(t, "1.2.3.4", owner)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages[0].Attachments))
+	require.Equal(t, "file.txt", messages[0].Attachments[0].Name)
+	require.Nil(t, messages[1].Attachments)
+}
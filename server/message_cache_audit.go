@@ -0,0 +1,120 @@
+package server
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// For compliance deployments that must be able to explain where a notification went, deletions of messages can be
+// recorded in the audit table, see messageCacheOptions.AuditDeletions. Every deleted message gets an entry with
+// the reason it was deleted, e.g. because it was pruned or replaced by a message with the same collapse key.
+// Entries are written in the same transaction as the deletion, so the audit trail never diverges from the
+// messages table. Audit entries are never deleted by the cache, not even along with their topic.
+
+const (
+	createAuditTableQuery = `
+		CREATE TABLE IF NOT EXISTS audit (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mid TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			time INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_topic_mid ON audit (topic, mid);
+	`
+	insertAuditEntryQuery    = `INSERT INTO audit (mid, topic, reason, time) VALUES (?, ?, ?, ?)`
+	insertAuditEntriesPrefix = `INSERT INTO audit (mid, topic, reason, time) SELECT mid, topic, ?, ? FROM messages`
+	selectAuditTrailQuery    = `SELECT mid, topic, reason, time FROM audit WHERE topic = ? AND mid = ? ORDER BY id`
+)
+
+// Reasons of audit entries
+const (
+	auditReasonPruned       = "pruned"        // Older than the cache duration, see Prune
+	auditReasonExpired      = "expired"       // The TTL of the message passed, see Prune
+	auditReasonDropped      = "dropped"       // A scheduled message was not published before its NotAfter time, see PruneExpiredScheduled
+	auditReasonDeleted      = "deleted"       // Moved to the trash, see DeleteMessage
+	auditReasonRestored     = "restored"      // Restored from the trash, see RestoreMessage; this is the only entry that is not a deletion
+	auditReasonTopicDeleted = "topic-deleted" // The whole topic was deleted, see DeleteTopic
+	auditReasonCollapsed    = "collapsed"     // Replaced by a newer message with the same collapse key
+	auditReasonDuplicate    = "duplicate"     // A duplicate row of the message was removed, see DeduplicateMessages
+	auditReasonCanceled     = "canceled"      // A scheduled message was canceled before it was published, see CancelScheduled
+)
+
+// auditEntry is an entry of the audit trail of a message, see AuditTrail
+type auditEntry struct {
+	ID     string // Message ID
+	Topic  string
+	Reason string // One of the auditReason* constants
+	Time   int64  // Unix time in seconds
+}
+
+// AuditTrail returns the audit entries of a message, oldest first. It returns an empty list if auditing is
+// disabled, or if the message was never deleted.
+func (c *messageCache) AuditTrail(topic, id string) ([]auditEntry, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	rows, err := c.db.Query(selectAuditTrailQuery, c.ResolveTopic(topic), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]auditEntry, 0)
+	for rows.Next() {
+		var entry auditEntry
+		if err := rows.Scan(&entry.ID, &entry.Topic, &entry.Reason, &entry.Time); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// deleteMessagesAudited runs the given DELETE FROM messages query in a transaction, and records the deleted
+// messages in the audit trail with the given reason, see auditDeletes. It returns the number of deleted messages.
+// The transaction is retried if the database is busy, see retryBusy.
+func (c *messageCache) deleteMessagesAudited(reason, query string, args ...interface{}) (int64, error) {
+	var deleted int64
+	err := c.retryBusy(func() error {
+		return c.withTx(func(tx *sql.Tx) error {
+			if err := c.auditDeletes(tx, reason, query, args...); err != nil {
+				return err
+			}
+			res, err := tx.Exec(query, args...)
+			if err != nil {
+				return err
+			}
+			deleted, err = res.RowsAffected()
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// auditDeletes records the messages that the given DELETE FROM messages query is about to delete in the audit
+// trail, if auditing is enabled. It must be called within the same transaction, right before the query. The
+// messages are selected with the WHERE clause of the query itself, so that the two cannot diverge.
+func (c *messageCache) auditDeletes(tx *sql.Tx, reason, query string, args ...interface{}) error {
+	if !c.auditDeletions {
+		return nil
+	}
+	auditQuery := strings.Replace(query, "DELETE FROM messages", insertAuditEntriesPrefix, 1)
+	_, err := tx.Exec(auditQuery, append([]interface{}{reason, time.Now().Unix()}, args...)...)
+	return err
+}
+
+// auditMessage records a single audit entry within the given transaction, if auditing is enabled
+func (c *messageCache) auditMessage(tx *sql.Tx, reason, topic, id string) error {
+	if !c.auditDeletions {
+		return nil
+	}
+	_, err := tx.Exec(insertAuditEntryQuery, id, topic, reason, time.Now().Unix())
+	return err
+}
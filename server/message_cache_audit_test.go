@@ -0,0 +1,79 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_AuditTrail(t *testing.T) {
+	testCacheAuditTrail(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_AuditTrail(t *testing.T) {
+	testCacheAuditTrail(t, createMemoryFilename())
+}
+
+func testCacheAuditTrail(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{AuditDeletions: true})
+	require.Nil(t, err)
+	collapsed := newDefaultMessage("mytopic", "build running")
+	collapsed.CollapseKey = "build"
+	expired := newDefaultMessage("mytopic", "short-lived")
+	expired.TTL = 1
+	expired.Time = time.Now().Add(-time.Minute).Unix()
+	old := newDefaultMessage("mytopic", "old")
+	old.Time = time.Now().Add(-48 * time.Hour).Unix()
+	deleted := newDefaultMessage("mytopic", "deleted by accident")
+	kept := newDefaultMessage("mytopic", "kept")
+	require.Nil(t, c.AddMessages([]*message{collapsed, expired, old, deleted, kept}))
+	replacement := newDefaultMessage("mytopic", "build done")
+	replacement.CollapseKey = "build"
+	require.Nil(t, c.AddMessage(replacement))
+	require.Nil(t, c.Prune(time.Now().Add(-24*time.Hour), 0))
+	require.Nil(t, c.DeleteMessage("mytopic", deleted.ID))
+	require.Nil(t, c.RestoreMessage("mytopic", deleted.ID))
+
+	for id, reason := range map[string]string{collapsed.ID: auditReasonCollapsed, expired.ID: auditReasonExpired, old.ID: auditReasonPruned} {
+		entries, err := c.AuditTrail("mytopic", id)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(entries))
+		require.Equal(t, id, entries[0].ID)
+		require.Equal(t, "mytopic", entries[0].Topic)
+		require.Equal(t, reason, entries[0].Reason)
+		require.InDelta(t, time.Now().Unix(), entries[0].Time, 5)
+	}
+	entries, err := c.AuditTrail("mytopic", deleted.ID)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, auditReasonDeleted, entries[0].Reason)
+	require.Equal(t, auditReasonRestored, entries[1].Reason)
+	entries, err = c.AuditTrail("mytopic", kept.ID)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+
+	// The trail outlives the topic
+	deletedCount, err := c.DeleteTopic("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), deletedCount)
+	entries, err = c.AuditTrail("mytopic", kept.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, auditReasonTopicDeleted, entries[0].Reason)
+	entries, err = c.AuditTrail("mytopic", old.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(entries))
+}
+
+func TestSqliteCache_AuditTrail_Disabled(t *testing.T) {
+	c := newSqliteTestCache(t)
+	m := newDefaultMessage("mytopic", "some message")
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.DeleteMessage("mytopic", m.ID))
+	entries, err := c.AuditTrail("mytopic", m.ID)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+	var count int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM audit`).Scan(&count))
+	require.Equal(t, 0, count)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Backup and Restore are specific to the SQLite backend: A backup is a complete SQLite database file, which
+// can also be used directly as cache file (e.g. when restoring manually with the server stopped).
+//
+// Copying the cache file while the server is running may produce a corrupt backup, since the file may be
+// written to in the middle of the copy. Backup instead uses "VACUUM INTO" to create a consistent snapshot,
+// and Restore uses SQLite's online backup API to replace the contents of the live database.
+//
+// SwapDatabase replaces the live database with another cache file, e.g. a rebuilt database. Since
+// messageCache.db is used without locking, the handle itself is never replaced. Instead, the file is copied
+// into the live database with the backup API as well, in a single step: Queries that are already running
+// finish against the old contents, and all later queries see the new ones. No prepared statements are kept
+// across queries, so there is nothing to re-prepare.
+
+const (
+	backupQuery          = `VACUUM INTO ?`
+	backupTempFilename   = "cache.db"
+	backupTempDirPattern = "ntfy-cache-backup"
+)
+
+var (
+	errUnexpectedSqliteConn = errors.New("unexpected SQLite driver connection")
+	errNotCacheDatabase     = errors.New("not a message cache database")
+)
+
+// Backup writes a consistent snapshot of the entire cache database to w, without blocking writers
+// for longer than it takes to create the snapshot. Messages in the insert buffer are flushed first.
+func (c *messageCache) Backup(w io.Writer) error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", backupTempDirPattern)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, backupTempFilename)
+	if _, err := c.db.Exec(backupQuery, filename); err != nil {
+		return err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Restore replaces the entire contents of the cache database with a backup created by Backup. The backup
+// is migrated to the current schema version before it is restored, so older backups can be restored as well.
+func (c *messageCache) Restore(r io.Reader) error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", backupTempDirPattern)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, backupTempFilename)
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	src, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := setupCacheDB(src, nil); err != nil {
+		return err
+	}
+	if err := copySqliteDB(c.db, src); err != nil {
+		return err
+	}
+	return c.reloadState()
+}
+
+// SwapDatabase atomically replaces the entire contents of the cache database with the given cache file, which
+// must have the current schema version. The file is opened read-only and is not modified; older backups
+// can be restored with Restore. Messages in the insert buffer are flushed first.
+func (c *messageCache) SwapDatabase(newFile string) error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(newFile); err != nil {
+		return err
+	}
+	src, err := sql.Open("sqlite3", sqliteDSN(newFile)+"&mode=ro")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	schemaVersion, err := cacheSchemaVersion(src)
+	if err != nil {
+		return err
+	} else if schemaVersion != currentSchemaVersion {
+		return fmt.Errorf("unexpected schema version %d of %s, expected %d", schemaVersion, newFile, currentSchemaVersion)
+	}
+	if err := copySqliteDB(c.db, src); err != nil {
+		return err
+	}
+	return c.reloadState()
+}
+
+// cacheSchemaVersion returns the schema version of the given cache database, errNotCacheDatabase if
+// it is not a cache database, or errSchemaUnknown if it has no schema version
+func cacheSchemaVersion(db *sql.DB) (int, error) {
+	rowsMC, err := db.Query(selectMessagesCountQuery)
+	if err != nil {
+		return 0, errNotCacheDatabase
+	}
+	rowsMC.Close()
+	rows, err := db.Query(selectSchemaVersionQuery)
+	if err != nil {
+		return 0, errNotCacheDatabase
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errSchemaUnknown
+	}
+	var schemaVersion int
+	if err := rows.Scan(&schemaVersion); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return schemaVersion, nil
+}
+
+// copySqliteDB copies the main database of src to dest using SQLite's online backup API
+func copySqliteDB(dest, src *sql.DB) error {
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			destSqliteConn, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errUnexpectedSqliteConn
+			}
+			srcSqliteConn, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errUnexpectedSqliteConn
+			}
+			backup, err := destSqliteConn.Backup("main", srcSqliteConn, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Close()
+				return err
+			}
+			return backup.Close()
+		})
+	})
+}
+
+// reloadState reloads all state that is kept in memory from the database, e.g. after a restore
+func (c *messageCache) reloadState() error {
+	c.mu.Lock()
+	c.dictionaries = make(map[int64]*bodyDictionary)
+	c.topicDictionaries = make(map[string]*bodyDictionary)
+	c.topicDefaults = make(map[string]*topicDefaults)
+	c.topicAliases = make(map[string]string)
+	c.mu.Unlock()
+	if err := c.loadBodyDictionaries(); err != nil {
+		return err
+	}
+	if err := c.loadTopicDefaults(); err != nil {
+		return err
+	}
+	return c.loadTopicAliases()
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSqliteCache_BackupRestore(t *testing.T) {
+	testCacheBackupRestore(t, newSqliteTestCache(t), newSqliteTestCache(t))
+}
+
+func TestMemCache_BackupRestore(t *testing.T) {
+	testCacheBackupRestore(t, newMemTestCache(t), newMemTestCache(t))
+}
+
+func testCacheBackupRestore(t *testing.T, c *messageCache, restored *messageCache) {
+	for i := 0; i < 10; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("alerts", newRepetitiveAlert(i))))
+	}
+	_, err := c.TrainBodyDictionary("alerts")
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(newDefaultMessage("alerts", newRepetitiveAlert(10)))) // Compressed
+	require.Nil(t, c.SetTopicDefaults("alerts", 4, []string{"prod"}))
+
+	var backup bytes.Buffer
+	require.Nil(t, c.Backup(&backup))
+	require.True(t, strings.HasPrefix(backup.String(), "SQLite format 3"))
+
+	// Restore replaces existing messages
+	require.Nil(t, restored.AddMessage(newDefaultMessage("othertopic", "will be gone")))
+	require.Nil(t, restored.Restore(&backup))
+
+	count, err := restored.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+	messages, err := restored.Messages("alerts", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 11, len(messages))
+	require.Equal(t, newRepetitiveAlert(10), messages[10].Message)
+
+	// In-memory state is reloaded
+	m := newDefaultMessage("alerts", "some message")
+	restored.ApplyTopicDefaults(m)
+	require.Equal(t, 4, m.Priority)
+}
+
+func TestSqliteCache_RestoreInvalid(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "still there")))
+	require.NotNil(t, c.Restore(strings.NewReader("this is not a database")))
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestSqliteCache_SwapDatabase(t *testing.T) {
+	testCacheSwapDatabase(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_SwapDatabase(t *testing.T) {
+	testCacheSwapDatabase(t, newMemTestCache(t))
+}
+
+func testCacheSwapDatabase(t *testing.T, c *messageCache) {
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "will be gone")))
+
+	// Rebuild a database elsewhere
+	filename := newSqliteTestCacheFile(t)
+	rebuilt := newSqliteTestCacheFromFile(t, filename)
+	require.Nil(t, rebuilt.AddMessage(newDefaultMessage("alerts", "message 1")))
+	require.Nil(t, rebuilt.AddMessage(newDefaultMessage("alerts", "message 2")))
+	require.Nil(t, rebuilt.SetTopicDefaults("alerts", 4, []string{"prod"}))
+	require.Nil(t, rebuilt.Close())
+
+	require.Nil(t, c.SwapDatabase(filename))
+	count, err := c.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+	messages, err := c.Messages("alerts", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	m := newDefaultMessage("alerts", "some message")
+	c.ApplyTopicDefaults(m)
+	require.Equal(t, 4, m.Priority)
+
+	// The swapped-in file is not modified by later writes
+	require.Nil(t, c.AddMessage(newDefaultMessage("alerts", "message 3")))
+	rebuilt = newSqliteTestCacheFromFile(t, filename)
+	count, err = rebuilt.MessageCount("alerts")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+}
+
+func TestSqliteCache_SwapDatabase_Invalid(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "still there")))
+
+	// Missing file
+	dir := t.TempDir()
+	require.NotNil(t, c.SwapDatabase(filepath.Join(dir, "doesnotexist.db")))
+
+	// Not a cache database
+	other, err := sql.Open("sqlite3", filepath.Join(dir, "other.db"))
+	require.Nil(t, err)
+	_, err = other.Exec(`CREATE TABLE something (id INT)`)
+	require.Nil(t, err)
+	require.Nil(t, other.Close())
+	require.Equal(t, errNotCacheDatabase, c.SwapDatabase(filepath.Join(dir, "other.db")))
+
+	// Outdated schema version
+	filename := filepath.Join(dir, "old.db")
+	old := newSqliteTestCacheFromFile(t, filename)
+	_, err = old.db.Exec(`UPDATE schemaVersion SET version = ? WHERE id = 1`, currentSchemaVersion-1)
+	require.Nil(t, err)
+	require.Nil(t, old.Close())
+	require.Error(t, c.SwapDatabase(filename))
+
+	// Missing schema version
+	filename = filepath.Join(dir, "unknown.db")
+	unknown := newSqliteTestCacheFromFile(t, filename)
+	_, err = unknown.db.Exec(`DELETE FROM schemaVersion`)
+	require.Nil(t, err)
+	require.Nil(t, unknown.Close())
+	require.True(t, errors.Is(c.SwapDatabase(filename), errSchemaUnknown))
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"heckel.io/ntfy/log"
+	"sync"
+	"time"
+)
+
+// The insert buffer is an optional write-behind buffer for the message cache, meant to smooth out write
+// bursts: AddMessage only queues the message, and a background goroutine writes queued messages to the
+// database in batches, either every flush interval or whenever the buffer is full.
+//
+// This trades durability for throughput: Messages that are still in the buffer are lost if the process crashes
+// before the buffer was flushed. Call Flush or Close to synchronously write all buffered messages, e.g. on
+// shutdown. To read your own writes, Messages and Message flush the buffer first if it holds messages of the
+// topic they read. All other query methods (e.g. MessageCount) only see buffered messages once they are flushed,
+// i.e. after at most the flush interval.
+//
+// If a batch cannot be written, e.g. because the disk is full, it is kept and retried with exponential backoff,
+// starting at the flush interval and capped at insertBufferMaxBackoff. While a full batch is waiting to be retried,
+// AddMessage blocks once the buffer is full. Messages that can never be written because they became invalid after
+// they were queued (e.g. their topic was disabled, see validateMessage) are dropped instead.
+
+const insertBufferMaxBackoff = time.Minute
+
+// messageInsertBuffer holds the channels used to communicate with the background flush goroutine
+type messageInsertBuffer struct {
+	queue     chan *bufferedMessage
+	flushReq  chan chan error
+	closeReq  chan chan error
+	size      int
+	interval  time.Duration
+	pending   map[string]int // Number of buffered messages per topic (as returned by ResolveTopic)
+	pendingMu sync.Mutex
+}
+
+// bufferedMessage is a message in the insert buffer, along with the topic it is counted under in pending
+type bufferedMessage struct {
+	m     *message
+	topic string
+}
+
+// EnableInsertBuffer enables the write-behind insert buffer, see above. Queued messages are written to
+// the database in batches of up to size messages, at least every interval. If the buffer is already
+// enabled, or this is a nop cache, this does nothing.
+func (c *messageCache) EnableInsertBuffer(size int, interval time.Duration) {
+	c.bufferMu.Lock()
+	defer c.bufferMu.Unlock()
+	if c.nop || c.insertBuffer != nil {
+		return
+	}
+	b := &messageInsertBuffer{
+		queue:    make(chan *bufferedMessage, size),
+		flushReq: make(chan chan error),
+		closeReq: make(chan chan error),
+		size:     size,
+		interval: interval,
+		pending:  make(map[string]int),
+	}
+	c.insertBuffer = b
+	go c.runInsertBuffer(b)
+}
+
+// Flush synchronously writes all messages that are currently in the insert buffer to the database.
+// If the insert buffer is not enabled, this does nothing.
+func (c *messageCache) Flush() error {
+	c.bufferMu.RLock()
+	defer c.bufferMu.RUnlock()
+	if c.insertBuffer == nil {
+		return nil
+	}
+	errChan := make(chan error)
+	c.insertBuffer.flushReq <- errChan
+	return <-errChan
+}
+
+// enqueue queues a message in the insert buffer, blocking if it is full
+func (b *messageInsertBuffer) enqueue(m *message, topic string) {
+	b.pendingMu.Lock()
+	b.pending[topic]++
+	b.pendingMu.Unlock()
+	b.queue <- &bufferedMessage{m: m, topic: topic}
+}
+
+// done removes written (or dropped) messages from the pending counts, see hasPending
+func (b *messageInsertBuffer) done(bms ...*bufferedMessage) {
+	b.pendingMu.Lock()
+	defer b.pendingMu.Unlock()
+	for _, bm := range bms {
+		if b.pending[bm.topic]--; b.pending[bm.topic] <= 0 {
+			delete(b.pending, bm.topic)
+		}
+	}
+}
+
+// hasPending returns true if the insert buffer holds messages of the given topic that were not written yet
+func (b *messageInsertBuffer) hasPending(topic string) bool {
+	b.pendingMu.Lock()
+	defer b.pendingMu.Unlock()
+	return b.pending[topic] > 0
+}
+
+// flushTopic flushes the insert buffer if it holds messages of the given topic, so that reads of the topic
+// include them. If the insert buffer is not enabled, this does nothing.
+func (c *messageCache) flushTopic(topic string) error {
+	c.bufferMu.RLock()
+	defer c.bufferMu.RUnlock()
+	if c.insertBuffer == nil || !c.insertBuffer.hasPending(c.ResolveTopic(topic)) {
+		return nil
+	}
+	errChan := make(chan error)
+	c.insertBuffer.flushReq <- errChan
+	return <-errChan
+}
+
+// Close flushes and stops the insert buffer (if enabled), waits for the write feed (if any) to pass all
+// queued events to its handler, and closes the database
+func (c *messageCache) Close() error {
+	c.bufferMu.Lock()
+	b := c.insertBuffer
+	c.insertBuffer = nil
+	c.bufferMu.Unlock()
+	var err error
+	if b != nil {
+		errChan := make(chan error)
+		b.closeReq <- errChan
+		err = <-errChan
+	}
+	if c.writeFeed != nil {
+		c.writeFeed.close()
+	}
+	if err != nil {
+		c.db.Close()
+		return err
+	}
+	return c.db.Close()
+}
+
+func (c *messageCache) runInsertBuffer(b *messageInsertBuffer) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	batch := make([]*bufferedMessage, 0, b.size)
+	var backoff time.Duration
+	var retryAt time.Time
+	flush := func() error {
+		for len(b.queue) > 0 {
+			batch = append(batch, <-b.queue)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		log.Debug("Cache: Flushing %d buffered message(s)", len(batch))
+		messages := make([]*message, 0, len(batch))
+		valid := batch[:0]
+		for _, bm := range batch {
+			if err := c.validateMessage(bm.m); err != nil {
+				log.Warn("Cache: Dropping buffered message %s: %s", bm.m.ID, err.Error())
+				b.done(bm)
+				continue
+			}
+			messages = append(messages, bm.m)
+			valid = append(valid, bm)
+		}
+		batch = valid
+		if err := c.AddMessages(messages); err != nil {
+			if backoff = 2 * backoff; backoff == 0 {
+				backoff = b.interval
+			} else if backoff > insertBufferMaxBackoff {
+				backoff = insertBufferMaxBackoff
+			}
+			retryAt = time.Now().Add(backoff)
+			return err // The batch is kept, and retried after the backoff
+		}
+		b.done(batch...)
+		batch = batch[:0]
+		backoff, retryAt = 0, time.Time{}
+		return nil
+	}
+	for {
+		queue := b.queue
+		if len(batch) >= b.size {
+			queue = nil // Waiting for a failed batch to be retried, so enqueue blocks once the buffer is full
+		}
+		select {
+		case m := <-queue:
+			batch = append(batch, m)
+			if len(batch) >= b.size && !time.Now().Before(retryAt) {
+				if err := flush(); err != nil {
+					log.Warn("Cache: Error flushing buffered messages, retrying in %s: %s", backoff, err.Error())
+				}
+			}
+		case <-ticker.C:
+			if !time.Now().Before(retryAt) {
+				if err := flush(); err != nil {
+					log.Warn("Cache: Error flushing buffered messages, retrying in %s: %s", backoff, err.Error())
+				}
+			}
+		case errChan := <-b.flushReq:
+			errChan <- flush()
+		case errChan := <-b.closeReq:
+			err := flush()
+			if err != nil {
+				log.Warn("Cache: Error flushing buffered messages on close, %d message(s) lost: %s", len(batch), err.Error())
+			}
+			errChan <- err
+			return
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_InsertBuffer(t *testing.T) {
+	testCacheInsertBuffer(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_InsertBuffer(t *testing.T) {
+	testCacheInsertBuffer(t, newMemTestCache(t))
+}
+
+func testCacheInsertBuffer(t *testing.T, c *messageCache) {
+	c.EnableInsertBuffer(10, time.Hour)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "buffered")))
+	}
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count) // Not flushed yet
+
+	require.Nil(t, c.Flush())
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 5, count)
+
+	// Buffer full, flushed in the background
+	for i := 0; i < 10; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "buffered")))
+	}
+	time.Sleep(100 * time.Millisecond)
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 15, count)
+
+	require.Equal(t, errUnexpectedMessageType, c.AddMessage(newKeepaliveMessage("mytopic")))
+}
+
+func TestSqliteCache_InsertBufferInterval(t *testing.T) {
+	c := newSqliteTestCache(t)
+	c.EnableInsertBuffer(100, 50*time.Millisecond)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "buffered")))
+	time.Sleep(200 * time.Millisecond)
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestSqliteCache_InsertBufferClose(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	c.EnableInsertBuffer(100, time.Hour)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "buffered")))
+	}
+	require.Nil(t, c.Close())
+
+	// Nothing is lost on a clean shutdown
+	c = newSqliteTestCacheFromFile(t, filename)
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 3, count)
+}
+
+func TestSqliteCache_InsertBufferReadYourWrites(t *testing.T) {
+	testCacheInsertBufferReadYourWrites(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_InsertBufferReadYourWrites(t *testing.T) {
+	testCacheInsertBufferReadYourWrites(t, newMemTestCache(t))
+}
+
+func testCacheInsertBufferReadYourWrites(t *testing.T, c *messageCache) {
+	c.EnableInsertBuffer(100, time.Hour)
+	m := newDefaultMessage("mytopic", "buffered")
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "buffered")))
+
+	// Reading a topic flushes the buffer if it holds messages of that topic
+	messages, err := c.Messages("emptytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	count, err := c.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count) // Not flushed yet
+
+	found, err := c.Message("mytopic", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, "buffered", found.Message)
+	count, err = c.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count) // Flushed along with mytopic
+
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "buffered again")))
+	messages, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Empty(t, c.insertBuffer.pending)
+}
+
+func TestSqliteCache_AddMessages(t *testing.T) {
+	testCacheAddMessages(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AddMessages(t *testing.T) {
+	testCacheAddMessages(t, newMemTestCache(t))
+}
+
+func testCacheAddMessages(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m2 := newDefaultMessage("mytopic", "message 2")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+	require.Nil(t, c.AddMessages([]*message{}))
+
+	// All or nothing
+	require.Equal(t, errUnexpectedMessageType, c.AddMessages([]*message{newDefaultMessage("mytopic", "message 3"), newOpenMessage("mytopic")}))
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "message 2", messages[1].Message)
+}
+
+func TestSqliteCache_InsertBufferFlushFails(t *testing.T) {
+	c := newSqliteTestCache(t)
+	c.EnableInsertBuffer(100, time.Hour)
+	_, err := c.db.Exec(`CREATE TRIGGER fail_insert BEFORE INSERT ON messages BEGIN SELECT RAISE(ABORT, 'injected failure'); END`)
+	require.Nil(t, err)
+	m := newDefaultMessage("mytopic", "buffered")
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "topic disabled while buffered")))
+	require.NotNil(t, c.Flush())
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+
+	// The batch is kept and written once the failure is gone, except for messages that became invalid
+	require.Nil(t, c.SetTopicDisabled("othertopic", true))
+	_, err = c.db.Exec(`DROP TRIGGER fail_insert`)
+	require.Nil(t, err)
+	require.Nil(t, c.Flush())
+	found, err := c.Message("mytopic", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, "buffered", found.Message)
+	count, err = c.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+	require.Empty(t, c.insertBuffer.pending)
+}
+
+func TestSqliteCache_InsertBufferFlushFailsRetried(t *testing.T) {
+	c := newSqliteTestCache(t)
+	c.EnableInsertBuffer(100, 20*time.Millisecond)
+	_, err := c.db.Exec(`CREATE TRIGGER fail_insert BEFORE INSERT ON messages BEGIN SELECT RAISE(ABORT, 'injected failure'); END`)
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "buffered")))
+	time.Sleep(100 * time.Millisecond) // Failed in the background at least once
+	_, err = c.db.Exec(`DROP TRIGGER fail_insert`)
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		count, err := c.MessageCount("mytopic")
+		return err == nil && count == 1
+	}, 2*time.Second, 20*time.Millisecond)
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message bodies of a topic can be compressed using a shared per-topic dictionary, which drastically
+// reduces the storage used by topics with repetitive messages (e.g. alerts from the same monitor). Since
+// DEFLATE supports preset dictionaries, each row is still compressed individually and can be decompressed
+// on its own, as long as the dictionary it was compressed with is known.
+//
+// Compression is opt-in per topic: It is enabled by calling TrainBodyDictionary, which builds a dictionary
+// from the most recent messages of the topic. All messages added after that are compressed, if that
+// makes them smaller. Dictionaries are never deleted, since older rows may still reference them.
+//
+// Compressed rows are marked in the encoding column with a "dict=<id>" storage codec, see splitStorageEncoding.
+//
+// Independently of dictionaries, bodies of at least messageCacheOptions.CompressionThreshold bytes are gzipped
+// for all topics, which helps with large, rarely repetitive payloads (e.g. multi-kilobyte JSON documents). Such
+// rows are marked with the "gzip" storage codec. Bodies below the threshold are stored verbatim. Like all storage
+// codecs, this is appended to the encoding of the message, so e.g. "base64" bodies are read back as "base64".
+// Since compressed bodies are opaque to SQLite, they cannot be matched by queries on the message column. Searches
+// (e.g. SearchMessages) therefore decode them and match them in Go.
+
+const (
+	bodyDictionaryMaxSize    = 32 * 1024 // DEFLATE window size; anything beyond that is never referenced
+	bodyDictionarySampleSize = 200       // Number of recent messages used to train a dictionary
+	bodyCompressionMinLength = 32        // Bodies shorter than this are never compressed
+	bodyCodecDictionary      = "dict"
+	bodyCodecBinary          = "bin" // Body was base64-decoded and is stored as raw bytes (BLOB)
+	bodyCodecGzip            = "gzip"
+)
+
+const (
+	createDictionariesTableQuery = `
+		CREATE TABLE IF NOT EXISTS dictionaries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			topic TEXT NOT NULL,
+			dict BLOB NOT NULL,
+			created INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_dictionaries_topic ON dictionaries (topic);
+	`
+	insertDictionaryQuery         = `INSERT INTO dictionaries (topic, dict, created) VALUES (?, ?, ?)`
+	selectDictionariesQuery       = `SELECT id, topic, dict FROM dictionaries ORDER BY id`
+	selectDictionarySamplesQuery  = `SELECT message, encoding FROM messages WHERE topic = ? ORDER BY id DESC LIMIT ?`
+	storageEncodingSeparator      = ";"
+	storageEncodingParamSeparator = "="
+)
+
+// bodyDictionary is a DEFLATE preset dictionary used to compress the message bodies of a topic
+type bodyDictionary struct {
+	id    int64
+	topic string
+	dict  []byte
+}
+
+// TrainBodyDictionary builds a compression dictionary from the most recent messages of the given topic,
+// and enables body compression for all messages subsequently added to that topic. It can be called again
+// at any time to retrain the dictionary, e.g. if the messages of the topic changed significantly.
+func (c *messageCache) TrainBodyDictionary(topic string) (int64, error) {
+	topic = c.ResolveTopic(topic)
+	rows, err := c.db.Query(selectDictionarySamplesQuery, topic, bodyDictionarySampleSize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	samples := make([]string, 0)
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var body, encoding string
+		if err := rows.Scan(&body, &encoding); err != nil {
+			return 0, err
+		}
+		body, _, err := c.decodeMessageBody(topic, body, encoding)
+		if err != nil {
+			return 0, err
+		}
+		if !seen[body] {
+			samples = append(samples, body)
+			seen[body] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+	if len(samples) == 0 {
+		return 0, errMessageNotFound
+	}
+	// Samples are newest first, but DEFLATE prefers matches close to the end of the
+	// dictionary, so the most recent messages go last.
+	var dict bytes.Buffer
+	for i := len(samples) - 1; i >= 0; i-- {
+		dict.WriteString(samples[i])
+	}
+	dictBytes := dict.Bytes()
+	if len(dictBytes) > bodyDictionaryMaxSize {
+		dictBytes = dictBytes[len(dictBytes)-bodyDictionaryMaxSize:]
+	}
+	res, err := c.db.Exec(insertDictionaryQuery, topic, dictBytes, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	c.addBodyDictionary(&bodyDictionary{id: id, topic: topic, dict: dictBytes})
+	return id, nil
+}
+
+func (c *messageCache) loadBodyDictionaries() error {
+	rows, err := c.db.Query(selectDictionariesQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d bodyDictionary
+		if err := rows.Scan(&d.id, &d.topic, &d.dict); err != nil {
+			return err
+		}
+		c.addBodyDictionary(&d)
+	}
+	return rows.Err()
+}
+
+func (c *messageCache) addBodyDictionary(d *bodyDictionary) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dictionaries[d.id] = d
+	if latest, ok := c.topicDictionaries[d.topic]; !ok || latest.id < d.id {
+		c.topicDictionaries[d.topic] = d
+	}
+}
+
+// encodeMessageBody returns the message body and the value of the encoding column as they should be
+// stored in the database. Base64-encoded (binary) bodies are stored as raw bytes in a BLOB, so they are
+// binary-safe and do not waste space. If the topic has a compression dictionary, the body is compressed,
+// and if the topic has an encryption key, it is encrypted (see encryptBody).
+func (c *messageCache) encodeMessageBody(m *message) (body interface{}, encoding string, err error) {
+	raw := []byte(m.Message)
+	codecs := make([]string, 0)
+	if m.Encoding == encodingBase64 {
+		if decoded, err := base64.StdEncoding.DecodeString(m.Message); err == nil {
+			raw = decoded
+			codecs = append(codecs, bodyCodecBinary)
+		}
+	}
+	compressed, codec, err := c.compressBody(m.Topic, raw)
+	if err != nil {
+		return nil, "", err
+	} else if codec != "" {
+		raw = compressed
+		codecs = append(codecs, codec)
+	}
+	encrypted, codec, err := c.encryptBody(m.Topic, raw)
+	if err != nil {
+		return nil, "", err
+	} else if codec != "" {
+		raw = encrypted
+		codecs = append(codecs, codec)
+	}
+	if len(codecs) == 0 {
+		return m.Message, m.Encoding, nil
+	}
+	return raw, joinStorageEncoding(m.Encoding, codecs...), nil
+}
+
+// compressBody compresses the body with the dictionary of the topic, or with gzip if it is larger than the
+// compression threshold, and returns the compressed body and the storage codec. If neither applies, or
+// compression is not worth it, the codec is empty.
+func (c *messageCache) compressBody(topic string, body []byte) ([]byte, string, error) {
+	c.mu.RLock()
+	d, ok := c.topicDictionaries[c.topicKey(topic)]
+	c.mu.RUnlock()
+	if !ok || len(body) < bodyCompressionMinLength {
+		if c.compressThreshold > 0 && len(body) >= c.compressThreshold {
+			return gzipBody(body)
+		}
+		return nil, "", nil
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriterDict(&buf, flate.BestCompression, d.dict)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	if buf.Len() >= len(body) {
+		return nil, "", nil // Not worth it
+	}
+	return buf.Bytes(), fmt.Sprintf("%s%s%d", bodyCodecDictionary, storageEncodingParamSeparator, d.id), nil
+}
+
+// gzipBody compresses the body with gzip, and returns the compressed body and the storage codec. If compression
+// is not worth it, the codec is empty.
+func gzipBody(body []byte) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	if buf.Len() >= len(body) {
+		return nil, "", nil // Not worth it
+	}
+	return buf.Bytes(), bodyCodecGzip, nil
+}
+
+// decodeMessageBody reverses encodeMessageBody, and returns the original message body and encoding
+func (c *messageCache) decodeMessageBody(topic, body, storageEncoding string) (string, string, error) {
+	encoding, codecs := splitStorageEncoding(storageEncoding)
+	for i := len(codecs) - 1; i >= 0; i-- {
+		name, param := splitStorageCodec(codecs[i])
+		switch name {
+		case bodyCodecDictionary:
+			id, err := strconv.ParseInt(param, 10, 64)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid dictionary ID in encoding %s", storageEncoding)
+			}
+			c.mu.RLock()
+			d, ok := c.dictionaries[id]
+			c.mu.RUnlock()
+			if !ok {
+				return "", "", fmt.Errorf("unknown dictionary %d", id)
+			}
+			decompressed, err := io.ReadAll(flate.NewReaderDict(strings.NewReader(body), d.dict))
+			if err != nil {
+				return "", "", err
+			}
+			body = string(decompressed)
+		case bodyCodecGzip:
+			r, err := gzip.NewReader(strings.NewReader(body))
+			if err != nil {
+				return "", "", err
+			}
+			decompressed, err := io.ReadAll(r)
+			if err != nil {
+				return "", "", err
+			}
+			body = string(decompressed)
+		case bodyCodecEncryption:
+			decrypted, err := c.decryptBody(topic, []byte(body), param)
+			if err != nil {
+				return "", "", err
+			}
+			body = string(decrypted)
+		case bodyCodecBinary:
+			body = base64.StdEncoding.EncodeToString([]byte(body))
+		default:
+			return "", "", fmt.Errorf("unknown storage codec %s", name)
+		}
+	}
+	return body, encoding, nil
+}
+
+// splitStorageEncoding splits the value of the encoding column into the encoding that is passed to clients
+// (e.g. "base64", or empty), and the list of storage codecs that were applied to the body before storing
+// it, in the order they were applied. Example: "base64;dict=3" -> "base64", ["dict=3"]
+func splitStorageEncoding(s string) (encoding string, codecs []string) {
+	parts := strings.Split(s, storageEncodingSeparator)
+	return parts[0], parts[1:]
+}
+
+// joinStorageEncoding is the reverse of splitStorageEncoding, and appends codecs to the given encoding
+func joinStorageEncoding(encoding string, codecs ...string) string {
+	return strings.Join(append([]string{encoding}, codecs...), storageEncodingSeparator)
+}
+
+func splitStorageCodec(codec string) (name string, param string) {
+	parts := strings.SplitN(codec, storageEncodingParamSeparator, 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestSqliteCache_BodyDictionary(t *testing.T) {
+	testCacheBodyDictionary(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_BodyDictionary(t *testing.T) {
+	testCacheBodyDictionary(t, newMemTestCache(t))
+}
+
+func testCacheBodyDictionary(t *testing.T, c *messageCache) {
+	for i := 0; i < 50; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("alerts", newRepetitiveAlert(i))))
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", newRepetitiveAlert(0))))
+	uncompressed := storedBodyBytes(t, c, "alerts")
+
+	_, err := c.TrainBodyDictionary("alerts")
+	require.Nil(t, err)
+	_, err = c.TrainBodyDictionary("emptytopic")
+	require.Equal(t, errMessageNotFound, err)
+
+	for i := 50; i < 100; i++ {
+		m := newDefaultMessage("alerts", newRepetitiveAlert(i))
+		if i == 99 {
+			m.Encoding = encodingBase64
+		}
+		require.Nil(t, c.AddMessage(m))
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("alerts", "short")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", newRepetitiveAlert(1))))
+	compressed := storedBodyBytes(t, c, "alerts") - uncompressed
+
+	// Storage reduction: the second 50 messages must use far less space than the first 50
+	require.Less(t, compressed*4, uncompressed)
+
+	// Round trip
+	messages, err := c.Messages("alerts", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 101, len(messages))
+	for i := 0; i < 100; i++ {
+		require.Equal(t, newRepetitiveAlert(i), messages[i].Message)
+	}
+	require.Equal(t, "", messages[98].Encoding)
+	require.Equal(t, encodingBase64, messages[99].Encoding) // Original encoding is preserved
+	require.Equal(t, "short", messages[100].Message)
+
+	// Other topics are not compressed
+	messages, err = c.Messages("othertopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, newRepetitiveAlert(1), messages[1].Message)
+	require.Equal(t, len(newRepetitiveAlert(0))+len(newRepetitiveAlert(1)), storedBodyBytes(t, c, "othertopic"))
+
+	// Updates are compressed too
+	messages, err = c.Messages("alerts", sinceAllMessages, false)
+	require.Nil(t, err)
+	m := messages[0]
+	m.Message = newRepetitiveAlert(1000)
+	require.Nil(t, c.UpdateMessage(m))
+	messages, err = c.Messages("alerts", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, newRepetitiveAlert(1000), messages[0].Message)
+}
+
+func TestSqliteCache_BodyDictionaryReopen(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	for i := 0; i < 10; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("alerts", newRepetitiveAlert(i))))
+	}
+	_, err := c.TrainBodyDictionary("alerts")
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(newDefaultMessage("alerts", newRepetitiveAlert(10))))
+	require.Nil(t, c.db.Close())
+
+	// Dictionaries are loaded when the cache is reopened
+	c = newSqliteTestCacheFromFile(t, filename)
+	messages, err := c.Messages("alerts", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 11, len(messages))
+	require.Equal(t, newRepetitiveAlert(10), messages[10].Message)
+}
+
+func TestSqliteCache_BinaryBody(t *testing.T) {
+	testCacheBinaryBody(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_BinaryBody(t *testing.T) {
+	testCacheBinaryBody(t, newMemTestCache(t))
+}
+
+func testCacheBinaryBody(t *testing.T, c *messageCache) {
+	binary := []byte{0x00, 0xff, 0x00, 'a', 0xfe, 0x00}
+	m1 := newDefaultMessage("mytopic", base64.StdEncoding.EncodeToString(binary))
+	m1.Encoding = encodingBase64
+	m2 := newDefaultMessage("mytopic", "not valid base64!") // Stored as text
+	m2.Encoding = encodingBase64
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	rows, err := c.db.Query(`SELECT typeof(message), length(message), encoding FROM messages ORDER BY id`)
+	require.Nil(t, err)
+	require.True(t, rows.Next())
+	var typ, encoding string
+	var length int
+	require.Nil(t, rows.Scan(&typ, &length, &encoding))
+	require.Equal(t, "blob", typ)
+	require.Equal(t, len(binary), length)
+	require.Equal(t, "base64;bin", encoding)
+	require.True(t, rows.Next())
+	require.Nil(t, rows.Scan(&typ, &length, &encoding))
+	require.Equal(t, "text", typ)
+	require.Equal(t, "base64", encoding)
+	require.Nil(t, rows.Close())
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, m1.Message, messages[0].Message)
+	require.Equal(t, encodingBase64, messages[0].Encoding)
+	b, err := messages[0].Bytes()
+	require.Nil(t, err)
+	require.Equal(t, binary, b)
+	require.Equal(t, "not valid base64!", messages[1].Message)
+}
+
+func TestSqliteCache_BinaryBodyCompressed(t *testing.T) {
+	c := newSqliteTestCache(t)
+	for i := 0; i < 10; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("alerts", newRepetitiveAlert(i))))
+	}
+	_, err := c.TrainBodyDictionary("alerts")
+	require.Nil(t, err)
+	m := newDefaultMessage("alerts", base64.StdEncoding.EncodeToString([]byte(newRepetitiveAlert(10)+"\x00")))
+	m.Encoding = encodingBase64
+	require.Nil(t, c.AddMessage(m))
+
+	messages, err := c.Messages("alerts", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, m.Message, messages[10].Message)
+	require.Equal(t, encodingBase64, messages[10].Encoding)
+}
+
+func TestSqliteCache_SearchMessagesCompressed(t *testing.T) {
+	testCacheSearchMessagesCompressed(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_SearchMessagesCompressed(t *testing.T) {
+	testCacheSearchMessagesCompressed(t, newMemTestCache(t))
+}
+
+func testCacheSearchMessagesCompressed(t *testing.T, c *messageCache) {
+	for i := 0; i < 10; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("alerts", newRepetitiveAlert(i))))
+	}
+	_, err := c.TrainBodyDictionary("alerts")
+	require.Nil(t, err)
+	for i := 10; i < 20; i++ {
+		m := newDefaultMessage("alerts", newRepetitiveAlert(i))
+		if i == 15 {
+			m.Title = "Paging on-call"
+		}
+		require.Nil(t, c.AddMessage(m))
+	}
+	var compressed int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE instr(encoding, ';dict=') > 0`).Scan(&compressed))
+	require.Equal(t, 10, compressed)
+
+	// Compressed bodies are decoded before they are matched
+	messages, err := c.SearchMessages("alerts", "WEB-12.prod", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, newRepetitiveAlert(12), messages[0].Message)
+
+	messages, err = c.SearchMessages("alerts", "highcpuusage", 3)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, newRepetitiveAlert(19), messages[0].Message)
+	require.Equal(t, newRepetitiveAlert(17), messages[2].Message)
+
+	messages, err = c.SearchMessages("alerts", "on-call", 0) // Title of a compressed row
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, newRepetitiveAlert(15), messages[0].Message)
+
+	messages, err = c.SearchMessages("alerts", "web-05.prod", 0) // Uncompressed rows still match
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+
+	messages, err = c.SearchMessages("alerts", "nothing", 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_SearchLikeCompressed(t *testing.T) {
+	testCacheSearchLikeCompressed(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_SearchLikeCompressed(t *testing.T) {
+	testCacheSearchLikeCompressed(t, createMemoryFilename())
+}
+
+func testCacheSearchLikeCompressed(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{CompressionThreshold: 100})
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("alerts", newRepetitiveAlert(i))))
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("alerts", "short alert on web-03")))
+	var gzipped int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE encoding = ';gzip'`).Scan(&gzipped))
+	require.Equal(t, 5, gzipped)
+
+	// Compressed bodies are decoded before they are matched, oldest first
+	messages, err := c.SearchLike("alerts", "WEB-03", 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, newRepetitiveAlert(3), messages[0].Message)
+	require.Equal(t, "short alert on web-03", messages[1].Message)
+
+	messages, err = c.SearchLike("alerts", "highcpuusage", 2) // Newest matches
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, newRepetitiveAlert(3), messages[0].Message)
+	require.Equal(t, newRepetitiveAlert(4), messages[1].Message)
+
+	messages, err = c.SearchLike("alerts", "nothing", 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_CompressionThreshold(t *testing.T) {
+	testCacheCompressionThreshold(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_CompressionThreshold(t *testing.T) {
+	testCacheCompressionThreshold(t, createMemoryFilename())
+}
+
+func testCacheCompressionThreshold(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{CompressionThreshold: 1024})
+	require.Nil(t, err)
+	large := strings.Repeat(`{"host":"web-01.prod.example.com","cpu":93,"status":"firing"},`, 100)
+	binary := base64.StdEncoding.EncodeToString([]byte(large + "\x00"))
+	m1 := newDefaultMessage("mytopic", large)
+	m2 := newDefaultMessage("mytopic", binary)
+	m2.Encoding = encodingBase64
+	m3 := newDefaultMessage("mytopic", "small message")
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+
+	// Large bodies are compressed, small ones are stored verbatim
+	var encodings []string
+	rows, err := c.db.Query(`SELECT encoding FROM messages ORDER BY id`)
+	require.Nil(t, err)
+	for rows.Next() {
+		var encoding string
+		require.Nil(t, rows.Scan(&encoding))
+		encodings = append(encodings, encoding)
+	}
+	require.Nil(t, rows.Close())
+	require.Equal(t, []string{";gzip", "base64;bin;gzip", ""}, encodings)
+	require.Less(t, storedBodyBytes(t, c, "mytopic"), len(large)/4)
+
+	// Round trip
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, large, messages[0].Message)
+	require.Equal(t, "", messages[0].Encoding)
+	require.Equal(t, binary, messages[1].Message)
+	require.Equal(t, encodingBase64, messages[1].Encoding) // Original encoding is preserved
+	require.Equal(t, "small message", messages[2].Message)
+	require.Equal(t, "", messages[2].Encoding)
+
+	// Compressed rows can still be read without the option
+	c, err = newSqliteCacheWithOptions(filename, false, &messageCacheOptions{})
+	require.Nil(t, err)
+	m, err := c.Message("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, large, m.Message)
+}
+
+func TestStorageEncoding_SplitJoin(t *testing.T) {
+	encoding, codecs := splitStorageEncoding("")
+	require.Equal(t, "", encoding)
+	require.Empty(t, codecs)
+
+	encoding, codecs = splitStorageEncoding("base64")
+	require.Equal(t, "base64", encoding)
+	require.Empty(t, codecs)
+
+	encoding, codecs = splitStorageEncoding("base64;dict=3")
+	require.Equal(t, "base64", encoding)
+	require.Equal(t, []string{"dict=3"}, codecs)
+
+	require.Equal(t, ";dict=3", joinStorageEncoding("", "dict=3"))
+	require.Equal(t, "base64", joinStorageEncoding("base64"))
+}
+
+func newRepetitiveAlert(i int) string {
+	return fmt.Sprintf(`[FIRING:1] HighCPUUsage (instance=web-%02d.prod.example.com:9100, job=node, severity=critical) `+
+		`CPU usage on web-%02d.prod.example.com has been above 90%% for more than 5 minutes. Current value: %d%%. `+
+		`Runbook: https://wiki.example.com/runbooks/high-cpu-usage`, i%20, i%20, 90+i%10)
+}
+
+func storedBodyBytes(t *testing.T, c *messageCache, topic string) int {
+	rows, err := c.db.Query(`SELECT IFNULL(SUM(length(message)), 0) FROM messages WHERE topic = ?`, topic)
+	require.Nil(t, err)
+	defer rows.Close()
+	require.True(t, rows.Next())
+	var size int
+	require.Nil(t, rows.Scan(&size))
+	return size
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Flapping monitors often send the same alert over and over within seconds. If messageCacheOptions.DebounceWindow
+// is set, a message that has the same title, body and priority as the most recent message of its topic, and is
+// published within the window, is not inserted. Instead, the most recent message is moved to the time of the new
+// one, and its repeat_count is incremented, so that the topic shows the alert once along with how often it fired.
+//
+// The window is measured from the time of the most recent message, which is updated with every repeat. A message
+// that keeps repeating is therefore merged for as long as the gaps between repeats are shorter than the window.
+// Scheduled messages, and messages with attachments, a collapse key or a deduplication key are never merged.
+
+const (
+	selectDebounceCandidateQuery = `
+		SELECT id, mid, time, topic, message, title, priority, encoding, publish_seq, repeat_count
+		FROM messages
+		WHERE topic = ? AND published = 1
+		ORDER BY time_ms DESC, id DESC
+		LIMIT 1
+	`
+	updateMessageRepeatedQuery = `
+		UPDATE messages
+		SET time = ?, time_ms = ?, updated = ?, repeat_count = repeat_count + 1
+		WHERE id = ?
+	`
+)
+
+// debounceMessage merges the message into the most recent message of its topic within the transaction, if it is
+// a repeat of it, see messageCacheOptions.DebounceWindow. It returns true if the message was merged, in which case
+// the ID, repeat count and publish sequence of the message are set to those of the message it was merged into.
+func (c *messageCache) debounceMessage(tx *sql.Tx, m *message) (bool, error) {
+	if c.debounceWindow == 0 || m.Time > time.Now().Unix() || len(messageAttachments(m)) > 0 || m.CollapseKey != "" || m.DedupKey != "" {
+		return false, nil
+	}
+	rows, err := tx.Query(selectDebounceCandidateQuery, c.topicKey(m.Topic))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false, nil
+	}
+	var rowID, timestamp, seq int64
+	var priority, repeatCount int
+	var id, topic, body, title, encoding string
+	if err := rows.Scan(&rowID, &id, &timestamp, &topic, &body, &title, &priority, &encoding, &seq, &repeatCount); err != nil {
+		return false, err
+	}
+	rows.Close()
+	if m.Time-timestamp > int64(c.debounceWindow.Seconds()) || priority != m.Priority {
+		return false, nil
+	}
+	title, err = c.decodeMessageTitle(topic, title, encoding)
+	if err != nil {
+		return false, err
+	} else if title != m.Title {
+		return false, nil
+	}
+	body, encoding, err = c.decodeMessageBody(topic, body, encoding)
+	if err != nil {
+		return false, err
+	} else if body != m.Message || encoding != m.Encoding {
+		return false, nil
+	}
+	if _, err := tx.Exec(updateMessageRepeatedQuery, m.Time, messageTimeMillis(m), m.Time, rowID); err != nil {
+		return false, err
+	}
+	m.ID = id
+	m.RepeatCount = repeatCount + 1
+	m.PublishSeq = seq
+	return true, nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_Debounce(t *testing.T) {
+	testCacheDebounce(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_Debounce(t *testing.T) {
+	testCacheDebounce(t, createMemoryFilename())
+}
+
+func testCacheDebounce(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{DebounceWindow: 10 * time.Second})
+	require.Nil(t, err)
+	now := time.Now().Unix()
+	old := newDefaultMessage("alerts", "disk full")
+	old.Time = now - 30
+	require.Nil(t, c.AddMessage(old))
+
+	// Repeats within the window are merged into the most recent message
+	m1 := newDefaultMessage("alerts", "disk full")
+	require.Nil(t, c.AddMessage(m1))
+	messages, err := c.Messages("alerts", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	seq := messages[1].PublishSeq
+	m2 := newDefaultMessage("alerts", "disk full")
+	m3 := newDefaultMessage("alerts", "disk full")
+	require.Nil(t, c.AddMessages([]*message{m2, m3}))
+	require.Equal(t, 0, m3.RepeatCount) // The caller's messages are not changed, see addMessages
+	messages, err = c.Messages("alerts", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, m1.ID, messages[1].ID)
+	require.Equal(t, 2, messages[1].RepeatCount)
+	require.Equal(t, seq, messages[1].PublishSeq)
+
+	// Messages that differ in title, body or priority are not merged, and neither are those on other topics
+	m4 := newDefaultMessage("alerts", "disk full")
+	m4.Priority = 5
+	m5 := newDefaultMessage("alerts", "disk full")
+	m5.Priority = 5
+	m6 := newDefaultMessage("alerts", "disk full")
+	m7 := newDefaultMessage("otheralerts", "disk full")
+	require.Nil(t, c.AddMessages([]*message{m4, m5, m6, m7}))
+
+	messages, err = c.Messages("alerts", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(messages))
+	require.Equal(t, old.ID, messages[0].ID)
+	require.Equal(t, 0, messages[0].RepeatCount)
+	require.Equal(t, m1.ID, messages[1].ID)
+	require.Equal(t, 2, messages[1].RepeatCount)
+	require.Equal(t, m4.ID, messages[2].ID)
+	require.Equal(t, 1, messages[2].RepeatCount)
+	require.Equal(t, m6.ID, messages[3].ID)
+	require.Equal(t, 0, messages[3].RepeatCount)
+
+	// Messages with attachments are never merged
+	m8 := newDefaultMessage("alerts", "disk full")
+	m8.Attachment = &attachment{Name: "df.txt", Size: 100, Expires: now + 3600, URL: "https://example.com/df.txt"}
+	require.Nil(t, c.AddMessage(m8))
+	count, err := c.MessageCount("alerts")
+	require.Nil(t, err)
+	require.Equal(t, 5, count)
+
+	// Neither are messages with a deduplication key
+	m9 := newDefaultMessage("alerts", "disk full")
+	m9.DedupKey = "disk-full-1"
+	require.Nil(t, c.AddMessage(m9))
+	count, err = c.MessageCount("alerts")
+	require.Nil(t, err)
+	require.Equal(t, 6, count)
+}
+
+func TestSqliteCache_Debounce_Disabled(t *testing.T) {
+	c := newSqliteTestCache(t)
+	m1 := newDefaultMessage("alerts", "disk full")
+	m2 := newDefaultMessage("alerts", "disk full")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+	require.NotEqual(t, m1.ID, m2.ID)
+	count, err := c.MessageCount("alerts")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"time"
+)
+
+// Messages that were forwarded via e-mail store the recipient address in the email column, so that it can be
+// audited which address a message was sent to, see MessagesByEmail. The column is empty for all other messages.
+// Like the sender, the address is never returned to subscribers.
+
+const (
+	selectMessagesByEmailQuery = `
+		SELECT ` + selectMessageColumns + `, email
+		FROM messages
+		WHERE email = ? AND time >= ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+)
+
+// MessagesByEmail returns the published messages of all topics that were forwarded to the given e-mail address
+// at or after the given time, ordered by time. The address must match exactly.
+func (c *messageCache) MessagesByEmail(email string, since time.Time) ([]*message, error) {
+	if email == "" {
+		return make([]*message, 0), nil
+	}
+	rows, err := c.db.Query(selectMessagesByEmailQuery, email, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
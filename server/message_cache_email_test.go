@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqliteCache_MessagesByEmail(t *testing.T) {
+	testCacheMessagesByEmail(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesByEmail(t *testing.T) {
+	testCacheMessagesByEmail(t, newMemTestCache(t))
+}
+
+func testCacheMessagesByEmail(t *testing.T, c *messageCache) {
+	now := time.Now().Unix()
+	add := func(topic, email string, time int64) *message {
+		m := newDefaultMessage(topic, "some message")
+		m.Email = email
+		m.Time = time
+		require.Nil(t, c.AddMessage(m))
+		return m
+	}
+	m1 := add("topic1", "phil@example.com", now-3600)
+	m2 := add("topic2", "phil@example.com", now-60)
+	add("topic1", "ben@example.com", now-60)
+	add("topic1", "", now-60)
+	add("topic1", "phil@example.com", now+3600) // Scheduled
+
+	messages, err := c.MessagesByEmail("phil@example.com", time.Unix(0, 0))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, m1.ID, messages[0].ID)
+	require.Equal(t, "phil@example.com", messages[0].Email)
+	require.Equal(t, m2.ID, messages[1].ID)
+	require.Equal(t, "topic2", messages[1].Topic)
+
+	messages, err = c.MessagesByEmail("phil@example.com", time.Unix(now-600, 0))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m2.ID, messages[0].ID)
+
+	messages, err = c.MessagesByEmail("", time.Unix(0, 0))
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	// Not returned by regular queries, but exported
+	messages, err = c.Messages("topic1", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, "", messages[0].Email)
+	var buf bytes.Buffer
+	require.Nil(t, c.ExportTopic("topic2", &buf))
+	require.Contains(t, buf.String(), `"email":"phil@example.com"`)
+	c2 := newMemTestCache(t)
+	_, err = c2.ImportMessages(&buf)
+	require.Nil(t, err)
+	messages, err = c2.MessagesByEmail("phil@example.com", time.Unix(0, 0))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Message bodies can be encrypted at rest with AES-GCM, using a separate key per topic, so that topics of
+// different tenants do not share a key. Keys are not stored in the cache; they are resolved through a
+// KeyProvider when a message is written or read.
+//
+// Encrypted rows are marked in the encoding column with an "enc=<key ID>" storage codec, where the key ID is
+// derived from the key itself. This allows keys to be rotated: Rows encrypted with an earlier key can still be
+// decrypted if the provider also implements KeyRotationProvider. Encryption is applied after compression,
+// since encrypted data does not compress.
+//
+// Titles are encrypted with the same key as the body, and are not compressed. Since the key ID is only stored
+// once in the encoding column, a title is encrypted if and only if its body is. Encrypted titles cannot be
+// matched in queries, see MessagesByTitle and SearchMessages.
+
+const (
+	bodyCodecEncryption = "enc"
+	encryptionKeyIDLen  = 8 // Bytes of the SHA-256 hash of the key used as key ID
+)
+
+var (
+	errEncryptionKeyNotFound = errors.New("encryption key not found")
+	errEncryptedBodyInvalid  = errors.New("encrypted message body is too short")
+)
+
+// KeyProvider resolves the keys used to encrypt message bodies, see messageCacheOptions.KeyProvider
+type KeyProvider interface {
+	// KeyForTopic returns the current key for the topic, or nil if the topic is not encrypted. Keys must be
+	// 16, 24 or 32 bytes long, to select AES-128, AES-192 or AES-256. The topic is the topic as stored, i.e.
+	// lowercased if topics are case-insensitive (see messageCacheOptions.CaseInsensitiveTopics).
+	KeyForTopic(topic string) ([]byte, error)
+}
+
+// KeyRotationProvider is a KeyProvider that can also resolve earlier keys, so that messages encrypted with
+// a key that has since been rotated can still be read
+type KeyRotationProvider interface {
+	KeyProvider
+
+	// KeyByID returns the key with the given ID (see EncryptionKeyID), or nil if it is unknown
+	KeyByID(id string) ([]byte, error)
+}
+
+// EncryptionKeyID returns the ID under which the given key is referenced in the encoding column
+func EncryptionKeyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:encryptionKeyIDLen])
+}
+
+// encryptBody encrypts the body with the key of the topic, and returns the encrypted body (nonce first) and
+// the storage codec. If the cache has no key provider, or the topic has no key, the codec is empty.
+func (c *messageCache) encryptBody(topic string, body []byte) ([]byte, string, error) {
+	if c.keyProvider == nil {
+		return nil, "", nil
+	}
+	key, err := c.keyProvider.KeyForTopic(c.topicKey(topic))
+	if err != nil {
+		return nil, "", err
+	} else if key == nil {
+		return nil, "", nil
+	}
+	encrypted, err := encryptWithKey(key, body)
+	if err != nil {
+		return nil, "", err
+	}
+	return encrypted, bodyCodecEncryption + storageEncodingParamSeparator + EncryptionKeyID(key), nil
+}
+
+// decryptBody decrypts a body that was encrypted with encryptBody using the key with the given ID
+func (c *messageCache) decryptBody(topic string, body []byte, keyID string) ([]byte, error) {
+	key, err := c.encryptionKey(topic, keyID)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newBodyCipher(key)
+	if err != nil {
+		return nil, err
+	} else if len(body) < gcm.NonceSize() {
+		return nil, errEncryptedBodyInvalid
+	}
+	nonce, ciphertext := body[:gcm.NonceSize()], body[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// encodeMessageTitle returns the title of a message as it should be stored in the database, given the storage
+// encoding of the body (see encodeMessageBody): If the body is encrypted, the title is encrypted with the same key.
+func (c *messageCache) encodeMessageTitle(m *message, storageEncoding string) (interface{}, error) {
+	keyID := encryptionKeyID(storageEncoding)
+	if m.Title == "" || keyID == "" {
+		return m.Title, nil
+	}
+	key, err := c.encryptionKey(m.Topic, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return encryptWithKey(key, []byte(m.Title))
+}
+
+// decodeMessageTitle reverses encodeMessageTitle
+func (c *messageCache) decodeMessageTitle(topic, title, storageEncoding string) (string, error) {
+	keyID := encryptionKeyID(storageEncoding)
+	if title == "" || keyID == "" {
+		return title, nil
+	}
+	decrypted, err := c.decryptBody(topic, []byte(title), keyID)
+	if err != nil {
+		return "", err
+	}
+	return string(decrypted), nil
+}
+
+// encryptionKeyID returns the ID of the key a row was encrypted with, or an empty string if the
+// storage encoding does not contain an encryption codec
+func encryptionKeyID(storageEncoding string) string {
+	_, codecs := splitStorageEncoding(storageEncoding)
+	for _, codec := range codecs {
+		if name, param := splitStorageCodec(codec); name == bodyCodecEncryption {
+			return param
+		}
+	}
+	return ""
+}
+
+// encryptionKey returns the key with the given ID, which is either the current key of the topic, or
+// an earlier key if the key provider supports key rotation
+func (c *messageCache) encryptionKey(topic, keyID string) ([]byte, error) {
+	if c.keyProvider == nil {
+		return nil, errEncryptionKeyNotFound
+	}
+	key, err := c.keyProvider.KeyForTopic(c.topicKey(topic))
+	if err != nil {
+		return nil, err
+	} else if key != nil && EncryptionKeyID(key) == keyID {
+		return key, nil
+	}
+	rotation, ok := c.keyProvider.(KeyRotationProvider)
+	if !ok {
+		return nil, errEncryptionKeyNotFound
+	}
+	key, err = rotation.KeyByID(keyID)
+	if err != nil {
+		return nil, err
+	} else if key == nil || EncryptionKeyID(key) != keyID {
+		return nil, errEncryptionKeyNotFound
+	}
+	return key, nil
+}
+
+func encryptWithKey(key []byte, body []byte) ([]byte, error) {
+	gcm, err := newBodyCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, body, nil), nil
+}
+
+func newBodyCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestSqliteCache_EncryptionPerTopicKeys(t *testing.T) {
+	keys := newTestKeyProvider()
+	c, err := newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{KeyProvider: keys})
+	require.Nil(t, err)
+	testCacheEncryptionPerTopicKeys(t, c, keys)
+}
+
+func TestMemCache_EncryptionPerTopicKeys(t *testing.T) {
+	keys := newTestKeyProvider()
+	c, err := newMemCacheWithOptions(&messageCacheOptions{KeyProvider: keys})
+	require.Nil(t, err)
+	testCacheEncryptionPerTopicKeys(t, c, keys)
+}
+
+func testCacheEncryptionPerTopicKeys(t *testing.T, c *messageCache, keys *testKeyProvider) {
+	keys.current["secret"] = bytes.Repeat([]byte{1}, 32)
+	keys.current["other"] = bytes.Repeat([]byte{2}, 16)
+	require.Nil(t, c.AddMessage(newDefaultMessage("secret", "top secret message")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("other", "another secret")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("plain", "not a secret")))
+
+	// Bodies of topics with a key are not stored in plain text, and reference the key
+	body, encoding := storedBodyAndEncoding(t, c, "secret")
+	require.NotContains(t, body, "top secret")
+	require.Equal(t, ";enc="+EncryptionKeyID(keys.current["secret"]), encoding)
+	_, encoding = storedBodyAndEncoding(t, c, "other")
+	require.Equal(t, ";enc="+EncryptionKeyID(keys.current["other"]), encoding)
+	body, encoding = storedBodyAndEncoding(t, c, "plain")
+	require.Equal(t, "not a secret", body)
+	require.Equal(t, "", encoding)
+
+	messages, err := c.Messages("secret", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "top secret message", messages[0].Message)
+	require.Equal(t, "", messages[0].Encoding)
+
+	// Rotate key: old messages are decrypted with the old key, new messages use the new key
+	oldKey := keys.current["secret"]
+	keys.current["secret"] = bytes.Repeat([]byte{3}, 32)
+	require.Nil(t, c.AddMessage(newDefaultMessage("secret", "after rotation")))
+	_, err = c.Messages("secret", sinceAllMessages, false)
+	require.Equal(t, errEncryptionKeyNotFound, err)
+
+	keys.previous[EncryptionKeyID(oldKey)] = oldKey
+	messages, err = c.Messages("secret", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "top secret message", messages[0].Message)
+	require.Equal(t, "after rotation", messages[1].Message)
+
+	// Keys with an invalid length are rejected when writing
+	keys.current["invalid"] = []byte("short")
+	require.Error(t, c.AddMessage(newDefaultMessage("invalid", "message")))
+}
+
+func TestSqliteCache_EncryptionWithCompressionAndBinary(t *testing.T) {
+	keys := newTestKeyProvider()
+	c, err := newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{KeyProvider: keys})
+	require.Nil(t, err)
+	testCacheEncryptionWithCompressionAndBinary(t, c, keys)
+}
+
+func TestMemCache_EncryptionWithCompressionAndBinary(t *testing.T) {
+	keys := newTestKeyProvider()
+	c, err := newMemCacheWithOptions(&messageCacheOptions{KeyProvider: keys})
+	require.Nil(t, err)
+	testCacheEncryptionWithCompressionAndBinary(t, c, keys)
+}
+
+func testCacheEncryptionWithCompressionAndBinary(t *testing.T, c *messageCache, keys *testKeyProvider) {
+	keys.current["alerts"] = bytes.Repeat([]byte{4}, 32)
+	for i := 0; i < 20; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("alerts", newRepetitiveAlert(i))))
+	}
+	_, err := c.TrainBodyDictionary("alerts")
+	require.Nil(t, err)
+
+	binary := newDefaultMessage("alerts", base64.StdEncoding.EncodeToString([]byte(newRepetitiveAlert(99))))
+	binary.Encoding = encodingBase64
+	require.Nil(t, c.AddMessage(binary))
+	_, encoding := storedBodyAndEncoding(t, c, "alerts")
+	require.True(t, strings.HasPrefix(encoding, "base64;bin;dict="))
+	require.True(t, strings.HasSuffix(encoding, ";enc="+EncryptionKeyID(keys.current["alerts"])))
+
+	messages, err := c.Messages("alerts", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 21, len(messages))
+	require.Equal(t, newRepetitiveAlert(0), messages[0].Message)
+	require.Equal(t, binary.Message, messages[20].Message)
+	require.Equal(t, encodingBase64, messages[20].Encoding)
+}
+
+func TestSqliteCache_EncryptionTitle(t *testing.T) {
+	keys := newTestKeyProvider()
+	c, err := newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{KeyProvider: keys})
+	require.Nil(t, err)
+	testCacheEncryptionTitle(t, c, keys)
+}
+
+func TestMemCache_EncryptionTitle(t *testing.T) {
+	keys := newTestKeyProvider()
+	c, err := newMemCacheWithOptions(&messageCacheOptions{KeyProvider: keys})
+	require.Nil(t, err)
+	testCacheEncryptionTitle(t, c, keys)
+}
+
+func testCacheEncryptionTitle(t *testing.T, c *messageCache, keys *testKeyProvider) {
+	keys.current["secret"] = bytes.Repeat([]byte{5}, 32)
+	m := newDefaultMessage("secret", "top secret message")
+	m.Title = "Patient record accessed"
+	require.Nil(t, c.AddMessage(m))
+	noTitle := newDefaultMessage("secret", "no title")
+	require.Nil(t, c.AddMessage(noTitle))
+	plain := newDefaultMessage("plain", "not a secret")
+	plain.Title = "Plain title"
+	require.Nil(t, c.AddMessage(plain))
+
+	require.NotContains(t, storedTitle(t, c, m.ID), "Patient")
+	require.Equal(t, "", storedTitle(t, c, noTitle.ID))
+	require.Equal(t, "Plain title", storedTitle(t, c, plain.ID))
+
+	// Round trip, also after key rotation and update
+	oldKey := keys.current["secret"]
+	keys.current["secret"] = bytes.Repeat([]byte{6}, 32)
+	keys.previous[EncryptionKeyID(oldKey)] = oldKey
+	messages, err := c.Messages("secret", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "Patient record accessed", messages[0].Title)
+	require.Equal(t, "", messages[1].Title)
+
+	m.Title = "Patient record updated"
+	require.Nil(t, c.UpdateMessage(m))
+	require.NotContains(t, storedTitle(t, c, m.ID), "Patient")
+	_, encoding := storedBodyAndEncoding(t, c, "secret")
+	require.Equal(t, ";enc="+EncryptionKeyID(oldKey), encoding) // Latest row is noTitle, still with the old key
+	updated, err := c.Message("secret", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, "Patient record updated", updated.Title)
+
+	// Encrypted titles never match
+	messages, err = c.MessagesByTitle("secret", "Patient record updated", sinceAllMessages)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	// A tampered title fails cleanly instead of returning garbage
+	raw := []byte(storedTitle(t, c, m.ID))
+	raw[len(raw)-1] ^= 0xff
+	_, err = c.db.Exec(`UPDATE messages SET title = ? WHERE mid = ?`, raw, m.ID)
+	require.Nil(t, err)
+	_, err = c.Message("secret", m.ID)
+	require.Error(t, err)
+}
+
+func TestSqliteCache_EncryptionWrongKey(t *testing.T) {
+	keys := newTestKeyProvider()
+	c, err := newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{KeyProvider: keys})
+	require.Nil(t, err)
+	testCacheEncryptionWrongKey(t, c, keys)
+}
+
+func TestMemCache_EncryptionWrongKey(t *testing.T) {
+	keys := newTestKeyProvider()
+	c, err := newMemCacheWithOptions(&messageCacheOptions{KeyProvider: keys})
+	require.Nil(t, err)
+	testCacheEncryptionWrongKey(t, c, keys)
+}
+
+func testCacheEncryptionWrongKey(t *testing.T, c *messageCache, keys *testKeyProvider) {
+	key := bytes.Repeat([]byte{7}, 32)
+	keys.current["secret"] = key
+	m := newDefaultMessage("secret", "top secret message")
+	m.Title = "Secret title"
+	require.Nil(t, c.AddMessage(m))
+
+	// A provider that returns a different key for the ID is detected via the key ID
+	keys.current["secret"] = bytes.Repeat([]byte{8}, 32)
+	keys.previous[EncryptionKeyID(key)] = bytes.Repeat([]byte{9}, 32)
+	_, err := c.Messages("secret", sinceAllMessages, false)
+	require.Equal(t, errEncryptionKeyNotFound, err)
+
+	// Decrypting with the wrong key fails authentication
+	_, err = c.decryptBody("secret", []byte(storedTitle(t, c, m.ID)), EncryptionKeyID(keys.current["secret"]))
+	require.Error(t, err)
+	_, err = c.decryptBody("secret", []byte("short"), EncryptionKeyID(keys.current["secret"]))
+	require.Equal(t, errEncryptedBodyInvalid, err)
+}
+
+func TestSqliteCache_EncryptionCaseInsensitiveTopics(t *testing.T) {
+	keys := newTestKeyProvider()
+	c, err := newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{KeyProvider: keys, CaseInsensitiveTopics: true})
+	require.Nil(t, err)
+	testCacheEncryptionCaseInsensitiveTopics(t, c, keys)
+}
+
+func TestMemCache_EncryptionCaseInsensitiveTopics(t *testing.T) {
+	keys := newTestKeyProvider()
+	c, err := newMemCacheWithOptions(&messageCacheOptions{KeyProvider: keys, CaseInsensitiveTopics: true})
+	require.Nil(t, err)
+	testCacheEncryptionCaseInsensitiveTopics(t, c, keys)
+}
+
+func testCacheEncryptionCaseInsensitiveTopics(t *testing.T, c *messageCache, keys *testKeyProvider) {
+	keys.current["mytopic"] = bytes.Repeat([]byte{1}, 32) // Keys are looked up by the stored, lowercased topic
+	m := newDefaultMessage("MyTopic", "top secret message")
+	m.Title = "Secret title"
+	require.Nil(t, c.AddMessage(m))
+	body, encoding := storedBodyAndEncoding(t, c, "mytopic")
+	require.NotContains(t, body, "top secret")
+	require.Equal(t, ";enc="+EncryptionKeyID(keys.current["mytopic"]), encoding)
+
+	for _, topic := range []string{"MyTopic", "mytopic"} {
+		messages, err := c.Messages(topic, sinceAllMessages, false)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(messages))
+		require.Equal(t, "top secret message", messages[0].Message)
+		require.Equal(t, "Secret title", messages[0].Title)
+	}
+}
+
+type testKeyProvider struct {
+	current  map[string][]byte // Topic -> key
+	previous map[string][]byte // Key ID -> key
+}
+
+func newTestKeyProvider() *testKeyProvider {
+	return &testKeyProvider{
+		current:  make(map[string][]byte),
+		previous: make(map[string][]byte),
+	}
+}
+
+func (p *testKeyProvider) KeyForTopic(topic string) ([]byte, error) {
+	return p.current[topic], nil
+}
+
+func (p *testKeyProvider) KeyByID(id string) ([]byte, error) {
+	return p.previous[id], nil
+}
+
+// storedBodyAndEncoding returns the raw message body and encoding column of the latest message in the topic
+func storedBodyAndEncoding(t *testing.T, c *messageCache, topic string) (string, string) {
+	var body, encoding string
+	require.Nil(t, c.db.QueryRow(`SELECT message, encoding FROM messages WHERE topic = ? ORDER BY id DESC LIMIT 1`, topic).Scan(&body, &encoding))
+	return body, encoding
+}
+
+// storedTitle returns the raw title column of a message
+func storedTitle(t *testing.T, c *messageCache, id string) string {
+	var title string
+	require.Nil(t, c.db.QueryRow(`SELECT title FROM messages WHERE mid = ?`, id).Scan(&title))
+	return title
+}
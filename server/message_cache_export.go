@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExportTopic and ImportMessages move the messages of a topic between caches as newline-delimited JSON (NDJSON),
+// e.g. to migrate a topic to another server. Unlike Backup, the export is independent of the SQLite backend and of
+// the storage settings of the cache: Bodies are exported decoded (i.e. decompressed and decrypted), and are stored
+// according to the settings of the importing cache.
+//
+// Each line holds one message, including the fields that are only stored in the cache (such as the delivery token
+// and the publisher's IP address), see exportedMessage. State that is kept per message rather than being part of
+// it, such as acknowledgements, pins, read state and delivery counts, is not exported.
+
+const (
+	selectTopicBatchEndRowIDQuery = `SELECT IFNULL(MAX(id), 0) FROM (SELECT id FROM messages WHERE topic = ? AND id > ? ORDER BY id LIMIT ?)`
+	selectMessagesForExportQuery  = `
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, encoding, updated, collapse_key, origin, body_html, category, publish_seq, topic_display, sound, has_location, lat, lng, repeat_count, ttl, icon, token, source_ip, user_agent, raw_priority, not_after, dedup_key, attachment_hash, email
+		FROM messages
+		WHERE topic = ? AND id > ? AND id <= ?
+		ORDER BY id
+	`
+)
+
+// exportedMessage is a message as written by ExportTopic and read by ImportMessages. Unlike the message sent to
+// subscribers, it includes the fields that are only stored in the cache.
+type exportedMessage struct {
+	message
+	Token          string `json:"token,omitempty"`
+	Sender         string `json:"sender,omitempty"`
+	SourceIP       string `json:"source_ip,omitempty"`
+	UserAgent      string `json:"user_agent,omitempty"`
+	RawPriority    int    `json:"raw_priority,omitempty"`
+	TTL            int64  `json:"ttl,omitempty"`
+	NotAfter       int64  `json:"not_after,omitempty"`
+	DedupKey       string `json:"dedup_key,omitempty"`
+	Markdown       bool   `json:"markdown,omitempty"`
+	AttachmentHash string `json:"attachment_hash,omitempty"`
+	Email          string `json:"email,omitempty"`
+}
+
+// ExportTopic writes all messages of a topic to w as NDJSON, including scheduled messages, in the order in which
+// they were inserted. Rows are read in batches of forEachMessageBatchSize, so memory usage is bounded regardless
+// of the size of the topic.
+func (c *messageCache) ExportTopic(topic string, w io.Writer) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+	topic = c.ResolveTopic(topic)
+	encoder := json.NewEncoder(w)
+	lastID := int64(0)
+	for {
+		endID, err := c.topicBatchEndRowID(topic, lastID)
+		if err != nil {
+			return err
+		} else if endID == 0 {
+			return nil
+		}
+		rows, err := c.db.Query(selectMessagesForExportQuery, topic, lastID, endID)
+		if err != nil {
+			return err
+		}
+		messages, err := c.readMessages(c.db, rows)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			if err := encoder.Encode(newExportedMessage(m)); err != nil {
+				return err
+			}
+		}
+		lastID = endID
+	}
+}
+
+// ImportMessages reads NDJSON as written by ExportTopic from r, and adds the messages in batches of
+// forEachMessageBatchSize with AddMessages. It returns the number of imported messages, which excludes messages
+// that were skipped because their deduplication key was already used. If a line cannot be parsed, or a batch
+// cannot be added, the messages of the previous batches remain imported.
+func (c *messageCache) ImportMessages(r io.Reader) (int, error) {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	imported := 0
+	batch := make([]*message, 0, forEachMessageBatchSize)
+	flush := func() error {
+		inserted, err := c.addMessages(batch)
+		if err != nil {
+			return err
+		}
+		imported += len(inserted)
+		batch = batch[:0]
+		return nil
+	}
+	for line := 1; decoder.More(); line++ {
+		var e exportedMessage
+		if err := decoder.Decode(&e); err != nil {
+			return imported, fmt.Errorf("cannot parse message %d: %w", line, err)
+		}
+		batch = append(batch, e.toMessage())
+		if len(batch) == forEachMessageBatchSize {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
+
+func newExportedMessage(m *message) *exportedMessage {
+	var attachmentHash string
+	if m.Attachment != nil {
+		attachmentHash = m.Attachment.Hash
+	}
+	return &exportedMessage{
+		message:        *m,
+		Token:          m.Token,
+		Sender:         m.Sender,
+		SourceIP:       m.SourceIP,
+		UserAgent:      m.UserAgent,
+		RawPriority:    m.RawPriority,
+		TTL:            m.TTL,
+		NotAfter:       m.NotAfter,
+		DedupKey:       m.DedupKey,
+		Markdown:       m.Markdown,
+		AttachmentHash: attachmentHash,
+		Email:          m.Email,
+	}
+}
+
+func (e *exportedMessage) toMessage() *message {
+	m := e.message
+	m.Token = e.Token
+	m.Sender = e.Sender
+	m.SourceIP = e.SourceIP
+	m.UserAgent = e.UserAgent
+	m.RawPriority = e.RawPriority
+	m.TTL = e.TTL
+	m.NotAfter = e.NotAfter
+	m.DedupKey = e.DedupKey
+	m.Markdown = e.Markdown
+	m.Email = e.Email
+	m.BodyHTML = "" // Rendered again from the body, see Markdown
+	if attachments := messageAttachments(&m); len(attachments) > 0 {
+		attachments[0].Hash = e.AttachmentHash
+	}
+	return &m
+}
+
+// topicBatchEndRowID returns the row ID of the last message of the next batch of at most
+// forEachMessageBatchSize messages of the topic after lastID, or 0 if there are no more messages
+func (c *messageCache) topicBatchEndRowID(topic string, lastID int64) (int64, error) {
+	rows, err := c.db.Query(selectTopicBatchEndRowIDQuery, topic, lastID, forEachMessageBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	var endID int64
+	if err := rows.Scan(&endID); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return endID, nil
+}
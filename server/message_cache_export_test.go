@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_ExportImportTopic(t *testing.T) {
+	testCacheExportImportTopic(t, newSqliteTestCache(t), newSqliteTestCache(t))
+}
+
+func TestMemCache_ExportImportTopic(t *testing.T) {
+	testCacheExportImportTopic(t, newMemTestCache(t), newMemTestCache(t))
+}
+
+func testCacheExportImportTopic(t *testing.T, c, imported *messageCache) {
+	m1 := newDefaultMessage("mytopic", "**disk** full")
+	m1.Title = "Alert"
+	m1.Priority = 5
+	m1.Tags = []string{"warning", "disk"}
+	m1.Click = "https://example.com"
+	m1.Actions = []*action{{ID: "a1", Action: "view", Label: "Open", URL: "https://example.com/disk"}}
+	m1.Markdown = true
+	m1.Sender = "1.2.3.4"
+	m1.SourceIP = "1.2.3.4"
+	m1.UserAgent = "curl/7.81.0"
+	m1.TTL = 3600
+	m1.DedupKey = "disk-full"
+	m1.Location = &location{Lat: 52.52, Lng: 13.405}
+	require.Nil(t, assignMessageToken(m1))
+	m2 := newDefaultMessage("mytopic", "aGVsbG8=")
+	m2.Encoding = encodingBase64
+	m2.Attachment = &attachment{Name: "log.txt", Type: "text/plain", Size: 1000, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://example.com/file/log.txt"}
+	m2.CollapseKey = "logs"
+	m3 := newDefaultMessage("mytopic", "scheduled")
+	m3.Time = time.Now().Add(time.Hour).Unix()
+	m3.NotAfter = time.Now().Add(2 * time.Hour).Unix()
+	messages := []*message{m1, m2, m3, newDefaultMessage("othertopic", "not exported")}
+	for i := 0; i < 2*forEachMessageBatchSize+10; i++ {
+		messages = append(messages, newDefaultMessage("mytopic", fmt.Sprintf("message %d", i)))
+	}
+	require.Nil(t, c.AddMessages(messages))
+
+	var exported bytes.Buffer
+	require.Nil(t, c.ExportTopic("mytopic", &exported))
+	require.Equal(t, 3+2*forEachMessageBatchSize+10, strings.Count(exported.String(), "\n"))
+	require.NotContains(t, exported.String(), "not exported")
+
+	count, err := imported.ImportMessages(bytes.NewReader(exported.Bytes()))
+	require.Nil(t, err)
+	require.Equal(t, 3+2*forEachMessageBatchSize+10, count)
+	var reexported bytes.Buffer
+	require.Nil(t, imported.ExportTopic("mytopic", &reexported))
+	require.Equal(t, exported.String(), reexported.String())
+
+	forensics, err := imported.MessageForensics("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, "curl/7.81.0", forensics.UserAgent)
+	valid, err := imported.ValidateToken("mytopic", m1.ID, m1.Token)
+	require.Nil(t, err)
+	require.True(t, valid)
+
+	// Importing the same messages again only skips the ones with a deduplication key
+	count, err = imported.ImportMessages(bytes.NewReader(exported.Bytes()))
+	require.Nil(t, err)
+	require.Equal(t, 2+2*forEachMessageBatchSize+10, count)
+}
+
+func TestSqliteCache_ImportMessages_Invalid(t *testing.T) {
+	c := newSqliteTestCache(t)
+	input := `{"id":"abcdefghijkl","time":1,"event":"message","topic":"mytopic","message":"valid"}` + "\n" + `{"id": not json}` + "\n"
+	count, err := c.ImportMessages(strings.NewReader(input))
+	require.NotNil(t, err)
+	require.Equal(t, 0, count)
+	require.Contains(t, err.Error(), "cannot parse message 2")
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Empty(t, messages) // Not flushed, since the batch was incomplete
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"database/sql"
+)
+
+// UpdateMessage and UpdateMessageIfUnchanged overwrite a message in place. If messageCacheOptions.KeepHistory is
+// set, the previous content of the message (body, title, priority, tags, click URL and actions) is copied to the
+// message_versions table before, in the same transaction as the update. The messages table stays authoritative
+// for all other reads; versions are only returned by MessageHistory. Versions are removed along with their
+// message (ON DELETE CASCADE). Since the updated timestamp only has a resolution of one second, versions are
+// ordered by their row ID rather than by it.
+
+const (
+	createMessageVersionsTableQuery = `
+		CREATE TABLE IF NOT EXISTS message_versions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			mid TEXT NOT NULL,
+			updated INT NOT NULL,
+			message TEXT NOT NULL,
+			encoding TEXT NOT NULL,
+			title TEXT NOT NULL,
+			priority INT NOT NULL,
+			tags TEXT NOT NULL,
+			click TEXT NOT NULL,
+			actions TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_versions_message_id ON message_versions (message_id);
+	`
+	insertMessageVersionQuery = `
+		INSERT INTO message_versions (message_id, mid, updated, message, encoding, title, priority, tags, click, actions)
+		SELECT id, mid, updated, message, encoding, title, priority, tags, click, actions
+		FROM messages
+		WHERE topic = ? AND mid = ?
+	`
+	selectMessageVersionsQuery = `
+		SELECT m.mid, m.time, m.topic, v.message, v.title, v.priority, v.tags, v.click, v.actions, m.attachment_name, m.attachment_type, m.attachment_size, m.attachment_expires, m.attachment_url, m.sender, v.encoding, v.updated, m.collapse_key, m.origin, m.body_html, m.category, m.publish_seq, m.topic_display, m.sound, m.has_location, m.lat, m.lng, m.repeat_count, m.ttl, m.icon, m.content_type
+		FROM message_versions v
+		JOIN messages m ON m.id = v.message_id
+		WHERE m.topic = ? AND m.mid = ?
+		ORDER BY v.id
+	`
+)
+
+// MessageHistory returns all versions of a message, oldest first, i.e. the previous versions recorded by
+// UpdateMessage and UpdateMessageIfUnchanged (see messageCacheOptions.KeepHistory), followed by the current
+// version. Fields that cannot be updated are taken from the current version. It returns errMessageNotFound if
+// the message does not exist.
+func (c *messageCache) MessageHistory(topic, id string) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	rows, err := c.db.Query(selectMessageVersionsQuery, c.ResolveTopic(topic), id)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := c.readMessages(c.db, rows)
+	if err != nil {
+		return nil, err
+	}
+	current, err := c.Message(topic, id)
+	if err != nil {
+		return nil, err
+	}
+	return append(versions, current), nil
+}
+
+// recordMessageVersion copies the current content of a message to the message_versions table within the given
+// transaction, if messageCacheOptions.KeepHistory is set. It does nothing if the message does not exist.
+func (c *messageCache) recordMessageVersion(tx *sql.Tx, topic, id string) error {
+	if !c.keepHistory {
+		return nil
+	}
+	_, err := tx.Exec(insertMessageVersionQuery, topic, id)
+	return err
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSqliteCache_MessageHistory(t *testing.T) {
+	testCacheMessageHistory(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_MessageHistory(t *testing.T) {
+	testCacheMessageHistory(t, createMemoryFilename())
+}
+
+func testCacheMessageHistory(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{KeepHistory: true})
+	require.Nil(t, err)
+	m := newDefaultMessage("mytopic", "disk at 90%")
+	m.Title = "Disk warning"
+	m.Priority = 3
+	m.Tags = []string{"disk"}
+	require.Nil(t, c.AddMessage(m))
+
+	m.Message = "disk at 95%"
+	m.Priority = 4
+	require.Nil(t, c.UpdateMessage(m))
+	m.Message = "disk full"
+	m.Title = "Disk full"
+	m.Priority = 5
+	m.Tags = []string{"disk", "skull"}
+	require.Nil(t, c.UpdateMessageIfUnchanged(m, m.Updated))
+	require.Equal(t, errMessageUpdateConflict, c.UpdateMessageIfUnchanged(m, m.Updated-1)) // Not recorded
+
+	history, err := c.MessageHistory("mytopic", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(history))
+	require.Equal(t, "disk at 90%", history[0].Message)
+	require.Equal(t, "Disk warning", history[0].Title)
+	require.Equal(t, 3, history[0].Priority)
+	require.Equal(t, m.Time, history[0].Updated)
+	require.Equal(t, "disk at 95%", history[1].Message)
+	require.Equal(t, 4, history[1].Priority)
+	require.Equal(t, []string{"disk"}, history[1].Tags)
+	require.Equal(t, "disk full", history[2].Message)
+	require.Equal(t, "Disk full", history[2].Title)
+	require.Equal(t, []string{"disk", "skull"}, history[2].Tags)
+	for _, version := range history {
+		require.Equal(t, m.ID, version.ID)
+		require.Equal(t, m.Time, version.Time)
+	}
+
+	// Normal reads only return the current version
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "disk full", messages[0].Message)
+
+	// Versions are kept in the trash, and removed along with their message
+	require.Nil(t, c.DeleteMessage("mytopic", m.ID))
+	require.Nil(t, c.RestoreMessage("mytopic", m.ID))
+	history, err = c.MessageHistory("mytopic", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(history))
+	_, err = c.DeleteTopic("mytopic")
+	require.Nil(t, err)
+	_, err = c.MessageHistory("mytopic", m.ID)
+	require.Equal(t, errMessageNotFound, err)
+	var count int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM message_versions`).Scan(&count))
+	require.Equal(t, 0, count)
+}
+
+func TestSqliteCache_MessageHistory_Disabled(t *testing.T) {
+	c := newSqliteTestCache(t)
+	m := newDefaultMessage("mytopic", "first")
+	require.Nil(t, c.AddMessage(m))
+	m.Message = "second"
+	require.Nil(t, c.UpdateMessage(m))
+
+	history, err := c.MessageHistory("mytopic", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(history))
+	require.Equal(t, "second", history[0].Message)
+	require.Equal(t, errMessageNotFound, c.UpdateMessage(newDefaultMessage("mytopic", "does not exist")))
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"math"
+)
+
+// Messages can optionally refer to a geolocation, e.g. the position of an IoT sensor that sent an alert, which
+// allows showing a topic's messages on a map. Since 0/0 is a valid location, whether a message has a location at
+// all is stored in a separate has_location column.
+//
+// MessagesInBox returns the messages within a bounding box. Boxes that cross the antimeridian (180° longitude)
+// are not supported; such a box has to be queried as two separate boxes, one on either side.
+
+const (
+	selectMessagesInBoxQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND has_location = 1 AND lat BETWEEN ? AND ? AND lng BETWEEN ? AND ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+)
+
+var (
+	errInvalidLocation    = errors.New("invalid location")
+	errInvalidBoundingBox = errors.New("invalid bounding box")
+)
+
+// MessagesInBox returns the published messages of a topic whose location is within the given bounding box
+// (inclusive), in the order they were published. The box must not cross the antimeridian, i.e. minLng must
+// not be greater than maxLng.
+func (c *messageCache) MessagesInBox(topic string, minLat, minLng, maxLat, maxLng float64) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if err := validateLocation(&location{Lat: minLat, Lng: minLng}); err != nil {
+		return nil, errInvalidBoundingBox
+	} else if err := validateLocation(&location{Lat: maxLat, Lng: maxLng}); err != nil {
+		return nil, errInvalidBoundingBox
+	} else if minLat > maxLat || minLng > maxLng {
+		return nil, errInvalidBoundingBox
+	}
+	rows, err := c.db.Query(selectMessagesInBoxQuery, c.ResolveTopic(topic), minLat, maxLat, minLng, maxLng)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// validateLocation checks that a message's location, if any, is a valid latitude and longitude in degrees
+func validateLocation(loc *location) error {
+	if loc == nil {
+		return nil
+	}
+	if math.IsNaN(loc.Lat) || math.IsNaN(loc.Lng) || loc.Lat < -90 || loc.Lat > 90 || loc.Lng < -180 || loc.Lng > 180 {
+		return errInvalidLocation
+	}
+	return nil
+}
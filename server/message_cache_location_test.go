@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func TestSqliteCache_Location(t *testing.T) {
+	testCacheLocation(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Location(t *testing.T) {
+	testCacheLocation(t, newMemTestCache(t))
+}
+
+func testCacheLocation(t *testing.T, c *messageCache) {
+	berlin := newDefaultMessage("sensors", "berlin")
+	berlin.Location = &location{Lat: 52.52, Lng: 13.405}
+	paris := newDefaultMessage("sensors", "paris")
+	paris.Location = &location{Lat: 48.8566, Lng: 2.3522}
+	nullIsland := newDefaultMessage("sensors", "null island")
+	nullIsland.Location = &location{Lat: 0, Lng: 0}
+	nowhere := newDefaultMessage("sensors", "no location")
+	require.Nil(t, c.AddMessages([]*message{berlin, paris, nullIsland, nowhere}))
+
+	messages, err := c.Messages("sensors", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(messages))
+	require.Equal(t, &location{Lat: 52.52, Lng: 13.405}, messages[0].Location)
+	require.Equal(t, &location{Lat: 0, Lng: 0}, messages[2].Location)
+	require.Nil(t, messages[3].Location)
+
+	// Central Europe
+	messages, err = c.MessagesInBox("sensors", 45, 0, 55, 15)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "berlin", messages[0].Message)
+	require.Equal(t, "paris", messages[1].Message)
+
+	// Messages without location are not at 0/0
+	messages, err = c.MessagesInBox("sensors", -1, -1, 1, 1)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "null island", messages[0].Message)
+
+	messages, err = c.MessagesInBox("othertopic", -90, -180, 90, 180)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	// Boxes that cross the antimeridian are rejected, as are invalid locations
+	_, err = c.MessagesInBox("sensors", -10, 170, 10, -170)
+	require.Equal(t, errInvalidBoundingBox, err)
+	_, err = c.MessagesInBox("sensors", 10, 0, -10, 1)
+	require.Equal(t, errInvalidBoundingBox, err)
+	_, err = c.MessagesInBox("sensors", -91, 0, 0, 1)
+	require.Equal(t, errInvalidBoundingBox, err)
+	for _, loc := range []*location{{Lat: 91, Lng: 0}, {Lat: 0, Lng: -180.5}, {Lat: math.NaN(), Lng: 0}} {
+		m := newDefaultMessage("sensors", "invalid location")
+		m.Location = loc
+		require.Equal(t, errInvalidLocation, c.AddMessage(m))
+		require.Equal(t, errInvalidLocation, c.AddMessages([]*message{newDefaultMessage("sensors", "valid"), m}))
+	}
+	count, err := c.MessageCount("sensors")
+	require.Nil(t, err)
+	require.Equal(t, 4, count)
+}
+
+func TestMessage_LocationJSON(t *testing.T) {
+	m := newDefaultMessage("sensors", "berlin")
+	m.Location = &location{Lat: 52.52, Lng: 13.405}
+	b, err := json.Marshal(m)
+	require.Nil(t, err)
+	require.Contains(t, string(b), `"location":{"lat":52.52,"lng":13.405}`)
+
+	b, err = json.Marshal(newDefaultMessage("sensors", "no location"))
+	require.Nil(t, err)
+	require.NotContains(t, string(b), `"location"`)
+}
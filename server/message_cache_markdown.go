@@ -0,0 +1,60 @@
+package server
+
+import (
+	"heckel.io/ntfy/util"
+)
+
+// Markdown bodies can be rendered to HTML when a message is added to the cache, so that clients do not
+// have to render Markdown themselves. Rendering is opt-in per message (see message.Markdown), and the
+// sanitized HTML is stored in the body_html column. If the body of a message is encrypted at rest, the
+// HTML is encrypted with the same key, since it contains the same information.
+//
+// The content type of the body is stored in the content_type column, so that clients know whether to render
+// historical messages as Markdown. It is empty for plain text.
+
+const (
+	contentTypeMarkdown = "text/markdown"
+)
+
+// messageContentType returns the content type of the body of m as it is stored in the content_type column.
+// Whether the body is Markdown is decided by message.Markdown, so that a message can be updated to plain text.
+func messageContentType(m *message) string {
+	if m.Markdown {
+		return contentTypeMarkdown
+	} else if m.ContentType == contentTypeMarkdown {
+		return ""
+	}
+	return m.ContentType
+}
+
+// encodeMessageHTML renders the body of a Markdown message to HTML, and returns it as it should be stored
+// in the database, given the storage encoding of the body (see encodeMessageBody). For messages that are not
+// Markdown, and for binary messages, the HTML is empty.
+func (c *messageCache) encodeMessageHTML(m *message, storageEncoding string) (interface{}, error) {
+	if !m.Markdown || m.Encoding == encodingBase64 {
+		return "", nil
+	}
+	html := util.RenderMarkdown(m.Message)
+	keyID := encryptionKeyID(storageEncoding)
+	if html == "" || keyID == "" {
+		return html, nil
+	}
+	key, err := c.encryptionKey(m.Topic, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return encryptWithKey(key, []byte(html))
+}
+
+// decodeMessageHTML reverses encodeMessageHTML
+func (c *messageCache) decodeMessageHTML(topic, html, storageEncoding string) (string, error) {
+	keyID := encryptionKeyID(storageEncoding)
+	if html == "" || keyID == "" {
+		return html, nil
+	}
+	decrypted, err := c.decryptBody(topic, []byte(html), keyID)
+	if err != nil {
+		return "", err
+	}
+	return string(decrypted), nil
+}
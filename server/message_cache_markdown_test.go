@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSqliteCache_MarkdownHTML(t *testing.T) {
+	testCacheMarkdownHTML(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MarkdownHTML(t *testing.T) {
+	testCacheMarkdownHTML(t, newMemTestCache(t))
+}
+
+func testCacheMarkdownHTML(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "**Backup** done <script>alert(1)</script>")
+	m1.Markdown = true
+	m2 := newDefaultMessage("mytopic", "**not** markdown")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.True(t, messages[0].Markdown)
+	require.Equal(t, contentTypeMarkdown, messages[0].ContentType)
+	require.Equal(t, "**Backup** done <script>alert(1)</script>", messages[0].Message)
+	require.Equal(t, "<p><strong>Backup</strong> done alert(1)</p>", messages[0].BodyHTML)
+	require.False(t, messages[1].Markdown)
+	require.Equal(t, "", messages[1].ContentType)
+	require.Equal(t, "", messages[1].BodyHTML)
+
+	// Updates render the HTML again, or clear it if the new body is not Markdown
+	updated := *messages[0]
+	updated.Message = "*Backup* failed"
+	require.Nil(t, c.UpdateMessage(&updated))
+	m, err := c.Message("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, "<p><em>Backup</em> failed</p>", m.BodyHTML)
+	updated.Markdown = false
+	require.Nil(t, c.UpdateMessageIfUnchanged(&updated, updated.Updated))
+	m, err = c.Message("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.False(t, m.Markdown)
+	require.Equal(t, "", m.ContentType)
+	require.Equal(t, "", m.BodyHTML)
+}
+
+func TestSqliteCache_MarkdownContentTypeBinary(t *testing.T) {
+	testCacheMarkdownContentTypeBinary(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MarkdownContentTypeBinary(t *testing.T) {
+	testCacheMarkdownContentTypeBinary(t, newMemTestCache(t))
+}
+
+func testCacheMarkdownContentTypeBinary(t *testing.T, c *messageCache) {
+	// Binary messages have no HTML, but the content type is still returned
+	m := newDefaultMessage("mytopic", "KiogYmluYXJ5ICoq")
+	m.Encoding = encodingBase64
+	m.Markdown = true
+	require.Nil(t, c.AddMessage(m))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.True(t, messages[0].Markdown)
+	require.Equal(t, contentTypeMarkdown, messages[0].ContentType)
+	require.Equal(t, "", messages[0].BodyHTML)
+}
+
+func TestSqliteCache_MarkdownContentTypeMigration(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	m1 := newDefaultMessage("mytopic", "**markdown**")
+	m1.Markdown = true
+	m2 := newDefaultMessage("mytopic", "plain")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+	require.Nil(t, c.Close())
+
+	// Turn the file back into a "version 50" cache, without the content_type column
+	db, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	_, err = db.Exec(`ALTER TABLE messages DROP COLUMN content_type; UPDATE schemaVersion SET version = 50`)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	// Old Markdown messages are recognized by their HTML, all others default to plain text
+	c = newSqliteTestCacheFromFile(t, filename)
+	checkSchemaVersion(t, c.db)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.True(t, messages[0].Markdown)
+	require.Equal(t, contentTypeMarkdown, messages[0].ContentType)
+	require.False(t, messages[1].Markdown)
+	require.Equal(t, "", messages[1].ContentType)
+}
+
+func TestSqliteCache_MarkdownHTMLEncrypted(t *testing.T) {
+	keys := newTestKeyProvider()
+	c, err := newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{KeyProvider: keys})
+	require.Nil(t, err)
+	testCacheMarkdownHTMLEncrypted(t, c, keys)
+}
+
+func TestMemCache_MarkdownHTMLEncrypted(t *testing.T) {
+	keys := newTestKeyProvider()
+	c, err := newMemCacheWithOptions(&messageCacheOptions{KeyProvider: keys})
+	require.Nil(t, err)
+	testCacheMarkdownHTMLEncrypted(t, c, keys)
+}
+
+func testCacheMarkdownHTMLEncrypted(t *testing.T, c *messageCache, keys *testKeyProvider) {
+	keys.current["secret"] = bytes.Repeat([]byte{1}, 32)
+	m := newDefaultMessage("secret", "*top secret*")
+	m.Markdown = true
+	require.Nil(t, c.AddMessage(m))
+
+	var html string
+	require.Nil(t, c.db.QueryRow(`SELECT body_html FROM messages WHERE mid = ?`, m.ID).Scan(&html))
+	require.NotContains(t, html, "top secret")
+
+	messages, err := c.Messages("secret", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "<p><em>top secret</em></p>", messages[0].BodyHTML)
+}
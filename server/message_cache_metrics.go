@@ -0,0 +1,37 @@
+package server
+
+import (
+	"time"
+)
+
+// To monitor the cache (e.g. with Prometheus histograms) without the cache depending on a metrics library, an
+// OnQuery hook can be set, see messageCacheOptions. It is called at the end of the main operations of the cache
+// with the name of the operation (one of the queryOp* constants), its duration and its error, if any. Operations
+// that are implemented on top of others, e.g. MessagesWithPriority, are reported under the name of the operation
+// they use. Since the hook is called synchronously, it must be fast.
+
+// queryHook is called with the name (one of the queryOp* constants), duration and error of a cache operation
+type queryHook func(op string, d time.Duration, err error)
+
+// Names of the operations reported to the OnQuery hook
+const (
+	queryOpAddMessage    = "add_message"
+	queryOpAddMessages   = "add_messages"
+	queryOpUpdateMessage = "update_message"
+	queryOpDeleteMessage = "delete_message"
+	queryOpMessage       = "message"
+	queryOpMessages      = "messages"
+	queryOpMessagesDue   = "messages_due"
+	queryOpPrune         = "prune"
+)
+
+// observe reports an operation to the OnQuery hook, if it is set. It is meant to be deferred at the start of the
+// operation with a pointer to its named error result, so that the error is read once the operation returns:
+//
+//	defer c.observe(queryOpPrune, time.Now(), &err)
+func (c *messageCache) observe(op string, start time.Time, err *error) {
+	if c.onQuery == nil {
+		return
+	}
+	c.onQuery(op, time.Since(start), *err)
+}
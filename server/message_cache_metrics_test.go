@@ -0,0 +1,68 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_OnQuery(t *testing.T) {
+	testCacheOnQuery(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_OnQuery(t *testing.T) {
+	testCacheOnQuery(t, createMemoryFilename())
+}
+
+func testCacheOnQuery(t *testing.T, filename string) {
+	ops := make([]string, 0)
+	errs := make([]error, 0)
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{
+		OnQuery: func(op string, d time.Duration, err error) {
+			require.True(t, d >= 0)
+			ops = append(ops, op)
+			errs = append(errs, err)
+		},
+	})
+	require.Nil(t, err)
+
+	m := newDefaultMessage("mytopic", "some message")
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.AddMessages([]*message{newDefaultMessage("mytopic", "another message")}))
+	m.Message = "updated"
+	require.Nil(t, c.UpdateMessage(m))
+	_, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	_, err = c.Message("mytopic", m.ID)
+	require.Nil(t, err)
+	_, err = c.MessagesDue()
+	require.Nil(t, err)
+	require.Nil(t, c.Prune(time.Now().Add(-time.Hour), 0))
+	require.Nil(t, c.DeleteMessage("mytopic", m.ID))
+	require.Equal(t, []string{
+		queryOpAddMessage,
+		queryOpAddMessages,
+		queryOpUpdateMessage,
+		queryOpMessages,
+		queryOpMessage,
+		queryOpMessagesDue,
+		queryOpPrune,
+		queryOpDeleteMessage,
+	}, ops)
+	for _, err := range errs {
+		require.Nil(t, err)
+	}
+
+	// Errors are reported as well
+	_, err = c.Message("mytopic", "doesnotexist")
+	require.Equal(t, errMessageNotFound, err)
+	require.Equal(t, queryOpMessage, ops[len(ops)-1])
+	require.Equal(t, errMessageNotFound, errs[len(errs)-1])
+}
+
+func TestSqliteCache_OnQuery_NotSet(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "some message")))
+	_, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"database/sql"
+)
+
+// MigrateCache copies all messages from one cache to another, e.g. from a cache file to a new one with different
+// storage settings, without downtime: The source can be used while it is copied, and messages added in the meantime
+// are copied by running it again. Like ImportMessages, messages are stored according to the settings of the
+// destination cache (e.g. its encryption keys and topic aliases), but unlike an export, the whole cache is copied,
+// and the state of the rows is preserved: scheduled messages stay scheduled, and updated timestamps, repeat counts
+// and read counts are kept.
+//
+// Messages are read in batches of forEachMessageBatchSize by row ID, and each batch is inserted in a single
+// transaction. Messages whose ID already exists in their topic in the destination are skipped, so that an
+// interrupted migration can simply be restarted. As with ExportTopic, per-message state that is kept in other
+// tables (acknowledgements, pins, per-subscriber read state and delivery counts) and per-topic settings are
+// not copied.
+
+const (
+	selectMessagesForMigrationQuery = `
+		SELECT ` + selectMessageColumns + `, token, source_ip, user_agent, raw_priority, not_after, dedup_key, attachment_hash, email
+		FROM messages
+		WHERE id > ? AND id <= ?
+		ORDER BY id
+	`
+	selectPublishedBetweenIDsQuery = `SELECT mid, published FROM messages WHERE id > ? AND id <= ?`
+	updateMigratedMessageQuery     = `UPDATE messages SET published = ?, updated = ?, read_count = ? WHERE topic = ? AND mid = ?`
+)
+
+// MigrateCache copies all messages from src to dst, see above. It returns the number of copied messages, which
+// excludes messages that were skipped because they already exist in dst (or because their deduplication key
+// was already used). If progress is not nil, it is called after every batch with the total number of copied
+// and skipped messages so far. If a batch fails, the messages of the previous batches remain copied.
+func MigrateCache(src, dst *messageCache, progress func(copied, skipped int)) (int, error) {
+	copied, skipped := 0, 0
+	lastID := int64(0)
+	for {
+		endID, err := src.batchEndRowID(lastID, forEachMessageBatchSize)
+		if err != nil {
+			return copied, err
+		} else if endID == 0 {
+			return copied, nil
+		}
+		messages, published, err := src.messagesForMigration(lastID, endID)
+		if err != nil {
+			return copied, err
+		}
+		n, err := dst.insertMigratedMessages(messages, published)
+		if err != nil {
+			return copied, err
+		}
+		copied += n
+		skipped += len(messages) - n
+		if progress != nil {
+			progress(copied, skipped)
+		}
+		lastID = endID
+	}
+}
+
+// messagesForMigration returns the messages with a row ID in (afterID, endID], along with their published state
+// by message ID. Messages that are deleted while they are read are not returned.
+func (c *messageCache) messagesForMigration(afterID, endID int64) ([]*message, map[string]bool, error) {
+	rows, err := c.db.Query(selectMessagesForMigrationQuery, afterID, endID)
+	if err != nil {
+		return nil, nil, err
+	}
+	messages, err := c.readMessages(c.db, rows)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err = c.db.Query(selectPublishedBetweenIDsQuery, afterID, endID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	published := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		var p bool
+		if err := rows.Scan(&id, &p); err != nil {
+			return nil, nil, err
+		}
+		published[id] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	remaining := make([]*message, 0, len(messages))
+	for _, m := range messages {
+		if _, ok := published[m.ID]; !ok {
+			continue
+		}
+		if len(m.Attachments) > 0 && m.Attachment != nil {
+			m.Attachments[0].Hash = m.Attachment.Hash // Only stored in the messages table, see toMessage
+		}
+		remaining = append(remaining, m)
+	}
+	return remaining, published, nil
+}
+
+// insertMigratedMessages inserts the messages in a single transaction like AddMessages, skipping messages whose ID
+// already exists in their topic, and sets their published state, updated timestamp and read count as in the
+// source. It returns the number of inserted messages.
+func (c *messageCache) insertMigratedMessages(ms []*message, published map[string]bool) (int, error) {
+	if err := c.prepareMessages(ms); err != nil {
+		return 0, err
+	} else if c.nop || len(ms) == 0 {
+		return 0, nil
+	}
+	ids := make([]string, len(ms))
+	repeatCounts := make([]int, len(ms))
+	for i, m := range ms {
+		ids[i], repeatCounts[i] = m.ID, m.RepeatCount
+	}
+	var inserted []*message
+	err := c.retryBusy(func() error {
+		for i, m := range ms {
+			m.ID, m.RepeatCount = ids[i], repeatCounts[i] // Undo debounceMessage of a rolled back attempt
+		}
+		inserted = make([]*message, 0, len(ms))
+		if c.spill != nil {
+			c.spill.mu.RLock() // Messages added while spilling would be lost
+			defer c.spill.mu.RUnlock()
+		}
+		return c.withTx(func(tx *sql.Tx) error {
+			stmt, err := tx.Prepare(insertMessageQuery)
+			if err != nil {
+				return err
+			}
+			defer stmt.Close()
+			for i, m := range ms {
+				topic := c.topicKey(m.Topic)
+				if _, err := queryMessageRowID(tx, topic, m.ID); err == nil {
+					continue // Copied before
+				} else if err != errMessageNotFound {
+					return err
+				}
+				if err := c.insertMessageWithStmt(tx, stmt, m); err == errMessageDuplicate {
+					continue
+				} else if err != nil {
+					return err
+				} else if m.ID != ids[i] {
+					continue // Merged into the previous message, see debounceMessage
+				}
+				if _, err := tx.Exec(updateMigratedMessageQuery, published[m.ID], m.Updated, m.ReadCount, topic, m.ID); err != nil {
+					return err
+				}
+				inserted = append(inserted, m)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.emitWrite(writeOpAdd, inserted...)
+	return len(inserted), c.maybeSpill()
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqliteCache_MigrateCache(t *testing.T) {
+	testCacheMigrateCache(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MigrateCache(t *testing.T) {
+	testCacheMigrateCache(t, newMemTestCache(t))
+}
+
+func testCacheMigrateCache(t *testing.T, src *messageCache) {
+	published := newDefaultMessage("mytopic", "published")
+	published.Title = "A title"
+	published.Tags = []string{"tag1", "tag2"}
+	published.Sender = "1.2.3.4"
+	published.Attachment = &attachment{Name: "screen.png", Type: "image/png", Size: 5000, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://ntfy.sh/file/screen.png", Hash: "abc123"}
+	require.Nil(t, assignMessageToken(published))
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	due := newDefaultMessage("othertopic", "due, but not delivered yet")
+	due.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, src.AddMessages([]*message{published, scheduled, due}))
+	_, err := src.db.Exec(`UPDATE messages SET time = ? WHERE mid = ?`, time.Now().Add(-time.Minute).Unix(), due.ID)
+	require.Nil(t, err)
+	_, err = src.db.Exec(`UPDATE messages SET updated = ? WHERE mid = ?`, published.Time+10, published.ID)
+	require.Nil(t, err)
+	require.Nil(t, src.IncrementRead("mytopic", published.ID))
+	for i := 0; i < 150; i++ {
+		require.Nil(t, src.AddMessage(newDefaultMessage("bulk", fmt.Sprintf("message %d", i))))
+	}
+
+	dst := newMemTestCache(t)
+	progress := make([][2]int, 0)
+	copied, err := MigrateCache(src, dst, func(copied, skipped int) {
+		progress = append(progress, [2]int{copied, skipped})
+	})
+	require.Nil(t, err)
+	require.Equal(t, 153, copied)
+	require.Equal(t, [][2]int{{100, 0}, {153, 0}}, progress)
+
+	// Fields and state are preserved
+	m, err := dst.Message("mytopic", published.ID)
+	require.Nil(t, err)
+	require.Equal(t, published.Time, m.Time)
+	require.Equal(t, published.Time+10, m.Updated)
+	require.Equal(t, "A title", m.Title)
+	require.Equal(t, []string{"tag1", "tag2"}, m.Tags)
+	require.Equal(t, "1.2.3.4", m.Sender)
+	var token, hash string
+	require.Nil(t, dst.db.QueryRow(`SELECT token, attachment_hash FROM messages WHERE mid = ?`, published.ID).Scan(&token, &hash))
+	require.Equal(t, published.Token, token)
+	require.Equal(t, "abc123", hash)
+	require.Equal(t, 1, m.ReadCount)
+	require.Equal(t, "screen.png", m.Attachment.Name)
+	require.Equal(t, "image/png", m.Attachment.Type)
+	require.Equal(t, int64(5000), m.Attachment.Size)
+	require.Equal(t, published.Attachment.Expires, m.Attachment.Expires)
+	require.Equal(t, "https://ntfy.sh/file/screen.png", m.Attachment.URL)
+
+	messages, err := dst.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	messages, err = dst.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, scheduled.ID, messages[1].ID)
+	messages, err = dst.MessagesDue()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, due.ID, messages[0].ID)
+
+	// Running it again only copies new messages
+	added := newDefaultMessage("mytopic", "added during migration")
+	require.Nil(t, src.AddMessage(added))
+	progress = progress[:0]
+	copied, err = MigrateCache(src, dst, func(copied, skipped int) {
+		progress = append(progress, [2]int{copied, skipped})
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, copied)
+	require.Equal(t, [][2]int{{0, 100}, {1, 153}}, progress)
+	count, err := dst.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 3, count)
+
+	// Nothing to do without progress callback
+	copied, err = MigrateCache(src, dst, nil)
+	require.Nil(t, err)
+	require.Equal(t, 0, copied)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A subscriber of several topics wants to see their messages as one merged stream. MessagesMultiTopic
+// reads them with a single query per batch of topics instead of one query per topic. MessagesMulti does the
+// same for a client that reconnects to several topics at once, but returns the messages grouped by topic.
+
+// The queries are formatted with the placeholders of the IN-list and notExpiredCondition, which cannot be part
+// of the format string itself, since it contains a literal %s.
+const (
+	selectMessagesMultiTopicQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic IN (%s) AND (time > ? OR (time = ? AND id > ?)) AND published = 1 AND %s
+		ORDER BY time DESC, id DESC
+		LIMIT ?
+	`
+	selectMessagesMultiQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic IN (%s) AND (time > ? OR (time = ? AND id > ?)) AND published = 1 AND %s
+		ORDER BY time_ms, id
+	`
+	selectMessagesMultiIncludeScheduledQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic IN (%s) AND (time > ? OR (time = ? AND id > ?) OR published = 0) AND %s
+		ORDER BY time_ms, id
+	`
+	selectMessageTimeAndRowIDQuery = `SELECT time, id FROM messages WHERE mid = ? ORDER BY id LIMIT 1`
+)
+
+// multiTopicBatchSize is the maximum number of topics in the IN-list of a single query, to stay below
+// SQLite's limit of query parameters
+const multiTopicBatchSize = 500
+
+// MessagesMultiTopic returns the (non-scheduled) messages of all given topics after the given since marker,
+// merged and ordered by time. If limit is positive, only the newest limit messages are returned. If the topics
+// do not fit into one query (see multiTopicBatchSize), the results of several queries are merged; messages of
+// different batches with the same time are then not necessarily in insertion order.
+func (c *messageCache) MessagesMultiTopic(topics []string, since sinceMarker, limit int) ([]*message, error) {
+	for _, topic := range topics {
+		if err := validateTopic(topic); err != nil {
+			return nil, err
+		}
+	}
+	if since.IsNone() || since.IsNow() || len(topics) == 0 {
+		return make([]*message, 0), nil
+	}
+	if limit <= 0 {
+		limit = -1 // No limit in SQLite
+	}
+	sinceTime, sinceRowID, err := c.multiTopicSince(since)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make([]interface{}, 0)
+	for _, topic := range topics {
+		resolved = append(resolved, c.ResolveTopic(topic))
+	}
+	messages := make([]*message, 0)
+	for len(resolved) > 0 {
+		n := len(resolved)
+		if n > multiTopicBatchSize {
+			n = multiTopicBatchSize
+		}
+		batch, err := c.messagesMultiTopicBatch(resolved[:n], sinceTime, sinceRowID, limit)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, batch...)
+		resolved = resolved[n:]
+	}
+	// Each batch is ordered newest first; merge them and keep the newest messages
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Time > messages[j].Time
+	})
+	if limit > 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// MessagesMulti returns the messages of all given topics after the given since marker, including scheduled
+// messages if scheduled is set, grouped by topic. The map has an entry for each given topic, and the messages of
+// each topic are in the same order as in Messages. Unlike for Messages, a since ID may belong to any of the
+// topics: It is resolved to the time of that message, see multiTopicSince. The topics are passed to the query
+// as parameters, in batches of multiTopicBatchSize.
+func (c *messageCache) MessagesMulti(topics []string, since sinceMarker, scheduled bool) (map[string][]*message, error) {
+	for _, topic := range topics {
+		if err := validateTopic(topic); err != nil {
+			return nil, err
+		}
+	}
+	grouped := make(map[string][]*message)
+	for _, topic := range topics {
+		grouped[topic] = make([]*message, 0)
+	}
+	if since.IsNone() || since.IsNow() || len(topics) == 0 {
+		return grouped, nil
+	}
+	sinceTime, sinceRowID, err := c.multiTopicSince(since)
+	if err != nil {
+		return nil, err
+	}
+	requested := make(map[string][]string) // Given topics by resolved topic, e.g. an alias and its canonical topic
+	resolved := make([]interface{}, 0)
+	for topic := range grouped {
+		key := c.ResolveTopic(topic)
+		if _, ok := requested[key]; !ok {
+			resolved = append(resolved, key)
+		}
+		requested[key] = append(requested[key], topic)
+	}
+	query := selectMessagesMultiQuery
+	if scheduled {
+		query = selectMessagesMultiIncludeScheduledQuery
+	}
+	for len(resolved) > 0 {
+		n := len(resolved)
+		if n > multiTopicBatchSize {
+			n = multiTopicBatchSize
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+		args := append(append([]interface{}{}, resolved[:n]...), sinceTime, sinceTime, sinceRowID)
+		rows, err := c.db.Query(fmt.Sprintf(query, placeholders, notExpiredCondition), args...)
+		if err != nil {
+			return nil, err
+		}
+		messages, err := c.readMessages(c.db, rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range messages {
+			for _, topic := range requested[c.ResolveTopic(m.Topic)] {
+				grouped[topic] = append(grouped[topic], m)
+			}
+		}
+		resolved = resolved[n:]
+	}
+	return grouped, nil
+}
+
+// multiTopicSince returns the time and row ID after which messages are returned by MessagesMultiTopic. A since
+// time t is expressed as (t, 0), i.e. all messages at or after t. A since ID is resolved to the time and row ID
+// of that message; if it does not exist, all messages are returned, just like for a single topic.
+func (c *messageCache) multiTopicSince(since sinceMarker) (int64, int64, error) {
+	if !since.IsID() {
+		return since.Time().Unix(), 0, nil
+	}
+	rows, err := c.db.Query(selectMessageTimeAndRowIDQuery, since.ID())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, 0, rows.Err()
+	}
+	var sinceTime, sinceRowID int64
+	if err := rows.Scan(&sinceTime, &sinceRowID); err != nil {
+		return 0, 0, err
+	}
+	return sinceTime, sinceRowID, nil
+}
+
+func (c *messageCache) messagesMultiTopicBatch(topics []interface{}, sinceTime, sinceRowID int64, limit int) ([]*message, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(topics)), ", ")
+	args := make([]interface{}, 0, len(topics)+4)
+	args = append(args, topics...)
+	args = append(args, sinceTime, sinceTime, sinceRowID, limit)
+	rows, err := c.db.Query(fmt.Sprintf(selectMessagesMultiTopicQuery, placeholders, notExpiredCondition), args...)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_MessagesMultiTopic(t *testing.T) {
+	testCacheMessagesMultiTopic(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesMultiTopic(t *testing.T) {
+	testCacheMessagesMultiTopic(t, newMemTestCache(t))
+}
+
+func testCacheMessagesMultiTopic(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("topic1", "message 1")
+	m1.Time = 1000
+	m2 := newDefaultMessage("topic2", "message 2")
+	m2.Time = 2000
+	m3 := newDefaultMessage("topic3", "message 3")
+	m3.Time = 3000
+	m4 := newDefaultMessage("topic1", "message 4")
+	m4.Time = 3000
+	m5 := newDefaultMessage("othertopic", "message 5")
+	m5.Time = 2500
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4, m5}))
+
+	topics := []string{"topic1", "topic2", "topic3"}
+	messages, err := c.MessagesMultiTopic(topics, sinceAllMessages, 0)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "message 2", messages[1].Message)
+	require.Equal(t, "message 3", messages[2].Message)
+	require.Equal(t, "message 4", messages[3].Message)
+
+	// Newest messages only
+	messages, err = c.MessagesMultiTopic(topics, sinceAllMessages, 2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+	require.Equal(t, "message 4", messages[1].Message)
+
+	// Since time and ID
+	messages, err = c.MessagesMultiTopic(topics, newSinceTime(2000), 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "message 2", messages[0].Message)
+
+	messages, err = c.MessagesMultiTopic(topics, newSinceID(m3.ID), 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 4", messages[0].Message)
+
+	messages, err = c.MessagesMultiTopic(topics, sinceNoMessages, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	_, err = c.MessagesMultiTopic([]string{"topic1", ""}, sinceAllMessages, 0)
+	require.Equal(t, errInvalidTopic, err)
+}
+
+func TestSqliteCache_MessagesMultiTopic_ManyTopics(t *testing.T) {
+	c := newSqliteTestCache(t)
+	topics := make([]string, 0)
+	messages := make([]*message, 0)
+	for i := 0; i < multiTopicBatchSize+100; i++ {
+		topic := fmt.Sprintf("topic%d", i)
+		topics = append(topics, topic)
+		m := newDefaultMessage(topic, fmt.Sprintf("message %d", i))
+		m.Time = int64(1000 + i)
+		messages = append(messages, m)
+	}
+	require.Nil(t, c.AddMessages(messages))
+
+	result, err := c.MessagesMultiTopic(topics, sinceAllMessages, 0)
+	require.Nil(t, err)
+	require.Equal(t, len(topics), len(result))
+	for i, m := range result {
+		require.Equal(t, fmt.Sprintf("message %d", i), m.Message)
+	}
+
+	result, err = c.MessagesMultiTopic(topics, sinceAllMessages, 3)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(result))
+	require.Equal(t, fmt.Sprintf("message %d", len(topics)-3), result[0].Message)
+	require.Equal(t, fmt.Sprintf("message %d", len(topics)-1), result[2].Message)
+}
+
+func TestSqliteCache_MessagesMulti(t *testing.T) {
+	testCacheMessagesMulti(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesMulti(t *testing.T) {
+	testCacheMessagesMulti(t, newMemTestCache(t))
+}
+
+func testCacheMessagesMulti(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("topic1", "message 1")
+	m1.Time = 1000
+	m2 := newDefaultMessage("topic2", "message 2")
+	m2.Time = 2000
+	m3 := newDefaultMessage("topic1", "message 3")
+	m3.Time = 3000
+	m4 := newDefaultMessage("othertopic", "message 4")
+	m4.Time = 2500
+	scheduled := newDefaultMessage("topic2", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4, scheduled}))
+
+	topics := []string{"topic1", "topic2", "emptytopic", "topic1"}
+	grouped, err := c.MessagesMulti(topics, sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(grouped))
+	require.Equal(t, 2, len(grouped["topic1"]))
+	require.Equal(t, "message 1", grouped["topic1"][0].Message)
+	require.Equal(t, "message 3", grouped["topic1"][1].Message)
+	require.Equal(t, 1, len(grouped["topic2"]))
+	require.Equal(t, "message 2", grouped["topic2"][0].Message)
+	require.Empty(t, grouped["emptytopic"])
+
+	grouped, err = c.MessagesMulti(topics, sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(grouped["topic2"]))
+	require.Equal(t, "scheduled", grouped["topic2"][1].Message)
+
+	// Since time and ID
+	grouped, err = c.MessagesMulti(topics, newSinceTime(2000), false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(grouped["topic1"]))
+	require.Equal(t, 1, len(grouped["topic2"]))
+
+	grouped, err = c.MessagesMulti(topics, newSinceID(m2.ID), true)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(grouped["topic1"]))
+	require.Equal(t, "message 3", grouped["topic1"][0].Message)
+	require.Equal(t, 1, len(grouped["topic2"]))
+	require.Equal(t, "scheduled", grouped["topic2"][0].Message)
+
+	grouped, err = c.MessagesMulti(topics, sinceNoMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(grouped))
+	require.Empty(t, grouped["topic1"])
+
+	grouped, err = c.MessagesMulti([]string{}, sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Empty(t, grouped)
+
+	// Topics are passed as parameters, never as part of the query
+	injected := "x') OR 1=1 --"
+	grouped, err = c.MessagesMulti([]string{injected}, sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(grouped))
+	require.Empty(t, grouped[injected])
+	_, err = c.MessagesMulti([]string{"topic1", ""}, sinceAllMessages, false)
+	require.Equal(t, errInvalidTopic, err)
+}
+
+func TestSqliteCache_MessagesMulti_ManyTopics(t *testing.T) {
+	c := newSqliteTestCache(t)
+	topics := make([]string, 0)
+	messages := make([]*message, 0)
+	for i := 0; i < multiTopicBatchSize+100; i++ {
+		topic := fmt.Sprintf("topic%d", i)
+		topics = append(topics, topic)
+		messages = append(messages, newDefaultMessage(topic, fmt.Sprintf("message %d", i)))
+	}
+	require.Nil(t, c.AddMessages(messages))
+
+	grouped, err := c.MessagesMulti(topics, sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, len(topics), len(grouped))
+	for i, topic := range topics {
+		require.Equal(t, 1, len(grouped[topic]))
+		require.Equal(t, fmt.Sprintf("message %d", i), grouped[topic][0].Message)
+	}
+}
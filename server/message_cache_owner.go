@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+)
+
+// The sender of a message is the owner of its attachments, which is what the attachment quota is accounted
+// by. To keep user names or IP addresses out of the database, an owner hasher (see messageCacheOptions) can
+// turn them into opaque values before they are stored, e.g. an HMAC (see newHMACOwnerHasher). Since the same
+// owner always results in the same value, quota accounting by owner works as before.
+//
+// Only messages added after the hasher was set are affected; existing rows keep the plain owner, since it
+// cannot be derived from the hash.
+
+const (
+	updateAttachmentOwnerQuery        = `UPDATE messages SET sender = ? WHERE sender = ? AND attachment_size > 0`
+	updateMessageAttachmentOwnerQuery = `UPDATE message_attachments SET owner = ? WHERE owner = ?`
+)
+
+// newHMACOwnerHasher returns an owner hasher that replaces an owner with the hex-encoded HMAC-SHA256 of it,
+// using the given secret key. The key must be kept, otherwise existing owners can no longer be matched.
+func newHMACOwnerHasher(key []byte) func(owner string) string {
+	return func(owner string) string {
+		if owner == "" {
+			return ""
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(owner))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+}
+
+// ownerKey returns the owner as it is stored in the database, i.e. hashed if the cache has an owner hasher
+func (c *messageCache) ownerKey(owner string) string {
+	if c.ownerHasher == nil {
+		return owner
+	}
+	return c.ownerHasher(owner)
+}
+
+// ReassignAttachmentOwner transfers all attachments of one owner to another, e.g. when a user is renamed,
+// and returns the number of messages whose attachments were reassigned. The attachment quota of both owners
+// is updated accordingly.
+func (c *messageCache) ReassignAttachmentOwner(from, to string) (int, error) {
+	from, to = c.ownerKey(from), c.ownerKey(to)
+	var reassigned int64
+	err := c.withTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(updateAttachmentOwnerQuery, to, from)
+		if err != nil {
+			return err
+		}
+		if reassigned, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		_, err = tx.Exec(updateMessageAttachmentOwnerQuery, to, from)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(reassigned), nil
+}
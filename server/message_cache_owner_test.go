@@ -0,0 +1,105 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_OwnerHasher(t *testing.T) {
+	testCacheOwnerHasher(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_OwnerHasher(t *testing.T) {
+	testCacheOwnerHasher(t, createMemoryFilename())
+}
+
+func testCacheOwnerHasher(t *testing.T, filename string) {
+	hasher := newHMACOwnerHasher([]byte("secret"))
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{OwnerHasher: hasher})
+	require.Nil(t, err)
+	expires := time.Now().Add(time.Hour).Unix()
+	m1 := newDefaultMessage("mytopic", "attachment of phil")
+	m1.Sender = "phil"
+	m1.Attachment = &attachment{Name: "a.txt", Size: 1000, Expires: expires, URL: "https://example.com/a.txt"}
+	m2 := newDefaultMessage("mytopic", "another attachment of phil")
+	m2.Sender = "phil"
+	m2.Attachment = &attachment{Name: "b.txt", Size: 500, Expires: expires, URL: "https://example.com/b.txt"}
+	m3 := newDefaultMessage("mytopic", "attachment of ben")
+	m3.Sender = "ben"
+	m3.Attachment = &attachment{Name: "c.txt", Size: 100, Expires: expires, URL: "https://example.com/c.txt"}
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+	require.Equal(t, "phil", m1.Sender) // Message is not modified
+
+	// Plain owner never lands on disk
+	for _, query := range []string{`SELECT COUNT(*) FROM messages WHERE sender IN ('phil', 'ben')`, `SELECT COUNT(*) FROM message_attachments WHERE owner IN ('phil', 'ben')`} {
+		var count int
+		require.Nil(t, c.db.QueryRow(query).Scan(&count))
+		require.Equal(t, 0, count)
+	}
+	var stored string
+	require.Nil(t, c.db.QueryRow(`SELECT sender FROM messages WHERE mid = ?`, m1.ID).Scan(&stored))
+	require.Equal(t, hasher("phil"), stored)
+	require.Len(t, stored, 64)
+
+	// Quota accounting works by equality
+	used, err := c.AttachmentBytesUsed("phil")
+	require.Nil(t, err)
+	require.Equal(t, int64(1500), used)
+	require.Nil(t, c.RecomputeAttachmentQuota("phil"))
+	used, err = c.AttachmentBytesUsed("phil")
+	require.Nil(t, err)
+	require.Equal(t, int64(1500), used)
+	messages, err := c.RecentForSender("phil", 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+
+	reassigned, err := c.ReassignAttachmentOwner("phil", "ben")
+	require.Nil(t, err)
+	require.Equal(t, 2, reassigned)
+	used, err = c.AttachmentBytesUsed("phil")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), used)
+	used, err = c.AttachmentBytesUsed("ben")
+	require.Nil(t, err)
+	require.Equal(t, int64(1600), used)
+	var count int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM message_attachments WHERE owner = ?`, hasher("ben")).Scan(&count))
+	require.Equal(t, 3, count)
+}
+
+func TestSqliteCache_ReassignAttachmentOwner(t *testing.T) {
+	testCacheReassignAttachmentOwner(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ReassignAttachmentOwner(t *testing.T) {
+	testCacheReassignAttachmentOwner(t, newMemTestCache(t))
+}
+
+func testCacheReassignAttachmentOwner(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "with attachment")
+	m1.Sender = "1.2.3.4"
+	m1.Attachment = &attachment{Name: "a.txt", Size: 1000, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://example.com/a.txt"}
+	m2 := newDefaultMessage("mytopic", "without attachment")
+	m2.Sender = "1.2.3.4"
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	reassigned, err := c.ReassignAttachmentOwner("1.2.3.4", "5.6.7.8")
+	require.Nil(t, err)
+	require.Equal(t, 1, reassigned)
+	used, err := c.AttachmentBytesUsed("5.6.7.8")
+	require.Nil(t, err)
+	require.Equal(t, int64(1000), used)
+	messages, err := c.RecentForSender("1.2.3.4", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "without attachment", messages[0].Message)
+}
+
+func TestHMACOwnerHasher(t *testing.T) {
+	hasher := newHMACOwnerHasher([]byte("secret"))
+	require.Equal(t, hasher("phil"), hasher("phil"))
+	require.NotEqual(t, hasher("phil"), hasher("ben"))
+	require.NotEqual(t, hasher("phil"), newHMACOwnerHasher([]byte("other secret"))("phil"))
+	require.Equal(t, "", hasher(""))
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Every stored message is assigned a global publish sequence number, which increases monotonically with every
+// message added to the cache. Unlike the row ID, the sequence is kept in its own table, so it is never reused,
+// not even if the newest messages are pruned or deleted. It is meant as a resume cursor for clients that does
+// not depend on the database backend, see MessagesSinceSeq.
+//
+// Since the sequence number is unique, it also breaks ties between messages that were updated within the
+// same second, see ChangesSince.
+
+const (
+	createPublishSequenceTableQuery = `
+		CREATE TABLE IF NOT EXISTS publish_sequence (
+			seq INT NOT NULL
+		);
+		INSERT INTO publish_sequence (seq) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM publish_sequence);
+	`
+	incrementPublishSequenceQuery = `UPDATE publish_sequence SET seq = seq + 1`
+	selectPublishSequenceQuery    = `SELECT seq FROM publish_sequence`
+	selectMessagesSinceSeqQuery   = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND publish_seq > ? AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY publish_seq
+	`
+	selectChangesSinceQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND (updated > ? OR (updated = ? AND publish_seq > ?)) AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY updated, publish_seq
+	`
+)
+
+// MessagesSinceSeq returns the published messages of a topic with a publish sequence number greater than
+// seq, ordered by their sequence number. Clients can pass the sequence number of the last message they
+// received to resume where they left off.
+func (c *messageCache) MessagesSinceSeq(topic string, seq int64) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	rows, err := c.db.Query(selectMessagesSinceSeqQuery, c.ResolveTopic(topic), seq)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// ChangesSince returns the published messages of a topic that were added or updated after the given cursor,
+// ordered by (updated, publish sequence number). The cursor is the updated timestamp and the publish sequence
+// number of the last message a client received, i.e. (0, 0) to get all messages. Unlike a cursor on the
+// updated timestamp alone, no messages are skipped or returned twice if many share the same second.
+func (c *messageCache) ChangesSince(topic string, updatedAfter int64, seqAfter int64) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	rows, err := c.db.Query(selectChangesSinceQuery, c.ResolveTopic(topic), updatedAfter, updatedAfter, seqAfter)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// nextPublishSeq increments the publish sequence within the given transaction and returns the new value
+func nextPublishSeq(tx *sql.Tx) (int64, error) {
+	if _, err := tx.Exec(incrementPublishSequenceQuery); err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(selectPublishSequenceQuery)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	var seq int64
+	if err := rows.Scan(&seq); err != nil {
+		return 0, err
+	}
+	return seq, rows.Err()
+}
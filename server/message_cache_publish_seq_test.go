@@ -0,0 +1,111 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_MessagesSinceSeq(t *testing.T) {
+	testCacheMessagesSinceSeq(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesSinceSeq(t *testing.T) {
+	testCacheMessagesSinceSeq(t, newMemTestCache(t))
+}
+
+func testCacheMessagesSinceSeq(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m2 := newDefaultMessage("othertopic", "other message")
+	m3 := newDefaultMessage("mytopic", "message 2")
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+	messages, err := c.MessagesSinceSeq("othertopic", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, int64(2), messages[0].PublishSeq)
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+
+	messages, err = c.MessagesSinceSeq("mytopic", 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, int64(1), messages[0].PublishSeq)
+	require.Equal(t, "message 2", messages[1].Message)
+	require.Equal(t, int64(3), messages[1].PublishSeq)
+
+	messages, err = c.MessagesSinceSeq("mytopic", messages[0].PublishSeq)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 2", messages[0].Message)
+
+	// Sequence numbers are not reused after the newest messages are deleted
+	_, err = c.DeleteTopic("mytopic")
+	require.Nil(t, err)
+	m4 := newDefaultMessage("mytopic", "message 3")
+	require.Nil(t, c.AddMessage(m4))
+	messages, err = c.MessagesSinceSeq("mytopic", 3)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+	require.Equal(t, int64(5), messages[0].PublishSeq)
+}
+
+func TestSqliteCache_PublishSeqReopen(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "message 1")))
+	require.Nil(t, c.db.Close())
+
+	c = newSqliteTestCacheFromFile(t, filename)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "message 2")))
+	messages, err := c.MessagesSinceSeq("mytopic", 1)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, int64(2), messages[0].PublishSeq)
+}
+
+func TestSqliteCache_ChangesSince(t *testing.T) {
+	testCacheChangesSince(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ChangesSince(t *testing.T) {
+	testCacheChangesSince(t, newMemTestCache(t))
+}
+
+func testCacheChangesSince(t *testing.T, c *messageCache) {
+	past := time.Now().Add(-time.Hour).Unix()
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m3 := newDefaultMessage("mytopic", "message 3")
+	m1.Time, m2.Time, m3.Time = past, past, past // All in the same second
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other message")))
+
+	// Page through messages that share the same updated timestamp
+	messages, err := c.ChangesSince("mytopic", 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "message 3", messages[2].Message)
+	messages, err = c.ChangesSince("mytopic", messages[0].Updated, messages[0].PublishSeq)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 2", messages[0].Message)
+	last := messages[1]
+	messages, err = c.ChangesSince("mytopic", last.Updated, last.PublishSeq)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	// Edits are returned once, after the cursor
+	m1.Message = "message 1 edited"
+	require.Nil(t, c.UpdateMessage(m1))
+	messages, err = c.ChangesSince("mytopic", last.Updated, last.PublishSeq)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 1 edited", messages[0].Message)
+	messages, err = c.ChangesSince("mytopic", messages[0].Updated, messages[0].PublishSeq)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// For a web inbox, every subscriber has their own read state: a message read by one subscriber is still
+// unread for all others. Read state is stored in the message_read table, with one row per message and
+// subscriber that read it. Rows are removed along with their message (ON DELETE CASCADE).
+//
+// For use cases that only need to know whether anybody read a message, e.g. to re-alert on unacknowledged pages,
+// there is also an anonymous read counter in the read_count column of the messages table, see IncrementRead.
+// It is independent of the per-subscriber read state.
+
+const (
+	createMessageReadTableQuery = `
+		CREATE TABLE IF NOT EXISTS message_read (
+			message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			mid TEXT NOT NULL,
+			subscriber TEXT NOT NULL,
+			read_at INT NOT NULL,
+			PRIMARY KEY (message_id, subscriber)
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_read_subscriber ON message_read (subscriber);
+	`
+	insertMessageReadQuery  = `INSERT OR IGNORE INTO message_read (message_id, mid, subscriber, read_at) VALUES (?, ?, ?, ?)`
+	selectMessageRowIDQuery = `SELECT id FROM messages WHERE mid = ? ORDER BY id LIMIT 1`
+	selectUnreadCountQuery  = `
+		SELECT COUNT(*)
+		FROM messages
+		WHERE topic = ? AND published = 1 AND ` + notExpiredCondition + `
+			AND NOT EXISTS (SELECT 1 FROM message_read WHERE message_id = messages.id AND subscriber = ?)
+	`
+	updateMessageReadCountQuery     = `UPDATE messages SET read_count = read_count + 1 WHERE topic = ? AND mid = ?`
+	selectMessagesWithoutReadsQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND read_count = 0 AND published = 1 AND ` + notExpiredCondition + `
+		ORDER BY time_ms, id
+	`
+	selectUnreadMessagesSinceTimeQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND time >= ? AND published = 1 AND ` + notExpiredCondition + `
+			AND NOT EXISTS (SELECT 1 FROM message_read WHERE message_id = messages.id AND subscriber = ?)
+		ORDER BY time_ms, id
+	`
+	selectUnreadMessagesSinceIDQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ? AND id > IFNULL((SELECT id FROM messages WHERE topic = ? AND mid = ?), 0) AND published = 1 AND ` + notExpiredCondition + `
+			AND NOT EXISTS (SELECT 1 FROM message_read WHERE message_id = messages.id AND subscriber = ?)
+		ORDER BY time_ms, id
+	`
+)
+
+// MarkRead records that the message with the given ID was read by the given subscriber, e.g. a user name.
+// Marking a message as read more than once keeps the time it was first read. If the message does not exist,
+// errMessageNotFound is returned.
+func (c *messageCache) MarkRead(mid, subscriber string) error {
+	return c.withTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(selectMessageRowIDQuery, mid)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			return errMessageNotFound
+		}
+		var rowID int64
+		if err := rows.Scan(&rowID); err != nil {
+			return err
+		}
+		rows.Close()
+		_, err = tx.Exec(insertMessageReadQuery, rowID, mid, subscriber, time.Now().Unix())
+		return err
+	})
+}
+
+// UnreadCount returns the number of (non-scheduled) messages of a topic that were not read by the given
+// subscriber, see MarkRead
+func (c *messageCache) UnreadCount(topic, subscriber string) (int, error) {
+	if err := validateTopic(topic); err != nil {
+		return 0, err
+	}
+	rows, err := c.db.Query(selectUnreadCountQuery, c.ResolveTopic(topic), subscriber)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	var count int
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// UnreadMessages is like Messages (without scheduled messages), but only returns messages that were not
+// read by the given subscriber, see MarkRead
+func (c *messageCache) UnreadMessages(topic, subscriber string, since sinceMarker) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	} else if since.IsNone() || since.IsNow() {
+		return make([]*message, 0), nil
+	}
+	topic = c.ResolveTopic(topic)
+	var rows *sql.Rows
+	var err error
+	if since.IsID() {
+		rows, err = c.db.Query(selectUnreadMessagesSinceIDQuery, topic, topic, since.ID(), subscriber)
+	} else {
+		rows, err = c.db.Query(selectUnreadMessagesSinceTimeQuery, topic, since.Time().Unix(), subscriber)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// IncrementRead increments the read counter of a message by one, e.g. when a client reports that it displayed
+// the message. The counter is returned as message.ReadCount. It returns errMessageNotFound if the message does
+// not exist.
+func (c *messageCache) IncrementRead(topic, id string) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+	res, err := c.db.Exec(updateMessageReadCountQuery, c.ResolveTopic(topic), id)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return errMessageNotFound
+	}
+	return nil
+}
+
+// MessagesUnread returns all published messages of a topic that were never read, i.e. whose read counter was
+// never incremented (see IncrementRead), in the same order as Messages
+func (c *messageCache) MessagesUnread(topic string) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	rows, err := c.db.Query(selectMessagesWithoutReadsQuery, c.ResolveTopic(topic))
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
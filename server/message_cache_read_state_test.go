@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_ReadState(t *testing.T) {
+	testCacheReadState(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ReadState(t *testing.T) {
+	testCacheReadState(t, newMemTestCache(t))
+}
+
+func testCacheReadState(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m3 := newDefaultMessage("mytopic", "message 3")
+	m4 := newDefaultMessage("othertopic", "message 4")
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4}))
+
+	count, err := c.UnreadCount("mytopic", "phil")
+	require.Nil(t, err)
+	require.Equal(t, 3, count)
+
+	require.Nil(t, c.MarkRead(m1.ID, "phil"))
+	require.Nil(t, c.MarkRead(m1.ID, "phil")) // Marking twice is fine
+	require.Nil(t, c.MarkRead(m3.ID, "phil"))
+	require.Nil(t, c.MarkRead(m2.ID, "ben"))
+	require.Equal(t, errMessageNotFound, c.MarkRead("doesnotexist", "phil"))
+
+	// Read state is per subscriber
+	count, err = c.UnreadCount("mytopic", "phil")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+	count, err = c.UnreadCount("mytopic", "ben")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+	count, err = c.UnreadCount("othertopic", "phil")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	messages, err := c.UnreadMessages("mytopic", "phil", sinceAllMessages)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 2", messages[0].Message)
+
+	messages, err = c.UnreadMessages("mytopic", "ben", newSinceID(m1.ID))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+
+	messages, err = c.UnreadMessages("mytopic", "ben", sinceNoMessages)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_ReadState_DeletedWithMessage(t *testing.T) {
+	testCacheReadStateDeletedWithMessage(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ReadState_DeletedWithMessage(t *testing.T) {
+	testCacheReadStateDeletedWithMessage(t, newMemTestCache(t))
+}
+
+func testCacheReadStateDeletedWithMessage(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "old message")
+	m1.Time = 1
+	m2 := newDefaultMessage("mytopic", "new message")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+	require.Nil(t, c.MarkRead(m1.ID, "phil"))
+	require.Nil(t, c.MarkRead(m2.ID, "phil"))
+
+	require.Nil(t, c.Prune(time.Unix(2, 0), 0))
+	var rows int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM message_read`).Scan(&rows))
+	require.Equal(t, 1, rows)
+
+	_, err := c.DeleteTopic("mytopic")
+	require.Nil(t, err)
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM message_read`).Scan(&rows))
+	require.Equal(t, 0, rows)
+}
+
+func TestSqliteCache_CompactOrphans(t *testing.T) {
+	testCacheCompactOrphans(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_CompactOrphans(t *testing.T) {
+	testCacheCompactOrphans(t, newMemTestCache(t))
+}
+
+func testCacheCompactOrphans(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "deleted without cascade")
+	m1.Attachment = &attachment{Name: "a.txt", Type: "text/plain", Size: 10, Expires: 1, URL: "https://example.com/a.txt"}
+	m1.Tags = []string{"tag1", "tag2"}
+	m2 := newDefaultMessage("mytopic", "kept")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+	_, err := c.MigrateTagsToNormalized()
+	require.Nil(t, err)
+	require.Nil(t, c.MarkRead(m1.ID, "phil"))
+	require.Nil(t, c.MarkRead(m1.ID, "ben"))
+	require.Nil(t, c.MarkRead(m2.ID, "phil"))
+
+	deleted, err := c.CompactOrphans()
+	require.Nil(t, err)
+	require.Equal(t, 0, deleted)
+
+	// Delete a message while foreign keys are not enforced, e.g. by third-party tooling
+	conn, err := c.db.Conn(context.Background())
+	require.Nil(t, err)
+	_, err = conn.ExecContext(context.Background(), `PRAGMA foreign_keys = OFF`)
+	require.Nil(t, err)
+	_, err = conn.ExecContext(context.Background(), `DELETE FROM messages WHERE mid = ?`, m1.ID)
+	require.Nil(t, err)
+	_, err = conn.ExecContext(context.Background(), `PRAGMA foreign_keys = ON`)
+	require.Nil(t, err)
+	require.Nil(t, conn.Close())
+
+	deleted, err = c.CompactOrphans()
+	require.Nil(t, err)
+	require.Equal(t, 5, deleted) // Two read state rows, two tags, one attachment
+	count, err := c.UnreadCount("mytopic", "ben")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+	var rows int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM message_read`).Scan(&rows))
+	require.Equal(t, 1, rows)
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM message_attachments`).Scan(&rows))
+	require.Equal(t, 0, rows)
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM message_tags`).Scan(&rows))
+	require.Equal(t, 0, rows)
+}
+
+func TestSqliteCache_IncrementRead(t *testing.T) {
+	testCacheIncrementRead(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_IncrementRead(t *testing.T) {
+	testCacheIncrementRead(t, newMemTestCache(t))
+}
+
+func testCacheIncrementRead(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m3 := newDefaultMessage("mytopic", "scheduled")
+	m3.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, newDefaultMessage("othertopic", "message 4")}))
+
+	unread, err := c.MessagesUnread("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(unread))
+
+	require.Nil(t, c.IncrementRead("mytopic", m1.ID))
+	require.Nil(t, c.IncrementRead("mytopic", m1.ID))
+	require.Equal(t, errMessageNotFound, c.IncrementRead("mytopic", "doesnotexist"))
+	require.Equal(t, errMessageNotFound, c.IncrementRead("othertopic", m2.ID))
+	require.Equal(t, errInvalidTopic, c.IncrementRead("  ", m2.ID))
+
+	m, err := c.Message("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, 2, m.ReadCount)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, messages[0].ReadCount)
+	require.Equal(t, 0, messages[1].ReadCount)
+
+	unread, err = c.MessagesUnread("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(unread))
+	require.Equal(t, m2.ID, unread[0].ID)
+
+	// The counter is independent of the per-subscriber read state
+	require.Nil(t, c.MarkRead(m2.ID, "phil"))
+	unread, err = c.MessagesUnread("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(unread))
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"github.com/mattn/go-sqlite3"
+	"heckel.io/ntfy/log"
+	"time"
+)
+
+// Even with a busy timeout, a write can fail with SQLITE_BUSY or SQLITE_LOCKED, e.g. if a long prune holds the
+// write lock for longer than the timeout, or if the lock cannot be upgraded without a deadlock (in which case
+// SQLite does not wait at all). If messageCacheOptions.BusyRetries is set, such writes are retried a few times
+// with exponential backoff. Busy and locked errors mean that the transaction was rolled back, so a retry cannot
+// write anything twice. Other errors are returned right away, and reads are never retried.
+
+// retryBusy calls fn, and calls it again (up to c.busyRetries times) as long as it fails with a busy or locked
+// error. The backoff starts at c.busyBackoff, and doubles with every retry. It returns the last error.
+func (c *messageCache) retryBusy(fn func() error) error {
+	backoff := c.busyBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.busyRetries || !isBusyError(err) {
+			return err
+		}
+		log.Debug("Message cache: Database is busy, retrying in %s (attempt %d of %d): %s", backoff, attempt+1, c.busyRetries, err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isBusyError returns true if err is (or wraps) an SQLite busy or locked error
+func isBusyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
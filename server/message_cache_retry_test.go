@@ -0,0 +1,81 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMessageCache_RetryBusy(t *testing.T) {
+	c := newSqliteTestCache(t)
+	c.busyRetries = 3
+	c.busyBackoff = time.Millisecond
+	busy := fmt.Errorf("cannot commit transaction: %w", sqlite3.Error{Code: sqlite3.ErrBusy})
+
+	calls := 0
+	require.Nil(t, c.retryBusy(func() error {
+		calls++
+		if calls <= 2 {
+			return busy
+		}
+		return nil
+	}))
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	require.Equal(t, busy, c.retryBusy(func() error {
+		calls++
+		return busy
+	}))
+	require.Equal(t, 4, calls) // First attempt plus 3 retries
+
+	calls = 0
+	constraint := sqlite3.Error{Code: sqlite3.ErrConstraint}
+	require.Equal(t, constraint, c.retryBusy(func() error {
+		calls++
+		return constraint
+	}))
+	require.Equal(t, 1, calls)
+}
+
+func TestIsBusyError(t *testing.T) {
+	require.True(t, isBusyError(sqlite3.Error{Code: sqlite3.ErrBusy}))
+	require.True(t, isBusyError(sqlite3.Error{Code: sqlite3.ErrLocked}))
+	require.True(t, isBusyError(fmt.Errorf("wrapped: %w", sqlite3.Error{Code: sqlite3.ErrBusy})))
+	require.False(t, isBusyError(sqlite3.Error{Code: sqlite3.ErrConstraint}))
+	require.False(t, isBusyError(errors.New("database is locked")))
+	require.False(t, isBusyError(nil))
+}
+
+func TestSqliteCache_RetryBusy_Locked(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{BusyTimeout: time.Millisecond, BusyRetries: 10, BusyRetryBackoff: 10 * time.Millisecond})
+	require.Nil(t, err)
+	noRetries, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{BusyTimeout: time.Millisecond})
+	require.Nil(t, err)
+
+	// Another connection holds the write lock for a while
+	db, err := sql.Open("sqlite3", sqliteDSN(filename))
+	require.Nil(t, err)
+	defer db.Close()
+	tx, err := db.Begin()
+	require.Nil(t, err)
+	_, err = tx.Exec(`CREATE TABLE lock_holder (id INT)`)
+	require.Nil(t, err)
+	require.True(t, isBusyError(noRetries.AddMessage(newDefaultMessage("mytopic", "not retried"))))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tx.Rollback()
+	}()
+
+	m := newDefaultMessage("mytopic", "retried")
+	require.Nil(t, c.AddMessage(m))
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages)) // Not inserted twice
+	require.Equal(t, m.ID, messages[0].ID)
+}
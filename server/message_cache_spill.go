@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/mattn/go-sqlite3"
+	"heckel.io/ntfy/log"
+	"os"
+	"sync"
+)
+
+// An in-memory cache can optionally spill to disk: Once it holds more than a certain number of messages, the
+// entire database is written to a file, and all subsequent queries are served from that file. This protects
+// the process from running out of memory if a topic suddenly balloons, while keeping the speed of the
+// in-memory cache for the common case.
+//
+// To be able to switch databases without replacing messageCache.db (which is used without locking), the
+// database is opened with a spillConnector, which opens new connections to whichever database is current.
+// After spilling, pooled connections to the in-memory database are closed, which frees its memory.
+
+const (
+	spillQuery        = `VACUUM INTO ?`
+	spillMaxIdleConns = 2 // Default of database/sql
+)
+
+var errSpillNotEnabled = errors.New("spilling to disk is not enabled for this cache")
+
+// messageCacheSpill is the state of a cache that can spill to disk, see messageCacheOptions.SpillFilename
+type messageCacheSpill struct {
+	connector *spillConnector
+	filename  string
+	threshold int
+	spilled   bool
+	options   *messageCacheOptions // SQLite pragmas of the spill file, see sqlitePragmasDSN
+	mu        sync.RWMutex         // Held for writing while spilling, and for reading while adding messages
+}
+
+// spillConnector is a driver.Connector that opens connections to a DSN that can be changed at runtime
+type spillConnector struct {
+	driver *sqlite3.SQLiteDriver
+	dsn    string
+	mu     sync.Mutex
+}
+
+func newSpillConnector(dsn string) *spillConnector {
+	return &spillConnector{
+		driver: &sqlite3.SQLiteDriver{},
+		dsn:    dsn,
+	}
+}
+
+func (c *spillConnector) Connect(_ context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	dsn := c.dsn
+	c.mu.Unlock()
+	return c.driver.Open(dsn)
+}
+
+func (c *spillConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func (c *spillConnector) setDSN(dsn string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dsn = dsn
+}
+
+// Spill writes the entire in-memory cache to the spill file, and serves all subsequent queries from that
+// file. Any existing spill file is overwritten. Spilling is only possible once; if the cache has already
+// been spilled, Spill does nothing.
+func (c *messageCache) Spill() error {
+	if c.spill == nil {
+		return errSpillNotEnabled
+	}
+	c.spill.mu.Lock()
+	defer c.spill.mu.Unlock()
+	if c.spill.spilled {
+		return nil
+	}
+	if err := os.Remove(c.spill.filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := c.db.Exec(spillQuery, c.spill.filename); err != nil {
+		return err
+	}
+	c.spill.connector.setDSN(sqlitePragmasDSN(sqliteDSN(c.spill.filename), c.spill.options))
+	c.db.SetMaxIdleConns(0) // Close pooled connections to the in-memory database
+	c.db.SetMaxIdleConns(spillMaxIdleConns)
+	c.spill.spilled = true
+	log.Info("Message cache: Spilled in-memory cache to %s", c.spill.filename)
+	return nil
+}
+
+// Spilled returns true if the cache has been spilled to disk, see Spill
+func (c *messageCache) Spilled() bool {
+	if c.spill == nil {
+		return false
+	}
+	c.spill.mu.RLock()
+	defer c.spill.mu.RUnlock()
+	return c.spill.spilled
+}
+
+// maybeSpill spills the cache to disk if it holds more messages than the spill threshold
+func (c *messageCache) maybeSpill() error {
+	if c.spill == nil || c.spill.threshold <= 0 || c.Spilled() {
+		return nil
+	}
+	count, err := c.messageCountTotal()
+	if err != nil {
+		return err
+	} else if count <= c.spill.threshold {
+		return nil
+	}
+	return c.Spill()
+}
+
+func (c *messageCache) messageCountTotal() (int, error) {
+	rows, err := c.db.Query(selectMessagesCountQuery)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	var count int
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// openSpillableDB opens an in-memory database that can later be spilled to disk
+func openSpillableDB(filename string) (*sql.DB, *spillConnector) {
+	connector := newSpillConnector(sqliteDSN(filename))
+	return sql.OpenDB(connector), connector
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemCache_SpillAtThreshold(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "spill.db")
+	c, err := newMemCacheWithOptions(&messageCacheOptions{SpillFilename: filename, SpillThreshold: 5})
+	require.Nil(t, err)
+	require.Nil(t, c.SetTopicDefaults("mytopic", 4, nil))
+
+	for i := 0; i < 5; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))))
+	}
+	require.False(t, c.Spilled())
+	require.NoFileExists(t, filename)
+
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "message 5")))
+	require.True(t, c.Spilled())
+	require.FileExists(t, filename)
+
+	// Cache continues to work, and is now served from disk
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "message 6")))
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 7, len(messages))
+	require.Equal(t, "message 0", messages[0].Message)
+	require.Equal(t, "message 6", messages[6].Message)
+	require.Equal(t, 4, messages[6].Priority)
+
+	db, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	defer db.Close()
+	var count int
+	require.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&count))
+	require.Equal(t, 7, count)
+}
+
+func TestMemCache_SpillManually(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "spill.db")
+	c, err := newMemCacheWithOptions(&messageCacheOptions{SpillFilename: filename})
+	require.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))))
+	}
+	require.False(t, c.Spilled()) // No threshold
+
+	require.Nil(t, c.Spill())
+	require.True(t, c.Spilled())
+	require.Nil(t, c.Spill()) // No-op
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 20, count)
+	_, err = c.DeleteTopic("mytopic")
+	require.Nil(t, err)
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+}
+
+func TestMemCache_SpillNotEnabled(t *testing.T) {
+	c := newMemTestCache(t)
+	require.Equal(t, errSpillNotEnabled, c.Spill())
+	require.False(t, c.Spilled())
+
+	_, err := newMemCacheWithOptions(&messageCacheOptions{SpillThreshold: 10})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"time"
+)
+
+// messageStore is the part of the message cache that the server uses. It is implemented by messageCache, which
+// stores messages in a SQLite file (or in memory, see newMemCache). The backend is selected with
+// Config.CacheBackend; backends that can be shared by several server instances (e.g. PostgreSQL) would have to
+// implement this interface. messageCache offers many more methods (e.g. for backups, exports or statistics),
+// which are only used by tools that work on a cache file directly.
+type messageStore interface {
+	AddMessage(m *message) error
+	Messages(topic string, since sinceMarker, scheduled bool) ([]*message, error)
+	MessagesWithDeletions(topic string, since sinceMarker, scheduled bool) ([]*message, error)
+	MessagesDue() ([]*message, error)
+	ClaimDue(now int64, limit int) ([]*message, error)
+	MessageCount(topic string) (int, error)
+	MessagesByEmail(email string, since time.Time) ([]*message, error)
+	ValidateToken(topic, id, token string) (bool, error)
+	DeleteMessage(topic, id string) error
+	Topics() (map[string]*topic, error)
+	TopicsDeliveredSince(t time.Time) ([]string, error)
+	MarkTopicDelivered(topic string, t time.Time) error
+	TopicDisabled(topic string) bool
+	SetTopicDisabled(topic string, disabled bool) error
+	ApplyTopicDefaults(m *message)
+	AttachmentsExpired() ([]string, error)
+	AttachmentBytesUsed(sender string) (int64, error)
+	Prune(olderThan time.Time, minKeep int) error
+	PruneExpiredScheduled(now int64) (int, error)
+	PurgeDeleted(before time.Time) (int, []string, error)
+	CompactOrphans() (int, error)
+	Warmup(topics []string) error
+	Flush() error
+	Close() error
+}
+
+var _ messageStore = (*messageCache)(nil)
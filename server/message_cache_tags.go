@@ -0,0 +1,146 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+)
+
+// Tags are stored as a JSON array in the tags column of the messages table. To be able to search messages
+// by tag across topics, they can additionally be stored in the normalized message_tags table, with one row
+// per message and tag. Rows are removed along with their message (ON DELETE CASCADE).
+
+const (
+	createMessageTagsTableQuery = `
+		CREATE TABLE IF NOT EXISTS message_tags (
+			message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (message_id, tag)
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_tags_tag ON message_tags (tag);
+	`
+	insertMessageTagQuery              = `INSERT OR IGNORE INTO message_tags (message_id, tag) VALUES (?, ?)`
+	selectMessagesWithoutTagsRowsQuery = `
+		SELECT id, tags
+		FROM messages
+		WHERE id > ? AND tags != '' AND NOT EXISTS (SELECT 1 FROM message_tags WHERE message_id = messages.id)
+		ORDER BY id
+		LIMIT ?
+	`
+)
+
+const migrateTagsBatchSize = 500
+
+// MigrateTagsToNormalized copies the tags of all messages into the message_tags table, and returns the
+// number of message rows processed. Each batch of rows is committed separately, and rows that already have
+// entries in message_tags are skipped, so the migration can be resumed if it is interrupted.
+//
+// Empty tags are dropped, and duplicate tags of a message are only stored once. Tags in the legacy
+// comma-separated format (before schema version 9) are split as well.
+func (c *messageCache) MigrateTagsToNormalized() (int, error) {
+	processed := 0
+	lastID := int64(0)
+	for {
+		n, last, err := c.migrateTagsBatch(lastID)
+		if err != nil {
+			return processed, err
+		} else if n == 0 {
+			return processed, nil
+		}
+		processed += n
+		lastID = last
+	}
+}
+
+func (c *messageCache) migrateTagsBatch(afterID int64) (n int, lastID int64, err error) {
+	err = c.withTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(selectMessagesWithoutTagsRowsQuery, afterID, migrateTagsBatchSize)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		ids := make([]int64, 0)
+		tags := make([][]string, 0)
+		for rows.Next() {
+			var id int64
+			var tagsStr string
+			if err := rows.Scan(&id, &tagsStr); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+			tags = append(tags, parseStoredTags(tagsStr))
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			return nil
+		}
+		stmt, err := tx.Prepare(insertMessageTagQuery)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for i, id := range ids {
+			for _, tag := range tags[i] {
+				if _, err := stmt.Exec(id, tag); err != nil {
+					return err
+				}
+			}
+		}
+		n, lastID = len(ids), ids[len(ids)-1]
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, lastID, nil
+}
+
+// MessagesWithTag returns the messages that Messages would return for the same arguments, but only those that
+// have the given tag, e.g. for a dashboard that only shows alerts. The tag must match one of the message's tags
+// exactly (ignoring surrounding whitespace), so filtering for "alert" does not match "alerting". Since the
+// message_tags table is only filled by MigrateTagsToNormalized, the messages are filtered after reading them.
+func (c *messageCache) MessagesWithTag(topic string, since sinceMarker, tag string, scheduled bool) ([]*message, error) {
+	messages, err := c.Messages(topic, since, scheduled)
+	if err != nil {
+		return nil, err
+	}
+	tag = strings.TrimSpace(tag)
+	filtered := make([]*message, 0)
+	for _, m := range messages {
+		for _, t := range m.Tags {
+			if strings.TrimSpace(t) == tag {
+				filtered = append(filtered, m)
+				break
+			}
+		}
+	}
+	return filtered, nil
+}
+
+// parseStoredTags parses the tags column of a message row, either as a JSON array or, for rows that
+// were never migrated, as a comma-separated list. Tags are trimmed, and empty and duplicate tags are removed.
+func parseStoredTags(tagsStr string) []string {
+	var raw []string
+	if err := json.Unmarshal([]byte(tagsStr), &raw); err != nil {
+		raw = strings.Split(tagsStr, ",")
+	}
+	return normalizeTags(raw)
+}
+
+// normalizeTags returns the given tags without surrounding whitespace, with empty and duplicate tags removed
+func normalizeTags(raw []string) []string {
+	seen := make(map[string]bool)
+	tags := make([]string, 0, len(raw))
+	for _, tag := range raw {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqliteCache_MigrateTagsToNormalized(t *testing.T) {
+	testCacheMigrateTagsToNormalized(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MigrateTagsToNormalized(t *testing.T) {
+	testCacheMigrateTagsToNormalized(t, newMemTestCache(t))
+}
+
+func testCacheMigrateTagsToNormalized(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "tagged")
+	m1.Tags = []string{"warning", "skull"}
+	m2 := newDefaultMessage("othertopic", "duplicates and empty tags")
+	m2.Tags = []string{"warning", "", " warning ", "backup"}
+	m3 := newDefaultMessage("mytopic", "no tags")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+
+	// Row stored in the legacy comma-separated format
+	_, err := c.db.Exec(`UPDATE messages SET tags = 'a,,b,a' WHERE mid = ?`, m3.ID)
+	require.Nil(t, err)
+
+	processed, err := c.MigrateTagsToNormalized()
+	require.Nil(t, err)
+	require.Equal(t, 3, processed)
+	require.Equal(t, []string{"backup", "warning"}, queryMessageTags(t, c, m2.ID))
+	require.Equal(t, []string{"a", "b"}, queryMessageTags(t, c, m3.ID))
+	require.Equal(t, 2, queryTagCount(t, c, "warning"))
+
+	// Resuming processes nothing, since all rows have been migrated
+	processed, err = c.MigrateTagsToNormalized()
+	require.Nil(t, err)
+	require.Equal(t, 0, processed)
+
+	// Tags are removed along with their message
+	_, err = c.DeleteTopic("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, queryTagCount(t, c, "warning"))
+}
+
+func TestSqliteCache_MigrateTagsToNormalized_Resume(t *testing.T) {
+	c := newSqliteTestCache(t)
+	for i := 0; i < migrateTagsBatchSize+10; i++ {
+		m := newDefaultMessage("mytopic", "some message")
+		m.Tags = []string{"tag"}
+		require.Nil(t, c.AddMessage(m))
+	}
+
+	// Simulate an interrupted run after the first batch
+	n, _, err := c.migrateTagsBatch(0)
+	require.Nil(t, err)
+	require.Equal(t, migrateTagsBatchSize, n)
+
+	processed, err := c.MigrateTagsToNormalized()
+	require.Nil(t, err)
+	require.Equal(t, 10, processed)
+	require.Equal(t, migrateTagsBatchSize+10, queryTagCount(t, c, "tag"))
+}
+
+func TestSqliteCache_MaxTags(t *testing.T) {
+	testCacheMaxTags(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_MaxTags(t *testing.T) {
+	testCacheMaxTags(t, createMemoryFilename())
+}
+
+func testCacheMaxTags(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{MaxTags: 3})
+	require.Nil(t, err)
+
+	m1 := newDefaultMessage("mytopic", "three tags")
+	m1.Tags = []string{"a", "b", "c"}
+	m2 := newDefaultMessage("mytopic", "three tags after normalization")
+	m2.Tags = []string{"a", " b", "b", "", "c", "a"}
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	m3 := newDefaultMessage("mytopic", "four tags")
+	m3.Tags = []string{"a", "b", "c", "d"}
+	require.Equal(t, errTooManyTags, c.AddMessage(m3))
+	require.Equal(t, errTooManyTags, c.AddMessages([]*message{newDefaultMessage("mytopic", "valid"), m3}))
+
+	m1.Tags = []string{"a", "b", "c", "d"}
+	require.Equal(t, errTooManyTags, c.UpdateMessage(m1))
+	require.Equal(t, errTooManyTags, c.UpdateMessageIfUnchanged(m1, m1.Updated))
+	m1.Tags = []string{"d"}
+	require.Nil(t, c.UpdateMessage(m1))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, []string{"d"}, messages[0].Tags)
+
+	// No limit
+	c, err = newSqliteCacheWithOptions(filename, false, &messageCacheOptions{})
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(m3))
+}
+
+func TestSqliteCache_MessagesWithTag(t *testing.T) {
+	testCacheMessagesWithTag(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesWithTag(t *testing.T) {
+	testCacheMessagesWithTag(t, newMemTestCache(t))
+}
+
+func testCacheMessagesWithTag(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "alert")
+	m1.Tags = []string{"disk", "alert"}
+	m2 := newDefaultMessage("mytopic", "alerting")
+	m2.Tags = []string{"alerting", "alerts", "red-alert"}
+	m3 := newDefaultMessage("mytopic", "comma")
+	m3.Tags = []string{"alert,disk"}
+	m4 := newDefaultMessage("mytopic", "whitespace")
+	m4.Tags = []string{" alert "}
+	m5 := newDefaultMessage("mytopic", "no tags")
+	m6 := newDefaultMessage("mytopic", "scheduled")
+	m6.Tags = []string{"alert"}
+	m6.Time = time.Now().Add(time.Hour).Unix()
+	m7 := newDefaultMessage("othertopic", "other topic")
+	m7.Tags = []string{"alert"}
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4, m5, m6, m7}))
+
+	messages, err := c.MessagesWithTag("mytopic", sinceAllMessages, "alert", false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "alert", messages[0].Message)
+	require.Equal(t, "whitespace", messages[1].Message)
+
+	messages, err = c.MessagesWithTag("mytopic", sinceAllMessages, "alert", true)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "scheduled", messages[2].Message)
+
+	messages, err = c.MessagesWithTag("mytopic", newSinceID(m1.ID), "alert", false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "whitespace", messages[0].Message)
+
+	messages, err = c.MessagesWithTag("mytopic", sinceAllMessages, "alerting", false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "alerting", messages[0].Message)
+
+	messages, err = c.MessagesWithTag("mytopic", sinceAllMessages, "aler", false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	messages, err = c.MessagesWithTag("mytopic", sinceAllMessages, "", false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func queryMessageTags(t *testing.T, c *messageCache, id string) []string {
+	rows, err := c.db.Query(`SELECT tag FROM message_tags WHERE message_id = (SELECT id FROM messages WHERE mid = ?) ORDER BY tag`, id)
+	require.Nil(t, err)
+	defer rows.Close()
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		require.Nil(t, rows.Scan(&tag))
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func queryTagCount(t *testing.T, c *messageCache, tag string) int {
+	var count int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM message_tags WHERE tag = ?`, tag).Scan(&count))
+	return count
+}
@@ -1,11 +1,16 @@
 package server
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -46,7 +51,7 @@ func testCacheMessages(t *testing.T, c *messageCache) {
 	require.Equal(t, messageEvent, messages[0].Event)
 	require.Equal(t, "", messages[0].Title)
 	require.Equal(t, 0, messages[0].Priority)
-	require.Nil(t, messages[0].Tags)
+	require.Equal(t, []string{}, messages[0].Tags)
 	require.Equal(t, "my other message", messages[1].Message)
 
 	// mytopic: since none
@@ -141,132 +146,3109 @@ func testCacheTopics(t *testing.T, c *messageCache) {
 	require.Equal(t, "topic2", topics["topic2"].ID)
 }
 
-func TestSqliteCache_MessagesTagsPrioAndTitle(t *testing.T) {
-	testCacheMessagesTagsPrioAndTitle(t, newSqliteTestCache(t))
+func TestSqliteCache_TopicsPage(t *testing.T) {
+	testCacheTopicsPage(t, newSqliteTestCache(t))
 }
 
-func TestMemCache_MessagesTagsPrioAndTitle(t *testing.T) {
-	testCacheMessagesTagsPrioAndTitle(t, newMemTestCache(t))
+func TestMemCache_TopicsPage(t *testing.T) {
+	testCacheTopicsPage(t, newMemTestCache(t))
 }
 
-func testCacheMessagesTagsPrioAndTitle(t *testing.T, c *messageCache) {
-	m := newDefaultMessage("mytopic", "some message")
-	m.Tags = []string{"tag1", "tag2"}
-	m.Priority = 5
-	m.Title = "some title"
-	require.Nil(t, c.AddMessage(m))
+func testCacheTopicsPage(t *testing.T, c *messageCache) {
+	for _, topic := range []string{"topic3", "topic1", "topic4", "topic2", "topic1", "topic5"} {
+		require.Nil(t, c.AddMessage(newDefaultMessage(topic, "some message")))
+	}
 
-	messages, _ := c.Messages("mytopic", sinceAllMessages, false)
-	require.Equal(t, []string{"tag1", "tag2"}, messages[0].Tags)
-	require.Equal(t, 5, messages[0].Priority)
-	require.Equal(t, "some title", messages[0].Title)
+	topics, err := c.TopicsPage(0, 2)
+	require.Nil(t, err)
+	require.Equal(t, []string{"topic1", "topic2"}, topics)
+
+	topics, err = c.TopicsPage(2, 2)
+	require.Nil(t, err)
+	require.Equal(t, []string{"topic3", "topic4"}, topics)
+
+	topics, err = c.TopicsPage(4, 2)
+	require.Nil(t, err)
+	require.Equal(t, []string{"topic5"}, topics)
+
+	topics, err = c.TopicsPage(6, 2)
+	require.Nil(t, err)
+	require.Empty(t, topics)
+
+	topics, err = c.TopicsPage(1, 0) // No limit
+	require.Nil(t, err)
+	require.Equal(t, []string{"topic2", "topic3", "topic4", "topic5"}, topics)
 }
 
-func TestSqliteCache_MessagesSinceID(t *testing.T) {
-	testCacheMessagesSinceID(t, newSqliteTestCache(t))
+func TestSqliteCache_TopicsWithPrefix(t *testing.T) {
+	testCacheTopicsWithPrefix(t, newSqliteTestCache(t))
 }
 
-func TestMemCache_MessagesSinceID(t *testing.T) {
-	testCacheMessagesSinceID(t, newMemTestCache(t))
+func TestMemCache_TopicsWithPrefix(t *testing.T) {
+	testCacheTopicsWithPrefix(t, newMemTestCache(t))
 }
 
-func testCacheMessagesSinceID(t *testing.T, c *messageCache) {
+func testCacheTopicsWithPrefix(t *testing.T, c *messageCache) {
+	for _, topic := range []string{"team.web.prod", "team.api.dev", "team.web.prod", "teamx", "other.team", "Team.web", "team_a", "team%b"} {
+		require.Nil(t, c.AddMessage(newDefaultMessage(topic, "some message")))
+	}
+
+	topics, err := c.TopicsWithPrefix("team.")
+	require.Nil(t, err)
+	require.Equal(t, []string{"team.api.dev", "team.web.prod"}, topics)
+
+	topics, err = c.TopicsWithPrefix("team_")
+	require.Nil(t, err)
+	require.Equal(t, []string{"team_a"}, topics)
+
+	topics, err = c.TopicsWithPrefix("team%")
+	require.Nil(t, err)
+	require.Equal(t, []string{"team%b"}, topics)
+
+	topics, err = c.TopicsWithPrefix("nope")
+	require.Nil(t, err)
+	require.Empty(t, topics)
+
+	topics, err = c.TopicsWithPrefix("")
+	require.Nil(t, err)
+	require.Equal(t, 7, len(topics))
+}
+
+func TestSqliteCache_LatestID(t *testing.T) {
+	testCacheLatestID(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_LatestID(t *testing.T) {
+	testCacheLatestID(t, newMemTestCache(t))
+}
+
+func testCacheLatestID(t *testing.T, c *messageCache) {
+	_, err := c.LatestID("mytopic")
+	require.Equal(t, errMessageNotFound, err)
+
 	m1 := newDefaultMessage("mytopic", "message 1")
-	m1.Time = 100
 	m2 := newDefaultMessage("mytopic", "message 2")
-	m2.Time = 200
-	m3 := newDefaultMessage("mytopic", "message 3")
-	m3.Time = time.Now().Add(time.Hour).Unix() // Scheduled, in the future, later than m7 and m5
-	m4 := newDefaultMessage("mytopic", "message 4")
-	m4.Time = 400
-	m5 := newDefaultMessage("mytopic", "message 5")
-	m5.Time = time.Now().Add(time.Minute).Unix() // Scheduled, in the future, later than m7
-	m6 := newDefaultMessage("mytopic", "message 6")
-	m6.Time = 600
-	m7 := newDefaultMessage("mytopic", "message 7")
-	m7.Time = 700
-
+	m3 := newDefaultMessage("mytopic", "scheduled") // Not published, ignored
+	m3.Time = time.Now().Add(time.Hour).Unix()
 	require.Nil(t, c.AddMessage(m1))
 	require.Nil(t, c.AddMessage(m2))
 	require.Nil(t, c.AddMessage(m3))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other")))
+
+	id, err := c.LatestID("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, m2.ID, id)
+
+	// Resume from the tip
+	m4 := newDefaultMessage("mytopic", "message 4")
 	require.Nil(t, c.AddMessage(m4))
-	require.Nil(t, c.AddMessage(m5))
-	require.Nil(t, c.AddMessage(m6))
-	require.Nil(t, c.AddMessage(m7))
+	messages, err := c.Messages("mytopic", newSinceID(id), false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m4.ID, messages[0].ID)
+}
 
-	// Case 1: Since ID exists, exclude scheduled
-	messages, _ := c.Messages("mytopic", newSinceID(m2.ID), false)
+func TestSqliteCache_MessagesAndMarkDelivered(t *testing.T) {
+	testCacheMessagesAndMarkDelivered(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesAndMarkDelivered(t *testing.T) {
+	testCacheMessagesAndMarkDelivered(t, newMemTestCache(t))
+}
+
+func testCacheMessagesAndMarkDelivered(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m2.Attachment = &attachment{Name: "a.png", Size: 100, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://ntfy.sh/file/a.png"}
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{m1, m2, scheduled, newDefaultMessage("othertopic", "other")}))
+
+	messages, err := c.MessagesAndMarkDelivered("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "message 2", messages[1].Message)
+	require.Equal(t, 1, len(messages[1].Attachments)) // Read within the transaction, see readMessages
+	require.Equal(t, "a.png", messages[1].Attachments[0].Name)
+
+	messages, err = c.MessagesAndMarkDelivered("mytopic", newSinceID(m1.ID), true)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 2", messages[0].Message)
+	require.Equal(t, "scheduled", messages[1].Message)
+
+	for id, expected := range map[string]int{m1.ID: 1, m2.ID: 2, scheduled.ID: 1} {
+		count, err := c.DeliveryCount("mytopic", id)
+		require.Nil(t, err)
+		require.Equal(t, expected, count)
+	}
+	_, err = c.DeliveryCount("mytopic", "doesnotexist")
+	require.Equal(t, errMessageNotFound, err)
+
+	messages, err = c.MessagesAndMarkDelivered("mytopic", sinceNoMessages, false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_OldestMessageTime(t *testing.T) {
+	testCacheOldestMessageTime(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_OldestMessageTime(t *testing.T) {
+	testCacheOldestMessageTime(t, newMemTestCache(t))
+}
+
+func testCacheOldestMessageTime(t *testing.T, c *messageCache) {
+	_, ok, err := c.OldestMessageTime("mytopic")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m1.Time = time.Now().Add(-2 * time.Hour).Unix()
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m2.Time = time.Now().Add(-time.Hour).Unix()
+	scheduled := newDefaultMessage("scheduledtopic", "scheduled") // Not published, ignored
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{m2, m1, scheduled, newDefaultMessage("othertopic", "other")}))
+
+	oldest, ok, err := c.OldestMessageTime("mytopic")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, m1.Time, oldest)
+
+	_, ok, err = c.OldestMessageTime("scheduledtopic")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// Pruned messages are gone
+	require.Nil(t, c.Prune(time.Now().Add(-90*time.Minute), 0))
+	oldest, ok, err = c.OldestMessageTime("mytopic")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, m2.Time, oldest)
+}
+
+func TestSqliteCache_MessagesSinceIDCapped(t *testing.T) {
+	testCacheMessagesSinceIDCapped(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesSinceIDCapped(t *testing.T) {
+	testCacheMessagesSinceIDCapped(t, newMemTestCache(t))
+}
+
+func testCacheMessagesSinceIDCapped(t *testing.T, c *messageCache) {
+	now := time.Now()
+	m1 := newDefaultMessage("mytopic", "3 days ago")
+	m1.Time = now.Add(-72 * time.Hour).Unix()
+	m2 := newDefaultMessage("mytopic", "2 days ago")
+	m2.Time = now.Add(-48 * time.Hour).Unix()
+	m3 := newDefaultMessage("mytopic", "30 minutes ago")
+	m3.Time = now.Add(-30 * time.Minute).Unix()
+	m4 := newDefaultMessage("mytopic", "now")
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4}))
+
+	messages, err := c.MessagesSinceIDCapped("mytopic", newSinceID(m1.ID), time.Hour)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "30 minutes ago", messages[0].Message)
+	require.Equal(t, "now", messages[1].Message)
+
+	messages, err = c.MessagesSinceIDCapped("mytopic", newSinceID(m3.ID), time.Hour)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "now", messages[0].Message)
+
+	messages, err = c.MessagesSinceIDCapped("mytopic", newSinceID("doesnotexist"), time.Hour)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+
+	messages, err = c.MessagesSinceIDCapped("mytopic", sinceAllMessages, time.Hour)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+
+	messages, err = c.MessagesSinceIDCapped("mytopic", newSinceID(m1.ID), 0) // No cap
+	require.Nil(t, err)
 	require.Equal(t, 3, len(messages))
+}
+
+func TestSqliteCache_NeighborMessages(t *testing.T) {
+	testCacheNeighborMessages(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_NeighborMessages(t *testing.T) {
+	testCacheNeighborMessages(t, newMemTestCache(t))
+}
+
+func testCacheNeighborMessages(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "first")
+	m1.Time = time.Now().Add(-time.Hour).Unix()
+	m2 := newDefaultMessage("mytopic", "second")
+	m2.Time = m1.Time
+	m3 := newDefaultMessage("mytopic", "third")
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{m1, m2, newDefaultMessage("othertopic", "other"), m3, scheduled}))
+
+	prev, next, err := c.NeighborMessages("mytopic", m2.ID)
+	require.Nil(t, err)
+	require.Equal(t, "first", prev.Message)
+	require.Equal(t, "third", next.Message)
+
+	prev, next, err = c.NeighborMessages("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Nil(t, prev)
+	require.Equal(t, "second", next.Message)
+
+	prev, next, err = c.NeighborMessages("mytopic", m3.ID)
+	require.Nil(t, err)
+	require.Equal(t, "second", prev.Message)
+	require.Nil(t, next) // Scheduled messages are skipped
+
+	_, _, err = c.NeighborMessages("mytopic", "doesnotexist")
+	require.Equal(t, errMessageNotFound, err)
+	_, _, err = c.NeighborMessages("othertopic", m2.ID)
+	require.Equal(t, errMessageNotFound, err)
+}
+
+func TestSqliteCache_MessagesBefore(t *testing.T) {
+	testCacheMessagesBefore(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesBefore(t *testing.T) {
+	testCacheMessagesBefore(t, newMemTestCache(t))
+}
+
+func testCacheMessagesBefore(t *testing.T, c *messageCache) {
+	ms := make([]*message, 0)
+	for i := 0; i < 5; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = time.Now().Add(time.Duration(i-10) * time.Minute).Unix()
+		ms = append(ms, m)
+		require.Nil(t, c.AddMessages([]*message{m, newDefaultMessage("othertopic", "other")}))
+	}
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+
+	messages, err := c.MessagesBefore("mytopic", ms[4].ID, 2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 2", messages[0].Message)
+	require.Equal(t, "message 3", messages[1].Message)
+
+	messages, err = c.MessagesBefore("mytopic", messages[0].ID, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 0", messages[0].Message)
+	require.Equal(t, "message 1", messages[1].Message)
+
+	messages, err = c.MessagesBefore("mytopic", scheduled.ID, 10) // Scheduled messages are skipped
+	require.Nil(t, err)
+	require.Equal(t, 5, len(messages))
+
+	messages, err = c.MessagesBefore("mytopic", ms[0].ID, 10)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	messages, err = c.MessagesBefore("mytopic", "doesnotexist", 10)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	messages, err = c.MessagesBefore("othertopic", ms[4].ID, 10)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_MessagesLatest(t *testing.T) {
+	testCacheMessagesLatest(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesLatest(t *testing.T) {
+	testCacheMessagesLatest(t, newMemTestCache(t))
+}
+
+func testCacheMessagesLatest(t *testing.T, c *messageCache) {
+	for i := 0; i < 5; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = time.Now().Add(time.Duration(i-10) * time.Minute).Unix()
+		require.Nil(t, c.AddMessages([]*message{m, newDefaultMessage("othertopic", "other")}))
+	}
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+
+	messages, err := c.MessagesLatest("mytopic", 2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
 	require.Equal(t, "message 4", messages[0].Message)
-	require.Equal(t, "message 6", messages[1].Message) // Not scheduled m3/m5!
-	require.Equal(t, "message 7", messages[2].Message)
+	require.Equal(t, "message 3", messages[1].Message)
 
-	// Case 2: Since ID exists, include scheduled
-	messages, _ = c.Messages("mytopic", newSinceID(m2.ID), true)
+	messages, err = c.MessagesLatest("mytopic", 0)
+	require.Nil(t, err)
 	require.Equal(t, 5, len(messages))
 	require.Equal(t, "message 4", messages[0].Message)
-	require.Equal(t, "message 6", messages[1].Message)
-	require.Equal(t, "message 7", messages[2].Message)
-	require.Equal(t, "message 5", messages[3].Message) // Order!
-	require.Equal(t, "message 3", messages[4].Message) // Order!
+	require.Equal(t, "message 0", messages[4].Message)
 
-	// Case 3: Since ID does not exist (-> Return all messages), include scheduled
-	messages, _ = c.Messages("mytopic", newSinceID("doesntexist"), true)
-	require.Equal(t, 7, len(messages))
+	// Messages keeps replaying in publishing order
+	messages, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, "message 0", messages[0].Message)
+
+	messages, err = c.MessagesLatest("doesnotexist", 10)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_MessagesBetween(t *testing.T) {
+	testCacheMessagesBetween(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesBetween(t *testing.T) {
+	testCacheMessagesBetween(t, newMemTestCache(t))
+}
+
+func testCacheMessagesBetween(t *testing.T, c *messageCache) {
+	now := time.Now()
+	day := now.Add(-48 * time.Hour).Truncate(time.Second)
+	for i, offset := range []time.Duration{-time.Second, 0, 12 * time.Hour, 24*time.Hour - time.Second, 24 * time.Hour} {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = day.Add(offset).Unix()
+		require.Nil(t, c.AddMessage(m))
+	}
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = now.Add(time.Hour).Unix()
+	other := newDefaultMessage("othertopic", "other")
+	other.Time = day.Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{scheduled, other}))
+
+	// Start is inclusive, end is exclusive
+	messages, err := c.MessagesBetween("mytopic", day, day.Add(24*time.Hour), false)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
 	require.Equal(t, "message 1", messages[0].Message)
-	require.Equal(t, "message 2", messages[1].Message)
-	require.Equal(t, "message 4", messages[2].Message)
-	require.Equal(t, "message 6", messages[3].Message)
-	require.Equal(t, "message 7", messages[4].Message)
-	require.Equal(t, "message 5", messages[5].Message) // Order!
-	require.Equal(t, "message 3", messages[6].Message) // Order!
+	require.Equal(t, "message 3", messages[2].Message)
 
-	// Case 4: Since ID exists and is last message (-> Return no messages), exclude scheduled
-	messages, _ = c.Messages("mytopic", newSinceID(m7.ID), false)
-	require.Equal(t, 0, len(messages))
+	messages, err = c.MessagesBetween("mytopic", now, now.Add(2*time.Hour), false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	messages, err = c.MessagesBetween("mytopic", now, now.Add(2*time.Hour), true)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "scheduled", messages[0].Message)
 
-	// Case 5: Since ID exists and is last message (-> Return no messages), include scheduled
-	messages, _ = c.Messages("mytopic", newSinceID(m7.ID), true)
+	// An end before or at start is an empty range
+	messages, err = c.MessagesBetween("mytopic", day.Add(24*time.Hour), day, true)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	messages, err = c.MessagesBetween("mytopic", day, day, true)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	_, err = c.MessagesBetween("", day, now, false)
+	require.Equal(t, errInvalidTopic, err)
+}
+
+func TestSqliteCache_MessagesPage(t *testing.T) {
+	testCacheMessagesPage(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesPage(t *testing.T) {
+	testCacheMessagesPage(t, newMemTestCache(t))
+}
+
+func testCacheMessagesPage(t *testing.T, c *messageCache) {
+	// Messages within the same second are ordered by insertion, older messages by time
+	ms := make([]*message, 0)
+	for i := 0; i < 7; i++ {
+		ms = append(ms, newDefaultMessage("mytopic", fmt.Sprintf("message %d", i)))
+	}
+	old := newDefaultMessage("mytopic", "old")
+	old.Time = time.Now().Add(-time.Hour).Unix()
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	ms = append(ms, old, scheduled, newDefaultMessage("othertopic", "other"))
+	require.Nil(t, c.AddMessages(ms))
+
+	all, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, "old", all[0].Message)
+	require.Equal(t, "message 0", all[1].Message)
+	paged := make([]*message, 0)
+	for offset := 0; ; offset += 3 {
+		page, err := c.MessagesPage("mytopic", sinceAllMessages, false, 3, offset)
+		require.Nil(t, err)
+		if len(page) == 0 {
+			break
+		}
+		require.LessOrEqual(t, len(page), 3)
+		paged = append(paged, page...)
+	}
+	require.Equal(t, all, paged)
+
+	messages, err := c.MessagesPage("mytopic", sinceAllMessages, true, 0, 0) // No limit
+	require.Nil(t, err)
+	require.Equal(t, 9, len(messages))
+	require.Equal(t, "scheduled", messages[8].Message)
+
+	messages, err = c.MessagesPage("mytopic", newSinceID(ms[4].ID), false, 5, 1) // "old" was inserted after ms[4]
+	require.Nil(t, err)
 	require.Equal(t, 2, len(messages))
 	require.Equal(t, "message 5", messages[0].Message)
-	require.Equal(t, "message 3", messages[1].Message)
-}
+	require.Equal(t, "message 6", messages[1].Message)
 
-func TestSqliteCache_Prune(t *testing.T) {
-	testCachePrune(t, newSqliteTestCache(t))
+	messages, err = c.MessagesPage("mytopic", sinceNoMessages, false, 5, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
 }
 
-func TestMemCache_Prune(t *testing.T) {
-	testCachePrune(t, newMemTestCache(t))
+func TestSqliteCache_MessagesPageWithTotal(t *testing.T) {
+	testCacheMessagesPageWithTotal(t, newSqliteTestCache(t))
 }
 
-func testCachePrune(t *testing.T, c *messageCache) {
-	m1 := newDefaultMessage("mytopic", "my message")
-	m1.Time = 1
+func TestMemCache_MessagesPageWithTotal(t *testing.T) {
+	testCacheMessagesPageWithTotal(t, newMemTestCache(t))
+}
 
-	m2 := newDefaultMessage("mytopic", "my other message")
-	m2.Time = 2
+func testCacheMessagesPageWithTotal(t *testing.T, c *messageCache) {
+	ms := make([]*message, 0)
+	for i := 0; i < 10; i++ {
+		ms = append(ms, newDefaultMessage("mytopic", fmt.Sprintf("message %d", i)))
+	}
+	ms[1].Attachment = &attachment{Name: "a.png", Size: 100, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://ntfy.sh/file/a.png"}
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	ms = append(ms, scheduled, newDefaultMessage("othertopic", "other"))
+	require.Nil(t, c.AddMessages(ms))
+
+	messages, total, err := c.MessagesPageWithTotal("mytopic", sinceAllMessages, false, 3, 0)
+	require.Nil(t, err)
+	require.Equal(t, 10, total)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "message 0", messages[0].Message)
+	require.Equal(t, "message 2", messages[2].Message)
+	require.Equal(t, 1, len(messages[1].Attachments)) // Read within the transaction
+	require.Equal(t, "a.png", messages[1].Attachments[0].Name)
+
+	messages, total, err = c.MessagesPageWithTotal("mytopic", sinceAllMessages, false, 3, 9)
+	require.Nil(t, err)
+	require.Equal(t, 10, total)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 9", messages[0].Message)
+
+	messages, total, err = c.MessagesPageWithTotal("mytopic", sinceAllMessages, true, 0, 0) // No limit
+	require.Nil(t, err)
+	require.Equal(t, 11, total)
+	require.Equal(t, 11, len(messages))
+	require.Equal(t, "scheduled", messages[10].Message)
+
+	messages, total, err = c.MessagesPageWithTotal("mytopic", newSinceID(ms[6].ID), false, 2, 1)
+	require.Nil(t, err)
+	require.Equal(t, 3, total)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 8", messages[0].Message)
+	require.Equal(t, "message 9", messages[1].Message)
+
+	_, total, err = c.MessagesPageWithTotal("mytopic", newSinceID(ms[6].ID), true, 2, 0)
+	require.Nil(t, err)
+	require.Equal(t, 4, total)
+
+	_, total, err = c.MessagesPageWithTotal("mytopic", newSinceID("doesnotexist"), false, 2, 0)
+	require.Nil(t, err)
+	require.Equal(t, 10, total)
+
+	messages, total, err = c.MessagesPageWithTotal("mytopic", sinceNoMessages, false, 2, 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, total)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_MessagesWithPriority(t *testing.T) {
+	testCacheMessagesWithPriority(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesWithPriority(t *testing.T) {
+	testCacheMessagesWithPriority(t, newMemTestCache(t))
+}
+
+func testCacheMessagesWithPriority(t *testing.T, c *messageCache) {
+	ms := make([]*message, 0)
+	for _, priority := range []int{1, 0, 4, 3, 5} {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("priority %d", priority))
+		m.Priority = priority
+		ms = append(ms, m)
+	}
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Priority = 5
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	ms = append(ms, scheduled)
+	require.Nil(t, c.AddMessages(ms))
+
+	messages, err := c.MessagesWithPriority("mytopic", sinceAllMessages, 4, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages)) // Priority 4 is included
+	require.Equal(t, "priority 4", messages[0].Message)
+	require.Equal(t, "priority 5", messages[1].Message)
+
+	messages, err = c.MessagesWithPriority("mytopic", sinceAllMessages, 3, false)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(messages)) // Priority 0 is treated as default priority
+	require.Equal(t, "priority 0", messages[0].Message)
+
+	messages, err = c.MessagesWithPriority("mytopic", sinceAllMessages, 4, true)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "scheduled", messages[2].Message)
+
+	messages, err = c.MessagesWithPriority("mytopic", newSinceID(ms[2].ID), 4, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "priority 5", messages[0].Message)
+
+	messages, err = c.MessagesWithPriority("mytopic", sinceAllMessages, 0, false) // No filtering
+	require.Nil(t, err)
+	require.Equal(t, 5, len(messages))
+
+	messages, err = c.MessagesWithPriority("mytopic", sinceNoMessages, 4, false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	_, err = c.MessagesWithPriority("  ", sinceAllMessages, 4, false)
+	require.NotNil(t, err)
+}
+
+func TestSqliteCache_MessagesByTitle(t *testing.T) {
+	testCacheMessagesByTitle(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesByTitle(t *testing.T) {
+	testCacheMessagesByTitle(t, newMemTestCache(t))
+}
+
+func testCacheMessagesByTitle(t *testing.T, c *messageCache) {
+	for i, title := range []string{"Build Failed", "Build Succeeded", "Build Failed", "build failed", "Build Failed"} {
+		m := newDefaultMessage("ci", fmt.Sprintf("build %d", i))
+		m.Time = int64(1000 + i)
+		m.Title = title
+		require.Nil(t, c.AddMessage(m))
+	}
+	other := newDefaultMessage("othertopic", "other")
+	other.Title = "Build Failed"
+	require.Nil(t, c.AddMessage(other))
+
+	messages, err := c.MessagesByTitle("ci", "Build Failed", sinceAllMessages)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "build 0", messages[0].Message)
+	require.Equal(t, "build 2", messages[1].Message)
+	require.Equal(t, "build 4", messages[2].Message)
+
+	messages, err = c.MessagesByTitle("ci", "Build Failed", newSinceTime(1001))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "build 2", messages[0].Message)
+
+	messages, err = c.MessagesByTitle("ci", "Build Failed", newSinceID(messages[0].ID))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "build 4", messages[0].Message)
+
+	messages, err = c.MessagesByTitle("ci", "Build Failed", newSinceID("doesnotexist"))
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+
+	messages, err = c.MessagesByTitle("ci", "Build Failed", sinceNoMessages)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_Message(t *testing.T) {
+	testCacheMessage(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Message(t *testing.T) {
+	testCacheMessage(t, newMemTestCache(t))
+}
+
+func testCacheMessage(t *testing.T, c *messageCache) {
+	m := newDefaultMessage("mytopic", "my message")
+	m.Title = "some title"
+	m.Tags = []string{"tag1", "tag2"}
+	m.Time = time.Now().Add(time.Hour).Unix() // Scheduled messages are returned too
+	require.Nil(t, c.AddMessage(m))
+
+	message, err := c.Message("mytopic", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, m.ID, message.ID)
+	require.Equal(t, "my message", message.Message)
+	require.Equal(t, "some title", message.Title)
+	require.Equal(t, []string{"tag1", "tag2"}, message.Tags)
+
+	_, err = c.Message("othertopic", m.ID)
+	require.Equal(t, errMessageNotFound, err)
+	_, err = c.Message("mytopic", "doesnotexist")
+	require.Equal(t, errMessageNotFound, err)
+
+	stats := c.LookupStats()
+	require.Equal(t, int64(1), stats.MessagesFound)
+	require.Equal(t, int64(2), stats.MessagesNotFound)
+}
+
+func TestSqliteCache_MessageByID(t *testing.T) {
+	testCacheMessageByID(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessageByID(t *testing.T) {
+	testCacheMessageByID(t, newMemTestCache(t))
+}
+
+func testCacheMessageByID(t *testing.T, c *messageCache) {
+	m := newDefaultMessage("mytopic", "my message")
+	m.Time = time.Now().Add(time.Hour).Unix() // Scheduled messages are returned too
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other message")))
+
+	message, err := c.MessageByID(m.ID)
+	require.Nil(t, err)
+	require.Equal(t, m.ID, message.ID)
+	require.Equal(t, "mytopic", message.Topic)
+	require.Equal(t, "my message", message.Message)
+
+	_, err = c.MessageByID("doesnotexist")
+	require.Equal(t, errMessageNotFound, err)
+
+	collision := newDefaultMessage("othertopic", "same ID")
+	collision.ID = m.ID
+	require.Nil(t, c.AddMessage(collision))
+	_, err = c.MessageByID(m.ID)
+	require.Equal(t, errMessageIDAmbiguous, err)
+
+	require.Contains(t, queryPlan(t, c, selectMessageByIDQuery, m.ID), "USING INDEX idx_mid (mid=?)")
+}
+
+func TestSqliteCache_EmptyTopic(t *testing.T) {
+	testCacheEmptyTopic(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_EmptyTopic(t *testing.T) {
+	testCacheEmptyTopic(t, newMemTestCache(t))
+}
+
+func TestNopCache_EmptyTopic(t *testing.T) {
+	testCacheEmptyTopic(t, newNopTestCache(t))
+}
+
+func testCacheEmptyTopic(t *testing.T, c *messageCache) {
+	for _, topic := range []string{"", " ", "\t\n"} {
+		require.Equal(t, errInvalidTopic, c.AddMessage(newDefaultMessage(topic, "some message")))
+		require.Equal(t, errInvalidTopic, c.AddMessages([]*message{newDefaultMessage(topic, "some message")}))
+		_, err := c.Messages(topic, sinceAllMessages, false)
+		require.Equal(t, errInvalidTopic, err)
+		_, err = c.Message(topic, "someid")
+		require.Equal(t, errInvalidTopic, err)
+		_, err = c.MessageCount(topic)
+		require.Equal(t, errInvalidTopic, err)
+	}
+	topics, err := c.Topics()
+	require.Nil(t, err)
+	require.Empty(t, topics)
+}
+
+func TestSqliteCache_ReadMessagesWithNulls(t *testing.T) {
+	c := newSqliteTestCache(t)
+	rows, err := c.db.Query(`
+		SELECT 'abcd' AS mid, 1000 AS time, 'mytopic' AS topic, 'my message' AS message, NULL AS title, 0 AS priority, NULL AS tags, NULL AS click,
+			NULL AS actions, NULL AS attachment_name, NULL AS attachment_type, NULL AS attachment_size, NULL AS attachment_expires,
+			NULL AS attachment_url, '' AS sender, NULL AS encoding, 1000 AS updated, '' AS collapse_key, '' AS origin, NULL AS body_html,
+			'' AS category, 0 AS publish_seq, '' AS topic_display, '' AS sound, 0 AS has_location, 0 AS lat, 0 AS lng
+	`)
+	require.Nil(t, err)
+	messages, err := c.readMessages(c.db, rows)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "abcd", messages[0].ID)
+	require.Equal(t, "my message", messages[0].Message)
+	require.Equal(t, "", messages[0].Title)
+	require.Equal(t, "", messages[0].Click)
+	require.Equal(t, "", messages[0].Encoding)
+	require.Equal(t, []string{}, messages[0].Tags)
+	require.Nil(t, messages[0].Actions)
+	require.Nil(t, messages[0].Attachment)
+}
+
+func TestSqliteCache_ReadMessagesColumnsByName(t *testing.T) {
+	c := newSqliteTestCache(t)
+	m := newDefaultMessage("mytopic", "my message")
+	m.Title = "my title"
+	m.Priority = 4
+	require.Nil(t, c.AddMessage(m))
+
+	// A newer version may have added columns, which are ignored
+	_, err := c.db.Exec(`ALTER TABLE messages ADD COLUMN column_of_the_future TEXT NOT NULL DEFAULT('something')`)
+	require.Nil(t, err)
+	rows, err := c.db.Query(`SELECT * FROM messages`)
+	require.Nil(t, err)
+	messages, err := c.readMessages(c.db, rows)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m.ID, messages[0].ID)
+	require.Equal(t, "my message", messages[0].Message)
+	require.Equal(t, "my title", messages[0].Title)
+	require.Equal(t, 4, messages[0].Priority)
+
+	// Columns can be in any order, and missing ones are left empty
+	rows, err = c.db.Query(`SELECT message, topic, mid, 'unknown' AS extra, time FROM messages`)
+	require.Nil(t, err)
+	messages, err = c.readMessages(c.db, rows)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m.ID, messages[0].ID)
+	require.Equal(t, "mytopic", messages[0].Topic)
+	require.Equal(t, m.Time, messages[0].Time)
+	require.Equal(t, "my message", messages[0].Message)
+	require.Equal(t, "", messages[0].Title)
+	require.Equal(t, 0, messages[0].Priority)
+}
+
+func TestSqliteCache_MessagesTagsPrioAndTitle(t *testing.T) {
+	testCacheMessagesTagsPrioAndTitle(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesTagsPrioAndTitle(t *testing.T) {
+	testCacheMessagesTagsPrioAndTitle(t, newMemTestCache(t))
+}
+
+func testCacheMessagesTagsPrioAndTitle(t *testing.T, c *messageCache) {
+	m := newDefaultMessage("mytopic", "some message")
+	m.Tags = []string{"tag1", "tag2"}
+	m.Priority = 5
+	m.Title = "some title"
+	require.Nil(t, c.AddMessage(m))
+
+	messages, _ := c.Messages("mytopic", sinceAllMessages, false)
+	require.Equal(t, []string{"tag1", "tag2"}, messages[0].Tags)
+	require.Equal(t, 5, messages[0].Priority)
+	require.Equal(t, "some title", messages[0].Title)
+}
+
+func TestSqliteCache_MessagesTagsNeverNil(t *testing.T) {
+	testCacheMessagesTagsNeverNil(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesTagsNeverNil(t *testing.T) {
+	testCacheMessagesTagsNeverNil(t, newMemTestCache(t))
+}
+
+func testCacheMessagesTagsNeverNil(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "no tags")
+	m2 := newDefaultMessage("mytopic", "one tag")
+	m2.Tags = []string{"tag1"}
+	m3 := newDefaultMessage("mytopic", "two tags")
+	m3.Tags = []string{"tag1", "tag2"}
+	m4 := newDefaultMessage("mytopic", "empty tags")
+	m4.Tags = []string{}
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.NotNil(t, messages[0].Tags)
+	require.Equal(t, []string{}, messages[0].Tags)
+	require.Equal(t, []string{"tag1"}, messages[1].Tags)
+	require.Equal(t, []string{"tag1", "tag2"}, messages[2].Tags)
+	require.NotNil(t, messages[3].Tags)
+	require.Equal(t, []string{}, messages[3].Tags)
+}
+
+func TestSqliteCache_MessagesTagsNilEmptyTags(t *testing.T) {
+	c, err := newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{NilEmptyTags: true})
+	require.Nil(t, err)
+	m1 := newDefaultMessage("mytopic", "no tags")
+	m2 := newDefaultMessage("mytopic", "one tag")
+	m2.Tags = []string{"tag1"}
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Nil(t, messages[0].Tags)
+	require.Equal(t, []string{"tag1"}, messages[1].Tags)
+}
+
+func TestSqliteCache_MessagesTagsWithCommas(t *testing.T) {
+	testCacheMessagesTagsWithCommas(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesTagsWithCommas(t *testing.T) {
+	testCacheMessagesTagsWithCommas(t, newMemTestCache(t))
+}
+
+func testCacheMessagesTagsWithCommas(t *testing.T, c *messageCache) {
+	m := newDefaultMessage("mytopic", "some message")
+	m.Tags = []string{"warning,critical", "disk \"full\"", "a\x1fb"}
+	require.Nil(t, c.AddMessage(m))
+
+	messages, _ := c.Messages("mytopic", sinceAllMessages, false)
+	require.Equal(t, []string{"warning,critical", "disk \"full\"", "a\x1fb"}, messages[0].Tags)
+}
+
+func TestSqliteCache_MessagesSinceID(t *testing.T) {
+	testCacheMessagesSinceID(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesSinceID(t *testing.T) {
+	testCacheMessagesSinceID(t, newMemTestCache(t))
+}
+
+func testCacheMessagesSinceID(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m1.Time = 100
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m2.Time = 200
+	m3 := newDefaultMessage("mytopic", "message 3")
+	m3.Time = time.Now().Add(time.Hour).Unix() // Scheduled, in the future, later than m7 and m5
+	m4 := newDefaultMessage("mytopic", "message 4")
+	m4.Time = 400
+	m5 := newDefaultMessage("mytopic", "message 5")
+	m5.Time = time.Now().Add(time.Minute).Unix() // Scheduled, in the future, later than m7
+	m6 := newDefaultMessage("mytopic", "message 6")
+	m6.Time = 600
+	m7 := newDefaultMessage("mytopic", "message 7")
+	m7.Time = 700
+
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	require.Nil(t, c.AddMessage(m4))
+	require.Nil(t, c.AddMessage(m5))
+	require.Nil(t, c.AddMessage(m6))
+	require.Nil(t, c.AddMessage(m7))
+
+	// Case 1: Since ID exists, exclude scheduled
+	messages, _ := c.Messages("mytopic", newSinceID(m2.ID), false)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "message 4", messages[0].Message)
+	require.Equal(t, "message 6", messages[1].Message) // Not scheduled m3/m5!
+	require.Equal(t, "message 7", messages[2].Message)
+
+	// Case 2: Since ID exists, include scheduled
+	messages, _ = c.Messages("mytopic", newSinceID(m2.ID), true)
+	require.Equal(t, 5, len(messages))
+	require.Equal(t, "message 4", messages[0].Message)
+	require.Equal(t, "message 6", messages[1].Message)
+	require.Equal(t, "message 7", messages[2].Message)
+	require.Equal(t, "message 5", messages[3].Message) // Order!
+	require.Equal(t, "message 3", messages[4].Message) // Order!
+
+	// Case 3: Since ID does not exist (-> Return all messages), include scheduled
+	messages, _ = c.Messages("mytopic", newSinceID("doesntexist"), true)
+	require.Equal(t, 7, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "message 2", messages[1].Message)
+	require.Equal(t, "message 4", messages[2].Message)
+	require.Equal(t, "message 6", messages[3].Message)
+	require.Equal(t, "message 7", messages[4].Message)
+	require.Equal(t, "message 5", messages[5].Message) // Order!
+	require.Equal(t, "message 3", messages[6].Message) // Order!
+
+	// Case 4: Since ID exists and is last message (-> Return no messages), exclude scheduled
+	messages, _ = c.Messages("mytopic", newSinceID(m7.ID), false)
+	require.Equal(t, 0, len(messages))
+
+	// Case 5: Since ID exists and is last message (-> Return no messages), include scheduled
+	messages, _ = c.Messages("mytopic", newSinceID(m7.ID), true)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 5", messages[0].Message)
+	require.Equal(t, "message 3", messages[1].Message)
+}
+
+func TestSqliteCache_MessagesSinceNow(t *testing.T) {
+	testCacheMessagesSinceNow(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesSinceNow(t *testing.T) {
+	testCacheMessagesSinceNow(t, newMemTestCache(t))
+}
+
+func testCacheMessagesSinceNow(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m1.Time = 100
+	require.Nil(t, c.AddMessage(m1))
+
+	// First call returns nothing
+	messages, err := c.Messages("mytopic", sinceNow, false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	// Resolving the marker points to the latest message
+	since, err := c.ResolveSince("mytopic", sinceNow)
+	require.Nil(t, err)
+	require.True(t, since.IsID())
+	require.Equal(t, m1.ID, since.ID())
+
+	// Subsequent calls only return new messages
+	m2 := newDefaultMessage("mytopic", "message 2")
+	require.Nil(t, c.AddMessage(m2))
+	messages, err = c.Messages("mytopic", since, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 2", messages[0].Message)
+
+	// Empty topic resolves to the current time
+	since, err = c.ResolveSince("emptytopic", sinceNow)
+	require.Nil(t, err)
+	require.False(t, since.IsID())
+	require.InDelta(t, time.Now().Unix(), since.Time().Unix(), 2)
+
+	// Other markers are not touched
+	since, err = c.ResolveSince("mytopic", sinceAllMessages)
+	require.Nil(t, err)
+	require.Equal(t, sinceAllMessages, since)
+}
+
+func TestSqliteCache_UpdateMessage(t *testing.T) {
+	testCacheUpdateMessage(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_UpdateMessage(t *testing.T) {
+	testCacheUpdateMessage(t, newMemTestCache(t))
+}
+
+func testCacheUpdateMessage(t *testing.T, c *messageCache) {
+	m := newDefaultMessage("mytopic", "disk is 90% full")
+	m.Time = 100
+	require.Nil(t, c.AddMessage(m))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, int64(100), messages[0].Updated) // Equals time if never updated
+
+	m.Message = "disk is 95% full"
+	m.Priority = 4
+	m.Tags = []string{"warning"}
+	require.Nil(t, c.UpdateMessage(m))
+	require.Greater(t, m.Updated, int64(100))
+
+	messages, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "disk is 95% full", messages[0].Message)
+	require.Equal(t, 4, messages[0].Priority)
+	require.Equal(t, []string{"warning"}, messages[0].Tags)
+	require.Equal(t, int64(100), messages[0].Time)
+	require.Equal(t, m.Updated, messages[0].Updated)
+
+	m2 := newDefaultMessage("mytopic", "does not exist")
+	require.Equal(t, errMessageNotFound, c.UpdateMessage(m2))
+}
+
+func TestSqliteCache_Actions(t *testing.T) {
+	testCacheActions(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Actions(t *testing.T) {
+	testCacheActions(t, newMemTestCache(t))
+}
+
+func testCacheActions(t *testing.T, c *messageCache) {
+	actions := []*action{
+		{ID: "a1", Action: "view", Label: "Open", URL: "https://example.com", Clear: true},
+		{ID: "a2", Action: "http", Label: "Restart", URL: "https://example.com/restart", Method: "POST", Headers: map[string]string{"Authorization": "Bearer abc"}, Body: "{}"},
+	}
+	m1 := newDefaultMessage("mytopic", "with actions")
+	m1.Actions = actions
+	m2 := newDefaultMessage("mytopic", "without actions")
+	m2.Actions = []*action{}
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, actions, messages[0].Actions)
+	require.Nil(t, messages[1].Actions)
+
+	// Actions can be added and removed by updating the message
+	m1.Actions = nil
+	m2.Actions = actions[:1]
+	require.Nil(t, c.UpdateMessage(m1))
+	require.Nil(t, c.UpdateMessage(m2))
+	messages, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Nil(t, messages[0].Actions)
+	require.Equal(t, actions[:1], messages[1].Actions)
+
+	var stored string
+	require.Nil(t, c.db.QueryRow(`SELECT actions FROM messages WHERE mid = ?`, m1.ID).Scan(&stored))
+	require.Equal(t, "", stored)
+}
+
+func TestSqliteCache_UpdateMessageIfUnchanged(t *testing.T) {
+	testCacheUpdateMessageIfUnchanged(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_UpdateMessageIfUnchanged(t *testing.T) {
+	testCacheUpdateMessageIfUnchanged(t, newMemTestCache(t))
+}
+
+func testCacheUpdateMessageIfUnchanged(t *testing.T, c *messageCache) {
+	m := newDefaultMessage("mytopic", "original")
+	require.Nil(t, c.AddMessage(m))
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	expectedUpdated := messages[0].Updated
+
+	// Two editors read the same version
+	editor1 := *messages[0]
+	editor2 := *messages[0]
+
+	// First editor wins
+	editor1.Message = "edited by editor 1"
+	require.Nil(t, c.UpdateMessageIfUnchanged(&editor1, expectedUpdated))
+	require.Greater(t, editor1.Updated, expectedUpdated) // Even within the same second
+
+	// Second editor conflicts
+	editor2.Message = "edited by editor 2"
+	require.Equal(t, errMessageUpdateConflict, c.UpdateMessageIfUnchanged(&editor2, expectedUpdated))
+
+	messages, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, "edited by editor 1", messages[0].Message)
+
+	// Second editor retries with the new version
+	require.Nil(t, c.UpdateMessageIfUnchanged(&editor2, messages[0].Updated))
+	messages, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, "edited by editor 2", messages[0].Message)
+
+	// Not found
+	m2 := newDefaultMessage("mytopic", "does not exist")
+	require.Equal(t, errMessageNotFound, c.UpdateMessageIfUnchanged(m2, 0))
+}
+
+func TestSqliteCache_CollapseKey(t *testing.T) {
+	testCacheCollapseKey(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_CollapseKey(t *testing.T) {
+	testCacheCollapseKey(t, newMemTestCache(t))
+}
+
+func testCacheCollapseKey(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "build 1 running")
+	m1.CollapseKey = "build"
+	m2 := newDefaultMessage("mytopic", "unrelated")
+	m3 := newDefaultMessage("othertopic", "build in other topic")
+	m3.CollapseKey = "build"
+	m4 := newDefaultMessage("mytopic", "build 1 done")
+	m4.CollapseKey = "build"
+	m5 := newDefaultMessage("mytopic", "also unrelated") // Empty key, no collapsing
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	require.Nil(t, c.AddMessage(m4))
+	require.Nil(t, c.AddMessage(m5))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "unrelated", messages[0].Message)
+	require.Equal(t, "build 1 done", messages[1].Message)
+	require.Equal(t, "build", messages[1].CollapseKey)
+	require.Equal(t, "also unrelated", messages[2].Message)
+	require.Equal(t, "", messages[2].CollapseKey)
+
+	messages, err = c.Messages("othertopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+
+	// A scheduled message replaces the published one
+	m6 := newDefaultMessage("mytopic", "build 2 scheduled")
+	m6.CollapseKey = "build"
+	m6.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(m6))
+	messages, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	messages, err = c.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "build 2 scheduled", messages[2].Message)
+}
+
+func TestSqliteCache_DedupKey(t *testing.T) {
+	testCacheDedupKey(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_DedupKey(t *testing.T) {
+	testCacheDedupKey(t, newMemTestCache(t))
+}
+
+func testCacheDedupKey(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "build done")
+	m1.CollapseKey = "build"
+	m1.DedupKey = "key1"
+	require.Nil(t, c.AddMessage(m1))
+
+	// A retried publish is dropped, and does not replace the original via its collapse key
+	retry := newDefaultMessage("mytopic", "build done")
+	retry.CollapseKey = "build"
+	retry.DedupKey = "key1"
+	require.Equal(t, errMessageDuplicate, c.AddMessage(retry))
+
+	// Keys are per topic, and messages without a key are never deduplicated
+	other := newDefaultMessage("othertopic", "build done")
+	other.DedupKey = "key1"
+	require.Nil(t, c.AddMessage(other))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "no key")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "no key")))
+
+	// Duplicates within a batch are skipped, the rest of the batch is stored
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m2.DedupKey = "key2"
+	dupe1 := newDefaultMessage("mytopic", "duplicate of 1")
+	dupe1.DedupKey = "key1"
+	dupe2 := newDefaultMessage("mytopic", "duplicate of 2")
+	dupe2.DedupKey = "key2"
+	require.Nil(t, c.AddMessages([]*message{m2, dupe1, dupe2}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(messages))
+	require.Equal(t, m1.ID, messages[0].ID)
+	require.Equal(t, "no key", messages[1].Message)
+	require.Equal(t, "no key", messages[2].Message)
+	require.Equal(t, m2.ID, messages[3].ID)
+	messages, err = c.Messages("othertopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+}
+
+func TestSqliteCache_DueMessagesBatched(t *testing.T) {
+	testCacheDueMessagesBatched(t, newSqliteTestCacheFile)
+}
+
+func TestMemCache_DueMessagesBatched(t *testing.T) {
+	testCacheDueMessagesBatched(t, func(t *testing.T) string { return createMemoryFilename() })
+}
+
+func testCacheDueMessagesBatched(t *testing.T, newFilename func(t *testing.T) string) {
+	now := time.Now()
+	addScheduled := func(c *messageCache) {
+		for i, due := range []time.Duration{time.Hour, 2 * time.Hour, 5 * time.Hour, 6 * time.Hour, 24 * time.Hour} {
+			m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+			m.Time = now.Add(due).Unix()
+			require.Nil(t, c.AddMessage(m))
+		}
+	}
+	later := now.Add(6 * time.Hour).Unix() // Simulate a downtime; messages 0-3 are due, 0 and 1 by more than 2 hours
+	options := func(policy string) *messageCacheOptions {
+		return &messageCacheOptions{MissedSchedulePolicy: policy, MissedScheduleGrace: 2 * time.Hour}
+	}
+
+	// Deliver: all due messages are delivered in batches
+	c, err := newSqliteCacheWithOptions(newFilename(t), false, options(missedScheduleDeliver))
+	require.Nil(t, err)
+	addScheduled(c)
+	messages, err := c.DueMessagesBatched(later, 3)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "message 0", messages[0].Message)
+	require.Equal(t, "message 2", messages[2].Message)
+	for _, m := range messages {
+		require.Nil(t, c.MarkPublished(m))
+	}
+	messages, err = c.DueMessagesBatched(later, 3)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+
+	// Skip: overdue messages are marked published, but not returned
+	c, err = newSqliteCacheWithOptions(newFilename(t), false, options(missedScheduleSkip))
+	require.Nil(t, err)
+	addScheduled(c)
+	messages, err = c.DueMessagesBatched(later, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 2", messages[0].Message)
+	require.Equal(t, "message 3", messages[1].Message)
+	published, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(published))
+	require.Equal(t, "message 0", published[0].Message)
+
+	// Reschedule: overdue messages are moved to now, and returned with the next batch
+	c, err = newSqliteCacheWithOptions(newFilename(t), false, options(missedScheduleReschedule))
+	require.Nil(t, err)
+	addScheduled(c)
+	messages, err = c.DueMessagesBatched(later, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 2", messages[0].Message)
+	for _, m := range messages {
+		require.Nil(t, c.MarkPublished(m))
+	}
+	messages, err = c.DueMessagesBatched(later, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 0", messages[0].Message)
+	require.Equal(t, later, messages[0].Time)
+	require.Equal(t, "message 1", messages[1].Message)
+
+	_, err = newSqliteCacheWithOptions(newFilename(t), false, options("drop"))
+	require.Equal(t, errInvalidDuePolicy, err)
+}
+
+func TestSqliteCache_ClaimDue(t *testing.T) {
+	testCacheClaimDue(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ClaimDue(t *testing.T) {
+	testCacheClaimDue(t, newMemTestCache(t))
+}
+
+func testCacheClaimDue(t *testing.T, c *messageCache) {
+	scheduled := time.Now().Add(time.Hour).Unix()
+	backlog := make([]*message, 0)
+	for i := 0; i < 1000; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = scheduled
+		backlog = append(backlog, m)
+	}
+	require.Nil(t, c.AddMessages(backlog))
+
+	// The backlog is drained in bounded batches, each message exactly once
+	later := scheduled + 60
+	claimed := make(map[string]bool)
+	batches := 0
+	for {
+		messages, err := c.ClaimDue(later, 150)
+		require.Nil(t, err)
+		if len(messages) == 0 {
+			break
+		}
+		require.LessOrEqual(t, len(messages), 150)
+		for _, m := range messages {
+			require.False(t, claimed[m.ID])
+			claimed[m.ID] = true
+		}
+		batches++
+	}
+	require.Equal(t, 1000, len(claimed))
+	require.Equal(t, 7, batches)
+
+	// Attachments are read within the claiming transaction
+	withAttachment := newDefaultMessage("mytopic", "with attachment")
+	withAttachment.Time = scheduled
+	withAttachment.Attachment = &attachment{Name: "a.png", Size: 100, Expires: later + 3600, URL: "https://ntfy.sh/file/a.png"}
+	require.Nil(t, c.AddMessage(withAttachment))
+	messages, err := c.ClaimDue(later, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, 1, len(messages[0].Attachments))
+	require.Equal(t, "a.png", messages[0].Attachments[0].Name)
+
+	// Claimed messages are published
+	messages, err = c.DueMessagesBatched(later, 10)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	published, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1001, len(published))
+	messages, err = c.ClaimDue(later, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_StuckScheduled(t *testing.T) {
+	testCacheStuckScheduled(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_StuckScheduled(t *testing.T) {
+	testCacheStuckScheduled(t, newMemTestCache(t))
+}
+
+func testCacheStuckScheduled(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "stuck for an hour")
+	m1.Time = time.Now().Add(time.Minute).Unix()
+	m2 := newDefaultMessage("mytopic", "just due")
+	m2.Time = time.Now().Add(time.Minute).Unix()
+	m3 := newDefaultMessage("mytopic", "not due yet")
+	m3.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+
+	// Simulate that m1 and m2 became due, but were never marked as published
+	_, err := c.db.Exec(`UPDATE messages SET time = ? WHERE mid = ?`, time.Now().Add(-time.Hour).Unix(), m1.ID)
+	require.Nil(t, err)
+	_, err = c.db.Exec(`UPDATE messages SET time = ? WHERE mid = ?`, time.Now().Add(-10*time.Second).Unix(), m2.ID)
+	require.Nil(t, err)
+
+	messages, err := c.StuckScheduled(5 * time.Minute)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "stuck for an hour", messages[0].Message)
+
+	require.Nil(t, c.MarkPublished(messages[0]))
+	messages, err = c.StuckScheduled(5 * time.Minute)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_MarkPublishedBatch(t *testing.T) {
+	testCacheMarkPublishedBatch(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MarkPublishedBatch(t *testing.T) {
+	testCacheMarkPublishedBatch(t, newMemTestCache(t))
+}
+
+func testCacheMarkPublishedBatch(t *testing.T, c *messageCache) {
+	ms := make([]*message, 0)
+	for i := 0; i < 5; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("scheduled %d", i))
+		m.Time = time.Now().Add(time.Minute).Unix()
+		ms = append(ms, m)
+	}
+	notDue := newDefaultMessage("mytopic", "not due yet")
+	notDue.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages(append(ms, notDue)))
+	_, err := c.db.Exec(`UPDATE messages SET time = ? WHERE mid != ?`, time.Now().Add(-time.Second).Unix(), notDue.ID)
+	require.Nil(t, err)
+
+	due, err := c.MessagesDue()
+	require.Nil(t, err)
+	require.Equal(t, 5, len(due))
+	require.Nil(t, c.MarkPublishedBatch(due))
+	require.Nil(t, c.MarkPublishedBatch(nil))
+
+	due, err = c.MessagesDue()
+	require.Nil(t, err)
+	require.Empty(t, due)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 5, len(messages))
+	messages, err = c.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 6, len(messages))
+	require.Equal(t, "not due yet", messages[5].Message)
+}
+
+func TestSqliteCache_MessagesByEncoding(t *testing.T) {
+	testCacheMessagesByEncoding(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesByEncoding(t *testing.T) {
+	testCacheMessagesByEncoding(t, newMemTestCache(t))
+}
+
+func testCacheMessagesByEncoding(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "plain text")
+	m2 := newDefaultMessage("mytopic", "AAECAwQ=")
+	m2.Encoding = encodingBase64
+	m3 := newDefaultMessage("mytopic", "another plain text")
+	m4 := newDefaultMessage("othertopic", "AAECAwQ=")
+	m4.Encoding = encodingBase64
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	require.Nil(t, c.AddMessage(m4))
+
+	// Stored as "base64;bin", but matched as "base64"
+	messages, err := c.MessagesByEncoding("mytopic", encodingBase64, sinceAllMessages)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m2.ID, messages[0].ID)
+	require.Equal(t, "AAECAwQ=", messages[0].Message)
+
+	messages, err = c.MessagesByEncoding("mytopic", "", sinceAllMessages)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "plain text", messages[0].Message)
+	require.Equal(t, "another plain text", messages[1].Message)
+
+	messages, err = c.MessagesByEncoding("mytopic", "", newSinceID(m1.ID))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "another plain text", messages[0].Message)
+
+	messages, err = c.MessagesByEncoding("mytopic", "base%", sinceAllMessages)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_MessagesByAttachmentType(t *testing.T) {
+	testCacheMessagesByAttachmentType(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesByAttachmentType(t *testing.T) {
+	testCacheMessagesByAttachmentType(t, newMemTestCache(t))
+}
+
+func testCacheMessagesByAttachmentType(t *testing.T, c *messageCache) {
+	expires := time.Now().Add(time.Hour).Unix()
+	newAttachmentMessage := func(topic, name, contentType string) *message {
+		m := newDefaultMessage(topic, name)
+		m.Attachment = &attachment{Name: name, Type: contentType, Size: 100, Expires: expires, URL: "https://ntfy.sh/file/" + name}
+		return m
+	}
+	m1 := newAttachmentMessage("mytopic", "photo.jpg", "image/jpeg")
+	m2 := newAttachmentMessage("mytopic", "report.pdf", "application/pdf")
+	m3 := newAttachmentMessage("mytopic", "screenshot.png", "image/png")
+	m4 := newAttachmentMessage("othertopic", "other.png", "image/png")
+	m5 := newDefaultMessage("mytopic", "no attachment")
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4, m5}))
+
+	messages, err := c.MessagesByAttachmentType("mytopic", "image/", sinceAllMessages)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "photo.jpg", messages[0].Attachment.Name)
+	require.Equal(t, "screenshot.png", messages[1].Attachment.Name)
+
+	messages, err = c.MessagesByAttachmentType("mytopic", "application/pdf", sinceAllMessages)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "report.pdf", messages[0].Attachment.Name)
+
+	messages, err = c.MessagesByAttachmentType("mytopic", "image/", newSinceID(m1.ID))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "screenshot.png", messages[0].Attachment.Name)
+
+	messages, err = c.MessagesByAttachmentType("mytopic", "%", sinceAllMessages)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	messages, err = c.MessagesByAttachmentType("mytopic", "", sinceAllMessages) // All attachments
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+}
+
+func TestSqliteCache_CaseInsensitiveTopics(t *testing.T) {
+	testCacheCaseInsensitiveTopics(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_CaseInsensitiveTopics(t *testing.T) {
+	testCacheCaseInsensitiveTopics(t, createMemoryFilename())
+}
+
+func testCacheCaseInsensitiveTopics(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{CaseInsensitiveTopics: true})
+	require.Nil(t, err)
+	m1 := newDefaultMessage("MyTopic", "first")
+	m2 := newDefaultMessage("mytopic", "second")
+	m3 := newDefaultMessage("MYTOPIC", "third")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+	require.Nil(t, c.AddMessage(m3))
+	require.Equal(t, "MYTOPIC", m3.Topic) // Message is not modified
+
+	for _, topic := range []string{"mytopic", "MyTopic", "myTOPIC"} {
+		messages, err := c.Messages(topic, sinceAllMessages, false)
+		require.Nil(t, err)
+		require.Equal(t, 3, len(messages))
+		for _, m := range messages {
+			require.Equal(t, "MyTopic", m.Topic) // First-seen casing
+		}
+		m, err := c.Message(topic, m2.ID)
+		require.Nil(t, err)
+		require.Equal(t, "second", m.Message)
+	}
+	var stored string
+	require.Nil(t, c.db.QueryRow(`SELECT DISTINCT topic FROM messages`).Scan(&stored))
+	require.Equal(t, "mytopic", stored)
+
+	// Topic settings apply regardless of case
+	require.Nil(t, c.SetTopicDisabled("MYTOPIC", true))
+	require.True(t, c.TopicDisabled("mytopic"))
+	require.Equal(t, errTopicDisabled, c.AddMessage(newDefaultMessage("MyTopic", "rejected")))
+	require.Nil(t, c.SetTopicAlias("OldTopic", "MyTopic"))
+	require.Equal(t, "mytopic", c.ResolveTopic("oldtopic"))
+
+	// Case-sensitive by default
+	c, err = newSqliteCacheWithOptions(filename, false, &messageCacheOptions{})
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessages([]*message{newDefaultMessage("OtherTopic", "first"), newDefaultMessage("othertopic", "second")}))
+	messages, err := c.Messages("OtherTopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "OtherTopic", messages[0].Topic)
+}
+
+func TestSqliteCache_SearchLike(t *testing.T) {
+	testCacheSearchLike(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_SearchLike(t *testing.T) {
+	testCacheSearchLike(t, newMemTestCache(t))
+}
+
+func testCacheSearchLike(t *testing.T, c *messageCache) {
+	for i, body := range []string{"backup failed on host1", "Backup succeeded", "disk 100% full", "disk 100 full", "backup_2 failed"} {
+		m := newDefaultMessage("mytopic", body)
+		m.Time = time.Now().Add(time.Duration(i-10) * time.Minute).Unix()
+		require.Nil(t, c.AddMessage(m))
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "backup failed")))
+
+	messages, err := c.SearchLike("mytopic", "backup", 0) // Case-insensitive
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "backup failed on host1", messages[0].Message)
+	require.Equal(t, "Backup succeeded", messages[1].Message)
+	require.Equal(t, "backup_2 failed", messages[2].Message)
+
+	messages, err = c.SearchLike("mytopic", "failed", 1) // Newest match
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "backup_2 failed", messages[0].Message)
+
+	// Metacharacters match literally
+	messages, err = c.SearchLike("mytopic", "100%", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "disk 100% full", messages[0].Message)
+	messages, err = c.SearchLike("mytopic", "p_2", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "backup_2 failed", messages[0].Message)
+
+	messages, err = c.SearchLike("mytopic", "nothing", 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_SearchMessages(t *testing.T) {
+	testCacheSearchMessages(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_SearchMessages(t *testing.T) {
+	testCacheSearchMessages(t, newMemTestCache(t))
+}
+
+func testCacheSearchMessages(t *testing.T, c *messageCache) {
+	for i, title := range []string{"", "Backup report", "", "disk 100% full"} {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Title = title
+		m.Time = time.Now().Add(time.Duration(i-10) * time.Minute).Unix()
+		require.Nil(t, c.AddMessage(m))
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "nightly backup failed")))
+	scheduled := newDefaultMessage("mytopic", "scheduled backup")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "backup failed")))
+
+	// Matches body and title case-insensitively, newest first
+	messages, err := c.SearchMessages("mytopic", "BACKUP", 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "nightly backup failed", messages[0].Message)
+	require.Equal(t, "Backup report", messages[1].Title)
+
+	messages, err = c.SearchMessages("mytopic", "message", 2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+	require.Equal(t, "message 2", messages[1].Message)
+
+	messages, err = c.SearchMessages("mytopic", "100%", 0) // Metacharacters match literally
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "disk 100% full", messages[0].Title)
+
+	messages, err = c.SearchMessages("mytopic", "nothing", 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	_, err = c.SearchMessages("", "backup", 0)
+	require.Equal(t, errInvalidTopic, err)
+}
+
+func TestSqliteCache_MessagesByCategory(t *testing.T) {
+	testCacheMessagesByCategory(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_MessagesByCategory(t *testing.T) {
+	testCacheMessagesByCategory(t, createMemoryFilename())
+}
+
+func testCacheMessagesByCategory(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{Categories: []string{"incident", "info", "maintenance"}})
+	require.Nil(t, err)
+
+	m1 := newDefaultMessage("mytopic", "database down")
+	m1.Category = "incident"
+	m2 := newDefaultMessage("mytopic", "deploying v2")
+	m2.Category = "maintenance"
+	m3 := newDefaultMessage("mytopic", "database up again")
+	m3.Category = "incident"
+	m4 := newDefaultMessage("mytopic", "no category")
+	m5 := newDefaultMessage("othertopic", "other incident")
+	m5.Category = "incident"
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4, m5}))
+
+	messages, err := c.MessagesByCategory("mytopic", "incident", sinceAllMessages)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "database down", messages[0].Message)
+	require.Equal(t, "incident", messages[0].Category)
+	require.Equal(t, "database up again", messages[1].Message)
+
+	messages, err = c.MessagesByCategory("mytopic", "incident", newSinceID(m1.ID))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "database up again", messages[0].Message)
+
+	messages, err = c.MessagesByCategory("mytopic", "", sinceAllMessages)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "no category", messages[0].Message)
+
+	// Unknown categories are rejected
+	m6 := newDefaultMessage("mytopic", "unknown category")
+	m6.Category = "urgent"
+	require.Equal(t, errCategoryNotAllowed, c.AddMessage(m6))
+	require.Equal(t, errCategoryNotAllowed, c.AddMessages([]*message{newDefaultMessage("mytopic", "valid"), m6}))
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 4, count)
+}
+
+func TestSqliteCache_MaxMessageSize(t *testing.T) {
+	testCacheMaxMessageSize(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_MaxMessageSize(t *testing.T) {
+	testCacheMaxMessageSize(t, createMemoryFilename())
+}
+
+func testCacheMaxMessageSize(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{MaxMessageSize: 10, MaxTitleLength: 5})
+	require.Nil(t, err)
+
+	m1 := newDefaultMessage("mytopic", "0123456789")
+	m1.Title = "äöüßé" // 5 characters, 10 bytes
+	require.Nil(t, c.AddMessage(m1))
+	m2 := newDefaultMessage("mytopic", "01234567890")
+	require.Equal(t, errMessageTooLarge, c.AddMessage(m2))
+	require.Equal(t, errMessageTooLarge, c.AddMessages([]*message{newDefaultMessage("mytopic", "valid"), m2}))
+	m3 := newDefaultMessage("mytopic", "short")
+	m3.Title = "too long"
+	require.Equal(t, errTitleTooLong, c.AddMessage(m3))
+
+	m1.Message = "much too large"
+	require.Equal(t, errMessageTooLarge, c.UpdateMessage(m1))
+	require.Equal(t, errMessageTooLarge, c.UpdateMessageIfUnchanged(m1, m1.Updated))
+	m1.Message = "updated"
+	require.Nil(t, c.UpdateMessage(m1))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "updated", messages[0].Message)
+
+	// No limit
+	c, err = newSqliteCacheWithOptions(filename, false, &messageCacheOptions{})
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+}
+
+func TestSqliteCache_Sound(t *testing.T) {
+	testCacheSound(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Sound(t *testing.T) {
+	testCacheSound(t, newMemTestCache(t))
+}
+
+func testCacheSound(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "with sound")
+	m1.Sound = "siren_2.long"
+	m2 := newDefaultMessage("mytopic", "without sound")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "siren_2.long", messages[0].Sound)
+	require.Equal(t, "", messages[1].Sound)
+
+	// Long sounds and special characters are rejected
+	for _, sound := range []string{strings.Repeat("a", soundMaxLength+1), "siren tone", "../siren", "<b>siren</b>", "sirène"} {
+		m := newDefaultMessage("mytopic", "invalid sound")
+		m.Sound = sound
+		require.Equal(t, errInvalidSound, c.AddMessage(m))
+		require.Equal(t, errInvalidSound, c.AddMessages([]*message{newDefaultMessage("mytopic", "valid"), m}))
+	}
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+}
+
+func TestSqliteCache_Icon(t *testing.T) {
+	testCacheIcon(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Icon(t *testing.T) {
+	testCacheIcon(t, newMemTestCache(t))
+}
+
+func testCacheIcon(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "with icon")
+	m1.Icon = "https://example.com/icon.png"
+	m2 := newDefaultMessage("mytopic", "without icon")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "https://example.com/icon.png", messages[0].Icon)
+	require.Equal(t, "", messages[1].Icon)
+
+	// Updating a message does not change its icon
+	m1.Message = "updated"
+	m1.Icon = "https://example.com/other.png"
+	require.Nil(t, c.UpdateMessage(m1))
+	m, err := c.Message("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, "updated", m.Message)
+	require.Equal(t, "https://example.com/icon.png", m.Icon)
+}
+
+func TestSqliteCache_ValidateMessageID(t *testing.T) {
+	testCacheValidateMessageID(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_ValidateMessageID(t *testing.T) {
+	testCacheValidateMessageID(t, createMemoryFilename())
+}
+
+func testCacheValidateMessageID(t *testing.T, filename string) {
+	// Default validator: non-empty, not too long
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{})
+	require.Nil(t, err)
+	m1 := newDefaultMessage("mytopic", "empty id")
+	m1.ID = ""
+	require.Equal(t, errInvalidMessageID, c.AddMessage(m1))
+	m2 := newDefaultMessage("mytopic", "long id")
+	m2.ID = strings.Repeat("a", messageIDMaxLength+1)
+	require.Equal(t, errInvalidMessageID, c.AddMessages([]*message{newDefaultMessage("mytopic", "valid"), m2}))
+	m3 := newDefaultMessage("mytopic", "imported id")
+	m3.ID = "imported-1"
+	require.Nil(t, c.AddMessage(m3))
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	// Custom validator, errors are wrapped
+	c, err = newSqliteCacheWithOptions(filename, false, &messageCacheOptions{
+		MessageIDValidator: func(id string) error {
+			if !validMessageID(id) {
+				return fmt.Errorf("message ID %s is not a %d-character random string", id, messageIDLength)
+			}
+			return nil
+		},
+	})
+	require.Nil(t, err)
+	m4 := newDefaultMessage("mytopic", "imported id")
+	m4.ID = "imported-2"
+	err = c.AddMessage(m4)
+	require.True(t, errors.Is(err, errInvalidMessageID))
+	require.Contains(t, err.Error(), "imported-2")
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "random id")))
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+}
+
+func TestSqliteCache_EditedMessages(t *testing.T) {
+	testCacheEditedMessages(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_EditedMessages(t *testing.T) {
+	testCacheEditedMessages(t, newMemTestCache(t))
+}
+
+func testCacheEditedMessages(t *testing.T, c *messageCache) {
+	ms := make([]*message, 0)
+	for i := 0; i < 4; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = time.Now().Add(-time.Hour).Unix()
+		ms = append(ms, m)
+	}
+	require.Nil(t, c.AddMessages(ms))
+	ms[1].Message = "message 1 (edited)"
+	require.Nil(t, c.UpdateMessage(ms[1]))
+	ms[3].Message = "message 3 (edited)"
+	require.Nil(t, c.UpdateMessage(ms[3]))
+
+	messages, err := c.EditedMessages("mytopic", sinceAllMessages)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 1 (edited)", messages[0].Message)
+	require.True(t, messages[0].Updated > messages[0].Time)
+	require.Equal(t, "message 3 (edited)", messages[1].Message)
+
+	messages, err = c.EditedMessages("mytopic", newSinceID(ms[2].ID))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 3 (edited)", messages[0].Message)
+
+	messages, err = c.EditedMessages("othertopic", sinceAllMessages)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_MessagesExcludingOrigin(t *testing.T) {
+	testCacheMessagesExcludingOrigin(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_MessagesExcludingOrigin(t *testing.T) {
+	testCacheMessagesExcludingOrigin(t, createMemoryFilename())
+}
+
+func testCacheMessagesExcludingOrigin(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{Origin: "node1"})
+	require.Nil(t, err)
+
+	m1 := newDefaultMessage("mytopic", "local message")
+	m2 := newDefaultMessage("mytopic", "federated message")
+	m2.Origin = "node2"
+	m3 := newDefaultMessage("mytopic", "legacy message")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	_, err = c.db.Exec(`UPDATE messages SET origin = '' WHERE mid = ?`, m3.ID)
+	require.Nil(t, err)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "node1", messages[0].Origin)
+	require.Equal(t, "node2", messages[1].Origin)
+	require.Equal(t, "node1", messages[2].Origin) // Rows without origin are local
+
+	messages, err = c.MessagesExcludingOrigin("mytopic", "node1", sinceAllMessages)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "federated message", messages[0].Message)
+
+	messages, err = c.MessagesExcludingOrigin("mytopic", "node2", newSinceID(m1.ID))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "legacy message", messages[0].Message)
+
+	messages, err = c.MessagesExcludingOrigin("mytopic", "node2", sinceNoMessages)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_ForEachMessageGlobal(t *testing.T) {
+	testCacheForEachMessageGlobal(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ForEachMessageGlobal(t *testing.T) {
+	testCacheForEachMessageGlobal(t, newMemTestCache(t))
+}
+
+func testCacheForEachMessageGlobal(t *testing.T, c *messageCache) {
+	count := forEachMessageBatchSize*2 + 5
+	for i := 0; i < count; i++ {
+		topic := "topic1"
+		if i%2 == 1 {
+			topic = "topic2"
+		}
+		require.Nil(t, c.AddMessage(newDefaultMessage(topic, fmt.Sprintf("message %d", i))))
+	}
+	scheduled := newDefaultMessage("topic1", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+
+	// All messages, in insertion order
+	messages := make([]string, 0)
+	require.Nil(t, c.ForEachMessageGlobal(func(m *message) error {
+		messages = append(messages, m.Message)
+		return nil
+	}))
+	require.Equal(t, count+1, len(messages))
+	require.Equal(t, "message 0", messages[0])
+	require.Equal(t, "message 1", messages[1])
+	require.Equal(t, "scheduled", messages[count])
+
+	// Callback may modify the cache
+	require.Nil(t, c.ForEachMessageGlobal(func(m *message) error {
+		m.Title = "updated"
+		return c.UpdateMessage(m)
+	}))
+	topic2, err := c.Messages("topic2", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, count/2, len(topic2))
+	for _, m := range topic2 {
+		require.Equal(t, "updated", m.Title)
+	}
+
+	// Early termination
+	errStop := errors.New("stop")
+	seen := 0
+	err = c.ForEachMessageGlobal(func(m *message) error {
+		seen++
+		if seen == 3 {
+			return errStop
+		}
+		return nil
+	})
+	require.Equal(t, errStop, err)
+	require.Equal(t, 3, seen)
+}
+
+func TestSqliteCache_IterateFrom(t *testing.T) {
+	testCacheIterateFrom(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_IterateFrom(t *testing.T) {
+	testCacheIterateFrom(t, newMemTestCache(t))
+}
+
+func testCacheIterateFrom(t *testing.T, c *messageCache) {
+	for i := 0; i < 25; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage(fmt.Sprintf("topic%d", i%3), fmt.Sprintf("message %d", i))))
+	}
+
+	// Read the first batches, then "crash" and resume from the persisted cursor
+	batch, cursor, err := c.IterateFrom(0, 10)
+	require.Nil(t, err)
+	require.Equal(t, 10, len(batch))
+	require.Equal(t, "message 0", batch[0].Message)
+	require.Equal(t, "message 9", batch[9].Message)
+	persisted := cursor
+
+	// Messages added or deleted while iterating are handled
+	require.Nil(t, c.AddMessage(newDefaultMessage("topic0", "added while iterating")))
+	require.Nil(t, c.DeleteMessage("topic1", batch[1].ID))
+	messages := make([]string, 0)
+	for {
+		batch, cursor, err = c.IterateFrom(persisted, 10)
+		require.Nil(t, err)
+		if len(batch) == 0 {
+			require.Equal(t, persisted, cursor)
+			break
+		}
+		for _, m := range batch {
+			messages = append(messages, m.Message)
+		}
+		require.Greater(t, cursor, persisted)
+		persisted = cursor
+	}
+	require.Equal(t, 16, len(messages))
+	require.Equal(t, "message 10", messages[0])
+	require.Equal(t, "added while iterating", messages[15])
+
+	// Default batch size
+	batch, _, err = c.IterateFrom(0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 25, len(batch))
+}
+
+func TestSqliteCache_TopicStorageBytes(t *testing.T) {
+	testCacheTopicStorageBytes(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicStorageBytes(t *testing.T) {
+	testCacheTopicStorageBytes(t, newMemTestCache(t))
+}
+
+func testCacheTopicStorageBytes(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "hello") // 5 bytes
+	m2 := newDefaultMessage("mytopic", "grüße") // 7 bytes in UTF-8
+	m2.Title = "hi"                             // 2 bytes
+	m2.Tags = []string{"a"}                     // ["a"], 5 bytes
+	m3 := newDefaultMessage("mytopic", "file")  // 4 bytes
+	m3.Attachment = &attachment{Name: "file.txt", Size: 1000, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://ntfy.sh/file/abc"}
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, newDefaultMessage("othertopic", "other")}))
+
+	size, err := c.TopicStorageBytes("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, int64(5+7+2+5+4+1000), size)
+
+	// Updates are accounted for, the attachment is kept
+	m3.Message = "new file" // 8 bytes
+	m3.Tags = []string{"b"} // ["b"], 5 bytes
+	require.Nil(t, c.UpdateMessage(m3))
+	size, err = c.TopicStorageBytes("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, int64(5+7+2+5+8+5+1000), size)
+	m1.Title = "title" // 5 bytes
+	require.Nil(t, c.UpdateMessageIfUnchanged(m1, m1.Time))
+	size, err = c.TopicStorageBytes("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, int64(5+5+7+2+5+8+5+1000), size)
+
+	size, err = c.TopicStorageBytes("emptytopic")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), size)
+}
+
+func TestSqliteCache_AgeHistogram(t *testing.T) {
+	testCacheAgeHistogram(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AgeHistogram(t *testing.T) {
+	testCacheAgeHistogram(t, newMemTestCache(t))
+}
+
+func testCacheAgeHistogram(t *testing.T, c *messageCache) {
+	now := time.Now()
+	histogram, err := c.AgeHistogram(now)
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{"0-1h": 0, "1-24h": 0, "1-7d": 0, "older": 0}, histogram)
+
+	for _, age := range []time.Duration{time.Minute, 59 * time.Minute, 2 * time.Hour, 3 * 24 * time.Hour, 6 * 24 * time.Hour, 30 * 24 * time.Hour} {
+		m := newDefaultMessage("mytopic", "message")
+		m.Time = now.Add(-age).Unix()
+		require.Nil(t, c.AddMessage(m))
+	}
+	m := newDefaultMessage("othertopic", "other topic, same histogram")
+	m.Time = now.Add(-90 * 24 * time.Hour).Unix()
+	require.Nil(t, c.AddMessage(m))
+	scheduled := newDefaultMessage("mytopic", "scheduled, not counted")
+	scheduled.Time = now.Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+
+	histogram, err = c.AgeHistogram(now)
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{"0-1h": 2, "1-24h": 1, "1-7d": 2, "older": 2}, histogram)
+
+	histogram, err = c.AgeHistogram(now.Add(24 * time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{"0-1h": 0, "1-24h": 0, "1-7d": 4, "older": 3}, histogram)
+}
+
+func TestSqliteCache_DailyCounts(t *testing.T) {
+	testCacheDailyCounts(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_DailyCounts(t *testing.T) {
+	testCacheDailyCounts(t, newMemTestCache(t))
+}
+
+func testCacheDailyCounts(t *testing.T, c *messageCache) {
+	for _, ts := range []string{
+		"2022-06-01T08:00:00Z",
+		"2022-06-01T21:30:00Z", // 2022-06-02 in UTC+3
+		"2022-06-02T12:00:00Z",
+		"2022-06-03T02:00:00Z", // 2022-06-02 in UTC-5
+		"2022-06-10T12:00:00Z", // Outside of range
+	} {
+		tm, err := time.Parse(time.RFC3339, ts)
+		require.Nil(t, err)
+		m := newDefaultMessage("mytopic", "message at "+ts)
+		m.Time = tm.Unix()
+		require.Nil(t, c.AddMessage(m))
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other topic")))
+
+	from := time.Date(2022, 5, 31, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 6, 5, 0, 0, 0, 0, time.UTC)
+	counts, err := c.DailyCounts("mytopic", from, to, 0)
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{"2022-06-01": 2, "2022-06-02": 1, "2022-06-03": 1}, counts)
+
+	counts, err = c.DailyCounts("mytopic", from, to, 3*time.Hour)
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{"2022-06-01": 1, "2022-06-02": 2, "2022-06-03": 1}, counts)
+
+	counts, err = c.DailyCounts("mytopic", from, to, -5*time.Hour)
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{"2022-06-01": 2, "2022-06-02": 2}, counts)
+
+	counts, err = c.DailyCounts("emptytopic", from, to, 0)
+	require.Nil(t, err)
+	require.Empty(t, counts)
+}
+
+func TestSqliteCache_AttachmentNameSanitized(t *testing.T) {
+	testCacheAttachmentNameSanitized(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AttachmentNameSanitized(t *testing.T) {
+	testCacheAttachmentNameSanitized(t, newMemTestCache(t))
+}
+
+func testCacheAttachmentNameSanitized(t *testing.T, c *messageCache) {
+	m := newDefaultMessage("mytopic", "sneaky file")
+	m.Attachment = &attachment{
+		Name:    "../../\"evil\"\r\n.sh",
+		Type:    "text/plain",
+		Size:    10,
+		Expires: time.Now().Add(time.Hour).Unix(),
+		URL:     "https://ntfy.sh/file/AbDeFgJhal.sh",
+	}
+	require.Nil(t, c.AddMessage(m))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "evil.sh", messages[0].Attachment.Name)
+}
+
+func TestSqliteCache_AttachmentSizeByID(t *testing.T) {
+	testCacheAttachmentSizeByID(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AttachmentSizeByID(t *testing.T) {
+	testCacheAttachmentSizeByID(t, newMemTestCache(t))
+}
+
+func testCacheAttachmentSizeByID(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "flower for you")
+	m1.Attachment = &attachment{
+		Name:    "flower.jpg",
+		Type:    "image/jpeg",
+		Size:    5000,
+		Expires: time.Now().Add(time.Hour).Unix(),
+		URL:     "https://ntfy.sh/file/AbDeFgJhal.jpg",
+	}
+	m2 := newDefaultMessage("mytopic", "no attachment")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+
+	size, err := c.AttachmentSizeByID("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, int64(5000), size)
+
+	_, err = c.AttachmentSizeByID("mytopic", m2.ID)
+	require.Equal(t, errAttachmentSizeUnknown, err)
+
+	_, err = c.AttachmentSizeByID("othertopic", m1.ID)
+	require.Equal(t, errMessageNotFound, err)
+}
+
+func TestSqliteCache_ValidateToken(t *testing.T) {
+	testCacheValidateToken(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ValidateToken(t *testing.T) {
+	testCacheValidateToken(t, newMemTestCache(t))
+}
+
+func testCacheValidateToken(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m2 := newDefaultMessage("mytopic", "message 2")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessages([]*message{m2}))
+	require.Empty(t, m1.Token) // Assigned to the stored copy, see addMessages
+	token1, token2 := storedToken(t, c, m1.ID), storedToken(t, c, m2.ID)
+	require.NotEmpty(t, token1)
+	require.NotEqual(t, token1, token2)
+
+	valid, err := c.ValidateToken("mytopic", m1.ID, token1)
+	require.Nil(t, err)
+	require.True(t, valid)
+
+	valid, err = c.ValidateToken("mytopic", m1.ID, token2)
+	require.Nil(t, err)
+	require.False(t, valid)
+
+	valid, err = c.ValidateToken("mytopic", m1.ID, "")
+	require.Nil(t, err)
+	require.False(t, valid)
+
+	_, err = c.ValidateToken("othertopic", m1.ID, token1)
+	require.Equal(t, errMessageNotFound, err)
+
+	// Never returned when reading messages
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, "", messages[0].Token)
+
+	// Tokens assigned by the publisher are kept
+	m3 := newDefaultMessage("mytopic", "message 3")
+	require.Nil(t, assignMessageToken(m3))
+	require.Nil(t, c.AddMessage(m3))
+	require.Equal(t, m3.Token, storedToken(t, c, m3.ID))
+}
+
+func storedToken(t *testing.T, c *messageCache, id string) string {
+	var token string
+	require.Nil(t, c.db.QueryRow(`SELECT token FROM messages WHERE mid = ?`, id).Scan(&token))
+	return token
+}
+
+func TestSqliteCache_TryAddMessage(t *testing.T) {
+	testCacheTryAddMessage(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TryAddMessage(t *testing.T) {
+	testCacheTryAddMessage(t, newMemTestCache(t))
+}
+
+func testCacheTryAddMessage(t *testing.T, c *messageCache) {
+	old := newDefaultMessage("mytopic", "two minutes ago")
+	old.Time = time.Now().Add(-2 * time.Minute).Unix()
+	require.Nil(t, c.AddMessage(old))
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, c.TryAddMessage(newDefaultMessage("mytopic", "some message"), 3))
+	}
+	require.Equal(t, errRateLimited, c.TryAddMessage(newDefaultMessage("mytopic", "too many"), 3))
+	require.Nil(t, c.TryAddMessage(newDefaultMessage("othertopic", "other topic"), 3))
+	require.Nil(t, c.TryAddMessage(newDefaultMessage("mytopic", "no limit"), 0))
+	require.Equal(t, errInvalidTopic, c.TryAddMessage(newDefaultMessage("", "no topic"), 3))
+
+	count, err := c.MessageCountSince("mytopic", time.Now().Add(-time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, 4, count)
+	count, err = c.MessageCountSince("mytopic", time.Unix(0, 0))
+	require.Nil(t, err)
+	require.Equal(t, 5, count)
+}
+
+func TestSqliteCache_ScheduledCount(t *testing.T) {
+	testCacheScheduledCount(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ScheduledCount(t *testing.T) {
+	testCacheScheduledCount(t, newMemTestCache(t))
+}
+
+func testCacheScheduledCount(t *testing.T, c *messageCache) {
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "published")))
+	expired := newDefaultMessage("mytopic", "expired")
+	expired.Time = time.Now().Add(-time.Hour).Unix()
+	expired.TTL = 60
+	require.Nil(t, c.AddMessage(expired))
+	for _, topic := range []string{"mytopic", "mytopic", "othertopic"} {
+		m := newDefaultMessage(topic, "scheduled")
+		m.Time = time.Now().Add(time.Hour).Unix()
+		require.Nil(t, c.AddMessage(m))
+	}
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 4, count) // Unchanged, includes scheduled and expired messages
+	count, err = c.PublishedCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+	count, err = c.ScheduledCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+	count, err = c.ScheduledCount("doesnotexist")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+	count, err = c.ScheduledCountTotal()
+	require.Nil(t, err)
+	require.Equal(t, 3, count)
+
+	_, err = c.ScheduledCount("  ")
+	require.Equal(t, errInvalidTopic, err)
+	_, err = c.PublishedCount("  ")
+	require.Equal(t, errInvalidTopic, err)
+}
+
+func TestSqliteCache_CancelScheduled(t *testing.T) {
+	testCacheCancelScheduled(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_CancelScheduled(t *testing.T) {
+	testCacheCancelScheduled(t, createMemoryFilename())
+}
+
+func testCacheCancelScheduled(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{AuditDeletions: true})
+	require.Nil(t, err)
+	published := newDefaultMessage("mytopic", "published")
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	due := newDefaultMessage("mytopic", "due")
+	due.Time = time.Now().Add(time.Hour).Unix()
+	claimed := newDefaultMessage("mytopic", "claimed")
+	claimed.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{published, scheduled, due, claimed}))
+
+	require.Nil(t, c.CancelScheduled("mytopic", scheduled.ID))
+	require.Equal(t, errMessageNotFound, c.CancelScheduled("mytopic", scheduled.ID))
+	require.Equal(t, errMessageNotScheduled, c.CancelScheduled("mytopic", published.ID))
+	require.Equal(t, errMessageNotFound, c.CancelScheduled("othertopic", due.ID))
+	require.Equal(t, errInvalidTopic, c.CancelScheduled("  ", due.ID))
+
+	// Became due just before cancellation, but was not picked up by the scheduler yet
+	_, err = c.db.Exec(`UPDATE messages SET time = ? WHERE mid IN (?, ?)`, time.Now().Add(-time.Second).Unix(), due.ID, claimed.ID)
+	require.Nil(t, err)
+	require.Nil(t, c.CancelScheduled("mytopic", due.ID))
+
+	// Picked up by the scheduler, too late to cancel
+	messages, err := c.ClaimDue(time.Now().Unix(), 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, claimed.ID, messages[0].ID)
+	require.Equal(t, errMessageNotScheduled, c.CancelScheduled("mytopic", claimed.ID))
+
+	messages, err = c.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, published.ID, messages[0].ID)
+	require.Equal(t, claimed.ID, messages[1].ID)
+	entries, err := c.AuditTrail("mytopic", due.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, auditReasonCanceled, entries[0].Reason)
+}
+
+func TestSqliteCache_Stats(t *testing.T) {
+	testCacheStats(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Stats(t *testing.T) {
+	testCacheStats(t, newMemTestCache(t))
+}
+
+func testCacheStats(t *testing.T, c *messageCache) {
+	messages, topics, oldest, err := c.Stats()
+	require.Nil(t, err)
+	require.Equal(t, 0, messages)
+	require.Equal(t, 0, topics)
+	require.True(t, oldest.IsZero())
+
+	for i, topic := range []string{"topic1", "topic2", "topic1", "topic3"} {
+		m := newDefaultMessage(topic, fmt.Sprintf("message %d", i))
+		m.Time = int64(2000 - i)
+		require.Nil(t, c.AddMessage(m))
+	}
+	messages, topics, oldest, err = c.Stats()
+	require.Nil(t, err)
+	require.Equal(t, 4, messages)
+	require.Equal(t, 3, topics)
+	require.Equal(t, time.Unix(1997, 0), oldest)
+}
+
+func TestSqliteCache_MessageRange(t *testing.T) {
+	testCacheMessageRange(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessageRange(t *testing.T) {
+	testCacheMessageRange(t, newMemTestCache(t))
+}
+
+func testCacheMessageRange(t *testing.T, c *messageCache) {
+	oldest, newest, count, err := c.MessageRange("mytopic")
+	require.Nil(t, err)
+	require.True(t, oldest.IsZero())
+	require.True(t, newest.IsZero())
+	require.Equal(t, 0, count)
+
+	for _, timestamp := range []int64{1500, 1000, 2000} {
+		m := newDefaultMessage("mytopic", "some message")
+		m.Time = timestamp
+		require.Nil(t, c.AddMessage(m))
+	}
+	other := newDefaultMessage("othertopic", "other topic")
+	other.Time = 500
+	require.Nil(t, c.AddMessage(other))
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+
+	oldest, newest, count, err = c.MessageRange("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, time.Unix(1000, 0), oldest)
+	require.Equal(t, time.Unix(2000, 0), newest)
+	require.Equal(t, 3, count)
+
+	_, _, _, err = c.MessageRange("  ")
+	require.Equal(t, errInvalidTopic, err)
+}
+
+func TestSqliteCache_RecentForSender(t *testing.T) {
+	testCacheRecentForSender(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_RecentForSender(t *testing.T) {
+	testCacheRecentForSender(t, newMemTestCache(t))
+}
+
+func testCacheRecentForSender(t *testing.T, c *messageCache) {
+	for i, topic := range []string{"topic1", "topic2", "topic1", "topic3"} {
+		m := newDefaultMessage(topic, fmt.Sprintf("message %d", i))
+		m.Time = int64(1000 + i)
+		m.Sender = "1.2.3.4"
+		require.Nil(t, c.AddMessage(m))
+	}
+	other := newDefaultMessage("topic1", "other sender")
+	other.Sender = "5.6.7.8"
+	require.Nil(t, c.AddMessage(other))
+	scheduled := newDefaultMessage("topic1", "scheduled")
+	scheduled.Sender = "1.2.3.4"
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+
+	messages, err := c.RecentForSender("1.2.3.4", 3)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+	require.Equal(t, "topic3", messages[0].Topic)
+	require.Equal(t, "message 2", messages[1].Message)
+	require.Equal(t, "message 1", messages[2].Message)
+
+	messages, err = c.RecentForSender("1.2.3.4", 0)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(messages))
+
+	messages, err = c.RecentForSender("9.9.9.9", 10)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_MessagesBySender(t *testing.T) {
+	testCacheMessagesBySender(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesBySender(t *testing.T) {
+	testCacheMessagesBySender(t, newMemTestCache(t))
+}
+
+func testCacheMessagesBySender(t *testing.T, c *messageCache) {
+	for i, topic := range []string{"topic1", "topic2", "topic1", "topic3"} {
+		m := newDefaultMessage(topic, fmt.Sprintf("message %d", i))
+		m.Time = int64(1000 + i)
+		m.Sender = "1.2.3.4"
+		require.Nil(t, c.AddMessage(m))
+	}
+	other := newDefaultMessage("topic1", "other sender")
+	other.Sender = "5.6.7.8"
+	require.Nil(t, c.AddMessage(other))
+	scheduled := newDefaultMessage("topic1", "scheduled")
+	scheduled.Sender = "1.2.3.4"
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+
+	messages, err := c.MessagesBySender("1.2.3.4", time.Unix(1001, 0))
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "topic2", messages[0].Topic)
+	require.Equal(t, "message 2", messages[1].Message)
+	require.Equal(t, "message 3", messages[2].Message)
+	require.Equal(t, "1.2.3.4", messages[2].Sender)
+
+	messages, err = c.MessagesBySender("1.2.3.4", time.Unix(0, 0))
+	require.Nil(t, err)
+	require.Equal(t, 4, len(messages))
+
+	messages, err = c.MessagesBySender("9.9.9.9", time.Unix(0, 0))
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_AckMessage(t *testing.T) {
+	testCacheAckMessage(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AckMessage(t *testing.T) {
+	testCacheAckMessage(t, newMemTestCache(t))
+}
+
+func testCacheAckMessage(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("alerts", "server down")
+	m1.Priority = 5
+	m2 := newDefaultMessage("alerts", "disk full")
+	m2.Priority = 4
+	m3 := newDefaultMessage("alerts", "backup done") // Default priority
+	m4 := newDefaultMessage("alerts", "scheduled alert")
+	m4.Priority = 5
+	m4.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	require.Nil(t, c.AddMessage(m4))
+
+	messages, err := c.UnackedMessages("alerts", 4)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "server down", messages[0].Message)
+	require.Equal(t, "disk full", messages[1].Message)
+
+	messages, err = c.UnackedMessages("alerts", 5)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "server down", messages[0].Message)
+
+	messages, err = c.UnackedMessages("alerts", 3)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+
+	require.Nil(t, c.AckMessage("alerts", m1.ID, "phil"))
+	require.Nil(t, c.AckMessage("alerts", m1.ID, "john")) // Already acked, no error
+	require.Equal(t, errMessageNotFound, c.AckMessage("alerts", "doesnotexist", "phil"))
+	require.Equal(t, errMessageNotFound, c.AckMessage("othertopic", m2.ID, "phil"))
+
+	messages, err = c.UnackedMessages("alerts", 4)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "disk full", messages[0].Message)
+
+	rows, err := c.db.Query(`SELECT acked_by FROM messages WHERE mid = ?`, m1.ID)
+	require.Nil(t, err)
+	require.True(t, rows.Next())
+	var ackedBy string
+	require.Nil(t, rows.Scan(&ackedBy))
+	require.Nil(t, rows.Close())
+	require.Equal(t, "phil", ackedBy) // First ack wins
+}
+
+func TestSqliteCache_TTL(t *testing.T) {
+	testCacheTTL(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TTL(t *testing.T) {
+	testCacheTTL(t, newMemTestCache(t))
+}
+
+func testCacheTTL(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "expired")
+	m1.Time = time.Now().Add(-time.Minute).Unix()
+	m1.TTL = 30
+	m2 := newDefaultMessage("mytopic", "not expired")
+	m2.Time = time.Now().Add(-time.Minute).Unix()
+	m2.TTL = 3600
+	m3 := newDefaultMessage("mytopic", "no ttl")
+	m3.Time = time.Now().Add(-time.Minute).Unix()
+	m4 := newDefaultMessage("mytopic", "scheduled")
+	m4.Time = time.Now().Add(time.Hour).Unix()
+	m4.TTL = 30 // Counts from the scheduled time
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "not expired", messages[0].Message)
+	require.Equal(t, int64(3600), messages[0].TTL)
+	require.Equal(t, "no ttl", messages[1].Message)
+	require.Equal(t, int64(0), messages[1].TTL)
+	require.Equal(t, "scheduled", messages[2].Message)
+	require.Equal(t, int64(30), messages[2].TTL)
+
+	messages, err = c.Messages("mytopic", newSinceID(m1.ID), false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+
+	// Expired messages are deleted physically by the pruner, regardless of olderThan
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 4, count)
+	require.Nil(t, c.Prune(time.Now().Add(-time.Hour), 0))
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 3, count)
+	require.Equal(t, int64(1), c.TotalPruned())
+}
+
+func TestSqliteCache_Prune(t *testing.T) {
+	testCachePrune(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Prune(t *testing.T) {
+	testCachePrune(t, newMemTestCache(t))
+}
+
+func testCachePrune(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "my message")
+	m1.Time = 1
+
+	m2 := newDefaultMessage("mytopic", "my other message")
+	m2.Time = 2
 
 	m3 := newDefaultMessage("another_topic", "and another one")
 	m3.Time = 1
 
-	require.Nil(t, c.AddMessage(m1))
-	require.Nil(t, c.AddMessage(m2))
-	require.Nil(t, c.AddMessage(m3))
-	require.Nil(t, c.Prune(time.Unix(2, 0)))
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	require.Equal(t, int64(0), c.TotalPruned())
+	require.True(t, c.LastPruneTime().IsZero())
+
+	start := time.Now()
+	require.Nil(t, c.Prune(time.Unix(2, 0), 0))
+	require.Equal(t, int64(2), c.TotalPruned())
+	require.False(t, c.LastPruneTime().Before(start))
+	require.True(t, c.LastPruneDuration() > 0)
+
+	require.Nil(t, c.Prune(time.Unix(2, 0), 0))
+	require.Equal(t, int64(2), c.TotalPruned()) // Nothing left to prune
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	count, err = c.MessageCount("another_topic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "my other message", messages[0].Message)
+}
+
+func TestSqliteCache_PruneExpiredScheduled(t *testing.T) {
+	testCachePruneExpiredScheduled(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_PruneExpiredScheduled(t *testing.T) {
+	testCachePruneExpiredScheduled(t, newMemTestCache(t))
+}
+
+func testCachePruneExpiredScheduled(t *testing.T, c *messageCache) {
+	now := time.Now()
+	m1 := newDefaultMessage("mytopic", "past drop-dead time")
+	m1.Time = now.Add(time.Hour).Unix()
+	m1.NotAfter = now.Add(-time.Minute).Unix()
+	m2 := newDefaultMessage("mytopic", "before drop-dead time")
+	m2.Time = now.Add(time.Hour).Unix()
+	m2.NotAfter = now.Add(2 * time.Hour).Unix()
+	m3 := newDefaultMessage("mytopic", "no drop-dead time")
+	m3.Time = now.Add(time.Hour).Unix()
+	m4 := newDefaultMessage("mytopic", "published")
+	m4.NotAfter = now.Add(-time.Minute).Unix()
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4}))
+
+	// Make scheduled messages due; the one past its drop-dead time can never fire
+	_, err := c.db.Exec(`UPDATE messages SET time = ? WHERE published = 0`, now.Add(-time.Second).Unix())
+	require.Nil(t, err)
+	messages, err := c.MessagesDue()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "before drop-dead time", messages[0].Message)
+	require.Equal(t, "no drop-dead time", messages[1].Message)
+
+	deleted, err := c.PruneExpiredScheduled(now.Unix())
+	require.Nil(t, err)
+	require.Equal(t, 1, deleted)
+	messages, err = c.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, int64(0), c.TotalPruned()) // Not counted as pruned by Prune
+
+	deleted, err = c.PruneExpiredScheduled(now.Add(3 * time.Hour).Unix())
+	require.Nil(t, err)
+	require.Equal(t, 1, deleted)
+	messages, err = c.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "published", messages[0].Message)
+	require.Equal(t, "no drop-dead time", messages[1].Message)
+}
+
+func TestSqliteCache_PruneMinKeep(t *testing.T) {
+	testCachePruneMinKeep(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_PruneMinKeep(t *testing.T) {
+	testCachePruneMinKeep(t, newMemTestCache(t))
+}
+
+func testCachePruneMinKeep(t *testing.T, c *messageCache) {
+	for i := 1; i <= 5; i++ {
+		m := newDefaultMessage("busytopic", fmt.Sprintf("message %d", i))
+		m.Time = int64(i)
+		require.Nil(t, c.AddMessage(m))
+	}
+	m := newDefaultMessage("quiettopic", "old message")
+	m.Time = 1
+	require.Nil(t, c.AddMessage(m))
+
+	require.Nil(t, c.Prune(time.Unix(10, 0), 2))
+	require.Equal(t, int64(3), c.TotalPruned())
+
+	messages, err := c.Messages("busytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 4", messages[0].Message)
+	require.Equal(t, "message 5", messages[1].Message)
+
+	messages, err = c.Messages("quiettopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "old message", messages[0].Message)
+}
+
+func TestSqliteCache_PruneTopicToCount(t *testing.T) {
+	testCachePruneTopicToCount(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_PruneTopicToCount(t *testing.T) {
+	testCachePruneTopicToCount(t, newMemTestCache(t))
+}
+
+func testCachePruneTopicToCount(t *testing.T, c *messageCache) {
+	ms := make([]*message, 0)
+	for i := 1; i <= 5; i++ {
+		m := newDefaultMessage("busytopic", fmt.Sprintf("message %d", i))
+		m.Time = time.Now().Add(time.Duration(i-10) * time.Second).Unix()
+		ms = append(ms, m)
+	}
+	scheduled := newDefaultMessage("busytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	ms = append(ms, scheduled, newDefaultMessage("othertopic", "other"))
+	require.Nil(t, c.AddMessages(ms))
+
+	deleted, err := c.PruneTopicToCount("busytopic", 2)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), deleted)
+	messages, err := c.Messages("busytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "message 4", messages[0].Message)
+	require.Equal(t, "message 5", messages[1].Message)
+	require.Equal(t, "scheduled", messages[2].Message)
+
+	deleted, err = c.PruneTopicToCount("busytopic", 2)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), deleted)
+
+	// Keeping none deletes all published messages, but never scheduled or pinned ones
+	require.Nil(t, c.SetPinned("busytopic", ms[4].ID, true))
+	deleted, err = c.PruneTopicToCount("busytopic", 0)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), deleted)
+	messages, err = c.Messages("busytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 5", messages[0].Message)
+	require.Equal(t, "scheduled", messages[1].Message)
+	require.Nil(t, c.SetPinned("busytopic", ms[4].ID, false))
+	deleted, err = c.PruneTopicToCount("busytopic", 0)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), deleted)
+
+	messages, err = c.Messages("othertopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+
+	_, err = c.PruneTopicToCount("  ", 0)
+	require.NotNil(t, err)
+}
+
+func TestSqliteCache_PruneToMaxRows(t *testing.T) {
+	testCachePruneToMaxRows(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_PruneToMaxRows(t *testing.T) {
+	testCachePruneToMaxRows(t, createMemoryFilename())
+}
+
+func testCachePruneToMaxRows(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{PruneBatchSize: 2})
+	require.Nil(t, err)
+	ms := make([]*message, 0)
+	for i := 1; i <= 7; i++ {
+		topic := "topic1"
+		if i%2 == 0 {
+			topic = "topic2"
+		}
+		m := newDefaultMessage(topic, fmt.Sprintf("message %d", i))
+		m.Time = time.Now().Add(time.Duration(i-10) * time.Second).Unix()
+		ms = append(ms, m)
+	}
+	scheduled := newDefaultMessage("topic1", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	ms = append(ms, scheduled)
+	require.Nil(t, c.AddMessages(ms))
+	require.Nil(t, c.SetPinned("topic1", ms[0].ID, true))
+
+	deleted, err := c.PruneToMaxRows(10)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), deleted)
+
+	// Oldest published messages across all topics are deleted first, in batches of 2
+	deleted, err = c.PruneToMaxRows(4)
+	require.Nil(t, err)
+	require.Equal(t, int64(4), deleted)
+	count, err := c.messageCountTotal()
+	require.Nil(t, err)
+	require.Equal(t, 4, count)
+	messages, err := c.Messages("topic1", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "message 1", messages[0].Message) // Pinned
+	require.Equal(t, "message 7", messages[1].Message)
+	require.Equal(t, "scheduled", messages[2].Message)
+	messages, err = c.Messages("topic2", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 6", messages[0].Message)
+
+	// Scheduled and pinned messages are never deleted, even if max cannot be reached
+	deleted, err = c.PruneToMaxRows(0)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), deleted)
+	count, err = c.messageCountTotal()
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+}
+
+func TestSqliteCache_PruneBatched(t *testing.T) {
+	testCachePruneBatched(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_PruneBatched(t *testing.T) {
+	testCachePruneBatched(t, createMemoryFilename())
+}
+
+func testCachePruneBatched(t *testing.T, filename string) {
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{PruneBatchSize: 2, AuditDeletions: true})
+	require.Nil(t, err)
+	old := make([]*message, 0)
+	for i := 1; i <= 5; i++ {
+		m := newDefaultMessage(fmt.Sprintf("topic%d", i%2), fmt.Sprintf("old message %d", i))
+		m.Time = int64(i)
+		old = append(old, m)
+	}
+	expired := newDefaultMessage("topic1", "expired")
+	expired.Time = time.Now().Add(-time.Minute).Unix()
+	expired.TTL = 1
+	pinned := newDefaultMessage("topic1", "pinned")
+	pinned.Time = 1
+	recent := newDefaultMessage("topic1", "recent")
+	require.Nil(t, c.AddMessages(append(old, expired, pinned, recent)))
+	require.Nil(t, c.SetPinned("topic1", pinned.ID, true))
+
+	require.Nil(t, c.Prune(time.Unix(100, 0), 0))
+	require.Equal(t, int64(6), c.TotalPruned())
+	messages, err := c.Messages("topic1", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "pinned", messages[0].Message)
+	require.Equal(t, "recent", messages[1].Message)
+	for _, m := range old {
+		entries, err := c.AuditTrail(m.Topic, m.ID)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(entries))
+		require.Equal(t, auditReasonPruned, entries[0].Reason)
+	}
+
+	// Keeping the newest messages of each topic works the same in batches
+	c, err = newSqliteCacheWithOptions(createMemoryFilename(), false, &messageCacheOptions{PruneBatchSize: 2})
+	require.Nil(t, err)
+	testCachePruneMinKeep(t, c)
+	c, err = newSqliteCacheWithOptions(createMemoryFilename(), false, &messageCacheOptions{PruneBatchSize: 2})
+	require.Nil(t, err)
+	testCachePruneTopicToCount(t, c)
+}
+
+func TestSqliteCache_DeleteTopicCascade(t *testing.T) {
+	testCacheDeleteTopicCascade(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_DeleteTopicCascade(t *testing.T) {
+	testCacheDeleteTopicCascade(t, newMemTestCache(t))
+}
+
+func testCacheDeleteTopicCascade(t *testing.T, c *messageCache) {
+	require.Equal(t, 1, queryPragmaInt(t, c, "foreign_keys"))
+	_, err := c.db.Exec(`
+		CREATE TABLE reactions (
+			message_id INT NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+			emoji TEXT NOT NULL
+		)
+	`)
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "message 1")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "message 2")))
+	_, err = c.db.Exec(`INSERT INTO reactions (message_id, emoji) SELECT id, 'tada' FROM messages`)
+	require.Nil(t, err)
+
+	_, err = c.DeleteTopic("mytopic")
+	require.Nil(t, err)
+
+	rows, err := c.db.Query(`SELECT COUNT(*) FROM reactions`)
+	require.Nil(t, err)
+	require.True(t, rows.Next())
+	var count int
+	require.Nil(t, rows.Scan(&count))
+	require.Nil(t, rows.Close())
+	require.Equal(t, 1, count)
+}
+
+func TestSqliteDSN(t *testing.T) {
+	require.Equal(t, "/var/cache/ntfy/cache.db?_foreign_keys=1", sqliteDSN("/var/cache/ntfy/cache.db"))
+	require.Equal(t, "file:abc?mode=memory&cache=shared&_foreign_keys=1", sqliteDSN("file:abc?mode=memory&cache=shared"))
+}
+
+func TestSqliteCache_PrunePinned(t *testing.T) {
+	testCachePrunePinned(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_PrunePinned(t *testing.T) {
+	testCachePrunePinned(t, newMemTestCache(t))
+}
+
+func testCachePrunePinned(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "pinned")
+	m1.Time = 1
+	m2 := newDefaultMessage("mytopic", "not pinned")
+	m2.Time = 1
+	m3 := newDefaultMessage("mytopic", "unpinned again")
+	m3.Time = 1
+	m4 := newDefaultMessage("mytopic", "pinned and scheduled")
+	m4.Time = time.Now().Add(time.Second).Unix()
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4}))
+	require.Nil(t, c.SetPinned("mytopic", m1.ID, true))
+	require.Nil(t, c.SetPinned("mytopic", m3.ID, true))
+	require.Nil(t, c.SetPinned("mytopic", m3.ID, false))
+	require.Nil(t, c.SetPinned("mytopic", m4.ID, true))
+	require.Equal(t, errMessageNotFound, c.SetPinned("mytopic", "doesnotexist", true))
+	require.Equal(t, errMessageNotFound, c.SetPinned("othertopic", m1.ID, true))
+
+	require.Nil(t, c.Prune(time.Unix(2, 0), 0))
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "pinned", messages[0].Message)
+
+	// Pinning does not affect scheduled delivery
+	time.Sleep(1100 * time.Millisecond)
+	messages, err = c.MessagesDue()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "pinned and scheduled", messages[0].Message)
+}
+
+func TestSqliteCache_DeleteTopic(t *testing.T) {
+	testCacheDeleteTopic(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_DeleteTopic(t *testing.T) {
+	testCacheDeleteTopic(t, newMemTestCache(t))
+}
+
+func testCacheDeleteTopic(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "my message")
+	m2 := newDefaultMessage("mytopic", "flower for you")
+	m2.Attachment = &attachment{
+		Name:    "flower.jpg",
+		Expires: time.Now().Add(time.Hour).Unix(),
+		URL:     "https://ntfy.sh/file/AbDeFgJhal.jpg",
+	}
+	m3 := newDefaultMessage("mytopic", "scheduled message")
+	m3.Time = time.Now().Add(time.Hour).Unix()
+	m4 := newDefaultMessage("another_topic", "and another one")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	require.Nil(t, c.AddMessage(m4))
+
+	deleted, attachmentIDs, err := c.DeleteTopicWithAttachments("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 3, deleted)
+	require.Equal(t, []string{m2.ID}, attachmentIDs)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	messages, err = c.Messages("another_topic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "and another one", messages[0].Message)
+
+	deleted, attachmentIDs, err = c.DeleteTopicWithAttachments("doesnotexist")
+	require.Nil(t, err)
+	require.Equal(t, 0, deleted)
+	require.Empty(t, attachmentIDs)
+
+	// Without collecting attachments, only the number of deleted messages is returned
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "added again")))
+	count, err := c.DeleteTopic("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), count)
+	messages, err = c.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	count, err = c.DeleteTopic("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), count)
+	messages, err = c.Messages("another_topic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+}
+
+func TestSqliteCache_DeleteTopicBuffered(t *testing.T) {
+	testCacheDeleteTopicBuffered(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_DeleteTopicBuffered(t *testing.T) {
+	testCacheDeleteTopicBuffered(t, newMemTestCache(t))
+}
+
+func testCacheDeleteTopicBuffered(t *testing.T, c *messageCache) {
+	c.EnableInsertBuffer(100, time.Hour)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "buffered")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "buffered as well")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "buffered")))
+
+	// Buffered messages of the topic are deleted as well, and not written afterwards
+	deleted, err := c.DeleteTopic("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), deleted)
+	require.Nil(t, c.Flush())
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+	count, err = c.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	_, err = c.DeleteTopic(" ")
+	require.Equal(t, errInvalidTopic, err)
+}
+
+func TestNopCache_DeleteTopic(t *testing.T) {
+	c := newNopTestCache(t)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my message")))
+	deleted, err := c.DeleteTopic("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), deleted)
+	n, attachmentIDs, err := c.DeleteTopicWithAttachments("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+	require.Empty(t, attachmentIDs)
+}
+
+func TestSqliteCache_DuplicateMessageIDs(t *testing.T) {
+	testCacheDuplicateMessageIDs(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_DuplicateMessageIDs(t *testing.T) {
+	testCacheDuplicateMessageIDs(t, newMemTestCache(t))
+}
+
+func testCacheDuplicateMessageIDs(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "original 1")
+	m2 := newDefaultMessage("mytopic", "original 2")
+	m3 := newDefaultMessage("mytopic", "unique")
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+	dupe1 := newDefaultMessage("mytopic", "duplicate 1a")
+	dupe1.ID = m1.ID
+	dupe2 := newDefaultMessage("othertopic", "duplicate 1b")
+	dupe2.ID = m1.ID
+	dupe3 := newDefaultMessage("mytopic", "duplicate 2")
+	dupe3.ID = m2.ID
+	require.Nil(t, c.AddMessages([]*message{dupe1, dupe2, dupe3}))
 
-	count, err := c.MessageCount("mytopic")
+	ids, err := c.DuplicateMessageIDs()
 	require.Nil(t, err)
-	require.Equal(t, 1, count)
+	require.ElementsMatch(t, []string{m1.ID, m2.ID}, ids)
 
-	count, err = c.MessageCount("another_topic")
+	deleted, err := c.DeduplicateMessages()
 	require.Nil(t, err)
-	require.Equal(t, 0, count)
+	require.Equal(t, 3, deleted)
 
+	ids, err = c.DuplicateMessageIDs()
+	require.Nil(t, err)
+	require.Empty(t, ids)
 	messages, err := c.Messages("mytopic", sinceAllMessages, false)
 	require.Nil(t, err)
-	require.Equal(t, 1, len(messages))
-	require.Equal(t, "my other message", messages[0].Message)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "original 1", messages[0].Message)
+	require.Equal(t, "original 2", messages[1].Message)
+	require.Equal(t, "unique", messages[2].Message)
 }
 
 func TestSqliteCache_Attachments(t *testing.T) {
@@ -345,9 +3327,380 @@ func testCacheAttachments(t *testing.T, c *messageCache) {
 	require.Nil(t, err)
 	require.Equal(t, int64(0), size)
 
+	m = newDefaultMessage("another-topic", "sending you a bike")
+	m.ID = "m4"
+	m.Sender = "5.6.7.8"
+	m.Attachment = &attachment{
+		Name:    "bike.jpg",
+		Type:    "image/jpeg",
+		Size:    1000,
+		Expires: expires3,
+		URL:     "https://ntfy.sh/file/bikeURL.jpg",
+	}
+	require.Nil(t, c.AddMessage(m))
+
+	size, err = c.AttachmentsSizeTotal()
+	require.Nil(t, err)
+	require.Equal(t, int64(31000), size) // m1 is expired
+
 	ids, err := c.AttachmentsExpired()
 	require.Nil(t, err)
 	require.Equal(t, []string{"m1"}, ids)
+
+	messages, err = c.MessagesWithExpiredAttachments(10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "m1", messages[0].ID)
+	require.Equal(t, "flower for you", messages[0].Message)
+	require.Equal(t, "flower.jpg", messages[0].Attachment.Name)
+
+	m = newDefaultMessage("mytopic", "another expired flower")
+	m.ID = "m5"
+	m.Attachment = &attachment{
+		Name:    "flower2.jpg",
+		Expires: expires1,
+		URL:     "https://ntfy.sh/file/Flower2.jpg",
+	}
+	require.Nil(t, c.AddMessage(m))
+
+	messages, err = c.MessagesWithExpiredAttachments(1)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+
+	messages, err = c.MessagesWithExpiredAttachments(0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+}
+
+func TestSqliteCache_MessageForensics(t *testing.T) {
+	testCacheMessageForensics(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessageForensics(t *testing.T) {
+	testCacheMessageForensics(t, newMemTestCache(t))
+}
+
+func testCacheMessageForensics(t *testing.T, c *messageCache) {
+	m := newDefaultMessage("mytopic", "some spam")
+	m.SourceIP = "1.2.3.4"
+	m.UserAgent = "curl/7.81.0"
+	require.Nil(t, c.AddMessage(m))
+
+	forensics, err := c.MessageForensics("mytopic", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, "1.2.3.4", forensics.SourceIP)
+	require.Equal(t, "curl/7.81.0", forensics.UserAgent)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "", messages[0].SourceIP) // Never returned to subscribers
+	require.Equal(t, "", messages[0].UserAgent)
+
+	_, err = c.MessageForensics("mytopic", "doesnotexist")
+	require.Equal(t, errMessageNotFound, err)
+}
+
+func TestSqliteCache_QueryPlanSinceTime(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Contains(t, queryPlan(t, c, selectMessagesSinceTimeQuery, "mytopic", 0), "USING INDEX idx_topic_time (topic=? AND time>?)")
+	require.Contains(t, queryPlan(t, c, selectMessageCountSinceQuery, "mytopic", 0), "USING COVERING INDEX idx_topic_time (topic=? AND time>?)")
+}
+
+func TestSqliteCache_QueryPlanHighPriority(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Contains(t, queryPlan(t, c, selectUnackedHighPriorityMessagesQuery, "alerts", 5), "USING INDEX idx_high_priority (topic=?)")
+	require.NotContains(t, queryPlan(t, c, selectUnackedMessagesQuery, "alerts", 3), "idx_high_priority")
+}
+
+func TestSqliteCache_AutoVacuumIncremental(t *testing.T) {
+	c, err := newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{AutoVacuum: "incremental"})
+	require.Nil(t, err)
+	require.Equal(t, 2, queryPragmaInt(t, c, "auto_vacuum")) // 2 = incremental
+
+	messages := make([]*message, 0)
+	for i := 0; i < 500; i++ {
+		m := newDefaultMessage("mytopic", strings.Repeat("x", 1000))
+		m.Time = 1
+		messages = append(messages, m)
+	}
+	require.Nil(t, c.AddMessages(messages))
+	require.Nil(t, c.Prune(time.Unix(2, 0), 0))
+	freePages := queryPragmaInt(t, c, "freelist_count")
+	require.Greater(t, freePages, 10)
+
+	require.Nil(t, c.IncrementalVacuum(10))
+	require.Equal(t, freePages-10, queryPragmaInt(t, c, "freelist_count"))
+	require.Nil(t, c.IncrementalVacuum(0))
+	require.Equal(t, 0, queryPragmaInt(t, c, "freelist_count"))
+}
+
+func TestSqliteCache_Ping(t *testing.T) {
+	testCachePing(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Ping(t *testing.T) {
+	testCachePing(t, newMemTestCache(t))
+}
+
+func testCachePing(t *testing.T, c *messageCache) {
+	require.Nil(t, c.Ping())
+	require.Nil(t, c.Close())
+	require.NotNil(t, c.Ping())
+}
+
+func TestSqliteCache_Compact(t *testing.T) {
+	testCacheCompact(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Compact(t *testing.T) {
+	testCacheCompact(t, newMemTestCache(t))
+}
+
+func testCacheCompact(t *testing.T, c *messageCache) {
+	messages := make([]*message, 0)
+	for i := 0; i < 500; i++ {
+		m := newDefaultMessage("mytopic", strings.Repeat("x", 1000))
+		m.Time = 1
+		messages = append(messages, m)
+	}
+	require.Nil(t, c.AddMessages(append(messages, newDefaultMessage("mytopic", "kept"))))
+	require.Nil(t, c.Prune(time.Unix(2, 0), 0))
+	pages := queryPragmaInt(t, c, "page_count")
+	require.Greater(t, queryPragmaInt(t, c, "freelist_count"), 10)
+
+	require.Nil(t, c.Compact())
+	require.Equal(t, 0, queryPragmaInt(t, c, "freelist_count"))
+	require.Less(t, queryPragmaInt(t, c, "page_count"), pages)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "kept", messages[0].Message)
+}
+
+func TestSqliteCache_Compact_WAL(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{JournalMode: "wal"})
+	require.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", strings.Repeat("x", 1000))))
+	}
+	stat, err := os.Stat(filename + "-wal")
+	require.Nil(t, err)
+	require.Greater(t, stat.Size(), int64(0))
+	require.Nil(t, c.Compact())
+	stat, err = os.Stat(filename + "-wal")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), stat.Size())
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 100, count)
+}
+
+func TestNopCache_Compact(t *testing.T) {
+	require.Nil(t, newNopTestCache(t).Compact())
+}
+
+func TestSqliteCache_AutoVacuumExistingDB(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	require.Equal(t, 0, queryPragmaInt(t, c, "auto_vacuum"))
+	require.Nil(t, c.db.Close())
+
+	// Only applies to new databases
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{AutoVacuum: "incremental"})
+	require.Nil(t, err)
+	require.Equal(t, 0, queryPragmaInt(t, c, "auto_vacuum"))
+
+	_, err = newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{AutoVacuum: "invalid"})
+	require.NotNil(t, err)
+}
+
+func TestSqliteCache_Synchronous(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Equal(t, 1, queryPragmaInt(t, c, "synchronous")) // Driver default is NORMAL
+	for mode, expected := range map[string]int{"off": 0, "normal": 1, "full": 2} {
+		c, err := newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{Synchronous: mode})
+		require.Nil(t, err)
+		require.Equal(t, expected, queryPragmaInt(t, c, "synchronous"))
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "some message")))
+		require.Nil(t, c.Close())
+	}
+	_, err := newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{Synchronous: "extra"})
+	require.NotNil(t, err)
+}
+
+func TestSqliteCache_JournalModeAndBusyTimeout(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Equal(t, "delete", queryPragmaString(t, c, "journal_mode")) // Driver defaults
+	require.Equal(t, 5000, queryPragmaInt(t, c, "busy_timeout"))
+
+	c, err := newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{JournalMode: "wal", BusyTimeout: 10 * time.Second})
+	require.Nil(t, err)
+	require.Equal(t, "wal", queryPragmaString(t, c, "journal_mode"))
+	require.Equal(t, 10000, queryPragmaInt(t, c, "busy_timeout"))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "some message")))
+	require.Nil(t, c.Close())
+
+	// Journal mode does not apply to in-memory caches
+	c, err = newSqliteCacheWithOptions(createMemoryFilename(), false, &messageCacheOptions{JournalMode: "wal", BusyTimeout: time.Second})
+	require.Nil(t, err)
+	require.Equal(t, "memory", queryPragmaString(t, c, "journal_mode"))
+	require.Equal(t, 1000, queryPragmaInt(t, c, "busy_timeout"))
+
+	_, err = newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{JournalMode: "off"})
+	require.NotNil(t, err)
+	_, err = newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{BusyTimeout: -time.Second})
+	require.NotNil(t, err)
+}
+
+func TestSqliteCache_ConnPool(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Equal(t, 0, c.db.Stats().MaxOpenConnections) // database/sql default, unlimited
+
+	c, err := newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{JournalMode: "wal", MaxOpenConns: 4, MaxIdleConns: 2, ConnMaxLifetime: time.Minute})
+	require.Nil(t, err)
+	require.Equal(t, 4, c.db.Stats().MaxOpenConnections)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "some message")))
+	require.Nil(t, c.Close())
+
+	_, err = newSqliteCacheWithOptions(newSqliteTestCacheFile(t), false, &messageCacheOptions{MaxOpenConns: -1})
+	require.NotNil(t, err)
+}
+
+func TestMemCache_ConnPool(t *testing.T) {
+	c := newMemTestCache(t)
+	require.Equal(t, 1, c.db.Stats().MaxOpenConnections)
+
+	// The database survives sequential calls, and idle connections are not closed
+	for i := 0; i < 10; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))))
+		messages, err := c.Messages("mytopic", sinceAllMessages, false)
+		require.Nil(t, err)
+		require.Equal(t, i+1, len(messages))
+	}
+	require.Equal(t, 1, c.db.Stats().OpenConnections)
+
+	c, err := newSqliteCacheWithOptions(createMemoryFilename(), false, &messageCacheOptions{MaxOpenConns: 3})
+	require.Nil(t, err)
+	require.Equal(t, 3, c.db.Stats().MaxOpenConnections)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "some message")))
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	_, err = newSqliteCacheWithOptions(createMemoryFilename(), false, &messageCacheOptions{ConnMaxLifetime: time.Minute})
+	require.NotNil(t, err)
+}
+
+func BenchmarkSqliteCache_AddMessage_SynchronousOff(b *testing.B) {
+	benchmarkCacheAddMessageSynchronous(b, "off")
+}
+
+func BenchmarkSqliteCache_AddMessage_SynchronousNormal(b *testing.B) {
+	benchmarkCacheAddMessageSynchronous(b, "normal")
+}
+
+func BenchmarkSqliteCache_AddMessage_SynchronousFull(b *testing.B) {
+	benchmarkCacheAddMessageSynchronous(b, "full")
+}
+
+func benchmarkCacheAddMessageSynchronous(b *testing.B, synchronous string) {
+	c, err := newSqliteCacheWithOptions(filepath.Join(b.TempDir(), "cache.db"), false, &messageCacheOptions{Synchronous: synchronous})
+	require.Nil(b, err)
+	defer c.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.AddMessage(newDefaultMessage("mytopic", "some message")); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSqliteCache_AddMessage_Loop(b *testing.B) {
+	benchmarkCacheAddMessages(b, false)
+}
+
+func BenchmarkSqliteCache_AddMessages_Batch(b *testing.B) {
+	benchmarkCacheAddMessages(b, true)
+}
+
+func benchmarkCacheAddMessages(b *testing.B, batch bool) {
+	c, err := newSqliteCache(filepath.Join(b.TempDir(), "cache.db"), false)
+	require.Nil(b, err)
+	defer c.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		messages := make([]*message, 500)
+		for j := range messages {
+			messages[j] = newDefaultMessage("mytopic", fmt.Sprintf("buffered message %d", j))
+		}
+		b.StartTimer()
+		if batch {
+			if err := c.AddMessages(messages); err != nil {
+				b.Fatal(err)
+			}
+		} else {
+			for _, m := range messages {
+				if err := c.AddMessage(m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func TestSqliteCache_TimeMillis(t *testing.T) {
+	c := newSqliteTestCache(t)
+	m1 := newDefaultMessage("mytopic", "now")
+	m2 := newDefaultMessage("mytopic", "in the past")
+	m2.Time = 1000
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	rows, err := c.db.Query(`SELECT time, time_ms FROM messages ORDER BY id`)
+	require.Nil(t, err)
+	defer rows.Close()
+	var timestamp, timeMillis int64
+	require.True(t, rows.Next())
+	require.Nil(t, rows.Scan(&timestamp, &timeMillis))
+	require.Equal(t, m1.Time, timestamp)
+	require.True(t, timeMillis >= m1.Time*1000 && timeMillis < (m1.Time+1)*1000)
+	require.True(t, rows.Next())
+	require.Nil(t, rows.Scan(&timestamp, &timeMillis))
+	require.Equal(t, int64(1000999), timeMillis) // Time was changed after creation, so the end of the second is used
+}
+
+func TestSqliteCache_TimeMillisSecondBoundary(t *testing.T) {
+	testCacheTimeMillisSecondBoundary(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TimeMillisSecondBoundary(t *testing.T) {
+	testCacheTimeMillisSecondBoundary(t, newMemTestCache(t))
+}
+
+func testCacheTimeMillisSecondBoundary(t *testing.T, c *messageCache) {
+	second := time.Now().Add(-time.Minute).Unix()
+	m1 := newDefaultMessage("mytopic", "created and stored in the second")
+	m1.Time, m1.TimeMillis = second, second*1000+500
+	require.Nil(t, c.AddMessage(m1))
+
+	// Created before m1, but stored after the second is over, e.g. because of the insert buffer
+	m2 := newDefaultMessage("mytopic", "created earlier, stored in the next second")
+	m2.Time, m2.TimeMillis = second, second*1000+100
+	require.Nil(t, c.AddMessage(m2))
+
+	// Without creation time, it is stored at the end of the second, never before messages stored earlier
+	m3 := newDefaultMessage("mytopic", "no creation time, stored in the next second")
+	m3.Time, m3.TimeMillis = second, 0
+	require.Nil(t, c.AddMessage(m3))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, m2.ID, messages[0].ID)
+	require.Equal(t, m1.ID, messages[1].ID)
+	require.Equal(t, m3.ID, messages[2].ID)
 }
 
 func TestSqliteCache_Migration_From0(t *testing.T) {
@@ -386,8 +3739,98 @@ func TestSqliteCache_Migration_From0(t *testing.T) {
 	require.Equal(t, 10, len(messages))
 	require.Equal(t, "some message 5", messages[5].Message)
 	require.Equal(t, "", messages[5].Title)
-	require.Nil(t, messages[5].Tags)
+	require.Equal(t, []string{}, messages[5].Tags)
 	require.Equal(t, 0, messages[5].Priority)
+	require.Equal(t, "", messages[5].Icon)
+	require.Equal(t, int64(6), messages[5].PublishSeq)
+	size, err := c.TopicStorageBytes("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, int64(10*len("some message 0")), size) // Backfilled
+
+	// Publish sequence continues after the existing messages
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "new message")))
+	messages, err = c.MessagesSinceSeq("mytopic", 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, int64(11), messages[0].PublishSeq)
+}
+
+func TestSqliteCache_Migration_ResumeFromEachVersion(t *testing.T) {
+	for version := 0; version < currentSchemaVersion; version++ {
+		t.Run(fmt.Sprintf("version %d", version), func(t *testing.T) {
+			filename := newSqliteTestCacheFile(t)
+			db, err := sql.Open("sqlite3", filename)
+			require.Nil(t, err)
+			_, err = db.Exec(`
+				CREATE TABLE messages (id VARCHAR(20) PRIMARY KEY, time INT NOT NULL, topic VARCHAR(64) NOT NULL, message VARCHAR(1024) NOT NULL);
+				CREATE INDEX idx_topic ON messages (topic);
+				INSERT INTO messages (id, time, topic, message) VALUES ('abcd', 1000, 'mytopic', 'some message');
+			`)
+			require.Nil(t, err)
+
+			// Simulate a migration that was interrupted after reaching the given version
+			for _, m := range migrations {
+				if m.from < version {
+					require.Nil(t, runMigration(db, m))
+				}
+			}
+			require.Nil(t, db.Close())
+
+			c := newSqliteTestCacheFromFile(t, filename)
+			checkSchemaVersion(t, c.db)
+			messages, err := c.Messages("mytopic", sinceAllMessages, false)
+			require.Nil(t, err)
+			require.Equal(t, 1, len(messages))
+			require.Equal(t, "some message", messages[0].Message)
+		})
+	}
+}
+
+func TestSqliteCache_Migration_FailedStepIsRolledBack(t *testing.T) {
+	c := newSqliteTestCache(t)
+	failing := &migration{
+		from: currentSchemaVersion,
+		to:   currentSchemaVersion + 1,
+		fn: func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`CREATE TABLE half_done (id INT)`); err != nil {
+				return err
+			}
+			return errors.New("disk full")
+		},
+	}
+	require.Equal(t, "disk full", runMigration(c.db, failing).Error())
+	checkSchemaVersion(t, c.db)
+	_, err := c.db.Exec(`SELECT * FROM half_done`)
+	require.NotNil(t, err)
+}
+
+func TestSqliteCache_Migration_RetryTransientFailure(t *testing.T) {
+	c := newSqliteTestCache(t)
+	attempts := 0
+	flaky := &migration{
+		from: currentSchemaVersion,
+		to:   currentSchemaVersion + 1,
+		fn: func(tx *sql.Tx) error {
+			attempts++
+			if attempts == 1 {
+				return errors.New("database is locked")
+			}
+			_, err := tx.Exec(`CREATE TABLE done (id INT)`)
+			return err
+		},
+	}
+	require.Nil(t, runMigrationWithRetry(c.db, flaky))
+	require.Equal(t, 2, attempts)
+	_, err := c.db.Exec(`SELECT * FROM done`)
+	require.Nil(t, err)
+}
+
+func TestSqliteCache_Migration_StepsAreComplete(t *testing.T) {
+	for i, m := range migrations {
+		require.Equal(t, i, m.from)
+		require.Equal(t, i+1, m.to)
+	}
+	require.Equal(t, currentSchemaVersion, migrations[len(migrations)-1].to)
 }
 
 func TestSqliteCache_Migration_From1(t *testing.T) {
@@ -421,6 +3864,8 @@ func TestSqliteCache_Migration_From1(t *testing.T) {
 			fmt.Sprintf("abcd%d", i), time.Now().Unix(), "mytopic", fmt.Sprintf("some message %d", i), "", 0, "")
 		require.Nil(t, err)
 	}
+	_, err = db.Exec(`UPDATE messages SET tags = 'tag1,tag2' WHERE id = 'abcd3'`)
+	require.Nil(t, err)
 	require.Nil(t, db.Close())
 
 	// Create cache to trigger migration
@@ -436,11 +3881,45 @@ func TestSqliteCache_Migration_From1(t *testing.T) {
 	messages, err := c.Messages("mytopic", sinceAllMessages, false)
 	require.Nil(t, err)
 	require.Equal(t, 10, len(messages))
+	require.Equal(t, []string{}, messages[2].Tags)
+	require.Equal(t, []string{"tag1", "tag2"}, messages[3].Tags) // Re-encoded as JSON
 
 	// 11!
 	messages, err = c.Messages("mytopic", sinceAllMessages, true)
 	require.Nil(t, err)
 	require.Equal(t, 11, len(messages))
+
+	// Millisecond time backfilled
+	rows, err := c.db.Query(`SELECT COUNT(*) FROM messages WHERE mid != ? AND time_ms != time * 1000`, delayedMessage.ID)
+	require.Nil(t, err)
+	require.True(t, rows.Next())
+	var mismatches int
+	require.Nil(t, rows.Scan(&mismatches))
+	require.Nil(t, rows.Close())
+	require.Equal(t, 0, mismatches)
+}
+
+func TestSqliteCache_SchemaNewerThanSupported(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	_, err := c.db.Exec(`UPDATE schemaVersion SET version = ?`, currentSchemaVersion+1)
+	require.Nil(t, err)
+	require.Nil(t, c.Close())
+
+	_, err = newSqliteCache(filename, false)
+	require.True(t, errors.Is(err, errSchemaNewer))
+	require.Contains(t, err.Error(), fmt.Sprintf("found schema version %d, supported up to %d", currentSchemaVersion+1, currentSchemaVersion))
+}
+
+func TestSqliteCache_SchemaVersionMissing(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	_, err := c.db.Exec(`DELETE FROM schemaVersion`)
+	require.Nil(t, err)
+	require.Nil(t, c.Close())
+
+	_, err = newSqliteCache(filename, false)
+	require.Equal(t, errSchemaUnknown, err)
 }
 
 func checkSchemaVersion(t *testing.T, db *sql.DB) {
@@ -467,6 +3946,117 @@ func TestMemCache_NopCache(t *testing.T) {
 	assert.Empty(t, topics)
 }
 
+func TestSqliteCache_WithTx(t *testing.T) {
+	testCacheWithTx(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_WithTx(t *testing.T) {
+	testCacheWithTx(t, newMemTestCache(t))
+}
+
+func testCacheWithTx(t *testing.T, c *messageCache) {
+	insert := func(tx *sql.Tx, id string) error {
+		m := newDefaultMessage("mytopic", "message "+id)
+		m.ID = id
+		return c.insertMessage(tx, m)
+	}
+	require.Nil(t, c.withTx(func(tx *sql.Tx) error {
+		return insert(tx, "committed")
+	}))
+
+	// Errors are passed through unchanged, and the transaction is rolled back
+	err := c.withTx(func(tx *sql.Tx) error {
+		require.Nil(t, insert(tx, "rolledback1"))
+		return errMessageNotFound
+	})
+	require.Equal(t, errMessageNotFound, err)
+
+	// Panics are passed on after rolling back
+	require.Panics(t, func() {
+		_ = c.withTx(func(tx *sql.Tx) error {
+			require.Nil(t, insert(tx, "rolledback2"))
+			panic("oh no")
+		})
+	})
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "committed", messages[0].ID)
+}
+
+func TestSqliteCache_NewCacheFromDB(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	db, err := sql.Open("sqlite3", sqliteDSN(filename))
+	require.Nil(t, err)
+	c, err := newCacheFromDB(db, false)
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my message")))
+	require.Nil(t, c.Close())
+
+	// Existing database is not set up again
+	db, err = sql.Open("sqlite3", sqliteDSN(filename))
+	require.Nil(t, err)
+	c, err = newCacheFromDB(db, false)
+	require.Nil(t, err)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "my message", messages[0].Message)
+}
+
+func init() {
+	// Driver with a sleep_ms function, to make queries deliberately slow in tests
+	sql.Register("sqlite3_sleep", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("sleep_ms", func(ms int64) int64 {
+				time.Sleep(time.Duration(ms) * time.Millisecond)
+				return 0
+			}, false)
+		},
+	})
+}
+
+func TestSqliteCache_MessagesContext(t *testing.T) {
+	c := newSqliteTestCache(t)
+	m := newDefaultMessage("mytopic", "my message")
+	require.Nil(t, c.AddMessage(m))
+	messages, err := c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	found, err := c.MessageContext(context.Background(), "mytopic", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, "my message", found.Message)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.MessagesContext(ctx, "mytopic", sinceAllMessages, false)
+	require.Equal(t, context.Canceled, err)
+	_, err = c.MessageContext(ctx, "mytopic", m.ID)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestSqliteCache_MessagesContext_CancelSlowQuery(t *testing.T) {
+	db, err := sql.Open("sqlite3_sleep", sqliteDSN(newSqliteTestCacheFile(t)))
+	require.Nil(t, err)
+	c, err := newCacheFromDB(db, false)
+	require.Nil(t, err)
+	defer c.Close()
+	for i := 0; i < 20; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))))
+	}
+	// Every row read from the messages view takes 100ms, so reading all of them would take 2s
+	_, err = db.Exec(`ALTER TABLE messages RENAME TO messages_data; CREATE VIEW messages AS SELECT * FROM messages_data WHERE sleep_ms(100) = 0`)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.MessagesContext(ctx, "mytopic", sinceAllMessages, false)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Less(t, time.Since(start), time.Second)
+}
+
 func newSqliteTestCache(t *testing.T) *messageCache {
 	c, err := newSqliteCache(newSqliteTestCacheFile(t), false)
 	if err != nil {
@@ -494,3 +4084,46 @@ func newMemTestCache(t *testing.T) *messageCache {
 	}
 	return c
 }
+
+func newNopTestCache(t *testing.T) *messageCache {
+	c, err := newNopCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func queryPragmaString(t *testing.T, c *messageCache, pragma string) string {
+	rows, err := c.db.Query("PRAGMA " + pragma)
+	require.Nil(t, err)
+	defer rows.Close()
+	require.True(t, rows.Next())
+	var value string
+	require.Nil(t, rows.Scan(&value))
+	return value
+}
+
+func queryPragmaInt(t *testing.T, c *messageCache, pragma string) int {
+	rows, err := c.db.Query("PRAGMA " + pragma)
+	require.Nil(t, err)
+	defer rows.Close()
+	require.True(t, rows.Next())
+	var value int
+	require.Nil(t, rows.Scan(&value))
+	return value
+}
+
+func queryPlan(t *testing.T, c *messageCache, query string, args ...interface{}) string {
+	rows, err := c.db.Query("EXPLAIN QUERY PLAN "+query, args...)
+	require.Nil(t, err)
+	defer rows.Close()
+	plan := make([]string, 0)
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		require.Nil(t, rows.Scan(&id, &parent, &notUsed, &detail))
+		plan = append(plan, detail)
+	}
+	require.Nil(t, rows.Err())
+	return strings.Join(plan, "\n")
+}
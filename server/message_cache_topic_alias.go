@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+)
+
+// Topics can be aliased to another (canonical) topic, e.g. to rename a topic without moving its messages: Once
+// the old name is an alias of the new one, messages published to either name are stored under the new name, and
+// reading either name returns the same messages. Aliases may point to other aliases, but never in a cycle.
+// Like topic defaults, aliases are kept in memory, and persisted in the topic_aliases table.
+
+const (
+	createTopicAliasesTableQuery = `
+		CREATE TABLE IF NOT EXISTS topic_aliases (
+			alias TEXT PRIMARY KEY,
+			canonical TEXT NOT NULL
+		);
+	`
+	upsertTopicAliasQuery = `
+		INSERT INTO topic_aliases (alias, canonical) VALUES (?, ?)
+		ON CONFLICT (alias) DO UPDATE SET canonical = excluded.canonical
+	`
+	deleteTopicAliasQuery   = `DELETE FROM topic_aliases WHERE alias = ?`
+	selectTopicAliasesQuery = `SELECT alias, canonical FROM topic_aliases`
+)
+
+var errTopicAliasCycle = errors.New("topic alias would create a cycle")
+
+// SetTopicAlias makes alias an alias of the canonical topic, so that AddMessage stores messages published to
+// alias under the canonical topic, and Messages and Message read from the canonical topic. An empty canonical
+// topic removes the alias. Messages that were stored under the alias before are not moved, and are hidden
+// while the alias exists. It returns errTopicAliasCycle if the canonical topic is (an alias of) alias.
+func (c *messageCache) SetTopicAlias(alias, canonical string) error {
+	if err := validateTopic(alias); err != nil {
+		return err
+	} else if canonical == "" {
+		alias = c.topicKey(alias)
+		if _, err := c.db.Exec(deleteTopicAliasQuery, alias); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.topicAliases, alias)
+		return nil
+	} else if err := validateTopic(canonical); err != nil {
+		return err
+	}
+	alias, canonical = c.topicKey(alias), c.topicKey(canonical)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic, ok := canonical, true; ok; topic, ok = c.topicAliases[topic] {
+		if topic == alias {
+			return errTopicAliasCycle
+		}
+	}
+	if _, err := c.db.Exec(upsertTopicAliasQuery, alias, canonical); err != nil {
+		return err
+	}
+	c.topicAliases[alias] = canonical
+	return nil
+}
+
+// ResolveTopic returns the canonical topic of the given topic, following aliases (see SetTopicAlias), or the
+// topic itself if it is not an alias. If topics are case-insensitive, the returned topic is lowercased.
+func (c *messageCache) ResolveTopic(topic string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.resolveTopicAliasLocked(c.topicKey(topic))
+}
+
+// resolveMessageTopic returns the topic that a message published to the given topic is stored under: the
+// canonical topic if it is an alias, or the topic in its original casing otherwise, so that the casing can be
+// kept as display name, see messageCacheOptions.CaseInsensitiveTopics
+func (c *messageCache) resolveMessageTopic(topic string) string {
+	if resolved := c.ResolveTopic(topic); resolved != c.topicKey(topic) {
+		return resolved
+	}
+	return topic
+}
+
+func (c *messageCache) resolveTopicAliasLocked(topic string) string {
+	for {
+		canonical, ok := c.topicAliases[topic]
+		if !ok {
+			return topic
+		}
+		topic = canonical
+	}
+}
+
+func (c *messageCache) loadTopicAliases() error {
+	rows, err := c.db.Query(selectTopicAliasesQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for rows.Next() {
+		var alias, canonical string
+		if err := rows.Scan(&alias, &canonical); err != nil {
+			return err
+		}
+		c.topicAliases[alias] = canonical
+	}
+	return rows.Err()
+}
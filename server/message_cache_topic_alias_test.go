@@ -0,0 +1,150 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_TopicAlias(t *testing.T) {
+	testCacheTopicAlias(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicAlias(t *testing.T) {
+	testCacheTopicAlias(t, newMemTestCache(t))
+}
+
+func testCacheTopicAlias(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("newname", "published to canonical topic")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.SetTopicAlias("oldname", "newname"))
+	m2 := newDefaultMessage("oldname", "published to alias")
+	require.Nil(t, c.AddMessage(m2))
+	require.Equal(t, "oldname", m2.Topic) // The caller's message is not changed, see AddMessage
+
+	for _, topic := range []string{"newname", "oldname"} {
+		messages, err := c.Messages(topic, sinceAllMessages, false)
+		require.Nil(t, err)
+		require.Equal(t, 2, len(messages))
+		require.Equal(t, "published to canonical topic", messages[0].Message)
+		require.Equal(t, "published to alias", messages[1].Message)
+		require.Equal(t, "newname", messages[1].Topic)
+
+		m, err := c.Message(topic, m1.ID)
+		require.Nil(t, err)
+		require.Equal(t, m1.ID, m.ID)
+	}
+
+	// Aliases of aliases are resolved
+	require.Nil(t, c.SetTopicAlias("ancientname", "oldname"))
+	require.Equal(t, "newname", c.ResolveTopic("ancientname"))
+	require.Nil(t, c.AddMessages([]*message{newDefaultMessage("ancientname", "published to alias of alias")}))
+	count, err := c.MessageCount("newname")
+	require.Nil(t, err)
+	require.Equal(t, 3, count)
+
+	// Cycles are rejected
+	require.Equal(t, errTopicAliasCycle, c.SetTopicAlias("newname", "ancientname"))
+	require.Equal(t, errTopicAliasCycle, c.SetTopicAlias("newname", "newname"))
+	require.Equal(t, errInvalidTopic, c.SetTopicAlias("", "newname"))
+
+	// Removing an alias
+	require.Nil(t, c.SetTopicAlias("oldname", ""))
+	require.Equal(t, "oldname", c.ResolveTopic("oldname"))
+	require.Equal(t, "oldname", c.ResolveTopic("ancientname"))
+	messages, err := c.Messages("oldname", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_TopicAliasReopen(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	require.Nil(t, c.SetTopicAlias("oldname", "newname"))
+	require.Nil(t, c.db.Close())
+
+	c = newSqliteTestCacheFromFile(t, filename)
+	require.Equal(t, "newname", c.ResolveTopic("oldname"))
+	require.Equal(t, errTopicAliasCycle, c.SetTopicAlias("newname", "oldname"))
+}
+
+func TestSqliteCache_TopicAliasQueries(t *testing.T) {
+	testCacheTopicAliasQueries(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicAliasQueries(t *testing.T) {
+	testCacheTopicAliasQueries(t, newMemTestCache(t))
+}
+
+func testCacheTopicAliasQueries(t *testing.T, c *messageCache) {
+	require.Nil(t, c.SetTopicAlias("oldname", "newname"))
+	m1 := newDefaultMessage("newname", "findme")
+	m1.Time = time.Now().Add(-time.Minute).Unix()
+	m1.Title = "A title"
+	m1.Sender = "1.2.3.4"
+	m1.SourceIP = "1.2.3.4"
+	m1.Attachment = &attachment{Name: "a.png", Type: "image/png", Size: 100, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://ntfy.sh/file/a.png"}
+	require.Nil(t, assignMessageToken(m1))
+	m2 := newDefaultMessage("newname", "aGVsbG8=")
+	m2.Encoding = encodingBase64
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	// Every topic-keyed method resolves the alias
+	updated := *m1
+	updated.Topic = "oldname"
+	updated.Message = "findme, edited"
+	require.Nil(t, c.UpdateMessage(&updated))
+	require.Nil(t, c.UpdateMessageIfUnchanged(&updated, updated.Updated))
+	m, err := c.Message("newname", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, "findme, edited", m.Message)
+
+	messages, total, err := c.MessagesPageWithTotal("oldname", sinceAllMessages, false, 1, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, total)
+	require.Equal(t, 1, len(messages))
+	id, err := c.LatestID("oldname")
+	require.Nil(t, err)
+	require.Equal(t, m2.ID, id)
+	oldest, ok, err := c.OldestMessageTime("oldname")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, m1.Time, oldest)
+	for _, query := range []func() ([]*message, error){
+		func() ([]*message, error) { return c.MessagesByTitle("oldname", "A title", sinceAllMessages) },
+		func() ([]*message, error) { return c.MessagesByEncoding("oldname", "", sinceAllMessages) },
+		func() ([]*message, error) { return c.MessagesByAttachmentType("oldname", "image/", sinceAllMessages) },
+		func() ([]*message, error) { return c.EditedMessages("oldname", sinceAllMessages) },
+		func() ([]*message, error) { return c.SearchLike("oldname", "findme", 0) },
+		func() ([]*message, error) { return c.MessagesLatest("oldname", 1000) },
+	} {
+		messages, err := query()
+		require.Nil(t, err)
+		require.NotEmpty(t, messages)
+		require.Equal(t, m1.ID, messages[len(messages)-1].ID)
+	}
+	messages, err = c.MessagesByCategory("oldname", "", sinceAllMessages)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	valid, err := c.ValidateToken("oldname", m1.ID, m1.Token)
+	require.Nil(t, err)
+	require.True(t, valid)
+	size, err := c.AttachmentSizeByID("oldname", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, int64(100), size)
+	forensics, err := c.MessageForensics("oldname", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, "1.2.3.4", forensics.SourceIP)
+	require.Nil(t, c.AckMessage("oldname", m1.ID, "phil"))
+	require.Nil(t, c.SetPinned("oldname", m1.ID, true))
+	count, err := c.MessageCount("oldname")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+
+	deleted, err := c.DeleteTopic("oldname")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), deleted)
+	count, err = c.MessageCount("newname")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Topics can have default values for the priority and tags of a message, which are applied when a message is
+// published without priority or tags. This avoids repetitive publish parameters for integrations that always
+// publish to the same topic. Topics can also have a max priority, which caps the priority of all messages
+// published to the topic, and they can be disabled, so that no new messages are accepted. A max attachment
+// TTL limits how long attachments of the topic are kept, regardless of the expiry requested by the uploader.
+// Defaults are kept in memory, and persisted in the topic_defaults table.
+
+const (
+	createTopicDefaultsTableQuery = `
+		CREATE TABLE IF NOT EXISTS topic_defaults (
+			topic TEXT PRIMARY KEY,
+			priority INT NOT NULL,
+			tags TEXT NOT NULL,
+			max_priority INT NOT NULL DEFAULT('0'),
+			disabled INT NOT NULL DEFAULT('0'),
+			attachment_ttl INT NOT NULL DEFAULT('0')
+		);
+	`
+	upsertTopicDefaultsQuery = `
+		INSERT INTO topic_defaults (topic, priority, tags) VALUES (?, ?, ?)
+		ON CONFLICT (topic) DO UPDATE SET priority = excluded.priority, tags = excluded.tags
+	`
+	upsertTopicMaxPriorityQuery = `
+		INSERT INTO topic_defaults (topic, priority, tags, max_priority) VALUES (?, 0, '', ?)
+		ON CONFLICT (topic) DO UPDATE SET max_priority = excluded.max_priority
+	`
+	upsertTopicDisabledQuery = `
+		INSERT INTO topic_defaults (topic, priority, tags, disabled) VALUES (?, 0, '', ?)
+		ON CONFLICT (topic) DO UPDATE SET disabled = excluded.disabled
+	`
+	upsertTopicAttachmentTTLQuery = `
+		INSERT INTO topic_defaults (topic, priority, tags, attachment_ttl) VALUES (?, 0, '', ?)
+		ON CONFLICT (topic) DO UPDATE SET attachment_ttl = excluded.attachment_ttl
+	`
+	deleteEmptyTopicDefaultsQuery = `DELETE FROM topic_defaults WHERE topic = ? AND priority = 0 AND tags = '' AND max_priority = 0 AND disabled = 0 AND attachment_ttl = 0`
+	selectTopicDefaultsQuery      = `SELECT topic, priority, tags, max_priority, disabled, attachment_ttl FROM topic_defaults`
+)
+
+var (
+	errInvalidTopicDefaultPriority = errors.New("invalid default priority")
+	errInvalidTopicAttachmentTTL   = errors.New("invalid attachment TTL")
+)
+
+// topicDefaults are the default priority and tags, the max priority, the disabled flag and the max attachment
+// TTL of a topic, see SetTopicDefaults, SetTopicMaxPriority, SetTopicDisabled and SetTopicAttachmentTTL
+type topicDefaults struct {
+	Priority      int
+	Tags          []string
+	MaxPriority   int
+	Disabled      bool
+	AttachmentTTL time.Duration
+}
+
+func (d *topicDefaults) empty() bool {
+	return d.Priority == 0 && len(d.Tags) == 0 && d.MaxPriority == 0 && !d.Disabled && d.AttachmentTTL == 0
+}
+
+// SetTopicDefaults sets the default priority and tags for messages published to the given topic. A priority
+// of 0 and empty tags mean no default.
+func (c *messageCache) SetTopicDefaults(topic string, priority int, tags []string) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	} else if priority < 0 || priority > 5 {
+		return errInvalidTopicDefaultPriority
+	}
+	topic = c.topicKey(topic)
+	tagsStr := ""
+	if len(tags) > 0 {
+		b, err := json.Marshal(tags)
+		if err != nil {
+			return err
+		}
+		tagsStr = string(b)
+	}
+	return c.updateTopicDefaults(topic, upsertTopicDefaultsQuery, []interface{}{topic, priority, tagsStr}, func(d *topicDefaults) {
+		d.Priority = priority
+		d.Tags = tags
+	})
+}
+
+// SetTopicMaxPriority caps the priority of messages published to the given topic to max; a higher priority
+// is lowered to max when the message is stored, and the original priority is kept in the cache for reference.
+// A max priority of 0 removes the cap, which is the default.
+func (c *messageCache) SetTopicMaxPriority(topic string, max int) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	} else if max < 0 || max > 5 {
+		return errInvalidTopicDefaultPriority
+	}
+	topic = c.topicKey(topic)
+	return c.updateTopicDefaults(topic, upsertTopicMaxPriorityQuery, []interface{}{topic, max}, func(d *topicDefaults) {
+		d.MaxPriority = max
+	})
+}
+
+// SetTopicDisabled disables or re-enables a topic. While a topic is disabled, AddMessage rejects new messages
+// for it with errTopicDisabled, but existing messages can still be read.
+func (c *messageCache) SetTopicDisabled(topic string, disabled bool) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+	topic = c.topicKey(topic)
+	return c.updateTopicDefaults(topic, upsertTopicDisabledQuery, []interface{}{topic, disabled}, func(d *topicDefaults) {
+		d.Disabled = disabled
+	})
+}
+
+// SetTopicAttachmentTTL limits how long the attachments of messages published to the given topic are kept: An
+// attachment that expires later than d from now is set to expire after d when the message is stored, so that
+// it is removed along with all other expired attachments, see AttachmentsExpired. Attachments without expiry,
+// i.e. external URLs, are not affected. The TTL is kept in seconds, and a TTL of 0 removes the limit.
+func (c *messageCache) SetTopicAttachmentTTL(topic string, d time.Duration) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	} else if d < 0 || (d > 0 && d < time.Second) {
+		return errInvalidTopicAttachmentTTL
+	}
+	topic = c.topicKey(topic)
+	seconds := int64(d.Seconds())
+	return c.updateTopicDefaults(topic, upsertTopicAttachmentTTLQuery, []interface{}{topic, seconds}, func(d *topicDefaults) {
+		d.AttachmentTTL = time.Duration(seconds) * time.Second
+	})
+}
+
+// TopicDisabled returns true if the topic has been disabled, see SetTopicDisabled
+func (c *messageCache) TopicDisabled(topic string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	defaults, ok := c.topicDefaults[c.topicKey(topic)]
+	return ok && defaults.Disabled
+}
+
+// updateTopicDefaults runs the given upsert query, removes the row if all defaults are empty, and
+// applies the same change to the in-memory defaults
+func (c *messageCache) updateTopicDefaults(topic, query string, args []interface{}, update func(d *topicDefaults)) error {
+	err := c.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+		_, err := tx.Exec(deleteEmptyTopicDefaultsQuery, topic)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defaults := &topicDefaults{}
+	if existing, ok := c.topicDefaults[topic]; ok {
+		*defaults = *existing
+	}
+	update(defaults)
+	if defaults.empty() {
+		delete(c.topicDefaults, topic)
+	} else {
+		c.topicDefaults[topic] = defaults
+	}
+	return nil
+}
+
+// ApplyTopicDefaults sets the priority and tags of the message to the defaults of its topic, if the
+// message does not have a priority or tags, and caps the priority to the max priority of the topic. If the
+// priority is lowered, the original priority is kept in message.RawPriority. The expiry of attachments is
+// capped to the max attachment TTL of the topic, see SetTopicAttachmentTTL. This is called by
+// AddMessage, but may also be called before the message is delivered to subscribers, so that they see
+// the same message.
+func (c *messageCache) ApplyTopicDefaults(m *message) {
+	c.mu.RLock()
+	defaults, ok := c.topicDefaults[c.topicKey(m.Topic)]
+	c.mu.RUnlock()
+	if !ok {
+		return
+	}
+	if m.Priority == 0 && defaults.Priority != 0 {
+		m.Priority = defaults.Priority
+	}
+	if len(m.Tags) == 0 && len(defaults.Tags) > 0 {
+		m.Tags = append([]string{}, defaults.Tags...)
+	}
+	if defaults.MaxPriority != 0 {
+		priority := m.Priority
+		if priority == 0 {
+			priority = 3 // Default priority
+		}
+		if priority > defaults.MaxPriority {
+			m.RawPriority = priority
+			m.Priority = defaults.MaxPriority
+		}
+	}
+	if defaults.AttachmentTTL != 0 {
+		maxExpires := time.Now().Add(defaults.AttachmentTTL).Unix()
+		for _, a := range messageAttachments(m) {
+			if a.Expires > maxExpires {
+				a.Expires = maxExpires
+			}
+		}
+	}
+}
+
+func (c *messageCache) loadTopicDefaults() error {
+	rows, err := c.db.Query(selectTopicDefaultsQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for rows.Next() {
+		var topic, tagsStr string
+		var defaults topicDefaults
+		var attachmentTTL int64
+		if err := rows.Scan(&topic, &defaults.Priority, &tagsStr, &defaults.MaxPriority, &defaults.Disabled, &attachmentTTL); err != nil {
+			return err
+		}
+		defaults.AttachmentTTL = time.Duration(attachmentTTL) * time.Second
+		if tagsStr != "" {
+			if err := json.Unmarshal([]byte(tagsStr), &defaults.Tags); err != nil {
+				return err
+			}
+		}
+		c.topicDefaults[topic] = &defaults
+	}
+	return rows.Err()
+}
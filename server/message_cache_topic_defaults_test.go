@@ -0,0 +1,224 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_TopicDefaults(t *testing.T) {
+	testCacheTopicDefaults(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicDefaults(t *testing.T) {
+	testCacheTopicDefaults(t, newMemTestCache(t))
+}
+
+func testCacheTopicDefaults(t *testing.T, c *messageCache) {
+	require.Nil(t, c.SetTopicDefaults("prod", 4, []string{"prod"}))
+	require.Equal(t, errInvalidTopicDefaultPriority, c.SetTopicDefaults("prod", 6, nil))
+	require.Equal(t, errInvalidTopic, c.SetTopicDefaults("", 4, nil))
+
+	m1 := newDefaultMessage("prod", "defaults applied")
+	m2 := newDefaultMessage("prod", "defaults overridden")
+	m2.Priority = 1
+	m2.Tags = []string{"staging"}
+	m3 := newDefaultMessage("other", "no defaults")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+
+	messages, err := c.Messages("prod", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, 4, messages[0].Priority)
+	require.Equal(t, []string{"prod"}, messages[0].Tags)
+	require.Equal(t, 1, messages[1].Priority)
+	require.Equal(t, []string{"staging"}, messages[1].Tags)
+
+	messages, err = c.Messages("other", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 0, messages[0].Priority)
+	require.Equal(t, []string{}, messages[0].Tags)
+
+	// Only tags, then remove
+	require.Nil(t, c.SetTopicDefaults("prod", 0, []string{"tag1", "tag2"}))
+	m4 := newDefaultMessage("prod", "only tags")
+	c.ApplyTopicDefaults(m4)
+	require.Equal(t, 0, m4.Priority)
+	require.Equal(t, []string{"tag1", "tag2"}, m4.Tags)
+
+	require.Nil(t, c.SetTopicDefaults("prod", 0, nil))
+	m5 := newDefaultMessage("prod", "no more defaults")
+	c.ApplyTopicDefaults(m5)
+	require.Equal(t, 0, m5.Priority)
+	require.Nil(t, m5.Tags)
+}
+
+func TestSqliteCache_TopicMaxPriority(t *testing.T) {
+	testCacheTopicMaxPriority(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicMaxPriority(t *testing.T) {
+	testCacheTopicMaxPriority(t, newMemTestCache(t))
+}
+
+func testCacheTopicMaxPriority(t *testing.T, c *messageCache) {
+	require.Nil(t, c.SetTopicDefaults("alerts", 0, []string{"alert"}))
+	require.Nil(t, c.SetTopicMaxPriority("alerts", 2))
+	require.Equal(t, errInvalidTopicDefaultPriority, c.SetTopicMaxPriority("alerts", 6))
+
+	m1 := newDefaultMessage("alerts", "urgent, but capped")
+	m1.Priority = 5
+	m2 := newDefaultMessage("alerts", "default priority, also capped")
+	m3 := newDefaultMessage("alerts", "low priority")
+	m3.Priority = 1
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+
+	messages, err := c.Messages("alerts", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, 2, messages[0].Priority)
+	require.Equal(t, []string{"alert"}, messages[0].Tags) // Max priority does not replace other defaults
+	require.Equal(t, 2, messages[1].Priority)
+	require.Equal(t, 1, messages[2].Priority)
+
+	var rawPriority int
+	require.Nil(t, c.db.QueryRow(`SELECT raw_priority FROM messages WHERE mid = ?`, m1.ID).Scan(&rawPriority))
+	require.Equal(t, 5, rawPriority)
+	require.Nil(t, c.db.QueryRow(`SELECT raw_priority FROM messages WHERE mid = ?`, m3.ID).Scan(&rawPriority))
+	require.Equal(t, 0, rawPriority)
+
+	// Removing the defaults keeps the cap, removing the cap as well removes the row
+	require.Nil(t, c.SetTopicDefaults("alerts", 0, nil))
+	m4 := newDefaultMessage("alerts", "still capped")
+	m4.Priority = 4
+	c.ApplyTopicDefaults(m4)
+	require.Equal(t, 2, m4.Priority)
+	require.Nil(t, m4.Tags)
+
+	require.Nil(t, c.SetTopicMaxPriority("alerts", 0))
+	m5 := newDefaultMessage("alerts", "no longer capped")
+	m5.Priority = 4
+	c.ApplyTopicDefaults(m5)
+	require.Equal(t, 4, m5.Priority)
+
+	var count int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM topic_defaults`).Scan(&count))
+	require.Equal(t, 0, count)
+}
+
+func TestSqliteCache_TopicDisabled(t *testing.T) {
+	testCacheTopicDisabled(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicDisabled(t *testing.T) {
+	testCacheTopicDisabled(t, newMemTestCache(t))
+}
+
+func testCacheTopicDisabled(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "before")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.SetTopicMaxPriority("mytopic", 3))
+	require.Nil(t, c.SetTopicDisabled("mytopic", true))
+	require.True(t, c.TopicDisabled("mytopic"))
+	require.False(t, c.TopicDisabled("othertopic"))
+
+	require.Equal(t, errTopicDisabled, c.AddMessage(newDefaultMessage("mytopic", "rejected")))
+	require.Equal(t, errTopicDisabled, c.AddMessages([]*message{newDefaultMessage("othertopic", "ok"), newDefaultMessage("mytopic", "rejected")}))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other topic")))
+
+	// Reads still work
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	m, err := c.Message("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, "before", m.Message)
+
+	// Re-enabling keeps the other settings
+	require.Nil(t, c.SetTopicDisabled("mytopic", false))
+	require.False(t, c.TopicDisabled("mytopic"))
+	m2 := newDefaultMessage("mytopic", "after")
+	m2.Priority = 5
+	require.Nil(t, c.AddMessage(m2))
+	m, err = c.Message("mytopic", m2.ID)
+	require.Nil(t, err)
+	require.Equal(t, 3, m.Priority)
+}
+
+func TestSqliteCache_TopicAttachmentTTL(t *testing.T) {
+	testCacheTopicAttachmentTTL(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicAttachmentTTL(t *testing.T) {
+	testCacheTopicAttachmentTTL(t, newMemTestCache(t))
+}
+
+func testCacheTopicAttachmentTTL(t *testing.T, c *messageCache) {
+	require.Nil(t, c.SetTopicAttachmentTTL("mytopic", time.Hour))
+	require.Equal(t, errInvalidTopicAttachmentTTL, c.SetTopicAttachmentTTL("mytopic", -time.Hour))
+	require.Equal(t, errInvalidTopicAttachmentTTL, c.SetTopicAttachmentTTL("mytopic", time.Millisecond))
+	require.Equal(t, errInvalidTopic, c.SetTopicAttachmentTTL("", time.Hour))
+
+	// Attachments that would be kept longer than the TTL are capped, others are left alone
+	longExpires := time.Now().Add(72 * time.Hour).Unix()
+	shortExpires := time.Now().Add(10 * time.Minute).Unix()
+	m1 := newDefaultMessage("mytopic", "long")
+	m1.Sender = "1.2.3.4"
+	m1.Attachments = []*attachment{
+		{Name: "a.txt", Size: 100, Expires: longExpires, URL: "https://example.com/a.txt"},
+		{Name: "b.txt", Size: 200, Expires: shortExpires, URL: "https://example.com/b.txt"},
+	}
+	m2 := newDefaultMessage("mytopic", "external")
+	m2.Attachment = &attachment{Name: "c.txt", URL: "https://external.com/c.txt"}
+	m3 := newDefaultMessage("othertopic", "other topic")
+	m3.Attachment = &attachment{Name: "d.txt", Size: 100, Expires: longExpires, URL: "https://example.com/d.txt"}
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.InDelta(t, time.Now().Add(time.Hour).Unix(), messages[0].Attachments[0].Expires, 5)
+	require.Equal(t, shortExpires, messages[0].Attachments[1].Expires)
+	require.Equal(t, int64(0), messages[1].Attachment.Expires)
+	messages, err = c.Messages("othertopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, longExpires, messages[0].Attachment.Expires)
+
+	// Capped attachments are expired along with all others
+	freed, err := c.ExpireAttachments(time.Now().Add(2 * time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, int64(100), freed["1.2.3.4"])
+
+	// A TTL of 0 removes the limit
+	require.Nil(t, c.SetTopicAttachmentTTL("mytopic", 0))
+	m4 := newDefaultMessage("mytopic", "no limit")
+	m4.Attachment = &attachment{Name: "e.txt", Size: 100, Expires: longExpires, URL: "https://example.com/e.txt"}
+	require.Nil(t, c.AddMessage(m4))
+	require.Equal(t, longExpires, m4.Attachment.Expires)
+}
+
+func TestSqliteCache_TopicDefaultsReopen(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	require.Nil(t, c.SetTopicDefaults("prod", 5, []string{"prod", "urgent"}))
+	require.Nil(t, c.SetTopicMaxPriority("prod", 4))
+	require.Nil(t, c.SetTopicDisabled("staging", true))
+	require.Nil(t, c.SetTopicAttachmentTTL("staging", time.Hour))
+	require.Nil(t, c.db.Close())
+
+	c = newSqliteTestCacheFromFile(t, filename)
+	m := newDefaultMessage("prod", "some message")
+	c.ApplyTopicDefaults(m)
+	require.Equal(t, 4, m.Priority)
+	require.Equal(t, 5, m.RawPriority)
+	require.Equal(t, []string{"prod", "urgent"}, m.Tags)
+	require.True(t, c.TopicDisabled("staging"))
+	m = newDefaultMessage("staging", "with attachment")
+	m.Attachment = &attachment{Name: "a.txt", Expires: time.Now().Add(72 * time.Hour).Unix()}
+	c.ApplyTopicDefaults(m)
+	require.InDelta(t, time.Now().Add(time.Hour).Unix(), m.Attachment.Expires, 5)
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// With messageCacheOptions.CaseInsensitiveTopics, new messages are stored under the lowercased topic, but rows
+// that were stored before the option was enabled keep their casing, so that e.g. "Alerts" and "alerts" remain
+// separate topics. NormalizeTopics folds these rows once, so that they are found case-insensitively as well.
+// Since the option may be turned on or off at any time, this is not a schema migration, but has to be run
+// explicitly, like MigrateTagsToNormalized.
+//
+// Topics that only differ in casing are merged into one topic:
+//   - Messages keep their time and ID, so the messages of both topics are interleaved by time. The display name of
+//     the merged topic is the casing of its first stored message, as if it had been stored with the option enabled.
+//   - Topic defaults (see SetTopicDefaults) are not merged field by field. The defaults of the lowercase topic win,
+//     otherwise those of the first casing in sort order (uppercase before lowercase letters).
+//   - The last delivery time (see MarkTopicDelivered) is the latest of all casings.
+//   - Aliases of any casing point to the lowercased canonical topic. Aliases that would point to themselves after
+//     folding are removed, and for colliding aliases, the same rule as for topic defaults applies.
+//
+// Trashed messages (see DeleteMessage) are moved to the folded topic, but their snapshot keeps the original casing,
+// so NormalizeTopics should be run again after restoring them.
+
+const (
+	selectTopicCasingsQuery = `
+		SELECT topic FROM messages
+		UNION SELECT topic FROM topic_defaults
+		UNION SELECT topic FROM topic_activity
+		UNION SELECT alias FROM topic_aliases
+		UNION SELECT canonical FROM topic_aliases
+		UNION SELECT topic FROM audit
+		UNION SELECT topic FROM dictionaries
+		UNION SELECT topic FROM deleted_messages
+	`
+	selectFirstTopicDisplayQuery = `
+		SELECT IIF(topic_display != '', topic_display, topic)
+		FROM messages
+		WHERE topic IN (SELECT value FROM json_each(?))
+		ORDER BY id
+		LIMIT 1
+	`
+	updateMessagesTopicQuery        = `UPDATE messages SET topic = ?, topic_display = ? WHERE topic = ?`
+	updateMessagesTopicDisplayQuery = `UPDATE messages SET topic_display = ? WHERE topic = ?`
+	mergeTopicDefaultsQuery         = `
+		INSERT OR IGNORE INTO topic_defaults (topic, priority, tags, max_priority, disabled, attachment_ttl)
+		SELECT ?, priority, tags, max_priority, disabled, attachment_ttl FROM topic_defaults WHERE topic = ?
+	`
+	deleteTopicDefaultsQuery = `DELETE FROM topic_defaults WHERE topic = ?`
+	mergeTopicActivityQuery  = `
+		INSERT INTO topic_activity (topic, last_delivered)
+		SELECT ?, last_delivered FROM topic_activity WHERE topic = ?
+		ON CONFLICT (topic) DO UPDATE SET last_delivered = MAX(last_delivered, excluded.last_delivered)
+	`
+	deleteTopicActivityQuery = `DELETE FROM topic_activity WHERE topic = ?`
+	mergeTopicAliasQuery     = `
+		INSERT OR IGNORE INTO topic_aliases (alias, canonical)
+		SELECT ?, canonical FROM topic_aliases WHERE alias = ?
+	`
+	updateTopicAliasCanonicalQuery  = `UPDATE topic_aliases SET canonical = ? WHERE canonical = ?`
+	deleteSelfTopicAliasesQuery     = `DELETE FROM topic_aliases WHERE alias = canonical`
+	updateAuditTopicQuery           = `UPDATE audit SET topic = ? WHERE topic = ?`
+	updateDictionariesTopicQuery    = `UPDATE dictionaries SET topic = ? WHERE topic = ?`
+	updateDeletedMessagesTopicQuery = `UPDATE deleted_messages SET topic = ? WHERE topic = ?`
+)
+
+var errTopicsNotCaseInsensitive = errors.New("topics are not case-insensitive")
+
+// NormalizeTopics folds the topics of all existing rows to their lowercased form, merging topics that only differ
+// in casing, see above. It returns the number of topics that were renamed, and errTopicsNotCaseInsensitive if the
+// cache was not created with messageCacheOptions.CaseInsensitiveTopics. Running it again does nothing.
+func (c *messageCache) NormalizeTopics() (int, error) {
+	if !c.foldTopics {
+		return 0, errTopicsNotCaseInsensitive
+	}
+	renamed := 0
+	err := c.retryBusy(func() error {
+		return c.withTx(func(tx *sql.Tx) error {
+			groups, err := c.topicCasings(tx)
+			if err != nil {
+				return err
+			}
+			renamed = 0
+			for key, casings := range groups {
+				n, err := c.normalizeTopic(tx, key, casings)
+				if err != nil {
+					return err
+				}
+				renamed += n
+			}
+			_, err = tx.Exec(deleteSelfTopicAliasesQuery)
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := c.reloadState(); err != nil {
+		return 0, err
+	}
+	return renamed, nil
+}
+
+// topicCasings returns all stored topics that are not folded yet, grouped by their folded form, together with
+// the folded form itself, if it is stored. Within a group, the casings are sorted.
+func (c *messageCache) topicCasings(tx *sql.Tx) (map[string][]string, error) {
+	rows, err := tx.Query(selectTopicCasingsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	all := make(map[string][]string)
+	for rows.Next() {
+		var topic string
+		if err := rows.Scan(&topic); err != nil {
+			return nil, err
+		}
+		key := c.topicKey(topic)
+		all[key] = append(all[key], topic)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]string)
+	for key, casings := range all {
+		if len(casings) == 1 && casings[0] == key {
+			continue // Already folded
+		}
+		sort.Strings(casings)
+		groups[key] = casings
+	}
+	return groups, nil
+}
+
+// normalizeTopic renames all casings of a topic to its folded form key, and returns the number of renamed casings
+func (c *messageCache) normalizeTopic(tx *sql.Tx, key string, casings []string) (int, error) {
+	display, err := firstTopicDisplay(tx, casings)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(updateMessagesTopicDisplayQuery, display, key); err != nil {
+		return 0, err
+	}
+	renamed := 0
+	for _, topic := range casings {
+		if topic == key {
+			continue // Its rows win on collisions, since the others are merged with INSERT OR IGNORE
+		}
+		if _, err := tx.Exec(updateMessagesTopicQuery, key, display, topic); err != nil {
+			return 0, err
+		}
+		for _, query := range []string{mergeTopicDefaultsQuery, mergeTopicActivityQuery, mergeTopicAliasQuery} {
+			if _, err := tx.Exec(query, key, topic); err != nil {
+				return 0, err
+			}
+		}
+		for _, query := range []string{deleteTopicDefaultsQuery, deleteTopicActivityQuery, deleteTopicAliasQuery} {
+			if _, err := tx.Exec(query, topic); err != nil {
+				return 0, err
+			}
+		}
+		for _, query := range []string{updateTopicAliasCanonicalQuery, updateAuditTopicQuery, updateDictionariesTopicQuery, updateDeletedMessagesTopicQuery} {
+			if _, err := tx.Exec(query, key, topic); err != nil {
+				return 0, err
+			}
+		}
+		renamed++
+	}
+	return renamed, nil
+}
+
+// firstTopicDisplay returns the display name of the first message stored under any of the given casings of a
+// topic, i.e. its display name if it has one, or its topic otherwise. If there are no messages, it is the first
+// casing.
+func firstTopicDisplay(tx *sql.Tx, casings []string) (string, error) {
+	b, err := json.Marshal(casings)
+	if err != nil {
+		return "", err
+	}
+	rows, err := tx.Query(selectFirstTopicDisplayQuery, string(b))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return casings[0], rows.Err()
+	}
+	var display string
+	if err := rows.Scan(&display); err != nil {
+		return "", err
+	}
+	return display, rows.Err()
+}
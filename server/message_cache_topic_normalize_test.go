@@ -0,0 +1,85 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqliteCache_NormalizeTopics(t *testing.T) {
+	testCacheNormalizeTopics(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_NormalizeTopics(t *testing.T) {
+	testCacheNormalizeTopics(t, createMemoryFilename())
+}
+
+func testCacheNormalizeTopics(t *testing.T, filename string) {
+	// Topics stored case-sensitively
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{})
+	require.Nil(t, err)
+	m1 := newDefaultMessage("Alerts", "first")
+	m1.Time = 1000
+	m2 := newDefaultMessage("alerts", "second")
+	m2.Time = 2000
+	m3 := newDefaultMessage("Alerts", "third")
+	m3.Time = 3000
+	m4 := newDefaultMessage("other", "untouched")
+	require.Nil(t, c.AddMessages([]*message{m2, m1, m3, m4}))
+	require.Nil(t, c.SetTopicDefaults("Alerts", 5, []string{"upper"}))
+	require.Nil(t, c.SetTopicDefaults("alerts", 2, []string{"lower"}))
+	require.Nil(t, c.SetTopicDisabled("Warnings", true))
+	require.Nil(t, c.MarkTopicDelivered("alerts", time.Unix(100, 0)))
+	require.Nil(t, c.MarkTopicDelivered("Alerts", time.Unix(200, 0)))
+	require.Nil(t, c.SetTopicAlias("Old", "Alerts"))
+	require.Nil(t, c.SetTopicAlias("ALERTS", "Alerts"))
+
+	_, err = c.NormalizeTopics()
+	require.Equal(t, errTopicsNotCaseInsensitive, err)
+
+	// Normalize with case-insensitive topics
+	c, err = newSqliteCacheWithOptions(filename, false, &messageCacheOptions{CaseInsensitiveTopics: true})
+	require.Nil(t, err)
+	renamed, err := c.NormalizeTopics()
+	require.Nil(t, err)
+	require.Equal(t, 4, renamed) // Alerts, ALERTS, Old, Warnings
+
+	topics, err := c.Topics()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(topics))
+	require.NotNil(t, topics["alerts"])
+	require.NotNil(t, topics["other"])
+
+	for _, topic := range []string{"alerts", "Alerts", "ALERTS", "old"} {
+		messages, err := c.Messages(topic, sinceAllMessages, false)
+		require.Nil(t, err)
+		require.Equal(t, 3, len(messages))
+		require.Equal(t, "first", messages[0].Message) // Interleaved by time
+		require.Equal(t, "second", messages[1].Message)
+		require.Equal(t, "third", messages[2].Message)
+		for _, m := range messages {
+			require.Equal(t, "alerts", m.Topic) // Casing of the first stored message, not the oldest by time
+		}
+	}
+
+	// Defaults of the lowercase topic win, other settings are moved
+	m := newDefaultMessage("ALERTS", "with defaults")
+	m.Priority = 0
+	c.ApplyTopicDefaults(m)
+	require.Equal(t, 2, m.Priority)
+	require.Equal(t, []string{"lower"}, m.Tags)
+	require.True(t, c.TopicDisabled("warnings"))
+	var lastDelivered int64
+	require.Nil(t, c.db.QueryRow(`SELECT last_delivered FROM topic_activity WHERE topic = 'alerts'`).Scan(&lastDelivered))
+	require.Equal(t, int64(200), lastDelivered)
+	var count int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM topic_aliases`).Scan(&count))
+	require.Equal(t, 1, count) // ALERTS -> alerts is removed
+	require.Equal(t, "alerts", c.ResolveTopic("OLD"))
+
+	// Running it again does nothing
+	renamed, err = c.NormalizeTopics()
+	require.Nil(t, err)
+	require.Equal(t, 0, renamed)
+}
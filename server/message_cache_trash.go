@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deleted messages go to the trash first, so that a message that was deleted by accident can be restored within
+// an undo window. DeleteMessage moves the message to the deleted_messages table, RecentlyDeleted lists the trash
+// of a topic, and RestoreMessage moves a message back. Unlike DeleteMessage, DeleteTopic deletes for good.
+//
+// Each row in the trash holds the columns needed to list the message (as stored, i.e. still encrypted or
+// compressed), plus a snapshot of the original rows of the message in the messages table and all tables that
+// reference it. The snapshot is a generic column-to-value map per row, so it does not have to be kept in sync
+// with the schema; restoring it brings back the message exactly as it was, including its read state. Rows are
+// purged from the trash after the undo window, see PurgeDeleted.
+//
+// While they are in the trash, deleted messages also serve as tombstones for clients that sync a topic by polling
+// with a since marker: MessagesWithDeletions returns them as lightweight message_delete events, so that clients
+// can remove their local copy. Clients that poll less often than the undo window may miss deletions. Polling
+// clients opt in with the "deletions" query parameter (see Server.sendOldMessages), so that existing clients do
+// not receive events they do not know.
+//
+// Note that there is no hard delete: DeleteMessage always keeps a tombstone, there is no per-call choice, and
+// tombstones are not purged by a separate pass, but along with the trash. A message that must be gone for good
+// right away can only be removed by purging the trash, see PurgeDeleted.
+
+const (
+	createDeletedMessagesTableQuery = `
+		CREATE TABLE IF NOT EXISTS deleted_messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			deleted_at INT NOT NULL,
+			snapshot BLOB NOT NULL,
+			mid TEXT NOT NULL,
+			time INT NOT NULL,
+			topic TEXT NOT NULL,
+			message TEXT NOT NULL,
+			title TEXT,
+			priority INT NOT NULL,
+			tags TEXT,
+			click TEXT,
+			actions TEXT,
+			attachment_name TEXT,
+			attachment_type TEXT,
+			attachment_size INT,
+			attachment_expires INT,
+			attachment_url TEXT,
+			sender TEXT NOT NULL,
+			encoding TEXT,
+			updated INT NOT NULL,
+			collapse_key TEXT NOT NULL,
+			origin TEXT NOT NULL,
+			body_html TEXT,
+			category TEXT NOT NULL,
+			publish_seq INT NOT NULL,
+			topic_display TEXT NOT NULL,
+			sound TEXT NOT NULL,
+			has_location INT NOT NULL,
+			lat REAL NOT NULL,
+			lng REAL NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_deleted_messages_topic_mid ON deleted_messages (topic, mid);
+		CREATE INDEX IF NOT EXISTS idx_deleted_messages_deleted_at ON deleted_messages (deleted_at);
+	`
+	insertDeletedMessageQuery = `
+		INSERT INTO deleted_messages (deleted_at, snapshot, mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, encoding, updated, collapse_key, origin, body_html, category, publish_seq, topic_display, sound, has_location, lat, lng)
+		SELECT ?, ?, mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, encoding, updated, collapse_key, origin, body_html, category, publish_seq, topic_display, sound, has_location, lat, lng
+		FROM messages
+		WHERE id = ?
+	`
+	selectRecentlyDeletedQuery = `
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, encoding, updated, collapse_key, origin, body_html, category, publish_seq, topic_display, sound, has_location, lat, lng
+		FROM deleted_messages
+		WHERE topic = ? AND deleted_at >= ?
+		ORDER BY deleted_at DESC, id DESC
+	`
+	selectDeletedSinceTimeQuery = `
+		SELECT mid, deleted_at, topic, topic_display
+		FROM deleted_messages
+		WHERE topic = ? AND deleted_at >= ?
+		ORDER BY deleted_at, id
+	`
+	selectDeletedSinceIDQuery = `
+		SELECT mid, deleted_at, topic, topic_display
+		FROM deleted_messages
+		WHERE topic = ? AND deleted_at >= IFNULL((SELECT time FROM messages WHERE topic = ? AND mid = ?), 0)
+		ORDER BY deleted_at, id
+	`
+	selectDeletedMessageSnapshotQuery   = `SELECT id, snapshot FROM deleted_messages WHERE topic = ? AND mid = ? ORDER BY id DESC LIMIT 1`
+	deleteDeletedMessageQuery           = `DELETE FROM deleted_messages WHERE id = ?`
+	selectPurgedAttachmentsQuery        = `SELECT mid FROM deleted_messages WHERE deleted_at < ? AND attachment_name != ''`
+	deleteDeletedMessagesOlderThanQuery = `DELETE FROM deleted_messages WHERE deleted_at < ?`
+	deleteMessageByRowIDQuery           = `DELETE FROM messages WHERE id = ?`
+)
+
+// deletedMessageUndoWindow is how long deleted messages are kept in the trash before they are purged
+const deletedMessageUndoWindow = 24 * time.Hour
+
+var errMessageRestoreConflict = errors.New("a message with this ID already exists")
+
+// trashedTables are the tables whose rows of a message are part of its snapshot, in the order they are restored;
+// the messages table must come first, since all others reference it
+var trashedTables = []struct {
+	name   string
+	column string // Column that references the row ID of the message
+}{
+	{"messages", "id"},
+	{"message_attachments", "message_id"},
+	{"message_read", "message_id"},
+	{"message_tags", "message_id"},
+	{"message_versions", "message_id"},
+}
+
+// messageSnapshot holds the rows of a message per table, each row as a map of column names to values
+type messageSnapshot map[string][]map[string]interface{}
+
+// DeleteMessage moves a message to the trash, from where it can be restored with RestoreMessage until it is
+// purged (see PurgeDeleted). Scheduled messages can be deleted as well. It returns errMessageNotFound if the
+// message does not exist, unless the cache is a nop cache, which does not store messages in the first place.
+func (c *messageCache) DeleteMessage(topic, id string) (err error) {
+	defer c.observe(queryOpDeleteMessage, time.Now(), &err)
+	if err := validateTopic(topic); err != nil {
+		return err
+	} else if c.nop {
+		return nil
+	}
+	topic = c.ResolveTopic(topic)
+	err = c.retryBusy(func() error {
+		return c.withTx(func(tx *sql.Tx) error {
+			rowID, err := queryMessageRowID(tx, topic, id)
+			if err != nil {
+				return err
+			}
+			snapshot := make(messageSnapshot)
+			for _, table := range trashedTables {
+				query := fmt.Sprintf(`SELECT * FROM %s WHERE %s = ?`, table.name, table.column)
+				if snapshot[table.name], err = queryRowMaps(tx, query, rowID); err != nil {
+					return err
+				}
+			}
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(snapshot); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(insertDeletedMessageQuery, time.Now().Unix(), buf.Bytes(), rowID); err != nil {
+				return err
+			} else if err := c.auditMessage(tx, auditReasonDeleted, topic, id); err != nil {
+				return err
+			}
+			_, err = tx.Exec(deleteMessageByRowIDQuery, rowID)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	c.emitWrite(writeOpDelete, &message{ID: id, Event: messageEvent, Topic: topic})
+	return nil
+}
+
+// RecentlyDeleted returns the messages of a topic that were deleted within the given duration and are still
+// in the trash, most recently deleted first. Only the first attachment of a message is returned.
+func (c *messageCache) RecentlyDeleted(topic string, within time.Duration) ([]*message, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	rows, err := c.db.Query(selectRecentlyDeletedQuery, c.ResolveTopic(topic), time.Now().Add(-within).Unix())
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(c.db, rows)
+}
+
+// MessagesWithDeletions returns the same messages as Messages, plus a message_delete event for every message of
+// the topic that was deleted since the marker and is still in the trash, ordered by time. Delete events only
+// have an ID, a topic, and the time of the deletion. For ID markers, all deletions since the time of the marker
+// message are returned (or all of them if it does not exist anymore), which may include deletions that the client
+// already knows about.
+func (c *messageCache) MessagesWithDeletions(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
+	messages, err := c.Messages(topic, since, scheduled)
+	if err != nil {
+		return nil, err
+	} else if since.IsNone() || since.IsNow() {
+		return messages, nil
+	}
+	deletions, err := c.deletedSince(c.ResolveTopic(topic), since)
+	if err != nil {
+		return nil, err
+	} else if len(deletions) == 0 {
+		return messages, nil
+	}
+	messages = append(messages, deletions...)
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Time < messages[j].Time
+	})
+	return messages, nil
+}
+
+// deletedSince returns a message_delete event for every message of the topic in the trash that was deleted since
+// the marker, see MessagesWithDeletions
+func (c *messageCache) deletedSince(topic string, since sinceMarker) ([]*message, error) {
+	query, args := selectDeletedSinceTimeQuery, []interface{}{topic, since.Time().Unix()}
+	if since.IsID() {
+		query, args = selectDeletedSinceIDQuery, []interface{}{topic, topic, since.ID()}
+	}
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deletions := make([]*message, 0)
+	for rows.Next() {
+		var id, topic, topicDisplay string
+		var deletedAt int64
+		if err := rows.Scan(&id, &deletedAt, &topic, &topicDisplay); err != nil {
+			return nil, err
+		}
+		if topicDisplay != "" {
+			topic = topicDisplay // See messageCacheOptions.CaseInsensitiveTopics
+		}
+		deletions = append(deletions, &message{ID: id, Time: deletedAt, Event: messageDeleteEvent, Topic: topic})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deletions, nil
+}
+
+// RestoreMessage moves a message from the trash back to its topic, as it was before it was deleted. It returns
+// errMessageNotFound if the message is not in the trash, and errMessageRestoreConflict if a message with the
+// same ID was added to the topic in the meantime.
+func (c *messageCache) RestoreMessage(topic, id string) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+	topic = c.ResolveTopic(topic)
+	err := c.withTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(selectDeletedMessageSnapshotQuery, topic, id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			return errMessageNotFound
+		}
+		var trashID int64
+		var encoded []byte
+		if err := rows.Scan(&trashID, &encoded); err != nil {
+			return err
+		}
+		rows.Close()
+		if _, err := queryMessageRowID(tx, topic, id); err == nil {
+			return errMessageRestoreConflict
+		} else if err != errMessageNotFound {
+			return err
+		}
+		snapshot := make(messageSnapshot)
+		if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&snapshot); err != nil {
+			return err
+		}
+		for _, table := range trashedTables {
+			for _, row := range snapshot[table.name] {
+				if err := insertRowMap(tx, table.name, row); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := tx.Exec(deleteDeletedMessageQuery, trashID); err != nil {
+			return err
+		}
+		return c.auditMessage(tx, auditReasonRestored, topic, id)
+	})
+	if err != nil {
+		return err
+	}
+	if c.writeFeed != nil {
+		m, err := c.Message(topic, id)
+		if err != nil {
+			return err
+		}
+		c.emitWrite(writeOpAdd, m)
+	}
+	return nil
+}
+
+// PurgeDeleted permanently deletes all messages from the trash that were deleted before the given time. It
+// returns the number of purged messages, and the IDs of all purged messages that had an attachment, so that the
+// attachment files can be removed from the file cache.
+func (c *messageCache) PurgeDeleted(before time.Time) (int, []string, error) {
+	ids := make([]string, 0)
+	var purged int64
+	err := c.withTx(func(tx *sql.Tx) error {
+		var err error
+		if ids, err = queryMessageIDs(tx, selectPurgedAttachmentsQuery, before.Unix()); err != nil {
+			return err
+		}
+		res, err := tx.Exec(deleteDeletedMessagesOlderThanQuery, before.Unix())
+		if err != nil {
+			return err
+		}
+		purged, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return int(purged), ids, nil
+}
+
+// queryMessageRowID returns the row ID of a message within the transaction, or errMessageNotFound
+func queryMessageRowID(tx *sql.Tx, topic, id string) (int64, error) {
+	rows, err := tx.Query(selectRowIDFromMessageID, topic, id)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errMessageNotFound
+	}
+	var rowID int64
+	if err := rows.Scan(&rowID); err != nil {
+		return 0, err
+	}
+	return rowID, rows.Err()
+}
+
+// queryRowMaps runs the given query within the transaction, and returns all rows as maps of column names to
+// values. NULL values are left out.
+func queryRowMaps(tx *sql.Tx, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{})
+		for i, column := range columns {
+			if values[i] != nil {
+				row[column] = values[i]
+			}
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// insertRowMap inserts a row as returned by queryRowMaps into the given table within the transaction
+func insertRowMap(tx *sql.Tx, table string, row map[string]interface{}) error {
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	placeholders := make([]string, len(columns))
+	args := make([]interface{}, len(columns))
+	for i, column := range columns {
+		placeholders[i] = "?"
+		args[i] = row[column]
+	}
+	query := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s)`, table, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	_, err := tx.Exec(query, args...)
+	return err
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_DeleteAndRestoreMessage(t *testing.T) {
+	testCacheDeleteAndRestoreMessage(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_DeleteAndRestoreMessage(t *testing.T) {
+	testCacheDeleteAndRestoreMessage(t, newMemTestCache(t))
+}
+
+func testCacheDeleteAndRestoreMessage(t *testing.T, c *messageCache) {
+	expires := time.Now().Add(time.Hour).Unix()
+	m1 := newDefaultMessage("mytopic", "deleted by accident")
+	m1.Title = "important"
+	m1.Tags = []string{"tag1"}
+	m1.Sender = "1.2.3.4"
+	m1.Attachments = []*attachment{
+		{Name: "a.txt", Size: 100, Expires: expires, URL: "https://example.com/a.txt"},
+		{Name: "b.txt", Size: 200, Expires: expires, URL: "https://example.com/b.txt"},
+	}
+	m2 := newDefaultMessage("mytopic", "kept")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+	require.Nil(t, c.MarkRead(m1.ID, "phil"))
+	used, err := c.AttachmentBytesUsed("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(100), used)
+
+	require.Nil(t, c.DeleteMessage("mytopic", m1.ID))
+	require.Equal(t, errMessageNotFound, c.DeleteMessage("mytopic", m1.ID))
+	require.Equal(t, errMessageNotFound, c.DeleteMessage("othertopic", m2.ID))
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "kept", messages[0].Message)
+	used, err = c.AttachmentBytesUsed("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), used)
+
+	// The trash lists the message until the undo window has passed
+	deleted, err := c.RecentlyDeleted("mytopic", time.Minute)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(deleted))
+	require.Equal(t, m1.ID, deleted[0].ID)
+	require.Equal(t, "deleted by accident", deleted[0].Message)
+	require.Equal(t, "important", deleted[0].Title)
+	require.Equal(t, "a.txt", deleted[0].Attachment.Name)
+	deleted, err = c.RecentlyDeleted("othertopic", time.Minute)
+	require.Nil(t, err)
+	require.Empty(t, deleted)
+
+	// Restoring brings back the message as it was, including all attachments and its read state
+	require.Nil(t, c.RestoreMessage("mytopic", m1.ID))
+	require.Equal(t, errMessageNotFound, c.RestoreMessage("mytopic", m1.ID))
+	messages, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, m1.ID, messages[0].ID)
+	require.Equal(t, "important", messages[0].Title)
+	require.Equal(t, []string{"tag1"}, messages[0].Tags)
+	require.Equal(t, int64(1), messages[0].PublishSeq)
+	require.Equal(t, 2, len(messages[0].Attachments))
+	require.Equal(t, "b.txt", messages[0].Attachments[1].Name)
+	count, err := c.UnreadCount("mytopic", "phil")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+	used, err = c.AttachmentBytesUsed("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(100), used)
+	deleted, err = c.RecentlyDeleted("mytopic", time.Minute)
+	require.Nil(t, err)
+	require.Empty(t, deleted)
+}
+
+func TestSqliteCache_DeleteMessage_Scheduled(t *testing.T) {
+	testCacheDeleteMessageScheduled(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_DeleteMessage_Scheduled(t *testing.T) {
+	testCacheDeleteMessageScheduled(t, newMemTestCache(t))
+}
+
+func testCacheDeleteMessageScheduled(t *testing.T, c *messageCache) {
+	m := newDefaultMessage("mytopic", "scheduled")
+	m.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.DeleteMessage("mytopic", m.ID))
+	messages, err := c.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	require.Equal(t, errMessageNotFound, c.DeleteMessage("mytopic", m.ID))
+}
+
+func TestNopCache_DeleteMessage(t *testing.T) {
+	c := newNopTestCache(t)
+	require.Nil(t, c.DeleteMessage("mytopic", "doesnotexist"))
+	require.Equal(t, errInvalidTopic, c.DeleteMessage("", "doesnotexist"))
+}
+
+func TestSqliteCache_RestoreMessage_Conflict(t *testing.T) {
+	c := newSqliteTestCache(t)
+	m := newDefaultMessage("mytopic", "original")
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.DeleteMessage("mytopic", m.ID))
+
+	// A message with the same ID was published in the meantime
+	republished := newDefaultMessage("mytopic", "republished")
+	republished.ID = m.ID
+	require.Nil(t, c.AddMessage(republished))
+	require.Equal(t, errMessageRestoreConflict, c.RestoreMessage("mytopic", m.ID))
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "republished", messages[0].Message)
+}
+
+func TestSqliteCache_MessagesWithDeletions(t *testing.T) {
+	testCacheMessagesWithDeletions(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesWithDeletions(t *testing.T) {
+	testCacheMessagesWithDeletions(t, newMemTestCache(t))
+}
+
+func testCacheMessagesWithDeletions(t *testing.T, c *messageCache) {
+	now := time.Now().Unix()
+	add := func(message string, time int64) *message {
+		m := newDefaultMessage("mytopic", message)
+		m.Time = time
+		require.Nil(t, c.AddMessage(m))
+		return m
+	}
+	m1 := add("message 1", now-300)
+	m2 := add("message 2", now-200)
+	m3 := add("message 3", now-100)
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other")))
+	require.Nil(t, c.DeleteMessage("mytopic", m1.ID))
+	require.Nil(t, c.DeleteMessage("mytopic", m3.ID))
+
+	// Deletions are returned after the remaining messages, since they happened later
+	messages, err := c.MessagesWithDeletions("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, m2.ID, messages[0].ID)
+	require.Equal(t, messageEvent, messages[0].Event)
+	require.Equal(t, "message 2", messages[0].Message)
+	for _, m := range messages[1:] {
+		require.Equal(t, messageDeleteEvent, m.Event)
+		require.Equal(t, "mytopic", m.Topic)
+		require.Equal(t, "", m.Message)
+		require.True(t, m.Time >= now)
+	}
+	require.Equal(t, m1.ID, messages[1].ID)
+	require.Equal(t, m3.ID, messages[2].ID)
+
+	// Since markers
+	messages, err = c.MessagesWithDeletions("mytopic", newSinceID(m2.ID), false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, messageDeleteEvent, messages[0].Event)
+	messages, err = c.MessagesWithDeletions("mytopic", newSinceTime(now+3600), false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	messages, err = c.MessagesWithDeletions("mytopic", sinceNoMessages, false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	// Plain reads do not include deletions, and restored or purged messages are not reported as deleted
+	messages, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Nil(t, c.RestoreMessage("mytopic", m1.ID))
+	_, _, err = c.PurgeDeleted(time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	messages, err = c.MessagesWithDeletions("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, messageEvent, messages[0].Event)
+	require.Equal(t, messageEvent, messages[1].Event)
+}
+
+func TestSqliteCache_PurgeDeleted(t *testing.T) {
+	testCachePurgeDeleted(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_PurgeDeleted(t *testing.T) {
+	testCachePurgeDeleted(t, newMemTestCache(t))
+}
+
+func testCachePurgeDeleted(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "with attachment")
+	m1.Attachment = &attachment{Name: "a.txt", Size: 100, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://example.com/a.txt"}
+	m2 := newDefaultMessage("mytopic", "without attachment")
+	m3 := newDefaultMessage("mytopic", "deleted recently")
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+	require.Nil(t, c.DeleteMessage("mytopic", m1.ID))
+	require.Nil(t, c.DeleteMessage("mytopic", m2.ID))
+	_, err := c.db.Exec(`UPDATE deleted_messages SET deleted_at = ?`, time.Now().Add(-2*deletedMessageUndoWindow).Unix())
+	require.Nil(t, err)
+	require.Nil(t, c.DeleteMessage("mytopic", m3.ID))
+
+	purged, ids, err := c.PurgeDeleted(time.Now().Add(-deletedMessageUndoWindow))
+	require.Nil(t, err)
+	require.Equal(t, 2, purged)
+	require.Equal(t, []string{m1.ID}, ids)
+	require.Equal(t, errMessageNotFound, c.RestoreMessage("mytopic", m1.ID))
+	deleted, err := c.RecentlyDeleted("mytopic", 3*deletedMessageUndoWindow)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(deleted))
+	require.Equal(t, "deleted recently", deleted[0].Message)
+}
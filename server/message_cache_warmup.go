@@ -0,0 +1,74 @@
+package server
+
+import (
+	"time"
+)
+
+// After a restart, the SQLite page cache is cold, and the first wave of reconnecting subscribers all
+// hit the disk at once with their since-ID queries. Warmup reads the most recent rows of the given topics
+// ahead of time, so that these pages are already in memory when the subscribers come back. Topics that
+// had subscribers before the restart can be found with TopicsDeliveredSince.
+
+const (
+	// warmupMessagesPerTopic is the number of most recent messages per topic read by Warmup. Reconnecting
+	// subscribers typically only ask for the last few messages, so there is no point in reading more.
+	warmupMessagesPerTopic = 1000
+
+	selectMessagesWarmupQuery = `
+		SELECT ` + selectMessageColumns + `
+		FROM messages
+		WHERE topic = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`
+	selectTopicsDeliveredSinceQuery = `SELECT topic FROM topic_activity WHERE last_delivered >= ? ORDER BY topic`
+)
+
+// Warmup reads the most recent messages of the given topics (see warmupMessagesPerTopic) and discards
+// them, so that the pages they are stored in are loaded into the page cache. The rows are only stepped
+// through, not scanned into messages.
+func (c *messageCache) Warmup(topics []string) error {
+	for _, topic := range topics {
+		if err := validateTopic(topic); err != nil {
+			return err
+		}
+		if err := c.warmupTopic(c.ResolveTopic(topic)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *messageCache) warmupTopic(topic string) error {
+	rows, err := c.db.Query(selectMessagesWarmupQuery, topic, warmupMessagesPerTopic)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		// Stepping through the rows is enough, SQLite reads all result columns on every step
+	}
+	return rows.Err()
+}
+
+// TopicsDeliveredSince returns the names of all topics that delivered messages to a subscriber
+// since the given time (see MarkTopicDelivered), ordered by name
+func (c *messageCache) TopicsDeliveredSince(t time.Time) ([]string, error) {
+	rows, err := c.db.Query(selectTopicsDeliveredSinceQuery, t.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := make([]string, 0)
+	for rows.Next() {
+		var topic string
+		if err := rows.Scan(&topic); err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSqliteCache_Warmup(t *testing.T) {
+	testCacheWarmup(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Warmup(t *testing.T) {
+	testCacheWarmup(t, newMemTestCache(t))
+}
+
+func testCacheWarmup(t *testing.T, c *messageCache) {
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my message")))
+	require.Nil(t, c.Warmup([]string{"mytopic", "topic-without-messages"}))
+	require.Nil(t, c.Warmup(nil))
+	require.Equal(t, errInvalidTopic, c.Warmup([]string{"mytopic", ""}))
+}
+
+func TestSqliteCache_TopicsDeliveredSince(t *testing.T) {
+	testCacheTopicsDeliveredSince(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicsDeliveredSince(t *testing.T) {
+	testCacheTopicsDeliveredSince(t, newMemTestCache(t))
+}
+
+func testCacheTopicsDeliveredSince(t *testing.T, c *messageCache) {
+	now := time.Now()
+	require.Nil(t, c.MarkTopicDelivered("recent", now.Add(-time.Hour)))
+	require.Nil(t, c.MarkTopicDelivered("another", now))
+	require.Nil(t, c.MarkTopicDelivered("old", now.Add(-48*time.Hour)))
+
+	topics, err := c.TopicsDeliveredSince(now.Add(-24 * time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, []string{"another", "recent"}, topics)
+
+	topics, err = c.TopicsDeliveredSince(now.Add(time.Minute))
+	require.Nil(t, err)
+	require.Empty(t, topics)
+}
+
+func TestSqliteCache_Warmup_ReconnectLatency(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	topics := make([]string, 0)
+	sinceIDs := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		topic := fmt.Sprintf("topic%d", i)
+		topics = append(topics, topic)
+		messages := make([]*message, 0)
+		for j := 0; j < 500; j++ {
+			messages = append(messages, newDefaultMessage(topic, fmt.Sprintf("message %d of a topic with a reasonably long body", j)))
+		}
+		require.Nil(t, c.AddMessages(messages))
+		sinceIDs[topic] = messages[400].ID
+	}
+	require.Nil(t, c.Close())
+
+	reconnect := func(c *messageCache) time.Duration {
+		start := time.Now()
+		for _, topic := range topics {
+			messages, err := c.Messages(topic, newSinceID(sinceIDs[topic]), false)
+			require.Nil(t, err)
+			require.Equal(t, 99, len(messages))
+		}
+		return time.Since(start)
+	}
+
+	// Cold: reconnect queries against a freshly opened cache
+	c = newSqliteTestCacheFromFile(t, filename)
+	cold := reconnect(c)
+	require.Nil(t, c.Close())
+
+	// Warm: the same queries after a warmup
+	c = newSqliteTestCacheFromFile(t, filename)
+	require.Nil(t, c.Warmup(topics))
+	warm := reconnect(c)
+	require.Nil(t, c.Close())
+
+	// Timings depend on the machine and the OS page cache, so they are logged rather than compared
+	t.Logf("Reconnect queries for %d topics: %s cold, %s after warmup", len(topics), cold, warm)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"heckel.io/ntfy/log"
+	"sync"
+	"sync/atomic"
+)
+
+// The write feed lets external systems, e.g. a search index, mirror all writes to the cache. If an OnWrite
+// handler is set (see messageCacheOptions), it is called for every message that was added, updated or
+// deleted, but only after the write was committed. Handlers are called one after another from a background
+// goroutine, so a slow handler never blocks ingestion: Events are queued (see writeFeedQueueSize), and if
+// the queue is full, new events are dropped and counted, see WriteFeedDropped.
+//
+// Only explicit writes are reported. Messages that are removed by Prune, replaced via their collapse key,
+// or hidden after their TTL has passed do not cause delete events; a mirror should apply the same retention.
+
+// writeOp is the type of a write reported to the OnWrite handler
+type writeOp int
+
+// Types of writes reported to the OnWrite handler
+const (
+	writeOpAdd writeOp = iota + 1
+	writeOpUpdate
+	writeOpDelete
+)
+
+// writeFeedQueueSize is the number of events that are queued for a slow OnWrite handler before events are dropped
+const writeFeedQueueSize = 1000
+
+func (op writeOp) String() string {
+	switch op {
+	case writeOpAdd:
+		return "add"
+	case writeOpUpdate:
+		return "update"
+	case writeOpDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+type writeEvent struct {
+	op writeOp
+	m  *message
+}
+
+// messageWriteFeed queues write events and passes them to the OnWrite handler in a background goroutine
+type messageWriteFeed struct {
+	handler func(op writeOp, m *message)
+	queue   chan *writeEvent
+	done    chan struct{}
+	dropped int64 // Accessed atomically
+	closed  bool
+	mu      sync.RWMutex // Protects closed, so that no events are sent to the closed queue
+}
+
+func newMessageWriteFeed(handler func(op writeOp, m *message)) *messageWriteFeed {
+	f := &messageWriteFeed{
+		handler: handler,
+		queue:   make(chan *writeEvent, writeFeedQueueSize),
+		done:    make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+func (f *messageWriteFeed) run() {
+	defer close(f.done)
+	for e := range f.queue {
+		f.handler(e.op, e.m)
+	}
+}
+
+// emit queues an event for each of the given messages, without blocking. The messages are copied, so that
+// later changes by the caller are not visible to the handler.
+func (f *messageWriteFeed) emit(op writeOp, ms ...*message) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return
+	}
+	for _, m := range ms {
+		mc := *m
+		select {
+		case f.queue <- &writeEvent{op: op, m: &mc}:
+		default:
+			atomic.AddInt64(&f.dropped, 1)
+			log.Debug("Cache: Write feed queue full, dropping %s event for message %s", op, m.ID)
+		}
+	}
+}
+
+// close stops accepting events, and waits until all queued events were passed to the handler
+func (f *messageWriteFeed) close() {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	close(f.queue)
+	f.mu.Unlock()
+	<-f.done
+}
+
+// emitWrite reports the given messages to the OnWrite handler, if any
+func (c *messageCache) emitWrite(op writeOp, ms ...*message) {
+	if c.writeFeed != nil {
+		c.writeFeed.emit(op, ms...)
+	}
+}
+
+// WriteFeedDropped returns the number of write events that were dropped because the OnWrite handler
+// could not keep up, see messageCacheOptions
+func (c *messageCache) WriteFeedDropped() int64 {
+	if c.writeFeed == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.writeFeed.dropped)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestSqliteCache_WriteFeed(t *testing.T) {
+	testCacheWriteFeed(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_WriteFeed(t *testing.T) {
+	testCacheWriteFeed(t, createMemoryFilename())
+}
+
+func testCacheWriteFeed(t *testing.T, filename string) {
+	var mu sync.Mutex
+	events := make([]string, 0)
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{
+		OnWrite: func(op writeOp, m *message) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, fmt.Sprintf("%s %s %s", op, m.Topic, m.Message))
+		},
+	})
+	require.Nil(t, err)
+
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m3 := newDefaultMessage("othertopic", "message 3")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessages([]*message{m2, m3}))
+	m1.Message = "message 1 updated"
+	require.Nil(t, c.UpdateMessage(m1))
+	m1.Message = "message 1 updated again"
+	require.Nil(t, c.UpdateMessageIfUnchanged(m1, m1.Updated))
+	m1.Message = "changed after the update" // Not visible to the handler
+
+	// Failed writes are not reported
+	require.Nil(t, c.SetTopicDisabled("disabled", true))
+	require.Equal(t, errTopicDisabled, c.AddMessage(newDefaultMessage("disabled", "rejected")))
+	require.Equal(t, errMessageNotFound, c.UpdateMessage(newDefaultMessage("mytopic", "does not exist")))
+
+	_, err = c.DeleteTopic("mytopic")
+	require.Nil(t, err)
+	require.Nil(t, c.Close()) // Waits for all events to be handled
+
+	require.Equal(t, []string{
+		"add mytopic message 1",
+		"add mytopic message 2",
+		"add othertopic message 3",
+		"update mytopic message 1 updated",
+		"update mytopic message 1 updated again",
+		"delete mytopic ",
+		"delete mytopic ",
+	}, events)
+	require.Equal(t, int64(0), c.WriteFeedDropped())
+}
+
+func TestSqliteCache_WriteFeed_SlowHandler(t *testing.T) {
+	testCacheWriteFeedSlowHandler(t, newSqliteTestCacheFile(t))
+}
+
+func TestMemCache_WriteFeed_SlowHandler(t *testing.T) {
+	testCacheWriteFeedSlowHandler(t, createMemoryFilename())
+}
+
+func testCacheWriteFeedSlowHandler(t *testing.T, filename string) {
+	unblock := make(chan struct{})
+	var mu sync.Mutex
+	handled := 0
+	c, err := newSqliteCacheWithOptions(filename, false, &messageCacheOptions{
+		OnWrite: func(op writeOp, m *message) {
+			<-unblock
+			mu.Lock()
+			defer mu.Unlock()
+			handled++
+		},
+	})
+	require.Nil(t, err)
+
+	// The handler blocks, but writes do not; events beyond the queue size are dropped
+	messages := make([]*message, 0)
+	for i := 0; i < writeFeedQueueSize+100; i++ {
+		messages = append(messages, newDefaultMessage("mytopic", fmt.Sprintf("message %d", i)))
+	}
+	require.Nil(t, c.AddMessages(messages))
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, writeFeedQueueSize+100, count)
+	dropped := c.WriteFeedDropped()
+	require.True(t, dropped == 99 || dropped == 100) // The handler may have picked up the first event already
+
+	close(unblock)
+	require.Nil(t, c.Close())
+	require.Equal(t, writeFeedQueueSize+100-int(dropped), handled)
+}
+
+func TestWriteOp_String(t *testing.T) {
+	require.Equal(t, "add", writeOpAdd.String())
+	require.Equal(t, "update", writeOpUpdate.String())
+	require.Equal(t, "delete", writeOpDelete.String())
+	require.Equal(t, "unknown", writeOp(0).String())
+}
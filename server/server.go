@@ -45,7 +45,7 @@ type Server struct {
 	firebaseClient    *firebaseClient
 	messages          int64
 	auth              auth.Auther
-	messageCache      *messageCache
+	messageCache      messageStore
 	fileCache         *fileCache
 	closeChan         chan bool
 	mu                sync.Mutex
@@ -96,6 +96,7 @@ const (
 	newMessageBody           = "New message"             // Used in poll requests as generic message
 	defaultAttachmentMessage = "You received a file: %s" // Used if message body is empty, and there is an attachment
 	encodingBase64           = "base64"
+	delayedMessagesBatchSize = 100 // Due messages claimed from the cache at a time, see sendDelayedMessages
 )
 
 // WebSocket constants
@@ -155,13 +156,30 @@ func New(conf *Config) (*Server, error) {
 	}, nil
 }
 
-func createMessageCache(conf *Config) (*messageCache, error) {
-	if conf.CacheDuration == 0 {
+func createMessageCache(conf *Config) (messageStore, error) {
+	var c *messageCache
+	var err error
+	if conf.CacheBackend != "" && conf.CacheBackend != CacheBackendSQLite {
+		return nil, fmt.Errorf("unsupported cache backend %s", conf.CacheBackend)
+	} else if conf.CacheDuration == 0 {
 		return newNopCache()
 	} else if conf.CacheFile != "" {
-		return newSqliteCache(conf.CacheFile, false)
+		c, err = newSqliteCacheWithOptions(conf.CacheFile, false, &messageCacheOptions{
+			Synchronous: conf.CacheSynchronous,
+			JournalMode: conf.CacheJournalMode,
+			BusyTimeout: conf.CacheBusyTimeout,
+			MaxTags:     conf.CacheMaxTags,
+		})
+	} else {
+		c, err = newMemCache()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if conf.CacheBatchSize > 0 && conf.CacheBatchTimeout > 0 {
+		c.EnableInsertBuffer(conf.CacheBatchSize, conf.CacheBatchTimeout)
 	}
-	return newMemCache()
+	return c, nil
 }
 
 // Run executes the main server. It listens on HTTP (+ HTTPS, if configured), and starts
@@ -219,6 +237,7 @@ func (s *Server) Run() error {
 		}()
 	}
 	s.mu.Unlock()
+	go s.warmupMessageCache()
 	go s.runManager()
 	go s.runDelayedSender()
 	go s.runFirebaseKeepaliver()
@@ -242,6 +261,9 @@ func (s *Server) Stop() {
 	if s.smtpServer != nil {
 		s.smtpServer.Close()
 	}
+	if err := s.messageCache.Flush(); err != nil {
+		log.Warn("Error flushing message cache: %s", err.Error())
+	}
 	close(s.closeChan)
 }
 
@@ -429,12 +451,16 @@ func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visito
 	t, err := s.topicFromPath(r.URL.Path)
 	if err != nil {
 		return err
+	} else if s.messageCache.TopicDisabled(t.ID) {
+		return errHTTPForbiddenTopicDisabled
 	}
 	body, err := util.Peek(r.Body, s.config.MessageLimit)
 	if err != nil {
 		return err
 	}
 	m := newDefaultMessage(t.ID, "")
+	m.SourceIP = v.ip
+	m.UserAgent = r.UserAgent()
 	cache, firebase, email, unifiedpush, err := s.parsePublishParams(r, v, m)
 	if err != nil {
 		return err
@@ -442,12 +468,17 @@ func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visito
 	if m.PollID != "" {
 		m = newPollRequestMessage(t.ID, m.PollID)
 	}
+	m.Email = email // Stored in the cache for auditing, see messageCache.MessagesByEmail
 	if err := s.handlePublishBody(r, v, m, body, unifiedpush); err != nil {
 		return err
 	}
 	if m.Message == "" {
 		m.Message = emptyMessageBody
 	}
+	if err := assignMessageToken(m); err != nil {
+		return err
+	}
+	s.messageCache.ApplyTopicDefaults(m)
 	delayed := m.Time > time.Now().Unix()
 	log.Debug("%s Received message: event=%s, body=%d byte(s), delayed=%t, firebase=%t, cache=%t, up=%t, email=%s",
 		logMessagePrefix(v, m), m.Event, len(m.Message), delayed, firebase, cache, unifiedpush, email)
@@ -458,6 +489,9 @@ func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visito
 		if err := t.Publish(v, m); err != nil {
 			return err
 		}
+		if t.Subscribers() > 0 {
+			s.markTopicDelivered(t.ID)
+		}
 		if s.firebaseClient != nil && firebase {
 			go s.sendToFirebase(v, m)
 		}
@@ -477,7 +511,7 @@ func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visito
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
-	if err := json.NewEncoder(w).Encode(m); err != nil {
+	if err := json.NewEncoder(w).Encode(&publishResponse{message: *m, Token: m.Token}); err != nil {
 		return err
 	}
 	s.mu.Lock()
@@ -533,6 +567,19 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 	firebase = readBoolParam(r, true, "x-firebase", "firebase")
 	m.Title = readParam(r, "x-title", "title", "t")
 	m.Click = readParam(r, "x-click", "click")
+	m.CollapseKey = readParam(r, "x-collapse-key", "collapse-key", "collapse")
+	m.Markdown = readBoolParam(r, false, "x-markdown", "markdown", "md")
+	if m.Markdown {
+		m.ContentType = contentTypeMarkdown
+	}
+	ttl := readParam(r, "x-ttl", "ttl")
+	if ttl != "" {
+		d, err := util.ParseDuration(ttl)
+		if err != nil || d < time.Second {
+			return false, false, "", false, errHTTPBadRequestTTLInvalid
+		}
+		m.TTL = int64(d.Seconds())
+	}
 	filename := readParam(r, "x-filename", "filename", "file", "f")
 	attach := readParam(r, "x-attach", "attach", "a")
 	if attach != "" || filename != "" {
@@ -559,6 +606,9 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 			m.Attachment.Name = "attachment"
 		}
 	}
+	if m.Attachment != nil {
+		m.Attachment.Name = util.SafeAttachmentName(m.Attachment.Name) // Before subscribers see it, see prepareMessage
+	}
 	email = readParam(r, "x-email", "x-e-mail", "email", "e-mail", "mail", "e")
 	if email != "" {
 		if err := v.EmailAllowed(); err != nil {
@@ -582,6 +632,9 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 		for _, s := range util.SplitNoEmpty(tagsStr, ",") {
 			m.Tags = append(m.Tags, strings.TrimSpace(s))
 		}
+		if s.config.CacheMaxTags > 0 && len(normalizeTags(m.Tags)) > s.config.CacheMaxTags {
+			return false, false, "", false, errHTTPBadRequestTagsTooMany
+		}
 	}
 	delayStr := readParam(r, "x-delay", "delay", "x-at", "at", "x-in", "in")
 	if delayStr != "" {
@@ -767,7 +820,7 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	if err != nil {
 		return err
 	}
-	poll, since, scheduled, filters, err := parseSubscribeParams(r)
+	poll, since, scheduled, deletions, filters, err := parseSubscribeParams(r)
 	if err != nil {
 		return err
 	}
@@ -793,7 +846,7 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	w.Header().Set("Access-Control-Allow-Origin", "*")            // CORS, allow cross-origin requests
 	w.Header().Set("Content-Type", contentType+"; charset=utf-8") // Android/Volley client needs charset!
 	if poll {
-		return s.sendOldMessages(topics, since, scheduled, v, sub)
+		return s.sendOldMessages(topics, since, scheduled, deletions, v, sub)
 	}
 	subscriberIDs := make([]int, 0)
 	for _, t := range topics {
@@ -807,7 +860,7 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	if err := sub(v, newOpenMessage(topicsStr)); err != nil { // Send out open message
 		return err
 	}
-	if err := s.sendOldMessages(topics, since, scheduled, v, sub); err != nil {
+	if err := s.sendOldMessages(topics, since, scheduled, deletions, v, sub); err != nil {
 		return err
 	}
 	for {
@@ -838,7 +891,7 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	if err != nil {
 		return err
 	}
-	poll, since, scheduled, filters, err := parseSubscribeParams(r)
+	poll, since, scheduled, deletions, filters, err := parseSubscribeParams(r)
 	if err != nil {
 		return err
 	}
@@ -908,7 +961,7 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	}
 	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
 	if poll {
-		return s.sendOldMessages(topics, since, scheduled, v, sub)
+		return s.sendOldMessages(topics, since, scheduled, deletions, v, sub)
 	}
 	subscriberIDs := make([]int, 0)
 	for _, t := range topics {
@@ -922,7 +975,7 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	if err := sub(v, newOpenMessage(topicsStr)); err != nil { // Send out open message
 		return err
 	}
-	if err := s.sendOldMessages(topics, since, scheduled, v, sub); err != nil {
+	if err := s.sendOldMessages(topics, since, scheduled, deletions, v, sub); err != nil {
 		return err
 	}
 	err = g.Wait()
@@ -933,9 +986,10 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	return err
 }
 
-func parseSubscribeParams(r *http.Request) (poll bool, since sinceMarker, scheduled bool, filters *queryFilter, err error) {
+func parseSubscribeParams(r *http.Request) (poll bool, since sinceMarker, scheduled bool, deletions bool, filters *queryFilter, err error) {
 	poll = readBoolParam(r, false, "x-poll", "poll", "po")
 	scheduled = readBoolParam(r, false, "x-scheduled", "scheduled", "sched")
+	deletions = readBoolParam(r, false, "x-deletions", "deletions", "del")
 	since, err = parseSince(r, poll)
 	if err != nil {
 		return
@@ -947,12 +1001,20 @@ func parseSubscribeParams(r *http.Request) (poll bool, since sinceMarker, schedu
 	return
 }
 
-func (s *Server) sendOldMessages(topics []*topic, since sinceMarker, scheduled bool, v *visitor, sub subscriber) error {
+// sendOldMessages sends the cached messages since the marker to the subscriber. If deletions is set, messages that
+// were deleted since the marker are sent as message_delete events as well, see messageCache.MessagesWithDeletions.
+func (s *Server) sendOldMessages(topics []*topic, since sinceMarker, scheduled, deletions bool, v *visitor, sub subscriber) error {
 	if since.IsNone() {
 		return nil
 	}
 	for _, t := range topics {
-		messages, err := s.messageCache.Messages(t.ID, since, scheduled)
+		var messages []*message
+		var err error
+		if deletions {
+			messages, err = s.messageCache.MessagesWithDeletions(t.ID, since, scheduled)
+		} else {
+			messages, err = s.messageCache.Messages(t.ID, since, scheduled)
+		}
 		if err != nil {
 			return err
 		}
@@ -961,10 +1023,21 @@ func (s *Server) sendOldMessages(topics []*topic, since sinceMarker, scheduled b
 				return err
 			}
 		}
+		if len(messages) > 0 {
+			s.markTopicDelivered(t.ID)
+		}
 	}
 	return nil
 }
 
+// markTopicDelivered records that messages of the topic were delivered, so that retention policies can
+// tell abandoned topics apart, see messageCache.TopicsIdleSince
+func (s *Server) markTopicDelivered(topic string) {
+	if err := s.messageCache.MarkTopicDelivered(topic, time.Now()); err != nil {
+		log.Warn("Unable to record delivery for topic %s: %s", topic, err.Error())
+	}
+}
+
 // parseSince returns a timestamp identifying the time span from which cached messages should be received.
 //
 // Values in the "since=..." parameter can be either a unix timestamp or a duration (e.g. 12h), or
@@ -1079,9 +1152,29 @@ func (s *Server) updateStatsAndPrune() {
 	// Prune message cache
 	olderThan := time.Now().Add(-1 * s.config.CacheDuration)
 	log.Debug("Manager: Pruning messages older than %s", olderThan.Format("2006-01-02 15:04:05"))
-	if err := s.messageCache.Prune(olderThan); err != nil {
+	if err := s.messageCache.Prune(olderThan, s.config.CacheMinKeep); err != nil {
 		log.Warn("Manager: Error pruning cache: %s", err.Error())
 	}
+	if deleted, err := s.messageCache.PruneExpiredScheduled(time.Now().Unix()); err != nil {
+		log.Warn("Manager: Error pruning expired scheduled messages: %s", err.Error())
+	} else if deleted > 0 {
+		log.Debug("Manager: Deleted %d scheduled message(s) past their drop-dead time", deleted)
+	}
+	if deleted, err := s.messageCache.CompactOrphans(); err != nil {
+		log.Warn("Manager: Error deleting orphaned rows: %s", err.Error())
+	} else if deleted > 0 {
+		log.Debug("Manager: Deleted %d orphaned row(s) of deleted messages", deleted)
+	}
+	if purged, ids, err := s.messageCache.PurgeDeleted(time.Now().Add(-deletedMessageUndoWindow)); err != nil {
+		log.Warn("Manager: Error purging deleted messages: %s", err.Error())
+	} else if purged > 0 {
+		log.Debug("Manager: Purged %d deleted message(s) past their undo window", purged)
+		if s.fileCache != nil && len(ids) > 0 {
+			if err := s.fileCache.Remove(ids...); err != nil {
+				log.Warn("Error deleting attachments: %s", err.Error())
+			}
+		}
+	}
 
 	// Prune old topics, remove subscriptions without subscribers
 	var subscribers, messages int
@@ -1130,6 +1223,22 @@ func (s *Server) runSMTPServer() error {
 	return s.smtpServer.ListenAndServe()
 }
 
+// warmupMessageCache pre-reads the messages of all topics that had subscribers within the cache duration,
+// so that the since-ID queries of reconnecting subscribers after a restart do not all hit a cold cache
+func (s *Server) warmupMessageCache() {
+	topics, err := s.messageCache.TopicsDeliveredSince(time.Now().Add(-s.config.CacheDuration))
+	if err != nil {
+		log.Warn("Cannot determine topics for cache warmup: %s", err.Error())
+		return
+	}
+	start := time.Now()
+	if err := s.messageCache.Warmup(topics); err != nil {
+		log.Warn("Error warming up message cache: %s", err.Error())
+		return
+	}
+	log.Debug("Warmed up message cache for %d topic(s) in %s", len(topics), time.Since(start))
+}
+
 func (s *Server) runManager() {
 	for {
 		select {
@@ -1171,21 +1280,25 @@ func (s *Server) runDelayedSender() {
 	}
 }
 
+// sendDelayedMessages sends all scheduled messages that are due. Messages are claimed (i.e. marked as published)
+// before they are sent, so that a message is never sent twice, even if the server crashes while sending: Delivery
+// is at-most-once, and a message that was claimed but not sent before a crash is lost, see messageCache.ClaimDue.
 func (s *Server) sendDelayedMessages() error {
-	messages, err := s.messageCache.MessagesDue()
-	if err != nil {
-		return err
-	}
-	for _, m := range messages {
-		v := s.visitorFromIP(m.Sender)
-		if err := s.sendDelayedMessage(v, m); err != nil {
-			log.Warn("%s Error sending delayed message: %s", logMessagePrefix(v, m), err.Error())
+	for {
+		messages, err := s.messageCache.ClaimDue(time.Now().Unix(), delayedMessagesBatchSize)
+		if err != nil {
+			return err
+		} else if len(messages) == 0 {
+			return nil
+		}
+		for _, m := range messages {
+			v := s.visitorFromIP(m.Sender)
+			s.sendDelayedMessage(v, m)
 		}
 	}
-	return nil
 }
 
-func (s *Server) sendDelayedMessage(v *visitor, m *message) error {
+func (s *Server) sendDelayedMessage(v *visitor, m *message) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	log.Debug("%s Sending delayed message", logMessagePrefix(v, m))
@@ -1204,10 +1317,6 @@ func (s *Server) sendDelayedMessage(v *visitor, m *message) error {
 	if s.config.UpstreamBaseURL != "" {
 		go s.forwardPollRequest(v, m)
 	}
-	if err := s.messageCache.MarkPublished(m); err != nil {
-		return err
-	}
-	return nil
 }
 
 func (s *Server) limitRequests(next handleFunc) handleFunc {
@@ -306,6 +306,46 @@ func TestServer_PublishAt(t *testing.T) {
 	require.Equal(t, "9.9.9.9", messages[0].Sender) // It's stored in the DB though!
 }
 
+func TestServer_SendDelayedMessagesClaimsInBatches(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for i := 0; i < delayedMessagesBatchSize+50; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = time.Now().Add(time.Hour).Unix()
+		require.Nil(t, s.messageCache.AddMessage(m))
+	}
+	_, err := s.messageCache.(*messageCache).db.Exec(`UPDATE messages SET time = ?`, time.Now().Add(-time.Second).Unix())
+	require.Nil(t, err)
+
+	require.Nil(t, s.sendDelayedMessages())
+	due, err := s.messageCache.MessagesDue()
+	require.Nil(t, err)
+	require.Empty(t, due) // Claimed, so they are not sent again after a crash
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, delayedMessagesBatchSize+50, len(messages))
+}
+
+func TestServer_SendDelayedMessagesWithAttachmentInMemory(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheFile = "" // In-memory caches only have a single connection, see readMessages
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+		"Attach": "https://ntfy.sh/file/a.png",
+		"In":     "30 min",
+	})
+	require.Equal(t, 200, response.Code)
+	_, err := s.messageCache.(*messageCache).db.Exec(`UPDATE messages SET time = ?`, time.Now().Add(-time.Second).Unix())
+	require.Nil(t, err)
+
+	require.Nil(t, s.sendDelayedMessages())
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "https://ntfy.sh/file/a.png", messages[0].Attachment.URL)
+}
+
 func TestServer_PublishAtWithCacheError(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -446,6 +486,179 @@ func TestServer_PublishAndPollSince(t *testing.T) {
 	require.Equal(t, 40008, toHTTPError(t, response.Body.String()).Code)
 }
 
+func TestServer_PublishWithCollapseKey(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	request(t, s, "PUT", "/mytopic", "backup running", map[string]string{"X-Collapse-Key": "backup"})
+	request(t, s, "PUT", "/mytopic", "something else", nil)
+	response := request(t, s, "PUT", "/mytopic?collapse=backup", "backup done", nil)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "backup", msg.CollapseKey)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "something else", messages[0].Message)
+	require.Equal(t, "backup done", messages[1].Message)
+	require.Equal(t, "backup", messages[1].CollapseKey)
+}
+
+func TestServer_PublishMarkdown(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	request(t, s, "PUT", "/mytopic", "**backup** done", map[string]string{"X-Markdown": "yes"})
+	request(t, s, "PUT", "/mytopic", "**plain** text", nil)
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "**backup** done", messages[0].Message)
+	require.Equal(t, "<p><strong>backup</strong> done</p>", messages[0].BodyHTML)
+	require.Equal(t, "text/markdown", messages[0].ContentType)
+	require.Equal(t, "", messages[1].BodyHTML)
+	require.Equal(t, "", messages[1].ContentType)
+}
+
+func TestServer_PollMarksTopicDelivered(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	request(t, s, "PUT", "/polled", "message", nil)
+	request(t, s, "PUT", "/abandoned", "message", nil)
+	request(t, s, "GET", "/polled/json?poll=1", "", nil)
+
+	var topic string
+	var lastDelivered int64
+	require.Nil(t, s.messageCache.(*messageCache).db.QueryRow(`SELECT topic, last_delivered FROM topic_activity`).Scan(&topic, &lastDelivered))
+	require.Equal(t, "polled", topic)
+	require.InDelta(t, time.Now().Unix(), lastDelivered, 2)
+}
+
+func TestServer_CacheBackendUnsupported(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.CacheBackend = "postgres"
+	_, err := New(conf)
+	require.EqualError(t, err, "unsupported cache backend postgres")
+}
+
+func TestServer_PollWithDeletions(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	m1 := toMessage(t, request(t, s, "PUT", "/mytopic", "kept", nil).Body.String())
+	m2 := toMessage(t, request(t, s, "PUT", "/mytopic", "deleted", nil).Body.String())
+	require.Nil(t, s.messageCache.DeleteMessage("mytopic", m2.ID))
+
+	// Deletions are only sent if asked for
+	messages := toMessages(t, request(t, s, "GET", "/mytopic/json?poll=1", "", nil).Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m1.ID, messages[0].ID)
+
+	messages = toMessages(t, request(t, s, "GET", "/mytopic/json?poll=1&deletions=1", "", nil).Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, m1.ID, messages[0].ID)
+	require.Equal(t, messageEvent, messages[0].Event)
+	require.Equal(t, m2.ID, messages[1].ID)
+	require.Equal(t, messageDeleteEvent, messages[1].Event)
+
+	messages = toMessages(t, request(t, s, "GET", "/mytopic/json?poll=1&since="+m1.ID, "", map[string]string{"X-Deletions": "1"}).Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m2.ID, messages[0].ID)
+	require.Equal(t, messageDeleteEvent, messages[0].Event)
+}
+
+func TestServer_PublishWithTTL(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "short-lived", map[string]string{"X-TTL": "10m"})
+	require.Equal(t, 200, response.Code)
+	messages, err := s.messageCache.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	var ttl int64
+	require.Nil(t, s.messageCache.(*messageCache).db.QueryRow(`SELECT ttl FROM messages WHERE mid = ?`, messages[0].ID).Scan(&ttl))
+	require.Equal(t, int64(600), ttl)
+
+	response = request(t, s, "PUT", "/mytopic?ttl=invalid", "invalid ttl", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40019, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishTooManyTags(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheMaxTags = 2
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "two tags", map[string]string{"Tags": "a,b,a, b"})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/mytopic", "three tags", map[string]string{"Tags": "a,b,c"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40020, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishToDisabledTopic(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	request(t, s, "PUT", "/mytopic", "before", nil)
+	require.Nil(t, s.messageCache.SetTopicDisabled("mytopic", true))
+	response := request(t, s, "PUT", "/mytopic", "after", nil)
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40302, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "before", messages[0].Message)
+}
+
+func TestServer_PublishSanitizesAttachmentNameWithoutCache(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+		"Attach":   "https://ntfy.sh/file/a.txt",
+		"Filename": "../../evil\".txt",
+		"Cache":    "no",
+	})
+	require.Equal(t, 200, response.Code)
+	published := toMessage(t, response.Body.String())
+	require.Equal(t, "evil.txt", published.Attachment.Name)
+	require.Contains(t, response.Body.String(), `"token":`)
+}
+
+func TestServer_PublishStoresEmail(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	s.smtpSender = &testMailer{}
+
+	response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+		"Email": "phil@example.com",
+	})
+	require.Equal(t, 200, response.Code)
+	require.NotContains(t, response.Body.String(), "phil@example.com")
+
+	messages, err := s.messageCache.MessagesByEmail("phil@example.com", time.Now().Add(-time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "a message", messages[0].Message)
+}
+
+func TestServer_PublishReturnsToken(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "my message", nil)
+	var published publishResponse
+	require.Nil(t, json.NewDecoder(strings.NewReader(response.Body.String())).Decode(&published))
+	require.Equal(t, "my message", published.Message)
+	require.NotEmpty(t, published.Token)
+
+	valid, err := s.messageCache.ValidateToken("mytopic", published.ID, published.Token)
+	require.Nil(t, err)
+	require.True(t, valid)
+
+	// Token is never returned to subscribers
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
+	require.NotContains(t, response.Body.String(), published.Token)
+}
+
 func TestServer_PublishViaGET(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/base64"
 	"heckel.io/ntfy/util"
 	"net/http"
 	"time"
@@ -8,10 +9,11 @@ import (
 
 // List of possible events
 const (
-	openEvent        = "open"
-	keepaliveEvent   = "keepalive"
-	messageEvent     = "message"
-	pollRequestEvent = "poll_request"
+	openEvent          = "open"
+	keepaliveEvent     = "keepalive"
+	messageEvent       = "message"
+	messageDeleteEvent = "message_delete"
+	pollRequestEvent   = "poll_request"
 )
 
 const (
@@ -20,20 +22,105 @@ const (
 
 // message represents a message published to a topic
 type message struct {
-	ID         string      `json:"id"`    // Random message ID
-	Time       int64       `json:"time"`  // Unix time in seconds
-	Event      string      `json:"event"` // One of the above
-	Topic      string      `json:"topic"`
-	Title      string      `json:"title,omitempty"`
-	Message    string      `json:"message,omitempty"`
-	Priority   int         `json:"priority,omitempty"`
-	Tags       []string    `json:"tags,omitempty"`
-	Click      string      `json:"click,omitempty"`
-	Actions    []*action   `json:"actions,omitempty"`
-	Attachment *attachment `json:"attachment,omitempty"`
-	PollID     string      `json:"poll_id,omitempty"`
-	Sender     string      `json:"-"`                  // IP address of uploader, used for rate limiting
-	Encoding   string      `json:"encoding,omitempty"` // empty for raw UTF-8, or "base64" for encoded bytes
+	ID          string      `json:"id"`    // Random message ID
+	Time        int64       `json:"time"`  // Unix time in seconds
+	Event       string      `json:"event"` // One of the above
+	Topic       string      `json:"topic"`
+	Title       string      `json:"title,omitempty"`
+	Message     string      `json:"message,omitempty"`
+	Priority    int         `json:"priority,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
+	Click       string      `json:"click,omitempty"`
+	Icon        string      `json:"icon,omitempty"` // URL of an image shown next to the notification
+	Actions     []*action   `json:"actions,omitempty"`
+	Attachment  *attachment `json:"attachment,omitempty"`
+	PollID      string      `json:"poll_id,omitempty"`
+	Sender      string      `json:"-"`                      // IP address of uploader, used for rate limiting
+	Encoding    string      `json:"encoding,omitempty"`     // empty for raw UTF-8, or "base64" for encoded bytes
+	SourceIP    string      `json:"-"`                      // IP address of the publisher, only used for abuse handling
+	UserAgent   string      `json:"-"`                      // User agent of the publisher, only used for abuse handling
+	Updated     int64       `json:"-"`                      // Unix time in seconds of the last update, equals Time if never updated
+	CollapseKey string      `json:"collapse_key,omitempty"` // If set, replaces earlier messages with the same key in the topic
+	Token       string      `json:"-"`                      // Secret delivery token, only returned to the publisher, see messageCache.ValidateToken
+	Origin      string      `json:"origin,omitempty"`       // ID of the server the message was originally published on, see messageCacheOptions.Origin
+	RawPriority int         `json:"-"`                      // Priority as published, if it was capped by the topic's max priority, see messageCache.SetTopicMaxPriority
+	Markdown    bool        `json:"-"`                      // If set, the body is rendered from Markdown to HTML when the message is added to the cache
+	ContentType string      `json:"content_type,omitempty"` // Content type of the body, e.g. "text/markdown", empty for plain text
+	BodyHTML    string      `json:"body_html,omitempty"`    // Sanitized HTML rendering of a Markdown body, see Markdown
+	Category    string      `json:"category,omitempty"`     // One of a fixed set of categories, see messageCacheOptions.Categories
+	Sound       string      `json:"sound,omitempty"`        // Sound or notification channel the client should use, e.g. "siren"
+	Location    *location   `json:"location,omitempty"`     // Geolocation the message refers to, e.g. of an IoT sensor, see messageCache.MessagesInBox
+	RepeatCount int         `json:"repeat_count,omitempty"` // Number of identical messages merged into this one, see messageCacheOptions.DebounceWindow
+	ReadCount   int         `json:"-"`                      // Number of times the message was read by any subscriber, see messageCache.IncrementRead
+	NotAfter    int64       `json:"-"`                      // Unix time after which a scheduled message is dropped instead of published, 0 for never
+	TTL         int64       `json:"-"`                      // Seconds after Time after which the message is no longer returned from the cache, 0 for no TTL
+	PublishSeq  int64       `json:"-"`                      // Global publish sequence number assigned by the cache, see messageCache.MessagesSinceSeq
+	DedupKey    string      `json:"-"`                      // Client-supplied idempotency key, a message with a key already used in the topic is not stored again
+	Email       string      `json:"-"`                      // E-mail address the message was forwarded to, if any, see messageCache.MessagesByEmail
+	TimeMillis  int64       `json:"-"`                      // Unix time in milliseconds when the message was created, orders messages within the same second
+
+	// Attachments are all attachments of the message, e.g. a bundle of log files. Attachment is the first one, so
+	// that clients that only support one attachment per message still see it.
+	Attachments []*attachment `json:"attachments,omitempty"`
+}
+
+// Bytes returns the raw message body, i.e. the decoded body if the message is base64-encoded
+func (m *message) Bytes() ([]byte, error) {
+	if m.Encoding == encodingBase64 {
+		return base64.StdEncoding.DecodeString(m.Message)
+	}
+	return []byte(m.Message), nil
+}
+
+// clone returns a copy of the message that can be changed without affecting the original, which may be shared
+// with subscribers at the same time. Attachments are copied as well; tags and actions are shared, since they are
+// only ever replaced, never changed in place.
+func (m *message) clone() *message {
+	c := *m
+	if m.Attachment != nil {
+		a := *m.Attachment
+		c.Attachment = &a
+	}
+	if m.Attachments != nil {
+		c.Attachments = make([]*attachment, len(m.Attachments))
+		for i, a := range m.Attachments {
+			if a == m.Attachment {
+				c.Attachments[i] = c.Attachment
+			} else {
+				a := *a
+				c.Attachments[i] = &a
+			}
+		}
+	}
+	return &c
+}
+
+// publishResponse is the response to a publish request; unlike the message sent to subscribers,
+// it includes the secret delivery token of the message
+type publishResponse struct {
+	message
+	Token string `json:"token,omitempty"`
+}
+
+// messageForensics contains details about the publisher of a message, see messageCache.MessageForensics
+type messageForensics struct {
+	SourceIP  string
+	UserAgent string
+}
+
+// attachmentExpiry describes an expired attachment, see messageCache.AttachmentsExpiredDetails
+type attachmentExpiry struct {
+	ID    string // Message ID
+	Owner string // As stored in the database, see messageCacheOptions.OwnerHasher
+	Size  int64
+}
+
+// attachmentRef identifies an attachment file of a message, see messageCache.AttachmentsAll
+type attachmentRef struct {
+	ID      string // Message ID
+	URL     string
+	Size    int64
+	Expires int64
 }
 
 type attachment struct {
@@ -42,6 +129,12 @@ type attachment struct {
 	Size    int64  `json:"size,omitempty"`
 	Expires int64  `json:"expires,omitempty"`
 	URL     string `json:"url"`
+	Hash    string `json:"-"` // Hash of the content, only stored in the cache, see messageCache.AttachmentByHash
+}
+
+type location struct {
+	Lat float64 `json:"lat"` // Latitude in degrees, -90 to 90
+	Lng float64 `json:"lng"` // Longitude in degrees, -180 to 180
 }
 
 type action struct {
@@ -84,12 +177,14 @@ type messageEncoder func(msg *message) (string, error)
 
 // newMessage creates a new message with the current timestamp
 func newMessage(event, topic, msg string) *message {
+	now := time.Now()
 	return &message{
-		ID:      util.RandomString(messageIDLength),
-		Time:    time.Now().Unix(),
-		Event:   event,
-		Topic:   topic,
-		Message: msg,
+		ID:         util.RandomString(messageIDLength),
+		Time:       now.Unix(),
+		TimeMillis: now.UnixMilli(),
+		Event:      event,
+		Topic:      topic,
+		Message:    msg,
 	}
 }
 
@@ -122,14 +217,15 @@ func validMessageID(s string) bool {
 type sinceMarker struct {
 	time time.Time
 	id   string
+	now  bool
 }
 
 func newSinceTime(timestamp int64) sinceMarker {
-	return sinceMarker{time.Unix(timestamp, 0), ""}
+	return sinceMarker{time.Unix(timestamp, 0), "", false}
 }
 
 func newSinceID(id string) sinceMarker {
-	return sinceMarker{time.Unix(0, 0), id}
+	return sinceMarker{time.Unix(0, 0), id, false}
 }
 
 func (t sinceMarker) IsAll() bool {
@@ -140,6 +236,12 @@ func (t sinceMarker) IsNone() bool {
 	return t == sinceNoMessages
 }
 
+// IsNow returns true if the marker was created with sinceNow, meaning that only messages published after
+// the marker was resolved (see messageCache.ResolveSince) should be returned
+func (t sinceMarker) IsNow() bool {
+	return t.now
+}
+
 func (t sinceMarker) IsID() bool {
 	return t.id != ""
 }
@@ -153,8 +255,9 @@ func (t sinceMarker) ID() string {
 }
 
 var (
-	sinceAllMessages = sinceMarker{time.Unix(0, 0), ""}
-	sinceNoMessages  = sinceMarker{time.Unix(1, 0), ""}
+	sinceAllMessages = sinceMarker{time.Unix(0, 0), "", false}
+	sinceNoMessages  = sinceMarker{time.Unix(1, 0), "", false}
+	sinceNow         = sinceMarker{time.Unix(0, 0), "", true}
 )
 
 type queryFilter struct {
@@ -22,7 +22,7 @@ var (
 // visitor represents an API user, and its associated rate.Limiter used for rate limiting
 type visitor struct {
 	config        *Config
-	messageCache  *messageCache
+	messageCache  messageStore
 	ip            string
 	requests      *rate.Limiter
 	emails        *rate.Limiter
@@ -40,7 +40,7 @@ type visitorStats struct {
 	VisitorAttachmentBytesRemaining int64 `json:"visitorAttachmentBytesRemaining"`
 }
 
-func newVisitor(conf *Config, messageCache *messageCache, ip string) *visitor {
+func newVisitor(conf *Config, messageCache messageStore, ip string) *visitor {
 	return &visitor{
 		config:        conf,
 		messageCache:  messageCache,
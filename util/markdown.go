@@ -0,0 +1,48 @@
+package util
+
+import (
+	"bytes"
+	"github.com/russross/blackfriday/v2"
+	"io"
+	"strings"
+)
+
+const (
+	markdownExtensions = blackfriday.CommonExtensions | blackfriday.Autolink
+	markdownHTMLFlags  = blackfriday.SkipHTML | blackfriday.Safelink | blackfriday.NofollowLinks |
+		blackfriday.NoreferrerLinks | blackfriday.HrefTargetBlank
+)
+
+// RenderMarkdown renders the given Markdown text to sanitized HTML. Raw HTML in the input (including
+// scripts and elements with event handlers) is dropped, and links and images are only rendered if they
+// point to a safe protocol (http, https, ftp, mailto), so the result can be embedded as-is.
+func RenderMarkdown(markdown string) string {
+	renderer := &markdownRenderer{
+		HTMLRenderer: blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{Flags: markdownHTMLFlags}),
+	}
+	html := blackfriday.Run([]byte(markdown), blackfriday.WithExtensions(markdownExtensions), blackfriday.WithRenderer(renderer))
+	return strings.TrimSpace(string(html))
+}
+
+// markdownRenderer is a blackfriday.HTMLRenderer that also drops images with unsafe sources,
+// since the Safelink flag only applies to links
+type markdownRenderer struct {
+	*blackfriday.HTMLRenderer
+}
+
+func (r *markdownRenderer) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	if node.Type == blackfriday.Image && !isSafeMarkdownURL(node.LinkData.Destination) {
+		return blackfriday.SkipChildren
+	}
+	return r.HTMLRenderer.RenderNode(w, node, entering)
+}
+
+func isSafeMarkdownURL(url []byte) bool {
+	url = bytes.ToLower(bytes.TrimSpace(url))
+	for _, prefix := range []string{"http://", "https://", "ftp://", "mailto:"} {
+		if bytes.HasPrefix(url, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,22 @@
+package util
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	require.Equal(t, "<p><strong>Backup</strong> done</p>", RenderMarkdown("**Backup** done"))
+	require.Equal(t, "<ul>\n<li>one</li>\n<li>two</li>\n</ul>", RenderMarkdown("- one\n- two"))
+	require.Equal(t, `<p><a href="https://ntfy.sh" target="_blank" rel="nofollow noreferrer">ntfy</a></p>`, RenderMarkdown("[ntfy](https://ntfy.sh)"))
+	require.Equal(t, "", RenderMarkdown(""))
+}
+
+func TestRenderMarkdown_Sanitized(t *testing.T) {
+	require.Equal(t, "<p>hi</p>", RenderMarkdown("<script>alert(1)</script>\n\nhi"))
+	require.Equal(t, "<p>click me</p>", RenderMarkdown(`click <a href="#" onclick="alert(1)">me</a>`))
+	require.NotContains(t, RenderMarkdown(`<img src="x" onerror="alert(1)">`), "onerror")
+	require.NotContains(t, RenderMarkdown("[click](javascript:alert(1))"), "javascript:")
+	require.NotContains(t, RenderMarkdown("![img](javascript:alert(1))"), "javascript:")
+	require.Equal(t, `<p><img src="https://example.com/a.png" alt="img" /></p>`, RenderMarkdown("![img](https://example.com/a.png)"))
+}
@@ -33,6 +33,12 @@ func ParseFutureTime(s string, now time.Time) (time.Time, error) {
 	return time.Time{}, errUnparsableTime
 }
 
+// ParseDuration parses a duration string like time.ParseDuration, but also supports days and spelled out
+// units, e.g. "2d", "10 mins" or "1 hour"
+func ParseDuration(s string) (time.Duration, error) {
+	return parseDuration(strings.TrimSpace(s))
+}
+
 func parseFromDuration(s string, now time.Time) (time.Time, error) {
 	d, err := parseDuration(s)
 	if err == nil {
@@ -58,3 +58,16 @@ func TestParseFutureTime_UnixTime(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, time.Date(2021, 12, 11, 0, 51, 51, 0, time.UTC), d)
 }
+
+func TestParseDuration(t *testing.T) {
+	d, err := ParseDuration("10m")
+	require.Nil(t, err)
+	require.Equal(t, 10*time.Minute, d)
+
+	d, err = ParseDuration(" 2 days ")
+	require.Nil(t, err)
+	require.Equal(t, 48*time.Hour, d)
+
+	_, err = ParseDuration("tomorrow")
+	require.Equal(t, errUnparsableTime, err)
+}
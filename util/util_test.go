@@ -107,6 +107,32 @@ func TestPriorityString_Invalid(t *testing.T) {
 	require.Equal(t, err, errInvalidPriority)
 }
 
+func TestSafeAttachmentName(t *testing.T) {
+	tests := []struct {
+		raw, expected string
+	}{
+		{"flower.jpg", "flower.jpg"},
+		{"my file (1).pdf", "my file (1).pdf"},
+		{"../../etc/passwd", "passwd"},
+		{"/var/lib/ntfy/cache.db", "cache.db"},
+		{`C:\Windows\system32\cmd.exe`, "cmd.exe"},
+		{"dir/", "attachment"},
+		{"..", "attachment"},
+		{"", "attachment"},
+		{"   ", "attachment"},
+		{`evil".txt`, "evil.txt"},
+		{"it's.txt", "its.txt"},
+		{"file.txt\r\nX-Injected: yes", "file.txtX-Injected: yes"},
+		{"tab\there\x00.txt", "tabhere.txt"},
+		{"\x1b[31mred.txt", "[31mred.txt"},
+		{"日本語.txt", "日本語.txt"},
+		{"invalid\xff.txt", "invalid.txt"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, SafeAttachmentName(test.raw), "raw: %q", test.raw)
+	}
+}
+
 func TestShortTopicURL(t *testing.T) {
 	require.Equal(t, "ntfy.sh/mytopic", ShortTopicURL("https://ntfy.sh/mytopic"))
 	require.Equal(t, "ntfy.sh/mytopic", ShortTopicURL("http://ntfy.sh/mytopic"))